@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"wx_channel/pkg/catalog"
+	"wx_channel/pkg/channels"
+	"wx_channel/pkg/download"
+)
+
+var (
+	catalog_author   string
+	catalog_limit    int
+	catalog_json     bool
+	catalog_spec     string
+	catalog_filename string
+)
+var catalog_cmd = &cobra.Command{
+	Use:   "catalog [关键词]",
+	Short: "查看打开过的视频",
+	Long:  "查看和搜索在微信中打开过的视频，关键词匹配标题、作者或视频 ID",
+	Run: func(cmd *cobra.Command, args []string) {
+		catalog_command(CatalogCommandArgs{
+			Filepath: cfg.ChannelCatalogFile,
+			Query:    strings.Join(args, " "),
+			Author:   catalog_author,
+			Limit:    catalog_limit,
+			JSON:     catalog_json,
+		})
+	},
+}
+var catalog_download_cmd = &cobra.Command{
+	Use:   "download <视频ID>",
+	Short: "重新下载打开过的视频",
+	Long:  "有登录信息时先获取最新的视频地址，获取失败时使用保存的地址下载",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		catalog_download_command(CatalogDownloadCommandArgs{
+			Filepath:    cfg.ChannelCatalogFile,
+			SessionFile: cfg.ChannelSessionFile,
+			ID:          args[0],
+			Spec:        catalog_spec,
+			Filename:    catalog_filename,
+		})
+	},
+}
+
+func init() {
+	catalog_cmd.Flags().StringVar(&catalog_author, "author", "", "只显示指定作者的视频（昵称或 ID）")
+	catalog_cmd.Flags().IntVar(&catalog_limit, "limit", 20, "显示的视频数，为 0 时显示全部")
+	catalog_cmd.Flags().BoolVar(&catalog_json, "json", false, "以 JSON 格式输出")
+	catalog_download_cmd.Flags().StringVar(&catalog_spec, "spec", "", "下载指定规格的视频，如 xWT111，默认下载原始视频")
+	catalog_download_cmd.Flags().StringVar(&catalog_filename, "filename", "", "下载后的文件名（默认按 download.filenameTemplate 生成）")
+
+	catalog_cmd.AddCommand(catalog_download_cmd)
+	root_cmd.AddCommand(catalog_cmd)
+}
+
+type CatalogCommandArgs struct {
+	Filepath string
+	Query    string
+	Author   string
+	Limit    int
+	JSON     bool
+}
+
+func catalog_command(args CatalogCommandArgs) {
+	list, err := catalog.Load(args.Filepath, catalog.ListOptions{
+		Query:  args.Query,
+		Author: args.Author,
+		Limit:  args.Limit,
+	})
+	if err != nil {
+		fmt.Printf("[ERROR]%v\n", err.Error())
+		return
+	}
+	if args.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(list)
+		return
+	}
+	if len(list) == 0 {
+		fmt.Printf("没有找到视频 %s\n", args.Filepath)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "视频 ID\t第一次打开\t作者\t规格\t标题")
+	for _, entry := range list {
+		profile := entry.Profile
+		author := ""
+		if profile.Contact != nil {
+			author = profile.Contact.Nickname
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			profile.ID,
+			entry.FirstSeenAt.Local().Format("2006-01-02 15:04"),
+			author,
+			strings.Join(spec_formats(&profile), ","),
+			truncate_text(strings.ReplaceAll(profile.Title, "\n", " "), 40),
+		)
+	}
+	tw.Flush()
+}
+
+type CatalogDownloadCommandArgs struct {
+	Filepath    string
+	SessionFile string
+	ID          string
+	Spec        string
+	Filename    string
+}
+
+func catalog_download_command(args CatalogDownloadCommandArgs) {
+	entry, err := catalog.Find(args.Filepath, args.ID)
+	if err != nil {
+		fmt.Printf("[ERROR]%v\n", err.Error())
+		return
+	}
+	profile := &entry.Profile
+	if profile.Type != "" && profile.Type != "media" {
+		fmt.Printf("[ERROR]%v\n", channels.ErrUnsupportedMedia.Error())
+		return
+	}
+	// 保存的地址有时效，优先获取最新的地址
+	if session, err := channels.LoadSession(args.SessionFile); err == nil {
+		latest, err := channels.NewClient(session).FetchProfile(channels.FeedRef{
+			ObjectID: profile.ID,
+			NonceID:  profile.NonceID,
+		})
+		if err != nil {
+			fmt.Printf("获取最新的视频地址失败，使用保存的地址 %v\n", err.Error())
+		} else {
+			profile = latest
+		}
+	}
+	if profile.URL == "" {
+		fmt.Printf("[ERROR]没有保存视频地址，请在微信中重新打开该视频\n")
+		return
+	}
+	if args.Spec != "" && profile.FindSpec(args.Spec) == nil {
+		fmt.Printf("[ERROR]没有 %s 规格，可选 %s\n", args.Spec, strings.Join(spec_formats(profile), "、"))
+		return
+	}
+	var key int
+	if profile.Key != "" {
+		key, err = strconv.Atoi(profile.Key)
+		if err != nil {
+			fmt.Printf("[ERROR]解密密钥无效 %s\n", profile.Key)
+			return
+		}
+	}
+	download_command(DownloadCommandArgs{
+		URL:        profile.SpecURL(args.Spec),
+		Filename:   args.Filename,
+		DecryptKey: key,
+		Retries:    download.DefaultRetryPolicy.MaxAttempts,
+		Profile:    profile,
+		Format:     args.Spec,
+		Sidecar:    sidecar_options(),
+		EmbedTags:  cfg.DownloadEmbedTags,
+	})
+}
+
+func truncate_text(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit]) + "..."
+}
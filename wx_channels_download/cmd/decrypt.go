@@ -1,16 +1,33 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"wx_channel/pkg/decrypt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
+
+	"wx_channel/pkg/decrypt"
 )
 
 var (
 	file_path          string
 	video_decrypt_key2 int
+	decrypt_enc_len    uint32
+	decrypt_force      bool
+	decrypt_output     string
+	decrypt_dir        string
+	decrypt_manifest   string
+	decrypt_workers    int
+	decrypt_in_place   bool
 )
 var decrypt_cmd = &cobra.Command{
 	Use:   "decrypt",
@@ -21,48 +38,292 @@ var decrypt_cmd = &cobra.Command{
 		if command != "decrypt" {
 			return
 		}
+		if decrypt_dir != "" {
+			decrypt_dir_command(DecryptDirCommandArgs{
+				Dir:      decrypt_dir,
+				Manifest: decrypt_manifest,
+				Output:   decrypt_output,
+				Workers:  decrypt_workers,
+				EncLen:   decrypt_enc_len,
+				Force:    decrypt_force,
+				InPlace:  decrypt_in_place,
+			})
+			return
+		}
 		decrypt_command(DecryptCOmmandArgs{
 			Filepath:   file_path,
+			Output:     decrypt_output,
 			DecryptKey: video_decrypt_key2,
+			EncLen:     decrypt_enc_len,
+			Force:      decrypt_force,
+			InPlace:    decrypt_in_place,
 		})
 	},
 }
 
 func init() {
-	decrypt_cmd.Flags().StringVar(&file_path, "filepath", "", "视频文件地址（必需）")
-	decrypt_cmd.Flags().IntVar(&video_decrypt_key2, "key", 0, "解密密钥（必需）")
-	decrypt_cmd.MarkFlagRequired("filepath")
+	decrypt_cmd.Flags().StringVar(&file_path, "filepath", "", "视频文件地址（单个文件时必需）")
+	decrypt_cmd.Flags().IntVar(&video_decrypt_key2, "key", 0, "解密密钥（单个文件时必需）")
+	decrypt_cmd.Flags().Uint32Var(&decrypt_enc_len, "enclen", 0, "加密区长度（默认读取文件旁的 .meta.json，没有时为 131072）")
+	decrypt_cmd.Flags().BoolVar(&decrypt_force, "force", false, "跳过密钥校验，即使解密结果不像有效的 MP4 也写入文件")
+	decrypt_cmd.Flags().StringVar(&decrypt_output, "output", "", "解密后的文件路径，批量模式下为输出目录（默认为原文件旁的 文件名.decrypted.mp4）")
+	decrypt_cmd.Flags().StringVar(&decrypt_dir, "dir", "", "批量解密的目录，按清单文件中的文件名和密钥解密")
+	decrypt_cmd.Flags().StringVar(&decrypt_manifest, "manifest", "", "批量解密的清单文件（默认为目录下的 manifest.json）")
+	decrypt_cmd.Flags().IntVar(&decrypt_workers, "workers", 4, "批量解密时同时处理的文件数")
+	decrypt_cmd.Flags().BoolVar(&decrypt_in_place, "in-place", false, "解密后覆盖原文件")
 
 	root_cmd.AddCommand(decrypt_cmd)
 }
 
 type DecryptCOmmandArgs struct {
 	Filepath   string
+	Output     string
 	DecryptKey int
+	EncLen     uint32
+	Force      bool
+	InPlace    bool
 }
 
+// 失败时以非 0 状态退出，方便脚本判断
 func decrypt_command(args DecryptCOmmandArgs) {
 	if args.Filepath == "" {
 		fmt.Printf("[ERROR]文件路径不能为空\n")
-		return
+		os.Exit(1)
 	}
 	if args.DecryptKey == 0 {
 		fmt.Printf("[ERROR]解密密钥不能为空\n")
-		return
+		os.Exit(1)
+	}
+	output := args.Output
+	if output == "" {
+		output = decrypted_filepath(args.Filepath, args.InPlace)
 	}
 	fmt.Printf("开始对文件解密 %s\n", args.Filepath)
-	length := uint32(131072)
-	key := uint64(args.DecryptKey)
-	data, err := os.ReadFile(args.Filepath)
+	length := decrypt.ResolveEncLen(args.EncLen, nil, args.Filepath)
+	if err := decrypt_file(args.Filepath, output, uint64(args.DecryptKey), length, args.Force, args.InPlace); err != nil {
+		fmt.Printf("[ERROR]%v\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("解密完成 %s\n", output)
+}
+
+// 没有指定输出路径时写入原文件旁的 文件名.decrypted.mp4，加上 --in-place 时覆盖原文件
+func decrypted_filepath(src_filepath string, in_place bool) string {
+	if in_place {
+		return src_filepath
+	}
+	ext := filepath.Ext(src_filepath)
+	return strings.TrimSuffix(src_filepath, ext) + ".decrypted" + ext
+}
+
+// 是否为同一个文件，目标文件不存在时比较路径
+func same_filepath(a string, b string) bool {
+	info_a, err_a := os.Stat(a)
+	info_b, err_b := os.Stat(b)
+	if err_a == nil && err_b == nil {
+		return os.SameFile(info_a, info_b)
+	}
+	abs_a, _ := filepath.Abs(a)
+	abs_b, _ := filepath.Abs(b)
+	return abs_a == abs_b
+}
+
+// 流式解密到同目录的临时文件，完成后再重命名为目标文件，中途失败不会影响原文件
+// 没有 in_place 时不会覆盖原文件，密钥错误时原文件仍然可用
+func decrypt_file(src_filepath string, dest_filepath string, key uint64, enc_len uint32, force bool, in_place bool) error {
+	if !in_place && same_filepath(src_filepath, dest_filepath) {
+		return fmt.Errorf("输出文件和原文件相同，确认覆盖原文件可加上 --in-place")
+	}
+	src, err := os.Open(src_filepath)
 	if err != nil {
-		fmt.Printf("[ERROR]读取已下载的文件失败 %v\n", err.Error())
-		return
+		return fmt.Errorf("读取已下载的文件失败 %v", err.Error())
 	}
-	decrypt.DecryptData(data, length, key)
-	err = os.WriteFile(args.Filepath, data, 0644)
+	defer src.Close()
+	info, err := src.Stat()
 	if err != nil {
-		fmt.Printf("[ERROR]写入文件失败 %v\n", err.Error())
-		return
+		return fmt.Errorf("读取已下载的文件失败 %v", err.Error())
+	}
+	if !force {
+		// 校验失败时不写入文件，避免错误的密钥破坏唯一的副本
+		head := make([]byte, decrypt.VerifyHeadSize)
+		n, _ := io.ReadFull(src, head)
+		if err := decrypt.VerifyKey(head[:n], key, enc_len); err != nil {
+			return fmt.Errorf("%v，确认无误可加上 --force 强制解密", err)
+		}
+		if _, err := src.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest_filepath), ".tmp_wx_decrypt_*")
+	if err != nil {
+		return fmt.Errorf("创建临时文件失败 %v", err.Error())
+	}
+	tmp_filepath := tmp.Name()
+	defer os.Remove(tmp_filepath)
+	reader := decrypt.NewReader(src, key, 0, enc_len)
+	if _, err := io.Copy(tmp, reader); err != nil {
+		tmp.Close()
+		return fmt.Errorf("写入文件失败 %v", err.Error())
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("写入文件失败 %v", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("写入文件失败 %v", err.Error())
+	}
+	os.Chmod(tmp_filepath, info.Mode().Perm())
+	// 在 Windows 上需要先关闭原文件才能覆盖
+	src.Close()
+	if err := os.Rename(tmp_filepath, dest_filepath); err != nil {
+		return fmt.Errorf("写入文件失败 %v", err.Error())
+	}
+	return nil
+}
+
+type DecryptDirCommandArgs struct {
+	Dir      string
+	Manifest string
+	Output   string
+	Workers  int
+	EncLen   uint32
+	Force    bool
+	InPlace  bool
+}
+
+type decrypt_dir_result struct {
+	Filename string
+	Size     int64
+	Elapsed  time.Duration
+	Err      error
+}
+
+func decrypt_dir_command(args DecryptDirCommandArgs) {
+	manifest_filepath := args.Manifest
+	if manifest_filepath == "" {
+		manifest_filepath = filepath.Join(args.Dir, "manifest.json")
+	}
+	manifest, err := read_decrypt_manifest(manifest_filepath)
+	if err != nil {
+		fmt.Printf("[ERROR]%v\n", err.Error())
+		os.Exit(1)
+	}
+	if len(manifest) == 0 {
+		fmt.Printf("[ERROR]清单文件中没有需要解密的文件\n")
+		os.Exit(1)
+	}
+	output_dir := args.Output
+	if output_dir == "" {
+		output_dir = args.Dir
+	}
+	if err := os.MkdirAll(output_dir, 0755); err != nil {
+		fmt.Printf("[ERROR]创建输出目录失败 %v\n", err.Error())
+		os.Exit(1)
+	}
+	workers := args.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	filenames := make([]string, 0, len(manifest))
+	for name := range manifest {
+		filenames = append(filenames, name)
+	}
+	sort.Strings(filenames)
+	fmt.Printf("开始批量解密 %d 个文件，清单 %s\n", len(filenames), manifest_filepath)
+
+	results := make([]decrypt_dir_result, len(filenames))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				name := filenames[idx]
+				src := filepath.Join(args.Dir, name)
+				dest := filepath.Join(output_dir, name)
+				if args.Output == "" {
+					dest = decrypted_filepath(dest, args.InPlace)
+				}
+				start := time.Now()
+				result := decrypt_dir_result{Filename: name}
+				if info, err := os.Stat(src); err == nil {
+					result.Size = info.Size()
+				}
+				if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+					result.Err = err
+				} else {
+					length := decrypt.ResolveEncLen(args.EncLen, nil, src)
+					result.Err = decrypt_file(src, dest, manifest[name], length, args.Force, args.InPlace)
+				}
+				result.Elapsed = time.Since(start)
+				results[idx] = result
+			}
+		}()
+	}
+	for i := range filenames {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	// 有文件解密失败时以非 0 状态退出，方便脚本判断
+	if failed := print_decrypt_dir_summary(results); failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// 清单为 JSON 对象，键为相对于目录的文件名，值为密钥（数字或字符串）
+func read_decrypt_manifest(manifest_filepath string) (map[string]uint64, error) {
+	data, err := os.ReadFile(manifest_filepath)
+	if err != nil {
+		return nil, fmt.Errorf("读取清单文件失败 %v", err.Error())
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("解析清单文件失败 %v", err.Error())
+	}
+	manifest := make(map[string]uint64, len(raw))
+	for name, v := range raw {
+		text := strings.Trim(strings.TrimSpace(string(v)), `"`)
+		key, err := strconv.ParseUint(text, 10, 64)
+		if err != nil || key == 0 {
+			return nil, fmt.Errorf("清单中 %s 的密钥无效 %s", name, string(v))
+		}
+		// 文件名只能是目录中的相对路径，不能通过 .. 或绝对路径写到目录外
+		local_name := filepath.FromSlash(name)
+		if !filepath.IsLocal(local_name) {
+			return nil, fmt.Errorf("清单中的文件名 %s 不在目录中", name)
+		}
+		manifest[filepath.Clean(local_name)] = key
+	}
+	return manifest, nil
+}
+
+// 返回失败的文件数
+func print_decrypt_dir_summary(results []decrypt_dir_result) int {
+	failed := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "文件\t状态\t大小\t耗时\t说明")
+	for _, r := range results {
+		status := "成功"
+		reason := ""
+		if r.Err != nil {
+			status = "失败"
+			reason = r.Err.Error()
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.2f MB\t%.1fs\t%s\n",
+			r.Filename,
+			status,
+			float64(r.Size)/1024/1024,
+			r.Elapsed.Seconds(),
+			reason,
+		)
 	}
-	fmt.Printf("解密完成 %s\n", args.Filepath)
+	tw.Flush()
+	fmt.Printf("\n解密完成，成功 %d 个，失败 %d 个\n", len(results)-failed, failed)
+	return failed
 }
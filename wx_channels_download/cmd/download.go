@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -9,14 +11,23 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"wx_channel/pkg/catalog"
+	"wx_channel/pkg/channels"
 	"wx_channel/pkg/decrypt"
 	"wx_channel/pkg/download"
+	"wx_channel/pkg/naming"
+	"wx_channel/pkg/sidecar"
+	"wx_channel/pkg/tags"
 )
 
 var (
 	video_url         string
 	filename          string
 	video_decrypt_key int
+	resume_download   bool
+	download_retries  int
+	download_enc_len  uint32
+	download_force    bool
 )
 
 var download_cmd = &cobra.Command{
@@ -28,19 +39,34 @@ var download_cmd = &cobra.Command{
 		if command != "download" {
 			return
 		}
-		download_command(DownloadCommandArgs{
+		download_args := DownloadCommandArgs{
 			URL:        video_url,
 			DecryptKey: video_decrypt_key,
 			Filename:   filename,
-		})
+			Resume:     resume_download,
+			Retries:    download_retries,
+			EncLen:     download_enc_len,
+			Force:      download_force,
+		}
+		// 打开过该视频时使用保存的视频信息生成文件名
+		if entry, err := catalog.FindByURL(cfg.ChannelCatalogFile, video_url); err == nil {
+			download_args.Profile = &entry.Profile
+			download_args.Format = url_spec(video_url)
+			download_args.Sidecar = sidecar_options()
+			download_args.EmbedTags = cfg.DownloadEmbedTags
+		}
+		download_command(download_args)
 	},
 }
 
 func init() {
-	now := int(time.Now().Unix())
 	download_cmd.Flags().StringVar(&video_url, "url", "", "视频URL（必需）")
 	download_cmd.Flags().IntVar(&video_decrypt_key, "key", 0, "解密密钥（未加密的视频不用传该参数）")
-	download_cmd.Flags().StringVar(&filename, "filename", strconv.Itoa(now)+".mp4", "下载后的文件名")
+	download_cmd.Flags().StringVar(&filename, "filename", "", "下载后的文件名（默认按 download.filenameTemplate 生成）")
+	download_cmd.Flags().BoolVar(&resume_download, "resume", false, "继续上次未完成的下载（需与上次使用相同的 --filename，未指定时查找同一视频的续传记录）")
+	download_cmd.Flags().IntVar(&download_retries, "retries", download.DefaultRetryPolicy.MaxAttempts, "每个分块失败后最多尝试的次数")
+	download_cmd.Flags().Uint32Var(&download_enc_len, "enclen", 0, "加密区长度（默认使用服务器返回的 X-enclen，没有时为 131072）")
+	download_cmd.Flags().BoolVar(&download_force, "force", false, "跳过密钥校验，即使解密结果不像有效的 MP4 也继续下载")
 	download_cmd.MarkFlagRequired("url")
 
 	root_cmd.AddCommand(download_cmd)
@@ -50,6 +76,15 @@ type DownloadCommandArgs struct {
 	URL        string
 	Filename   string
 	DecryptKey int
+	Resume     bool
+	Retries    int
+	EncLen     uint32
+	Force      bool
+	// 下载完成后写入标签、保存视频信息，Profile 为空时不处理
+	Profile   *channels.Profile
+	Format    string
+	Sidecar   sidecar.Options
+	EmbedTags bool
 }
 
 func download_command(args DownloadCommandArgs) {
@@ -59,53 +94,117 @@ func download_command(args DownloadCommandArgs) {
 		fmt.Printf("[ERROR]获取下载路径失败 %v\n", err.Error())
 		return
 	}
-	tmp_filename := "tmp_wx_" + strconv.Itoa(int(time.Now().Unix()))
-	tmp_dest_filepath := filepath.Join(homedir, "Downloads", tmp_filename)
-	dest_filepath := filepath.Join(homedir, "Downloads", args.Filename)
-
-	if args.DecryptKey == 0 {
-		tmp_dest_filepath = dest_filepath
+	dir := filepath.Join(homedir, "Downloads")
+	dest_filepath := filepath.Join(dir, args.Filename)
+	if args.Filename == "" {
+		name := default_filename(args)
+		if args.Resume {
+			dest_filepath = filepath.Join(dir, name+".mp4")
+			// 之前的版本默认使用下载时间或标题命名，按远程文件查找之前未完成的下载
+			if j, _ := download.LoadChunkJournal(dest_filepath); j == nil {
+				if meta, err := download.ProbeRemoteFile(url); err == nil {
+					p, err := download.FindResumable(dir, meta)
+					if err != nil {
+						fmt.Printf("[ERROR]%v\n", err.Error())
+						return
+					}
+					if p != "" {
+						dest_filepath = p
+						fmt.Printf("继续之前未完成的下载 %s\n", p)
+					}
+				}
+			}
+		} else {
+			// 不覆盖已存在的文件
+			dest_filepath = naming.Unique(dir, name, ".mp4", nil)
+		}
 	}
 
-	if err := download.MultiThreadingDownload(url, 4, tmp_dest_filepath, tmp_dest_filepath); err != nil {
-		fmt.Printf("[ERROR]%v\n", err.Error())
-		return
+	opts := download.MultiThreadingDownloadOptions{
+		Threads: 4,
+		Resume:  args.Resume,
+		Retry: download.RetryPolicy{
+			MaxAttempts: args.Retries,
+			MaxSplits:   download.DefaultRetryPolicy.MaxSplits,
+		},
+	}
+	enc_len := decrypt.DefaultEncLen
+	opts.OnProbe = func(meta *download.RemoteFileMeta) error {
+		enc_len = decrypt.ResolveEncLen(args.EncLen, meta.Header, "")
+		if args.DecryptKey != 0 && !args.Force {
+			// 下载前先用文件开头校验密钥，避免下载完才发现解密失败
+			if err := decrypt.VerifyKey(meta.Head, uint64(args.DecryptKey), enc_len); err != nil {
+				return fmt.Errorf("%v，确认无误可加上 --force 继续下载", err)
+			}
+		}
+		if args.DecryptKey == 0 {
+			if _, ok := decrypt.EncLenFromHeader(meta.Header); ok {
+				// 没有传 key 时保留加密区长度，之后用 decrypt 命令解密时读取
+				if err := decrypt.WriteMetadata(dest_filepath, &decrypt.Metadata{EncLen: enc_len}); err != nil {
+					fmt.Printf("[ERROR]写入元数据文件失败 %v\n", err.Error())
+				}
+			}
+		}
+		return nil
 	}
-	// elapsed := time.Since(start_time)
-	// speed := float64(file_size) / elapsed.Seconds() / 1024 / 1024
-
-	// fmt.Printf("文件大小: %.2f MB\n", float64(file_size)/1024/1024)
-	// fmt.Printf("耗时: %.2f 秒\n", elapsed.Seconds())
-	// fmt.Printf("平均速度: %.2f MB/s\n", speed)
-
 	if args.DecryptKey != 0 {
-		fmt.Printf("下载完成!\n")
-		fmt.Printf("开始对临时文件解密 %s\n", tmp_dest_filepath)
-		length := uint32(131072)
+		// 每段数据按其在文件中的偏移边下载边解密，不再生成临时文件
 		key := uint64(args.DecryptKey)
-		data, err := os.ReadFile(tmp_dest_filepath)
-		if err != nil {
-			fmt.Printf("[ERROR]读取临时文件失败 %v\n", err.Error())
-			return
+		opts.Transform = func(reader io.Reader, offset int64) io.Reader {
+			return decrypt.NewReader(reader, key, uint64(offset), enc_len)
 		}
-		decrypt.DecryptData(data, length, key)
-		err = os.WriteFile(dest_filepath, data, 0644)
-		if err != nil {
-			fmt.Printf("[ERROR]写入文件失败 %v\n", err.Error())
-			return
+	}
+
+	mode, err := download.Download(url, dest_filepath, opts, func(progress *download.PartialFileDownloadProgress) {
+		if progress.TotalSize > 0 {
+			fmt.Printf("\r\033[K已下载: %d/%d 字节 (%.2f%%)", progress.DownloadedSize, progress.TotalSize, progress.Percent)
+		} else {
+			fmt.Printf("\r\033[K已下载: %d 字节", progress.DownloadedSize)
 		}
-		fmt.Printf("删除临时文件 %s\n", tmp_dest_filepath)
-		if err := os.Remove(tmp_dest_filepath); err != nil {
-			if os.IsNotExist(err) {
-				fmt.Println("[ERROR]临时文件不存在")
-			} else if os.IsPermission(err) {
-				fmt.Println("[ERROR]没有权限删除临时文件")
-			} else {
-				fmt.Printf("[ERROR]临时文件删除失败 %v\n", err.Error())
-			}
+	})
+	if mode == download.DownloadModeSingleThreading {
+		fmt.Println()
+	}
+	if err != nil {
+		fmt.Printf("[ERROR]%s失败 %v\n", mode, err.Error())
+		return
+	}
+	if args.Profile != nil && args.EmbedTags {
+		if err := tags.EmbedDecrypted(dest_filepath, tags.FromProfile(args.Profile)); err != nil {
+			fmt.Printf("[ERROR]%v\n", err.Error())
 		}
-		fmt.Printf("解密完成，文件路径为 %s\n", dest_filepath)
+	}
+	if args.Profile != nil && args.Sidecar.Enabled() {
+		if err := sidecar.Write(dest_filepath, args.Profile, args.Format, args.Sidecar); err != nil {
+			fmt.Printf("[ERROR]%v\n", err.Error())
+		}
+	}
+	// 成功时也提示实际使用的下载方式，服务器不支持分段下载时会改为单线程
+	if args.DecryptKey != 0 {
+		fmt.Printf("%s并解密完成，文件路径为 %s\n", mode, dest_filepath)
 		return
 	}
-	fmt.Printf("下载完成，文件路径为 %s\n", dest_filepath)
+	fmt.Printf("%s完成，文件路径为 %s\n", mode, dest_filepath)
+}
+
+// 按配置中的文件名模板生成，没有视频信息时只能使用下载时间
+func default_filename(args DownloadCommandArgs) string {
+	vars := naming.DefaultVars(url_spec(args.URL), time.Now())
+	if args.Profile != nil {
+		vars = naming.ProfileVars(args.Profile, args.Format, time.Now())
+	}
+	name := naming.Filename(cfg.DownloadFilenameTemplate, vars)
+	if name == "" {
+		name = strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	return name
+}
+
+// 地址中的规格，原始视频为空
+func url_spec(video_url string) string {
+	u, err := url.Parse(video_url)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("X-snsvideoflag")
 }
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"wx_channel/pkg/channels"
+	"wx_channel/pkg/download"
+	"wx_channel/pkg/naming"
+	"wx_channel/pkg/sidecar"
+)
+
+var (
+	fetch_nonce_id string
+	fetch_spec     string
+	fetch_json     bool
+	fetch_download bool
+	fetch_filename string
+)
+var fetch_cmd = &cobra.Command{
+	Use:   "fetch <视频ID|分享链接>",
+	Short: "在命令行中获取视频信息",
+	Long:  "使用打开视频时保存的登录信息获取视频的地址、密钥和规格，不需要在微信中打开视频",
+	Run: func(cmd *cobra.Command, args []string) {
+		var input string
+		if len(args) > 0 {
+			input = args[0]
+		}
+		fetch_command(FetchCommandArgs{
+			Input:       input,
+			NonceID:     fetch_nonce_id,
+			Spec:        fetch_spec,
+			JSON:        fetch_json,
+			Download:    fetch_download,
+			Filename:    fetch_filename,
+			SessionFile: cfg.ChannelSessionFile,
+		})
+	},
+}
+
+func init() {
+	fetch_cmd.Flags().StringVar(&fetch_nonce_id, "nonce-id", "", "视频的 nonce id（分享链接中的 nid）")
+	fetch_cmd.Flags().StringVar(&fetch_spec, "spec", "", "下载指定规格的视频，如 xWT111，默认下载原始视频")
+	fetch_cmd.Flags().BoolVar(&fetch_json, "json", false, "以 JSON 格式输出")
+	fetch_cmd.Flags().BoolVar(&fetch_download, "download", false, "获取后直接下载")
+	fetch_cmd.Flags().StringVar(&fetch_filename, "filename", "", "下载后的文件名（默认按 download.filenameTemplate 生成）")
+
+	root_cmd.AddCommand(fetch_cmd)
+}
+
+type FetchCommandArgs struct {
+	Input       string
+	NonceID     string
+	Spec        string
+	JSON        bool
+	Download    bool
+	Filename    string
+	SessionFile string
+}
+
+func fetch_command(args FetchCommandArgs) {
+	if args.Input == "" {
+		fmt.Printf("[ERROR]视频 ID 或分享链接不能为空\n")
+		return
+	}
+	session, err := channels.LoadSession(args.SessionFile)
+	if err != nil {
+		fmt.Printf("[ERROR]%v\n", err.Error())
+		return
+	}
+	client := channels.NewClient(session)
+	ref, err := client.ResolveFeedRef(args.Input)
+	if err != nil {
+		fmt.Printf("[ERROR]%v\n", err.Error())
+		return
+	}
+	if args.NonceID != "" {
+		ref.NonceID = args.NonceID
+	}
+	profile, err := client.FetchProfile(ref)
+	if err != nil {
+		fmt.Printf("[ERROR]%v\n", err.Error())
+		return
+	}
+	if args.Spec != "" && profile.FindSpec(args.Spec) == nil {
+		fmt.Printf("[ERROR]没有 %s 规格，可选 %s\n", args.Spec, strings.Join(spec_formats(profile), "、"))
+		return
+	}
+	filename := args.Filename
+	if filename == "" {
+		filename = fetch_filename_of(profile, args.Spec)
+	}
+
+	if args.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(profile)
+	} else {
+		print_profile(profile, args.Spec, filename)
+	}
+	if !args.Download {
+		return
+	}
+	var key int
+	if profile.Key != "" {
+		key, err = strconv.Atoi(profile.Key)
+		if err != nil {
+			fmt.Printf("[ERROR]解密密钥无效 %s\n", profile.Key)
+			return
+		}
+	}
+	download_command(DownloadCommandArgs{
+		URL:        profile.SpecURL(args.Spec),
+		Filename:   args.Filename,
+		DecryptKey: key,
+		Retries:    download.DefaultRetryPolicy.MaxAttempts,
+		Profile:    profile,
+		Format:     args.Spec,
+		Sidecar:    sidecar_options(),
+		EmbedTags:  cfg.DownloadEmbedTags,
+	})
+}
+
+// 和由本程序下载的任务使用同一个配置
+func sidecar_options() sidecar.Options {
+	return sidecar.Options{
+		JSON:   cfg.DownloadSidecarJSON,
+		NFO:    cfg.DownloadSidecarNFO,
+		Poster: cfg.DownloadSidecarPoster,
+	}
+}
+
+func spec_formats(profile *channels.Profile) []string {
+	formats := make([]string, 0, len(profile.Spec))
+	for _, spec := range profile.Spec {
+		formats = append(formats, spec.FileFormat)
+	}
+	return formats
+}
+
+// 按配置中的文件名模板生成，和页面中下载时的文件名一致
+func fetch_filename_of(profile *channels.Profile, spec string) string {
+	name := naming.Filename(cfg.DownloadFilenameTemplate, naming.ProfileVars(profile, spec, time.Now()))
+	if name == "" {
+		name = profile.ID
+	}
+	return name + ".mp4"
+}
+
+func print_profile(profile *channels.Profile, spec string, filename string) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "标题\t%s\n", profile.Title)
+	if profile.Contact != nil {
+		fmt.Fprintf(tw, "作者\t%s\n", profile.Contact.Nickname)
+	}
+	fmt.Fprintf(tw, "视频 ID\t%s\n", profile.ID)
+	fmt.Fprintf(tw, "nonce id\t%s\n", profile.NonceID)
+	if profile.Size > 0 {
+		fmt.Fprintf(tw, "大小\t%.2f MB\n", float64(profile.Size)/1024/1024)
+	}
+	fmt.Fprintf(tw, "密钥\t%s\n", profile.Key)
+	fmt.Fprintf(tw, "地址\t%s\n", profile.SpecURL(spec))
+	for _, s := range profile.Spec {
+		fmt.Fprintf(tw, "规格\t%s %dx%d %s\n", s.FileFormat, s.Width, s.Height, s.CodingFormat)
+	}
+	tw.Flush()
+
+	command := fmt.Sprintf("download --url %q --filename %q", profile.SpecURL(spec), filename)
+	if profile.Key != "" {
+		command += " --key " + profile.Key
+	}
+	fmt.Printf("\n下载命令\n%s\n", command)
+}
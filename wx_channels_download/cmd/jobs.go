@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"wx_channel/pkg/jobs"
+)
+
+var (
+	jobs_status string
+	jobs_limit  int
+	jobs_json   bool
+)
+var jobs_cmd = &cobra.Command{
+	Use:   "jobs",
+	Short: "查看下载记录",
+	Long:  "查看在页面中和由本程序下载的视频记录",
+	Run: func(cmd *cobra.Command, args []string) {
+		jobs_command(JobsCommandArgs{
+			Filepath: cfg.DownloadJobsFile,
+			Status:   jobs_status,
+			Limit:    jobs_limit,
+			JSON:     jobs_json,
+		})
+	},
+}
+
+func init() {
+	jobs_cmd.Flags().StringVar(&jobs_status, "status", "", "只显示指定状态的记录（pending、downloading、completed、failed）")
+	jobs_cmd.Flags().IntVar(&jobs_limit, "limit", 20, "显示的记录数，为 0 时显示全部")
+	jobs_cmd.Flags().BoolVar(&jobs_json, "json", false, "以 JSON 格式输出")
+
+	root_cmd.AddCommand(jobs_cmd)
+}
+
+type JobsCommandArgs struct {
+	Filepath string
+	Status   string
+	Limit    int
+	JSON     bool
+}
+
+var job_status_text = map[string]string{
+	jobs.StatusPending:     "等待中",
+	jobs.StatusDownloading: "下载中",
+	jobs.StatusCompleted:   "已完成",
+	jobs.StatusFailed:      "失败",
+}
+
+func jobs_command(args JobsCommandArgs) {
+	list, err := jobs.Load(args.Filepath, jobs.ListOptions{
+		Status: args.Status,
+		Limit:  args.Limit,
+	})
+	if err != nil {
+		fmt.Printf("[ERROR]%v\n", err.Error())
+		return
+	}
+	if args.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(list)
+		return
+	}
+	if len(list) == 0 {
+		fmt.Printf("没有下载记录 %s\n", args.Filepath)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\t时间\t状态\t规格\t文件名\t说明")
+	for _, job := range list {
+		status := job_status_text[job.Status]
+		if status == "" {
+			status = job.Status
+		}
+		filename := job.Filename
+		if filename == "" {
+			filename = job.Title
+		}
+		reason := job.Filepath
+		if job.Status == jobs.StatusFailed {
+			reason = job.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			job.ID,
+			job.CreatedAt.Local().Format("2006-01-02 15:04"),
+			status,
+			job.Format,
+			filename,
+			reason,
+		)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"wx_channel/pkg/remux"
+)
+
+var (
+	remux_inputs     []string
+	remux_output     string
+	remux_fragmented bool
+)
+var remux_cmd = &cobra.Command{
+	Use:   "remux [文件...]",
+	Short: "将录制的 FLV 直播转换为 MP4",
+	Long:  "将录制的 FLV 直播（H.264/AAC）转换为 MP4，不重新编码，多个文件按顺序合并为一个",
+	Run: func(cmd *cobra.Command, args []string) {
+		remux_command(RemuxCommandArgs{
+			Inputs:     append(remux_inputs, args...),
+			Output:     remux_output,
+			Fragmented: remux_fragmented,
+		})
+	},
+}
+
+func init() {
+	remux_cmd.Flags().StringSliceVar(&remux_inputs, "input", nil, "FLV 文件路径，可以指定多个，按顺序合并")
+	remux_cmd.Flags().StringVar(&remux_output, "output", "", "输出的 MP4 文件路径（默认为第一个文件同名的 .mp4）")
+	remux_cmd.Flags().BoolVar(&remux_fragmented, "fragmented", false, "输出 fragmented MP4")
+
+	root_cmd.AddCommand(remux_cmd)
+}
+
+type RemuxCommandArgs struct {
+	Inputs     []string
+	Output     string
+	Fragmented bool
+}
+
+func remux_command(args RemuxCommandArgs) {
+	if len(args.Inputs) == 0 {
+		fmt.Printf("[ERROR]文件路径不能为空\n")
+		return
+	}
+	output := args.Output
+	if output == "" {
+		first := args.Inputs[0]
+		output = strings.TrimSuffix(first, filepath.Ext(first)) + ".mp4"
+	}
+	for _, input := range args.Inputs {
+		if abs_input, err := filepath.Abs(input); err == nil {
+			if abs_output, err := filepath.Abs(output); err == nil && abs_input == abs_output {
+				fmt.Printf("[ERROR]输出文件不能和输入文件相同 %s\n", input)
+				return
+			}
+		}
+	}
+	fmt.Printf("开始转换 %d 个文件\n", len(args.Inputs))
+	result, err := remux.RemuxFLVToMP4(args.Inputs, output, remux.Options{
+		Fragmented: args.Fragmented,
+	})
+	if err != nil {
+		fmt.Printf("[ERROR]%v\n", err.Error())
+		return
+	}
+	fmt.Printf("转换完成 %s\n", output)
+	fmt.Printf("时长 %s，视频帧 %d，音频帧 %d\n", result.Duration.Round(1e9), result.VideoSamples, result.AudioSamples)
+	if result.Discontinuities > 0 {
+		fmt.Printf("修正了 %d 处时间戳间隔\n", result.Discontinuities)
+	}
+}
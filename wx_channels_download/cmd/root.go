@@ -15,6 +15,7 @@ import (
 	"wx_channel/internal/download"
 	"wx_channel/internal/interceptor"
 	"wx_channel/internal/manager"
+	"wx_channel/pkg/jobs"
 )
 
 var (
@@ -106,6 +107,10 @@ func root_command(args RootCommandArg) {
 
 	mgr := manager.NewServerManager()
 
+	// 由本程序下载的任务和通过下载服务的下载共用，页面通过下载服务的 /events 订阅
+	events := jobs.NewEvents()
+	args.Events = events
+
 	// 初始化拦截服务
 	interceptorServer, err := interceptor.NewInterceptorServer(args.InterceptorConfig)
 	if err != nil {
@@ -115,7 +120,7 @@ func root_command(args RootCommandArg) {
 	mgr.RegisterServer(interceptorServer)
 
 	// 初始化下载服务
-	downloadServer := download.NewDownloadServer(cfg.DownloadLocalServerAddr)
+	downloadServer := download.NewDownloadServer(cfg, events)
 	mgr.RegisterServer(downloadServer)
 
 	cleanup := func() {
@@ -140,6 +145,13 @@ func root_command(args RootCommandArg) {
 		} else {
 			color.Green("下载服务启动成功")
 		}
+		if ffmpeg := downloadServer.FFmpeg(); ffmpeg.Available {
+			if isDevMode {
+				color.Green(fmt.Sprintf("ffmpeg %s %s", ffmpeg.Version, ffmpeg.Path))
+			}
+		} else {
+			color.Yellow("未检测到 ffmpeg，转码功能不可用，可以在配置文件中通过 download.ffmpegPath 指定路径")
+		}
 	}
 	// 启动代理服务
 	if err := mgr.StartServer("interceptor"); err != nil {
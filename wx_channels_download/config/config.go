@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -19,6 +20,7 @@ type Config struct {
 	DownloadPauseWhenDownload    bool   `json:"downloadPauseWhenDownload"`  // 下载时暂停播放
 	DownloadLocalServerEnabled   bool   `json:"downloadLocalServerEnabled"` // 下载时是否使用本地服务器
 	DownloadLocalServerAddr      string `json:"downloadLocalServerAddr"`    // 下载时本地服务器地址
+	DownloadLocalServerRoot      string `json:"-"`                          // 本地服务器允许访问的本地视频目录
 	ProxySystem                  bool
 	Hostname                     string
 	Port                         int
@@ -29,6 +31,28 @@ type Config struct {
 	InjectExtraScriptAfterJSMain string // 额外注入的 js
 	InjectGlobalScript           string // 全局用户脚本
 	CreditEncrypted              string `json:"creditEncrypted"` // 加密的积分数据（可选）
+
+	DownloadProfiles      map[string]TranscodeProfile `json:"-"` // 本地服务器可用的转码配置
+	DownloadFFmpegPath    string                      `json:"-"` // ffmpeg 可执行文件路径，为空时从 PATH 中查找
+	DownloadMaxTranscodes int                         `json:"-"` // 本地服务器同时转码的最大个数
+
+	DownloadLiveDir             string        `json:"-"` // 直播录制文件保存目录
+	DownloadLiveSegmentDuration time.Duration `json:"-"` // 直播录制每个分段的时长
+
+	DownloadJobsFile     string `json:"-"`                  // 下载记录文件路径
+	DownloadDir          string `json:"-"`                  // 由本程序下载时的保存目录
+	DownloadMaxDownloads int    `json:"-"`                  // 由本程序同时下载的最大个数
+	DownloadServerSide   bool   `json:"downloadServerSide"` // 点击下载原始视频时由本程序下载
+
+	ChannelSessionFile string `json:"-"` // 打开视频时保存的登录信息，用于 fetch 命令
+
+	ChannelCatalogFile string `json:"-"` // 打开过的视频目录，用于 catalog 命令
+
+	DownloadSidecarJSON   bool `json:"-"` // 由本程序下载完成后保存视频信息 .json
+	DownloadSidecarNFO    bool `json:"-"` // 由本程序下载完成后保存 .nfo
+	DownloadSidecarPoster bool `json:"-"` // 由本程序下载完成后保存封面 -poster.jpg
+
+	DownloadEmbedTags bool `json:"-"` // 下载完成后在 MP4、MP3 中写入标题、作者和封面
 }
 
 func LoadConfig() (*Config, error) {
@@ -83,6 +107,19 @@ func LoadConfig() (*Config, error) {
 	viper.SetDefault("download.pauseWhenDownload", false)
 	viper.SetDefault("download.localServer.enabled", false)
 	viper.SetDefault("download.localServer.addr", "127.0.0.1:8080")
+	viper.SetDefault("download.localServer.root", "")
+	viper.SetDefault("download.ffmpegPath", "")
+	viper.SetDefault("download.maxTranscodes", 2)
+	viper.SetDefault("download.live.dir", "")
+	viper.SetDefault("download.live.segmentDuration", "30m")
+	viper.SetDefault("download.sidecar.json", false)
+	viper.SetDefault("download.sidecar.nfo", false)
+	viper.SetDefault("download.sidecar.poster", false)
+	viper.SetDefault("download.embedTags", false)
+	viper.SetDefault("download.jobsFile", "download_jobs.jsonl")
+	viper.SetDefault("download.dir", "")
+	viper.SetDefault("download.maxDownloads", 2)
+	viper.SetDefault("download.serverSide", false)
 	viper.SetDefault("proxy.system", true)
 	viper.SetDefault("proxy.port", 2023)
 	viper.SetDefault("proxy.hostname", "127.0.0.1")
@@ -90,9 +127,15 @@ func LoadConfig() (*Config, error) {
 	viper.SetDefault("debug.api", "debug.weixin.qq.com")
 	viper.SetDefault("debug", false)
 	viper.SetDefault("channel.disableLocationToHome", false)
+	viper.SetDefault("channel.sessionFile", "channels_session.json")
 	viper.SetDefault("inject.extraScript.afterJSMain", "")
 	viper.SetDefault("inject.globalScript", "")
 
+	profiles, err := load_transcode_profiles()
+	if err != nil {
+		return nil, err
+	}
+
 	// 加载积分密钥文件（独立文件）
 	creditEncrypted := loadCreditKey(base_dir)
 
@@ -102,6 +145,16 @@ func LoadConfig() (*Config, error) {
 		DownloadPauseWhenDownload:    viper.GetBool("download.pauseWhenDownload"),
 		DownloadLocalServerEnabled:   viper.GetBool("download.localServer.enabled"),
 		DownloadLocalServerAddr:      viper.GetString("download.localServer.addr"),
+		DownloadLocalServerRoot:      viper.GetString("download.localServer.root"),
+		DownloadProfiles:             profiles,
+		DownloadFFmpegPath:           viper.GetString("download.ffmpegPath"),
+		DownloadMaxTranscodes:        viper.GetInt("download.maxTranscodes"),
+		DownloadLiveDir:              viper.GetString("download.live.dir"),
+		DownloadLiveSegmentDuration:  viper.GetDuration("download.live.segmentDuration"),
+		DownloadJobsFile:             viper.GetString("download.jobsFile"),
+		DownloadDir:                  viper.GetString("download.dir"),
+		DownloadMaxDownloads:         viper.GetInt("download.maxDownloads"),
+		DownloadServerSide:           viper.GetBool("download.serverSide"),
 		ProxySystem:                  viper.GetBool("proxy.system"),
 		Port:                         viper.GetInt("proxy.port"),
 		Hostname:                     viper.GetString("proxy.hostname"),
@@ -112,11 +165,37 @@ func LoadConfig() (*Config, error) {
 		InjectExtraScriptAfterJSMain: viper.GetString("inject.extraScript.afterJSMain"),
 		InjectGlobalScript:           viper.GetString("inject.globalScript"),
 		CreditEncrypted:              creditEncrypted,
+		ChannelSessionFile:           viper.GetString("channel.sessionFile"),
+		ChannelCatalogFile:           viper.GetString("channel.catalogFile"),
+		DownloadSidecarJSON:          viper.GetBool("download.sidecar.json"),
+		DownloadSidecarNFO:           viper.GetBool("download.sidecar.nfo"),
+		DownloadSidecarPoster:        viper.GetBool("download.sidecar.poster"),
+		DownloadEmbedTags:            viper.GetBool("download.embedTags"),
 	}
 	if has_config {
 		config.FilePath = config_filepath
 	}
 
+	// 下载记录默认保存在配置文件所在目录
+	if config.DownloadJobsFile == "" {
+		config.DownloadJobsFile = "download_jobs.jsonl"
+	}
+	if !filepath.IsAbs(config.DownloadJobsFile) {
+		config.DownloadJobsFile = filepath.Join(base_dir, config.DownloadJobsFile)
+	}
+	if config.ChannelSessionFile == "" {
+		config.ChannelSessionFile = "channels_session.json"
+	}
+	if !filepath.IsAbs(config.ChannelSessionFile) {
+		config.ChannelSessionFile = filepath.Join(base_dir, config.ChannelSessionFile)
+	}
+	if config.ChannelCatalogFile == "" {
+		config.ChannelCatalogFile = "channels_catalog.jsonl"
+	}
+	if !filepath.IsAbs(config.ChannelCatalogFile) {
+		config.ChannelCatalogFile = filepath.Join(base_dir, config.ChannelCatalogFile)
+	}
+
 	extra_js_filepath := config.InjectExtraScriptAfterJSMain
 	if extra_js_filepath != "" {
 		// If it's a relative path, resolve it against the current working directory
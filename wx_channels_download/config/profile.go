@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// 本地下载服务的转码配置，Args 为 ffmpeg 输入与输出之间的参数
+// 实际执行的命令为 ffmpeg -i pipe:0 <args> pipe:1，因此输出格式需要支持流式写入
+type TranscodeProfile struct {
+	Args        []string `json:"args" mapstructure:"args"`
+	ContentType string   `json:"contentType" mapstructure:"contentType"`
+	Ext         string   `json:"ext" mapstructure:"ext"`
+}
+
+// 内置的转码配置，config.yaml 中同名的配置会覆盖
+var DefaultTranscodeProfiles = map[string]TranscodeProfile{
+	"mp3": {
+		Args:        []string{"-vn", "-acodec", "libmp3lame", "-ab", "192k", "-f", "mp3"},
+		ContentType: "audio/mpeg",
+		Ext:         "mp3",
+	},
+	"mp3_loudnorm": {
+		Args:        []string{"-vn", "-af", "loudnorm=I=-16:TP=-1.5:LRA=11", "-acodec", "libmp3lame", "-ab", "192k", "-f", "mp3"},
+		ContentType: "audio/mpeg",
+		Ext:         "mp3",
+	},
+	"m4a": {
+		Args:        []string{"-vn", "-acodec", "aac", "-ab", "192k", "-f", "ipod", "-movflags", "frag_keyframe+empty_moov+default_base_moof"},
+		ContentType: "audio/mp4",
+		Ext:         "m4a",
+	},
+	"aac": {
+		Args:        []string{"-vn", "-acodec", "aac", "-ab", "192k", "-f", "adts"},
+		ContentType: "audio/aac",
+		Ext:         "aac",
+	},
+	"opus": {
+		Args:        []string{"-vn", "-acodec", "libopus", "-ab", "128k", "-f", "ogg"},
+		ContentType: "audio/ogg",
+		Ext:         "opus",
+	},
+	"wav": {
+		Args:        []string{"-vn", "-acodec", "pcm_s16le", "-f", "wav"},
+		ContentType: "audio/wav",
+		Ext:         "wav",
+	},
+	"flac": {
+		Args:        []string{"-vn", "-acodec", "flac", "-f", "flac"},
+		ContentType: "audio/flac",
+		Ext:         "flac",
+	},
+	"720p": {
+		Args:        []string{"-vf", "scale=-2:'min(720,ih)'", "-vcodec", "libx264", "-preset", "veryfast", "-crf", "23", "-acodec", "aac", "-ab", "128k", "-f", "mp4", "-movflags", "frag_keyframe+empty_moov+default_base_moof"},
+		ContentType: "video/mp4",
+		Ext:         "mp4",
+	},
+}
+
+// 合并内置配置与 config.yaml 中 download.profiles 下的配置
+func load_transcode_profiles() (map[string]TranscodeProfile, error) {
+	profiles := make(map[string]TranscodeProfile, len(DefaultTranscodeProfiles))
+	for name, p := range DefaultTranscodeProfiles {
+		profiles[name] = p
+	}
+	var custom map[string]TranscodeProfile
+	if err := viper.UnmarshalKey("download.profiles", &custom); err != nil {
+		return nil, fmt.Errorf("解析转码配置失败 %v", err.Error())
+	}
+	for name, p := range custom {
+		if len(p.Args) == 0 {
+			return nil, fmt.Errorf("转码配置 %s 缺少 args", name)
+		}
+		p.Ext = strings.TrimPrefix(p.Ext, ".")
+		if p.Ext == "" {
+			return nil, fmt.Errorf("转码配置 %s 缺少 ext", name)
+		}
+		if p.ContentType == "" {
+			p.ContentType = "application/octet-stream"
+		}
+		profiles[name] = p
+	}
+	return profiles, nil
+}
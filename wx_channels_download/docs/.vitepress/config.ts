@@ -68,7 +68,11 @@ export default defineConfig({
         items: [
           { text: "代理服务", link: "/cli/proxy" },
           { text: "下载", link: "/cli/download" },
+          { text: "获取视频", link: "/cli/fetch" },
+          { text: "打开过的视频", link: "/cli/catalog" },
           { text: "解密", link: "/cli/decrypt" },
+          { text: "直播转换", link: "/cli/remux" },
+          { text: "下载记录", link: "/cli/jobs" },
           { text: "删除证书", link: "/cli/uninstall" },
           { text: "查看版本", link: "/cli/version" },
         ],
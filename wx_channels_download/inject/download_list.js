@@ -3,9 +3,275 @@ var __wx_channels_download_list__ = {
   list: [], // 下载列表数据
   container: null, // 列表容器
   isExpanded: false, // 是否展开
-  maxItems: 10, // 最大显示数量
+  maxItems: 100, // 最大显示数量，下载记录保存在本地，不受该数量限制
+  events: null, // 下载服务的事件订阅
+  waiters: {}, // 等待下载结束的任务
 };
 
+// 下载记录保存在本程序中，刷新页面后不会丢失
+async function __wx_jobs_request(path, body) {
+  try {
+    var response = await fetch("/__wx_channels_api/jobs" + path, {
+      method: "POST",
+      headers: {
+        "Content-Type": "application/json",
+      },
+      body: JSON.stringify(body || {}),
+    });
+    var data = await response.json();
+    if (!response.ok) {
+      throw new Error(data.error || "请求失败");
+    }
+    return data;
+  } catch (err) {
+    console.warn("[download_list]同步下载记录失败", path, err);
+    return null;
+  }
+}
+
+// 读取保存的下载记录
+async function load_download_list() {
+  var jobs = await __wx_jobs_request(
+    "?limit=" + __wx_channels_download_list__.maxItems
+  );
+  if (!Array.isArray(jobs)) {
+    return;
+  }
+  var list = __wx_channels_download_list__.list;
+  jobs.forEach(function (job) {
+    if (list.find((i) => i.id === job.id)) {
+      return;
+    }
+    var item = job_to_download_item(job);
+    // 由本程序下载的任务在刷新后继续，等待下载结束
+    if (job.source === "server" && (job.status === "pending" || job.status === "downloading")) {
+      watch_server_download(item);
+    }
+    // 页面中的下载在刷新后就中断了
+    if (job.source === "page" && job.status === "downloading") {
+      item.status = "failed";
+      item.error = "页面刷新，下载中断";
+      __wx_jobs_request("/update", {
+        id: item.id,
+        status: item.status,
+        error: item.error,
+      });
+    }
+    list.push(item);
+  });
+  list.sort((a, b) => b.timestamp - a.timestamp);
+  update_download_list_display();
+}
+
+// 本程序保存的下载记录转换为列表项
+function job_to_download_item(job) {
+  return {
+    id: job.id,
+    profile: job.profile || { id: job.feed_id, title: job.title },
+    spec: job.spec || null,
+    status: job.status,
+    error: job.error,
+    filename: job.filename,
+    filepath: job.filepath,
+    timestamp: new Date(job.created_at).valueOf(),
+    url: job.url,
+    key: job.key,
+    progress: job.progress || 0,
+    source: job.source,
+  };
+}
+
+// 等待由本程序下载的任务结束
+function watch_server_download(item) {
+  __wx_channels_wait_server_download(item.id)
+    .then(function () {
+      update_download_item_status(item.id, "completed");
+    })
+    .catch(function (err) {
+      update_download_item_status(item.id, "failed", err.message || String(err));
+    });
+}
+
+// 订阅下载服务的事件，实时更新进度，其他标签页开始的下载也会显示
+// 未开启下载服务时，由本程序下载的任务通过轮询获取进度
+function subscribe_download_events() {
+  if (!__wx_channels_config__.downloadLocalServerEnabled || typeof EventSource === "undefined") {
+    return;
+  }
+  if (__wx_channels_download_list__.events) {
+    return;
+  }
+  var source = new EventSource(`http://${__wx_channels_config__.downloadLocalServerAddr}/events`);
+  var connected = false;
+  source.onopen = function () {
+    if (connected) {
+      // 断线期间可能错过了结束事件，重新查询一次
+      recheck_download_waiters();
+    }
+    connected = true;
+  };
+  source.onerror = function () {
+    console.warn("[download_list]下载服务事件连接断开，稍后重连");
+  };
+  ["queued", "progress", "decrypting", "transcoding", "done", "failed"].forEach(function (type) {
+    source.addEventListener(type, function (e) {
+      try {
+        apply_download_event(JSON.parse(e.data));
+      } catch (err) {
+        console.warn("[download_list]处理下载事件失败", err);
+      }
+    });
+  });
+  __wx_channels_download_list__.events = source;
+}
+
+// 等待下载服务发送任务结束的事件，没有订阅时返回 null
+function wait_download_event(id, server) {
+  var events = __wx_channels_download_list__.events;
+  if (!id || !events || events.readyState === EventSource.CLOSED) {
+    return null;
+  }
+  return new Promise(function (resolve, reject) {
+    __wx_channels_download_list__.waiters[id] = {
+      resolve: resolve,
+      reject: reject,
+      server: !!server,
+    };
+  });
+}
+
+function settle_download_waiter(id, err, result) {
+  var waiter = __wx_channels_download_list__.waiters[id];
+  if (!waiter) {
+    return;
+  }
+  delete __wx_channels_download_list__.waiters[id];
+  if (err) {
+    waiter.reject(err);
+    return;
+  }
+  waiter.resolve(result);
+}
+
+async function recheck_download_waiters() {
+  var waiters = __wx_channels_download_list__.waiters;
+  for (var id in waiters) {
+    if (!waiters[id].server) {
+      continue;
+    }
+    var job = await __wx_jobs_request("/get", { id: id });
+    if (!job) {
+      continue;
+    }
+    if (job.status === "completed") {
+      settle_download_waiter(id, null, job);
+    } else if (job.status === "failed") {
+      settle_download_waiter(id, new Error(job.error || "下载失败"));
+    }
+  }
+}
+
+// 根据下载服务的事件更新列表项
+async function apply_download_event(ev) {
+  var list = __wx_channels_download_list__.list;
+  var item = list.find((i) => i.id === ev.id);
+  if (!item && ev.source === "server") {
+    // 其他标签页加入的任务
+    var job = await __wx_jobs_request("/get", { id: ev.id });
+    item = list.find((i) => i.id === ev.id);
+    if (!job || item) {
+      return;
+    }
+    item = job_to_download_item(job);
+    list.unshift(item);
+  }
+  if (!item) {
+    return;
+  }
+  switch (ev.type) {
+    case "queued":
+      item.status = "pending";
+      item.progress = 0;
+      break;
+    case "progress":
+    case "decrypting":
+    case "transcoding":
+      item.status = "downloading";
+      item.stage = ev.stage;
+      item.bytes = ev.bytes;
+      item.total = ev.total;
+      item.speed = ev.speed;
+      item.eta = ev.eta;
+      if (ev.total > 0) {
+        item.progress = Math.min(100, Math.max(0, ev.percent));
+      }
+      if (ev.filepath) {
+        item.filepath = ev.filepath;
+      }
+      break;
+    case "done":
+      item.status = "completed";
+      item.progress = 100;
+      if (ev.filepath) {
+        item.filepath = ev.filepath;
+      }
+      settle_download_waiter(ev.id, null, ev);
+      break;
+    case "failed":
+      item.status = "failed";
+      item.progress = 0;
+      item.error = ev.error;
+      settle_download_waiter(ev.id, new Error(ev.error || "下载失败"));
+      break;
+  }
+  update_download_list_display();
+}
+
+function format_bytes(bytes) {
+  if (!bytes || bytes < 0) {
+    return "0 B";
+  }
+  var units = ["B", "KB", "MB", "GB"];
+  var i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return bytes.toFixed(i === 0 ? 0 : 1) + " " + units[i];
+}
+
+function format_eta(seconds) {
+  seconds = Math.round(seconds);
+  var m = Math.floor(seconds / 60);
+  var s = seconds % 60;
+  if (m >= 60) {
+    return Math.floor(m / 60) + ":" + String(m % 60).padStart(2, "0") + ":" + String(s).padStart(2, "0");
+  }
+  return m + ":" + String(s).padStart(2, "0");
+}
+
+// 进度文字，有下载服务的事件时显示速度和剩余时间
+function download_progress_text(item, progressValue) {
+  var parts = [];
+  if (item.total > 0 || !item.stage) {
+    parts.push(progressValue.toFixed(1) + "%");
+  } else {
+    parts.push("已输出 " + format_bytes(item.bytes));
+  }
+  if (item.stage === "decrypting") {
+    parts.unshift("解密中");
+  } else if (item.stage === "transcoding") {
+    parts.unshift("转码中");
+  }
+  if (item.speed > 0) {
+    parts.push(format_bytes(item.speed) + "/s");
+  }
+  if (item.eta >= 0 && item.speed > 0) {
+    parts.push("剩余 " + format_eta(item.eta));
+  }
+  return parts.join(" · ");
+}
+
 // 初始化下载列表
 function init_download_list() {
   if (document.getElementById("__wx_channels_download_list__")) {
@@ -157,7 +423,8 @@ function find_existing_download_item(profile, spec) {
 }
 
 // 添加下载项到列表
-function add_to_download_list(profile, spec, status, filename) {
+// source 为 server 时由本程序下载，下载记录由本程序保存
+function add_to_download_list(profile, spec, status, filename, source) {
   if (!__wx_channels_download_list__.container) {
     init_download_list();
   }
@@ -167,7 +434,7 @@ function add_to_download_list(profile, spec, status, filename) {
   
   if (existingItem) {
     // 如果已存在且正在下载，不重复添加
-    if (existingItem.status === "downloading") {
+    if (existingItem.status === "downloading" || existingItem.status === "pending") {
       if (window.__wx_channels_tip__ && window.__wx_channels_tip__.toast) {
         window.__wx_channels_tip__.toast("该视频正在下载中", 2000);
       }
@@ -178,6 +445,18 @@ function add_to_download_list(profile, spec, status, filename) {
     existingItem.status = status;
     existingItem.timestamp = Date.now();
     existingItem.filename = filename || __wx_build_filename(profile, spec, __wx_channels_config__.downloadFilenameTemplate);
+    existingItem.error = null;
+    existingItem.progress = 0;
+    existingItem.source = source || "page";
+    if (existingItem.source === "page") {
+      __wx_jobs_request("/add", {
+        id: existingItem.id,
+        url: existingItem.url,
+        filename: existingItem.filename,
+        profile: profile,
+        spec: spec,
+      });
+    }
     
     // 将该项移到列表开头
     var index = __wx_channels_download_list__.list.indexOf(existingItem);
@@ -202,10 +481,20 @@ function add_to_download_list(profile, spec, status, filename) {
     url: profile.url + (spec ? "&X-snsvideoflag=" + spec.fileFormat : ""),
     key: profile.key,
     progress: 0, // 下载进度百分比 (0-100)
+    source: source || "page",
   };
 
   // 添加到列表开头
   __wx_channels_download_list__.list.unshift(item);
+  if (item.source === "page") {
+    __wx_jobs_request("/add", {
+      id: item.id,
+      url: item.url,
+      filename: item.filename,
+      profile: profile,
+      spec: spec,
+    });
+  }
 
   // 限制列表长度
   if (__wx_channels_download_list__.list.length > __wx_channels_download_list__.maxItems) {
@@ -232,10 +521,31 @@ function update_download_item_status(id, status, error) {
     if (status === "completed" || status === "failed") {
       item.progress = status === "completed" ? 100 : 0;
     }
+    // 由本程序下载的任务状态由本程序更新
+    if (item.source !== "server") {
+      __wx_jobs_request("/update", {
+        id: id,
+        status: status,
+        error: error || "",
+      });
+    }
     update_download_list_display();
   }
 }
 
+// 同步本程序中的下载任务状态和进度
+function apply_download_job(job) {
+  var item = __wx_channels_download_list__.list.find((i) => i.id === job.id);
+  if (!item) {
+    return;
+  }
+  item.status = job.status;
+  item.progress = job.progress || 0;
+  item.error = job.error;
+  item.filepath = job.filepath;
+  update_download_list_display();
+}
+
 // 更新下载项进度
 function update_download_item_progress(id, progress) {
   var item = __wx_channels_download_list__.list.find((i) => i.id === id);
@@ -248,6 +558,8 @@ function update_download_item_progress(id, progress) {
 
 // 将函数暴露到全局，以便 main.js 可以调用
 window.update_download_item_progress = update_download_item_progress;
+window.apply_download_job = apply_download_job;
+window.wait_download_event = wait_download_event;
 
 // 更新列表显示
 function update_download_list_display() {
@@ -306,10 +618,11 @@ function create_download_list_item(item) {
     "font-size: 13px; font-weight: 500; color: #333; " +
     "overflow: hidden; text-overflow: ellipsis; white-space: nowrap; flex: 1;";
   title.textContent = item.filename || item.profile.title || "未命名视频";
-  title.title = item.filename || item.profile.title || "未命名视频";
+  title.title = item.filepath || item.filename || item.profile.title || "未命名视频";
 
   var statusBadge = document.createElement("span");
   var statusConfig = {
+    pending: { text: "等待中", color: "#faad14" },
     downloading: { text: "下载中", color: "#07c160" },
     completed: { text: "已完成", color: "#1890ff" },
     failed: { text: "失败", color: "#ff4d4f" },
@@ -364,7 +677,7 @@ function create_download_list_item(item) {
     var progressText = document.createElement("div");
     progressText.style.cssText =
       "font-size: 11px; color: #07c160; margin-top: 4px; text-align: right;";
-    progressText.textContent = progressValue.toFixed(1) + "%";
+    progressText.textContent = download_progress_text(item, progressValue);
 
     progressContainer.appendChild(progressText);
     itemEl.appendChild(progressContainer);
@@ -478,6 +791,7 @@ function remove_from_download_list(id) {
   __wx_channels_download_list__.list = __wx_channels_download_list__.list.filter(
     (i) => i.id !== id
   );
+  __wx_jobs_request("/remove", { id: id });
   update_download_list_display();
   if (__wx_channels_download_list__.list.length === 0) {
     hide_download_list();
@@ -487,9 +801,15 @@ function remove_from_download_list(id) {
 // 清空下载列表
 function clear_download_list() {
   if (confirm("确定要清空所有下载记录吗？")) {
-    __wx_channels_download_list__.list = [];
+    // 正在下载的记录保留
+    __wx_channels_download_list__.list = __wx_channels_download_list__.list.filter(
+      (i) => i.status === "downloading" || i.status === "pending"
+    );
+    __wx_jobs_request("/clear");
     update_download_list_display();
-    hide_download_list();
+    if (__wx_channels_download_list__.list.length === 0) {
+      hide_download_list();
+    }
   }
 }
 
@@ -619,6 +939,17 @@ function modify_floating_download_btn() {
           return original_download_handler.call(this, spec, mp3);
         }
 
+        // 由本程序下载时先加入队列，等待下载
+        var server =
+          typeof __wx_channels_use_server_download === "function" &&
+          __wx_channels_use_server_download(profile, mp3);
+        var existing = find_existing_download_item(profile, spec);
+        if (server && existing && (existing.status === "pending" || existing.status === "downloading")) {
+          // 本程序中已有该任务，不再重复加入队列
+          add_to_download_list(profile, spec, "pending", null, "server");
+          return;
+        }
+
         // 检查积分（解耦：通过 API 检查，不直接依赖积分模块）
         if (typeof window.fetch_credit_info === "function") {
           var creditCheck = await window.fetch_credit_info();
@@ -668,8 +999,11 @@ function modify_floating_download_btn() {
         // 确保使用最新的 profile 数据（深拷贝避免引用问题）
         var currentProfile = JSON.parse(JSON.stringify(profile));
         
+
         // 添加到下载列表（会自动去重）
-        var itemId = add_to_download_list(currentProfile, spec, "downloading");
+        var itemId = server
+          ? add_to_download_list(currentProfile, spec, "pending", null, "server")
+          : add_to_download_list(currentProfile, spec, "downloading");
         var item = __wx_channels_download_list__.list.find((i) => i.id === itemId);
         
         if (!item) {
@@ -846,6 +1180,8 @@ window.fetch_credit_info = fetch_credit_info;
 setTimeout(function () {
   init_download_list();
   modify_floating_download_btn();
+  subscribe_download_events();
+  load_download_list();
   // 启动积分更新定时器
   setTimeout(function() {
     start_credit_timer();
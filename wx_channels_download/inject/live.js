@@ -1,42 +1,159 @@
+window.__wx_channels_live_store__ = {
+  profile: null,
+  record: null,
+  timer: null,
+};
 
-function __wx_copy_live_download_command() {
-  var profile = __wx_channels_live_store__.profile;
-  if (!profile) {
-    alert("检测不到视频，请将本工具更新到最新版");
-    return;
-  }
-  var filename = (() => {
-    return new Date().valueOf();
-  })();
-  var _profile = {
-    ...profile,
+// 直播页面没有注入 main.js，这里接收 finderGetLiveInfo 中发出的事件
+if (!window.__wx_channels_events__) {
+  window.__wx_channels_events__ = {
+    emit: function (event, data) {
+      if (event === "FeedProfileLoaded") {
+        var profile = __wx_format_feed(data);
+        if (profile) {
+          window.__wx_channels_live_store__.profile = profile;
+        }
+      }
+    },
+    on: function () {},
   };
-  var command = `ffmpeg -i "${_profile.url}" -c copy -y "live_${filename}.flv"`;
-  __wx_log({
-    prefix: "",
-    msg: "",
-  });
-  __wx_log({
-    prefix: "",
-    msg: "直播下载命令",
-  });
-  __wx_log({
-    prefix: "",
-    msg: command,
+}
+
+async function __wx_live_record_request(body) {
+  var response = await fetch("/__wx_channels_api/live/record", {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify(body),
   });
-  if (window.__wx_channels_tip__ && window.__wx_channels_tip__.toast) {
-    window.__wx_channels_tip__.toast("请在终端查看下载命令", 1e3);
+  var data = await response.json();
+  if (!response.ok) {
+    throw new Error(data.error || "请求失败");
+  }
+  return data;
+}
+
+function __wx_format_live_duration(seconds) {
+  var total = Math.floor(seconds || 0);
+  var h = Math.floor(total / 3600);
+  var m = Math.floor((total % 3600) / 60);
+  var s = total % 60;
+  return [h, m, s]
+    .map(function (v) {
+      return String(v).padStart(2, "0");
+    })
+    .join(":");
+}
+
+var __wx_live_record_state_text = {
+  recording: "录制中",
+  reconnecting: "重连中",
+  stopped: "已停止",
+  failed: "录制失败",
+};
+
+function __wx_render_live_record_status() {
+  var record = window.__wx_channels_live_store__.record;
+  var $status = __wx_channels_live_record_status__;
+  if (!record) {
+    $status.style.display = "none";
+    return;
+  }
+  var text = __wx_live_record_state_text[record.state] || record.state;
+  if (record.state === "recording" || record.state === "reconnecting") {
+    text += " " + __wx_format_live_duration(record.duration);
+  }
+  text += " " + (record.bytes / 1024 / 1024).toFixed(1) + "MB";
+  if (record.segments && record.segments.length > 1) {
+    text += " " + record.segments.length + "个分段";
+  }
+  if (record.state === "failed" && record.error) {
+    text += " " + record.error;
+  }
+  $status.innerText = text;
+  $status.title = (record.segments || []).join("\n");
+  $status.style.display = "block";
+}
+
+function __wx_is_live_recording() {
+  var record = window.__wx_channels_live_store__.record;
+  return !!record && (record.state === "recording" || record.state === "reconnecting");
+}
+
+function __wx_poll_live_record_status() {
+  var store = window.__wx_channels_live_store__;
+  clearInterval(store.timer);
+  store.timer = setInterval(async function () {
+    if (!store.record) {
+      clearInterval(store.timer);
+      return;
+    }
+    try {
+      store.record = await __wx_live_record_request({
+        action: "status",
+        id: store.record.id,
+      });
+    } catch (err) {
+      return;
+    }
+    __wx_render_live_record_status();
+    if (!__wx_is_live_recording()) {
+      clearInterval(store.timer);
+      __wx_log({
+        msg: `直播录制${__wx_live_record_state_text[store.record.state]}\n${store.record.segments.join("\n")}`,
+      });
+    }
+  }, 2000);
+}
+
+async function __wx_toggle_live_record() {
+  var store = window.__wx_channels_live_store__;
+  try {
+    if (__wx_is_live_recording()) {
+      store.record = await __wx_live_record_request({
+        action: "stop",
+        id: store.record.id,
+      });
+      __wx_render_live_record_status();
+      return;
+    }
+    var profile = store.profile;
+    if (!profile || !profile.url) {
+      alert("检测不到直播，请将本工具更新到最新版");
+      return;
+    }
+    var nickname = profile.contact ? profile.contact.nickname : "";
+    store.record = await __wx_live_record_request({
+      action: "start",
+      url: profile.url,
+      name: `live_${nickname ? nickname + "_" : ""}${new Date().valueOf()}`,
+    });
+    __wx_render_live_record_status();
+    __wx_poll_live_record_status();
+    __wx_log({
+      msg: `开始录制直播 ${profile.title}`,
+    });
+    if (window.__wx_channels_tip__ && window.__wx_channels_tip__.toast) {
+      window.__wx_channels_tip__.toast("开始录制，再次点击停止", 1e3);
+    }
+  } catch (err) {
+    alert(err.message);
   }
 }
 
 var __wx_channels_live_download_btn__ = icon_download4();
-__wx_channels_live_download_btn__.onclick = function() {
-  __wx_copy_live_download_command();
+__wx_channels_live_download_btn__.title = "录制直播";
+__wx_channels_live_download_btn__.onclick = function () {
+  __wx_toggle_live_record();
 };
+var __wx_channels_live_record_status__ = document.createElement("div");
+__wx_channels_live_record_status__.style.cssText =
+  "display: none; margin-right: 8px; font-size: 12px; line-height: 28px; color: #fa5151; white-space: nowrap;";
 
 async function insert_live_download_btn() {
   __wx_log({
-    msg: "等待注入命令按钮",
+    msg: "等待注入录制按钮",
   });
   var $elm1 = await __wx_find_elm(function () {
     return document.querySelector(".host__info .extra");
@@ -50,16 +167,16 @@ async function insert_live_download_btn() {
       return;
     }
     $elm1.insertBefore(__wx_channels_live_download_btn__, relative_node);
+    $elm1.insertBefore(__wx_channels_live_record_status__, __wx_channels_live_download_btn__);
     __wx_log({
-      msg: "注入下载按钮成功2!",
+      msg: "注入录制按钮成功!",
     });
     return;
   }
   __wx_log({
-    msg: "没有找到操作栏，注入命令按钮失败\n",
+    msg: "没有找到操作栏，注入录制按钮失败\n",
   });
 }
 setTimeout(() => {
-  window.__wx_channels_live_store__ = {};
   insert_live_download_btn();
 }, 800);
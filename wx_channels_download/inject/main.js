@@ -185,13 +185,21 @@ async function __wx_channels_download4(profile, opt) {
   console.log("__wx_channels_download4");
   if (__wx_channels_config__.downloadLocalServerEnabled) {
     var fullname = filename + (toMP3 ? ".mp3" : ".mp4");
-    var url = `http://${__wx_channels_config__.downloadLocalServerAddr}/download?url=${encodeURIComponent(profile.url)}&key=${profile.key}&filename=${encodeURIComponent(fullname)}&mp3=${Number(toMP3)}`;
+    var url = `http://${__wx_channels_config__.downloadLocalServerAddr}/download?url=${encodeURIComponent(profile.url)}&key=${profile.key}&filename=${encodeURIComponent(fullname)}&mp3=${Number(toMP3)}&id=${profile.downloadItemId || ""}${toMP3 ? __wx_channels_tag_query(profile) : ""}`;
+    // 订阅了下载服务的事件时，等待下载结束后再更新下载列表
+    var waiting =
+      typeof window.wait_download_event === "function"
+        ? window.wait_download_event(profile.downloadItemId)
+        : null;
     var a = document.createElement("a");
     a.href = url;
     a.download = fullname;
     document.body.appendChild(a);
     a.click();
     document.body.removeChild(a);
+    if (waiting) {
+      await waiting;
+    }
     return;
   }
   await __wx_load_script("https://res.wx.qq.com/t/wx_fed/cdn_libs/res/FileSaver.min.js");
@@ -247,6 +255,138 @@ async function __wx_channels_download4(profile, opt) {
     __wx_channels_play_cur_video();
   }
 }
+/** 是否由本程序下载，页面只需要发送视频信息 */
+function __wx_channels_use_server_download(profile, mp3) {
+  return !!__wx_channels_config__.downloadServerSide && profile.type === "media" && !mp3;
+}
+/** 由本程序下载并解密到本地目录，等待下载结束，force 为 true 时不校验密钥 */
+async function __wx_channels_server_download(profile, spec, filename, force) {
+  console.log("__wx_channels_server_download");
+  var { data, decryptor_array, ...rest } = profile;
+  var response = await fetch("/__wx_channels_api/jobs/download", {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify({
+      id: profile.downloadItemId,
+      url: profile.url,
+      filename,
+      profile: rest,
+      spec: spec || null,
+      force: !!force,
+    }),
+  });
+  var job = await response.json();
+  if (!response.ok) {
+    throw new Error(job.error || "添加下载任务失败");
+  }
+  __wx_log({
+    msg: "已添加到下载队列，由本工具下载",
+  });
+  if (window.__wx_channels_tip__ && window.__wx_channels_tip__.toast) {
+    window.__wx_channels_tip__.toast("已添加到下载队列", 1e3);
+  }
+  try {
+    job = await __wx_channels_wait_server_download(job.id);
+  } catch (err) {
+    // 密钥校验失败时可以跳过校验重新下载
+    if (!force && (await __wx_channels_server_error_code(job.id)) === "invalid_key") {
+      if (confirm(`${err.message}\n是否跳过密钥校验重新下载？`)) {
+        return __wx_channels_server_download(profile, spec, filename, true);
+      }
+    }
+    throw err;
+  }
+  __wx_log({
+    msg: `下载完成\n${job.filepath}`,
+  });
+  return job;
+}
+/** 本程序下载失败的原因 */
+async function __wx_channels_server_error_code(id) {
+  try {
+    var response = await fetch("/__wx_channels_api/jobs/get", {
+      method: "POST",
+      headers: {
+        "Content-Type": "application/json",
+      },
+      body: JSON.stringify({ id }),
+    });
+    var job = await response.json();
+    return job.error_code || "";
+  } catch (err) {
+    return "";
+  }
+}
+/** 等待本程序下载结束，下载中同步进度到下载列表 */
+async function __wx_channels_wait_server_download(id) {
+  // 订阅了下载服务的事件时不需要轮询
+  var waiting =
+    typeof window.wait_download_event === "function"
+      ? window.wait_download_event(id, true)
+      : null;
+  if (waiting) {
+    var get_job = async function () {
+      var response = await fetch("/__wx_channels_api/jobs/get", {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+        },
+        body: JSON.stringify({ id }),
+      });
+      return response.json();
+    };
+    // 开始等待之前可能已经结束
+    var job = await get_job();
+    if (!job.status) {
+      throw new Error(job.error || "下载任务不存在");
+    }
+    if (job.status === "completed") {
+      return job;
+    }
+    if (job.status === "failed") {
+      throw new Error(job.error || "下载失败");
+    }
+    await waiting;
+    return get_job();
+  }
+  while (true) {
+    await new Promise((resolve) => setTimeout(resolve, 1000));
+    var job = null;
+    try {
+      var response = await fetch("/__wx_channels_api/jobs/get", {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+        },
+        body: JSON.stringify({ id }),
+      });
+      job = await response.json();
+      if (response.status === 404) {
+        throw new Error(job.error || "下载任务不存在");
+      }
+      if (!response.ok) {
+        continue;
+      }
+    } catch (err) {
+      if (job) {
+        throw err;
+      }
+      // 网络错误时继续等待
+      continue;
+    }
+    if (typeof window.apply_download_job === "function") {
+      window.apply_download_job(job);
+    }
+    if (job.status === "completed") {
+      return job;
+    }
+    if (job.status === "failed") {
+      throw new Error(job.error || "下载失败");
+    }
+  }
+}
 /** 下载为mp3 */
 async function __wx_channels_download_as_mp3(profile, filename) {
   console.log("__wx_channels_download_as_mp3");
@@ -254,9 +394,18 @@ async function __wx_channels_download_as_mp3(profile, filename) {
     alert("请先开启本地下载服务");
     return;
   }
-  const url = `http://${__wx_channels_config__.downloadLocalServerAddr}/download?url=${encodeURIComponent(profile.url)}&key=${profile.key}&mp3=1&filename=${encodeURIComponent(filename + ".mp3")}`;
+  const url = `http://${__wx_channels_config__.downloadLocalServerAddr}/download?url=${encodeURIComponent(profile.url)}&key=${profile.key}&mp3=1&filename=${encodeURIComponent(filename + ".mp3")}&id=${profile.downloadItemId || ""}${__wx_channels_tag_query(profile)}`;
   window.open(url);
 }
+/** 转码为 mp3 时由本地服务写入的标题、作者和封面 */
+function __wx_channels_tag_query(profile) {
+  var title = (profile.title || "")
+    .split("\n")
+    .map((line) => line.trim())
+    .find((line) => !!line);
+  var artist = profile.contact ? profile.contact.nickname : "";
+  return `&title=${encodeURIComponent(title || profile.id || "")}&artist=${encodeURIComponent(artist || "")}&cover=${encodeURIComponent(profile.coverUrl || "")}`;
+}
 /** 复制当前页面地址 */
 function __wx_channels_handle_copy__() {
   __wx_channels_copy(location.href);
@@ -303,6 +452,9 @@ ${_profile.key || "该视频未加密"}`,
     __wx_channels_download3(_profile, filename);
     return;
   }
+  if (__wx_channels_use_server_download(_profile, mp3)) {
+    return __wx_channels_server_download(_profile, spec, filename);
+  }
   _profile.data = __wx_channels_store__.buffers;
   __wx_channels_download4(_profile, { filename, toMP3: mp3 });
 }
@@ -236,8 +236,75 @@ function __wx_find_elm(selector) {
   });
 }
 
-/** 构建文件名 */
+/** 格式化日期，和 pkg/naming 一致，使用 YYYY、MM、DD、HH、mm、ss */
+function __wx_format_date(seconds, format) {
+  var d = new Date(Number(seconds) * 1000);
+  if (!seconds || isNaN(d.valueOf())) {
+    return "";
+  }
+  var pad = (n) => String(n).padStart(2, "0");
+  return (format || "YYYY-MM-DD").replace(/YYYY|MM|DD|HH|mm|ss/g, (token) => {
+    switch (token) {
+      case "YYYY":
+        return String(d.getFullYear());
+      case "MM":
+        return pad(d.getMonth() + 1);
+      case "DD":
+        return pad(d.getDate());
+      case "HH":
+        return pad(d.getHours());
+      case "mm":
+        return pad(d.getMinutes());
+    }
+    return pad(d.getSeconds());
+  });
+}
+
+/** 去掉文件名中不能使用的字符，和 pkg/naming 的 Sanitize 一致 */
+function __wx_sanitize_filename(name) {
+  name = String(name)
+    .replace(/[\n\r\t]/g, " ")
+    .replace(/[\x00-\x1f\x7f\\/:*?"<>|]/g, "_")
+    .split(" ")
+    .filter(Boolean)
+    .join(" ")
+    .replace(/^[. ]+|[. ]+$/g, "");
+  var bytes = new TextEncoder().encode(name);
+  if (bytes.length > 200) {
+    name = new TextDecoder().decode(bytes.slice(0, 200)).replace(/\uFFFD+$/, "").replace(/[. ]+$/, "");
+  }
+  if (/^(CON|PRN|AUX|NUL|COM[1-9]|LPT[1-9])$/i.test(name.split(".")[0])) {
+    name = "_" + name;
+  }
+  return name;
+}
+
+/** 文件名模板中的过滤器 */
+function __wx_apply_filter(value, name, arg) {
+  switch (name) {
+    case "truncate": {
+      // 只接受非负整数，和 pkg/naming 一致
+      if (!/^\d+$/.test(arg)) {
+        return value;
+      }
+      var n = Number(arg);
+      return Array.from(value).slice(0, n).join("");
+    }
+    case "default":
+      return value === "" ? arg : value;
+    case "firstline":
+      return value.split("\n").map((line) => line.trim()).find(Boolean) || "";
+    case "date":
+      return /^\d+$/.test(value) ? __wx_format_date(value, arg) : "";
+    case "sanitize":
+      return __wx_sanitize_filename(value);
+  }
+  return value;
+}
+
+/** 构建文件名，变量和过滤器与 pkg/naming 一致，命令行下载时使用相同的模板 */
 function __wx_build_filename(profile, spec, template) {
+  var now = new Date();
   var default_name = (() => {
     if (profile.title) {
       return profile.title;
@@ -245,23 +312,46 @@ function __wx_build_filename(profile, spec, template) {
     if (profile.id) {
       return profile.id;
     }
-    return new Date().valueOf();
+    return String(now.valueOf());
   })();
   var params = {
     filename: default_name,
     id: profile.id,
+    nonce_id: profile.nonce_id,
     title: profile.title,
-    spec: 'original',
-    created_at: profile.createtime,
-    download_at: (new Date().valueOf() / 1000).toFixed(0),
+    spec: "original",
+    download_at: (now.valueOf() / 1000).toFixed(0),
+    download_date: __wx_format_date(now.valueOf() / 1000),
   };
+  if (profile.createtime) {
+    params.created_at = String(profile.createtime);
+    params.date = __wx_format_date(profile.createtime);
+  }
   if (profile.contact) {
     params.author = profile.contact.nickname;
+    params.author_id = profile.contact.id;
   }
   if (spec) {
     params.spec = spec.fileFormat;
+    params.width = spec.width ? String(spec.width) : undefined;
+    params.height = spec.height ? String(spec.height) : undefined;
+  }
+  var duration_ms = (spec && spec.durationMs) || ((profile.spec || []).find((s) => s.durationMs) || {}).durationMs;
+  var duration = duration_ms ? duration_ms / 1000 : Number(profile.duration);
+  if (duration > 0) {
+    params.duration = String(Math.round(duration));
   }
-  var filename = template ? template.replace(/\{\{([^}]+)\}\}/g, (match, key) => params[key]) : default_name;
+  var filename = __wx_sanitize_filename(
+    (template || "{{filename}}_{{spec}}").replace(/\{\{([^}]+)\}\}/g, (match, expr) => {
+      var parts = expr.split("|");
+      var value = params[parts[0].trim()];
+      value = value === undefined || value === null ? "" : String(value);
+      return parts.slice(1).reduce((v, filter) => {
+        var [name, ...rest] = filter.trim().split(":");
+        return __wx_apply_filter(v, name, rest.join(":"));
+      }, value);
+    })
+  );
   if (window.beforeFilename) {
     return window.beforeFilename(filename, params, profile, spec);
   }
@@ -51,7 +51,7 @@ type DecryptCOmmandArgs struct {
 }
 
 func (a *Biz) DecryptCannelFile(args DecryptCOmmandArgs) error {
-	length := uint32(131072)
+	length := decrypt.ResolveEncLen(0, nil, args.FilePath)
 	key := uint64(args.DecryptKey)
 	data, err := os.ReadFile(args.FilePath)
 	if err != nil {
@@ -127,14 +127,7 @@ func (a *Biz) DownloadChannelFile(args DownloadCommandArgs) {
 	fmt.Println()
 	if args.DecryptKey != 0 {
 		fmt.Printf("开始对文件解密 %s", tmp_dest_filepath)
-		length := uint32(131072)
-		enclen_str := resp.Header.Get("X-enclen")
-		if enclen_str != "" {
-			v, err := strconv.ParseUint(enclen_str, 10, 32)
-			if err == nil {
-				length = uint32(v)
-			}
-		}
+		length := decrypt.ResolveEncLen(0, resp.Header, "")
 		key := uint64(args.DecryptKey)
 		data, err := os.ReadFile(tmp_dest_filepath)
 		if err != nil {
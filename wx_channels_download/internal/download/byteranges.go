@@ -0,0 +1,178 @@
+package download
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"wx_channel/pkg/decrypt"
+)
+
+// 不能原样转发给客户端的上游响应头
+// 解密后内容已经改变，编码、校验相关的头都不再成立，逐跳头也不应转发
+var droppedProxyHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Trailer",
+	"Te",
+	"Content-Encoding",
+	"Content-Md5",
+	"Digest",
+	"Content-Disposition",
+	"Set-Cookie",
+}
+
+func copyProxyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = v
+	}
+	for _, k := range droppedProxyHeaders {
+		dst.Del(k)
+	}
+}
+
+// 解析 Content-Range: bytes start-end/total，total 未知时为 -1
+func parseContentRange(cr string) (start, end, total int64, ok bool) {
+	unit, spec, found := strings.Cut(strings.TrimSpace(cr), " ")
+	if !found || unit != "bytes" {
+		return 0, 0, 0, false
+	}
+	rng, size, found := strings.Cut(strings.TrimSpace(spec), "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	total = -1
+	if size != "*" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, 0, false
+		}
+		total = n
+	}
+	first, last, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	var err error
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 {
+		return 0, 0, 0, false
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+		return 0, 0, 0, false
+	}
+	if total >= 0 && end >= total {
+		return 0, 0, 0, false
+	}
+	return start, end, total, true
+}
+
+// 解析 Range 请求头，支持 bytes=start-end、bytes=start- 和 bytes=-N
+// total 为文件大小，解析后返回每一段的起止位置（包含 end）
+func parseRangeHeader(header string, total int64) ([][2]int64, error) {
+	unit, spec, found := strings.Cut(strings.TrimSpace(header), "=")
+	if !found || strings.TrimSpace(unit) != "bytes" {
+		return nil, errors.New("invalid range unit")
+	}
+	var ranges [][2]int64
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, found := strings.Cut(part, "-")
+		if !found {
+			return nil, errors.New("invalid range")
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		if first == "" {
+			// 后缀范围，表示最后 N 个字节
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, errors.New("invalid suffix range")
+			}
+			if n > total {
+				n = total
+			}
+			if n == 0 {
+				continue
+			}
+			ranges = append(ranges, [2]int64{total - n, total - 1})
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, errors.New("invalid range start")
+		}
+		if start >= total {
+			continue
+		}
+		end := total - 1
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, errors.New("invalid range end")
+			}
+			if end >= total {
+				end = total - 1
+			}
+		}
+		ranges = append(ranges, [2]int64{start, end})
+	}
+	if len(ranges) == 0 {
+		return nil, errors.New("range not satisfiable")
+	}
+	return ranges, nil
+}
+
+// 判断响应是否为多段 Range 响应，返回分隔符
+func multipartBoundary(header http.Header) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		return "", false
+	}
+	boundary := params["boundary"]
+	return boundary, boundary != ""
+}
+
+// 逐段读取 multipart/byteranges 响应，按每段自己的 Content-Range 偏移解密后写出
+// 使用与上游相同的分隔符，响应头中的 Content-Type 可以直接沿用
+func copyDecryptedMultipart(w io.Writer, body io.Reader, boundary string, key uint64, encLen uint32) error {
+	mr := multipart.NewReader(body, boundary)
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		start, _, _, ok := parseContentRange(part.Header.Get("Content-Range"))
+		if !ok {
+			return errors.New("invalid Content-Range in multipart response")
+		}
+		header := make(textproto.MIMEHeader, len(part.Header))
+		for k, v := range part.Header {
+			header[k] = v
+		}
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(pw, decrypt.NewReader(part, key, uint64(start), encLen)); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
@@ -3,92 +3,32 @@ package download
 import (
 	"bufio"
 	"crypto/tls"
-	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"os/exec"
 	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"wx_channel/config"
 	"wx_channel/pkg/decrypt"
+	"wx_channel/pkg/jobs"
 )
 
-// 解密读取器
-type DecryptReader struct {
-	reader   io.Reader
-	ctx      *decrypt.RandCtx64
-	limit    uint64
-	consumed uint64
-	ks       [8]byte
-	ksPos    int
-}
-
-func NewDecryptReader(reader io.Reader, key uint64, offset uint64, limit uint64) *DecryptReader {
-	ctx := decrypt.CreateISAacInst(key)
-	dr := &DecryptReader{
-		reader:   reader,
-		ctx:      ctx,
-		limit:    limit,
-		consumed: 0,
-		ksPos:    8,
-	}
-	if limit > 0 {
-		// 将 consumed 对齐到文件偏移，超出加密区则设置为加密区末尾
-		if offset >= limit {
-			dr.consumed = limit
-		} else {
-			dr.consumed = offset
-			// 跳过完整的 8 字节块
-			skipBlocks := offset / 8
-			for i := uint64(0); i < skipBlocks; i++ {
-				_ = dr.ctx.ISAacRandom()
-			}
-			// 生成当前块并设置起始位置
-			randNumber := dr.ctx.ISAacRandom()
-			binary.BigEndian.PutUint64(dr.ks[:], randNumber)
-			dr.ksPos = int(offset % 8)
-		}
-	}
-	return dr
-}
-
-func (dr *DecryptReader) Read(p []byte) (int, error) {
-	n, err := dr.reader.Read(p)
-	if n <= 0 {
-		return n, err
-	}
-	if dr.limit == 0 || dr.consumed >= dr.limit {
-		return n, err
-	}
-
-	toDecrypt := uint64(n)
-	remaining := dr.limit - dr.consumed
-	if toDecrypt > remaining {
-		toDecrypt = remaining
-	}
-	// 逐字节异或，维护 keystream 位置
-	for i := uint64(0); i < toDecrypt; i++ {
-		if dr.ksPos >= 8 {
-			randNumber := dr.ctx.ISAacRandom()
-			binary.BigEndian.PutUint64(dr.ks[:], randNumber)
-			dr.ksPos = 0
-		}
-		p[i] ^= dr.ks[dr.ksPos]
-		dr.ksPos++
-	}
-	dr.consumed += toDecrypt
-	return n, err
-}
-
 type MediaProxyWithDecrypt struct {
-	client *http.Client
+	client   *http.Client
+	profiles map[string]config.TranscodeProfile
+	ffmpeg   *FFmpeg
+	jobs     *TranscodeJobs
+	events   *jobs.Events
+	// 转码为 mp3 时写入页面传入的标题、作者和封面
+	embedTags bool
 }
 
-func NewMediaProxyWithDecrypt() *MediaProxyWithDecrypt {
+func NewMediaProxyWithDecrypt(profiles map[string]config.TranscodeProfile, ffmpeg *FFmpeg, transcodes *TranscodeJobs, events *jobs.Events, embedTags bool) *MediaProxyWithDecrypt {
 	tr := &http.Transport{
 		TLSNextProto:        make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
 		MaxIdleConns:        100,
@@ -96,7 +36,12 @@ func NewMediaProxyWithDecrypt() *MediaProxyWithDecrypt {
 		IdleConnTimeout:     90 * time.Second,
 	}
 	return &MediaProxyWithDecrypt{
-		client: &http.Client{Transport: tr},
+		client:    &http.Client{Transport: tr},
+		profiles:  profiles,
+		ffmpeg:    ffmpeg,
+		jobs:      transcodes,
+		events:    events,
+		embedTags: embedTags,
 	}
 }
 
@@ -117,7 +62,7 @@ func (mp *MediaProxyWithDecrypt) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	filename := q.Get("filename")
 	if filename == "" {
 		if u, err := url.Parse(targetURL); err == nil {
-			if base := path.Base(u.Path); base != "" && base != "/" {
+			if base := path.Base(u.Path); base != "" && base != "/" && base != "." {
 				filename = base
 			}
 		}
@@ -125,48 +70,90 @@ func (mp *MediaProxyWithDecrypt) ServeHTTP(w http.ResponseWriter, r *http.Reques
 			filename = "download.mp4"
 		}
 	}
-	decryptKeyStr := q.Get("key")
-	toMP3 := q.Get("mp3")
-	if decryptKeyStr != "" {
-		decryptKey, err := strconv.ParseUint(decryptKeyStr, 0, 64)
+	var decryptKey uint64
+	if decryptKeyStr := q.Get("key"); decryptKeyStr != "" {
+		v, err := strconv.ParseUint(decryptKeyStr, 0, 64)
 		if err != nil {
 			http.Error(w, "invalid decryptKey", http.StatusBadRequest)
 			return
 		}
-		if toMP3 == "1" {
-			mp.convertWithDecrypt(w, targetURL, decryptKey, 131072, filename)
+		decryptKey = v
+	}
+	// 未指定时使用上游响应头中的 X-enclen
+	var encLen uint32
+	if v := q.Get("enclen"); v != "" {
+		n, ok := decrypt.ParseEncLen(v)
+		if !ok {
+			http.Error(w, "invalid enclen", http.StatusBadRequest)
 			return
 		}
-		mp.decryptOnly(w, r, targetURL, decryptKey, 131072, filename)
+		encLen = n
+	}
+	// mp3=1 为旧的参数，等同于 profile=mp3
+	profileName := q.Get("profile")
+	if profileName == "" && q.Get("mp3") == "1" {
+		profileName = "mp3"
+	}
+	if profileName != "" {
+		profile, ok := mp.profiles[profileName]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown profile %q", profileName), http.StatusBadRequest)
+			return
+		}
+		mp.transcode(w, r, targetURL, decryptKey, encLen, filename, profileName, profile)
 		return
 	}
-	mp.convertOnly(targetURL, w, filename, "mp3")
+	if decryptKey != 0 {
+		mp.decryptOnly(w, r, targetURL, decryptKey, encLen, filename)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	mp.simpleProxy(targetURL, w, r, filename)
 }
 
-func (mp *MediaProxyWithDecrypt) convertWithDecrypt(w http.ResponseWriter, targetURL string, key uint64, encLimit uint64, filename string) {
+// 使用 ffmpeg 按 profile 转码，key 不为 0 时先边下载边解密
+// 客户端断开时 ffmpeg 会随请求的 context 一起结束
+func (mp *MediaProxyWithDecrypt) transcode(w http.ResponseWriter, r *http.Request, targetURL string, key uint64, encLen uint32, filename string, profileName string, profile config.TranscodeProfile) {
+	// 在请求上游和写响应头之前确认 ffmpeg 可以处理，避免返回一半的文件
+	if err := mp.ffmpeg.CheckProfile(profile); err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if !mp.jobs.Acquire() {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "too many transcodes in progress", http.StatusServiceUnavailable)
+		return
+	}
+	defer mp.jobs.Release()
+
+	ctx := r.Context()
 	req, err := mp.prepareRequest(http.MethodGet, targetURL, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
-	resp, err := mp.client.Do(req)
+	resp, err := mp.client.Do(req.WithContext(ctx))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		http.Error(w, fmt.Sprintf("upstream status %d", resp.StatusCode), http.StatusBadGateway)
+		return
+	}
 
-	decryptReader := NewDecryptReader(resp.Body, key, 0, encLimit)
+	var input io.Reader = resp.Body
+	if key != 0 {
+		input = decrypt.NewReader(resp.Body, key, 0, decrypt.ResolveEncLen(encLen, resp.Header, ""))
+	}
 
-	cmd := exec.Command("ffmpeg",
-		"-i", "pipe:0",
-		"-vn",
-		"-acodec", "libmp3lame",
-		"-ab", "192k",
-		"-f", "mp3",
-		"pipe:1",
-	)
-	cmd.Stdin = decryptReader
+	args := append([]string{"-i", "pipe:0"}, profile.Args...)
+	args = append(args, "pipe:1")
+	cmd := mp.ffmpeg.CommandContext(ctx, args...)
+	cmd.Stdin = input
+	stderr := newRingBuffer(stderrBufferSize)
+	cmd.Stderr = stderr
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -176,25 +163,83 @@ func (mp *MediaProxyWithDecrypt) convertWithDecrypt(w http.ResponseWriter, targe
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	job := mp.jobs.Add(cmd.Process.Pid, profileName, filename, targetURL)
+	defer mp.jobs.Remove(job.ID)
 
-	w.Header().Set("Content-Type", "audio/mpeg")
-	// 设置下载文件名,确保使用 .mp3 扩展名
+	w.Header().Set("Content-Type", profile.ContentType)
+	// 设置下载文件名,确保使用转码后格式的扩展名
 	downloadFilename := filename
-	if !strings.HasSuffix(strings.ToLower(downloadFilename), ".mp3") {
-		downloadFilename = strings.TrimSuffix(downloadFilename, path.Ext(downloadFilename)) + ".mp3"
+	if !strings.HasSuffix(strings.ToLower(downloadFilename), "."+profile.Ext) {
+		downloadFilename = strings.TrimSuffix(downloadFilename, path.Ext(downloadFilename)) + "." + profile.Ext
 	}
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", downloadFilename))
 	bw := bufio.NewWriterSize(w, 64*1024)
-	defer bw.Flush()
-	if _, err := io.Copy(bw, stdout); err != nil {
+	var output io.Reader = stdout
+	if mp.embedTags && profile.Ext == "mp3" {
+		output = id3Reader(stdout, r.URL.Query())
+	}
+	t := mp.track(r, downloadFilename, jobs.StageTranscoding, 0)
+	_, copyErr := io.Copy(&countingWriter{w: bw, job: job}, t.Reader(output))
+	if copyErr != nil {
+		// 写给客户端失败时 ffmpeg 会阻塞在输出上，需要主动结束
 		_ = cmd.Process.Kill()
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	waitErr := cmd.Wait()
+	if ctx.Err() != nil {
+		t.finish(ctx, nil)
+		return
+	}
+	if copyErr == nil && waitErr == nil {
+		bw.Flush()
+		t.finish(ctx, nil)
 		return
 	}
-	_ = cmd.Wait()
+	if copyErr != nil {
+		t.finish(ctx, copyErr)
+	} else {
+		t.finish(ctx, fmt.Errorf("转码失败 %v", waitErr))
+	}
+	fmt.Printf("[ERROR]转码失败 %s %v\n%s\n", downloadFilename, waitErr, stderr.String())
+	if job.bytes.Load() == int64(bw.Buffered()) {
+		// 输出的内容都还在缓冲区中，没有发送给客户端，丢弃后返回错误信息
+		w.Header().Del("Content-Disposition")
+		http.Error(w, fmt.Sprintf("ffmpeg failed: %v\n%s", waitErr, stderr.String()), http.StatusBadGateway)
+		return
+	}
+	// 已经发送了一部分内容，不能再发送缓冲区中的内容，中断连接让客户端知道下载失败
+	panic(http.ErrAbortHandler)
 }
 
-func (mp *MediaProxyWithDecrypt) decryptOnly(w http.ResponseWriter, r *http.Request, targetURL string, key uint64, encLimit uint64, filename string) {
+type profileCapability struct {
+	ContentType string `json:"contentType"`
+	Ext         string `json:"ext"`
+	Supported   bool   `json:"supported"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// 返回 ffmpeg 的检测结果以及每个转码配置当前是否可用
+func (mp *MediaProxyWithDecrypt) ServeCapabilities(w http.ResponseWriter, r *http.Request) {
+	profiles := make(map[string]profileCapability, len(mp.profiles))
+	for name, profile := range mp.profiles {
+		c := profileCapability{
+			ContentType: profile.ContentType,
+			Ext:         profile.Ext,
+			Supported:   true,
+		}
+		if err := mp.ffmpeg.CheckProfile(profile); err != nil {
+			c.Supported = false
+			c.Reason = err.Error()
+		}
+		profiles[name] = c
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ffmpeg":   mp.ffmpeg.Capabilities(),
+		"profiles": profiles,
+	})
+}
+
+func (mp *MediaProxyWithDecrypt) decryptOnly(w http.ResponseWriter, r *http.Request, targetURL string, key uint64, encLen uint32, filename string) {
 	req, err := mp.prepareRequest(r.Method, targetURL, r.Header)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
@@ -208,86 +253,92 @@ func (mp *MediaProxyWithDecrypt) decryptOnly(w http.ResponseWriter, r *http.Requ
 	}
 	defer resp.Body.Close()
 
-	var startOffset uint64 = 0
-	if cr := resp.Header.Get("Content-Range"); cr != "" {
-		parts := strings.Split(cr, " ")
-		if len(parts) == 2 {
-			rangePart := parts[1]
-			dash := strings.Index(rangePart, "-")
-			if dash > 0 {
-				if v, err := strconv.ParseUint(rangePart[:dash], 10, 64); err == nil {
-					startOffset = v
-				}
-			}
-		}
-	}
-	decryptReader := NewDecryptReader(resp.Body, key, startOffset, encLimit)
+	encLen = decrypt.ResolveEncLen(encLen, resp.Header, "")
 
-	for k, v := range resp.Header {
-		w.Header()[k] = v
-	}
-	w.Header().Set("Content-Type", "application/octet-stream")
+	copyProxyHeader(w.Header(), resp.Header)
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
 	if w.Header().Get("Accept-Ranges") == "" {
 		w.Header().Set("Accept-Ranges", "bytes")
 	}
 
-	w.WriteHeader(resp.StatusCode)
-	if r.Method == http.MethodHead {
+	// 错误响应（例如 416）的内容不是视频数据，不需要解密
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		w.WriteHeader(resp.StatusCode)
+		if r.Method != http.MethodHead {
+			io.Copy(w, resp.Body)
+		}
 		return
 	}
-	io.Copy(w, decryptReader)
-}
 
-func (mp *MediaProxyWithDecrypt) convertOnly(targetURL string, w http.ResponseWriter, filename string, format string) {
-	if format != "mp3" {
-		mp.simpleProxy(targetURL, w, nil)
-		return
-	}
-	req, err := mp.prepareRequest(http.MethodGet, targetURL, nil)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
-	}
-	resp, err := mp.client.Do(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-	cmd := exec.Command("ffmpeg",
-		"-i", "pipe:0",
-		"-vn",
-		"-acodec", "libmp3lame",
-		"-ab", "192k",
-		"-f", "mp3",
-		"pipe:1",
-	)
-	cmd.Stdin = resp.Body
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if err := cmd.Start(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if resp.StatusCode == http.StatusPartialContent {
+		if boundary, ok := multipartBoundary(resp.Header); ok {
+			// 多段 Range，每一段都按自己的偏移解密，重新编码后长度可能变化
+			w.Header().Del("Content-Length")
+			w.WriteHeader(resp.StatusCode)
+			if r.Method == http.MethodHead {
+				return
+			}
+			t := mp.track(r, filename, jobs.StageDecrypting, resp.ContentLength)
+			err := copyDecryptedMultipart(w, t.Reader(resp.Body), boundary, key, encLen)
+			t.finish(r.Context(), err)
+			if err != nil && r.Context().Err() == nil {
+				// 响应头已经发送，只能中断连接，避免客户端把不完整的内容当作成功
+				fmt.Printf("[ERROR]解密多段响应失败 %s %v\n", filename, err)
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+		start, _, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok {
+			http.Error(w, "invalid Content-Range from upstream", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(resp.StatusCode)
+		if r.Method == http.MethodHead {
+			return
+		}
+		t := mp.track(r, filename, jobs.StageDecrypting, resp.ContentLength)
+		_, err := io.Copy(w, t.Reader(decrypt.NewReader(resp.Body, key, uint64(start), encLen)))
+		t.finish(r.Context(), err)
 		return
 	}
-	w.Header().Set("Content-Type", "audio/mpeg")
-	// 设置下载文件名,确保使用 .mp3 扩展名
-	downloadFilename := filename
-	if !strings.HasSuffix(strings.ToLower(downloadFilename), ".mp3") {
-		downloadFilename = strings.TrimSuffix(downloadFilename, path.Ext(downloadFilename)) + ".mp3"
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// 上游忽略了 Range 时，单段请求（包括 bytes=-N）在本地截取，多段请求返回完整内容
+	// 带 If-Range 时 200 可能表示文件已经变化，只能返回完整内容，否则客户端会拼接两个文件
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && r.Header.Get("If-Range") == "" && resp.ContentLength > 0 {
+		ranges, err := parseRangeHeader(rangeHeader, resp.ContentLength)
+		if err != nil {
+			w.Header().Del("Content-Length")
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", resp.ContentLength))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if len(ranges) == 1 {
+			start, end := ranges[0][0], ranges[0][1]
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, resp.ContentLength))
+			w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+			w.WriteHeader(http.StatusPartialContent)
+			if r.Method == http.MethodHead {
+				return
+			}
+			if _, err := io.CopyN(io.Discard, resp.Body, start); err != nil {
+				return
+			}
+			t := mp.track(r, filename, jobs.StageDecrypting, end-start+1)
+			_, err := io.CopyN(w, t.Reader(decrypt.NewReader(resp.Body, key, uint64(start), encLen)), end-start+1)
+			t.finish(r.Context(), err)
+			return
+		}
 	}
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", downloadFilename))
-	bufferedWriter := bufio.NewWriterSize(w, 64*1024)
-	defer bufferedWriter.Flush()
-	if _, err := io.Copy(bufferedWriter, stdout); err != nil {
-		cmd.Process.Kill()
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	w.WriteHeader(resp.StatusCode)
+	if r.Method == http.MethodHead {
 		return
 	}
-	_ = cmd.Wait()
+	t := mp.track(r, filename, jobs.StageDecrypting, resp.ContentLength)
+	_, err = io.Copy(w, t.Reader(decrypt.NewReader(resp.Body, key, 0, encLen)))
+	t.finish(r.Context(), err)
 }
 
 func (mp *MediaProxyWithDecrypt) prepareRequest(method, targetURL string, header http.Header) (*http.Request, error) {
@@ -298,16 +349,21 @@ func (mp *MediaProxyWithDecrypt) prepareRequest(method, targetURL string, header
 	if err != nil {
 		return nil, err
 	}
+	// 需要按字节偏移解密，不能让上游压缩内容
+	req.Header.Set("Accept-Encoding", "identity")
 	// Copy headers if provided
 	if header != nil {
 		if rangeHeader := header.Get("Range"); rangeHeader != "" {
 			req.Header.Set("Range", rangeHeader)
 		}
+		if ifRange := header.Get("If-Range"); ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
 	}
 	return req, nil
 }
 
-func (mp *MediaProxyWithDecrypt) simpleProxy(targetURL string, w http.ResponseWriter, r *http.Request) {
+func (mp *MediaProxyWithDecrypt) simpleProxy(targetURL string, w http.ResponseWriter, r *http.Request, filename string) {
 	var header http.Header
 	method := http.MethodGet
 	if r != nil {
@@ -335,14 +391,43 @@ func (mp *MediaProxyWithDecrypt) simpleProxy(targetURL string, w http.ResponseWr
 	if method == http.MethodHead {
 		return
 	}
-	io.Copy(w, resp.Body)
+	if r == nil || (resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent) {
+		io.Copy(w, resp.Body)
+		return
+	}
+	t := mp.track(r, filename, jobs.StageDownloading, resp.ContentLength)
+	_, err = io.Copy(w, t.Reader(resp.Body))
+	t.finish(r.Context(), err)
 }
 
+// 只允许视频号页面和本机的页面跨域访问，其他网站不能读取本地文件和下载任务
+func allowed_origin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return u.Scheme == "http" || u.Scheme == "https"
+	case "channels.weixin.qq.com":
+		return u.Scheme == "https"
+	}
+	return false
+}
+
+// 没有 Origin 的请求（播放器、命令行等）不受影响，其他网站发起的请求直接拒绝
 func withCORS(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if !allowed_origin(origin) {
+				http.Error(w, "forbidden origin", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
 		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Range, Accept, Origin, X-Requested-With")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Range, If-Range, Accept, Origin, X-Requested-With")
 		w.Header().Set("Access-Control-Expose-Headers", "Content-Range, Accept-Ranges, Content-Type, Content-Length, Content-Disposition")
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
@@ -0,0 +1,335 @@
+package download
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"wx_channel/config"
+	"wx_channel/pkg/decrypt"
+	"wx_channel/pkg/jobs"
+)
+
+func TestWithCORS(t *testing.T) {
+	handler := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	cases := []struct {
+		name   string
+		origin string
+		status int
+		allow  string
+	}{
+		{"没有 Origin", "", http.StatusOK, ""},
+		{"视频号页面", "https://channels.weixin.qq.com", http.StatusOK, "https://channels.weixin.qq.com"},
+		{"本机页面", "http://127.0.0.1:2022", http.StatusOK, "http://127.0.0.1:2022"},
+		{"localhost", "http://localhost:5173", http.StatusOK, "http://localhost:5173"},
+		{"其他网站", "https://example.com", http.StatusForbidden, ""},
+		{"相似的域名", "https://channels.weixin.qq.com.example.com", http.StatusForbidden, ""},
+		{"视频号页面 http", "http://channels.weixin.qq.com", http.StatusForbidden, ""},
+		{"null", "null", http.StatusForbidden, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, method := range []string{http.MethodGet, http.MethodOptions} {
+				req := httptest.NewRequest(method, "/local?path=a.mp4", nil)
+				if c.origin != "" {
+					req.Header.Set("Origin", c.origin)
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				status := c.status
+				if method == http.MethodOptions && status == http.StatusOK {
+					status = http.StatusNoContent
+				}
+				if rec.Code != status {
+					t.Fatalf("%s 状态码 %d，期望 %d", method, rec.Code, status)
+				}
+				if got := rec.Header().Get("Access-Control-Allow-Origin"); got != c.allow {
+					t.Fatalf("%s Access-Control-Allow-Origin 为 %q，期望 %q", method, got, c.allow)
+				}
+			}
+		})
+	}
+}
+
+const (
+	fixtureKey    = 123456789
+	fixtureEncLen = 4096
+	fixtureSize   = 16384
+)
+
+// 明文和按 fixtureEncLen 加密后的内容
+func encrypted_fixture() (plain []byte, encrypted []byte) {
+	plain = make([]byte, fixtureSize)
+	rand.New(rand.NewSource(1)).Read(plain)
+	encrypted = bytes.Clone(plain)
+	decrypt.XORKeyStreamAt(encrypted, 0, fixtureKey, fixtureEncLen)
+	return plain, encrypted
+}
+
+// /video 支持 Range，/norange 忽略 Range，/broken 返回不完整的多段响应
+func new_upstream(encrypted []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(decrypt.EncLenHeader, strconv.Itoa(fixtureEncLen))
+		switch r.URL.Path {
+		case "/video":
+			http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(encrypted))
+		case "/norange":
+			w.Header().Set("Content-Length", strconv.Itoa(len(encrypted)))
+			w.Write(encrypted)
+		case "/broken":
+			w.Header().Set("Content-Type", "multipart/byteranges; boundary=BOUNDARY")
+			w.WriteHeader(http.StatusPartialContent)
+			fmt.Fprintf(w, "--BOUNDARY\r\nContent-Range: bytes 0-99/%d\r\n\r\n", len(encrypted))
+			w.Write(encrypted[:50])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func new_proxy() *httptest.Server {
+	mp := NewMediaProxyWithDecrypt(nil, nil, nil, jobs.NewEvents(), false)
+	return httptest.NewServer(mp)
+}
+
+func proxy_get(t *testing.T, proxy *httptest.Server, target string, rangeHeader string) (*http.Response, []byte, error) {
+	t.Helper()
+	u := proxy.URL + "/?key=" + strconv.Itoa(fixtureKey) + "&url=" + url.QueryEscape(target)
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+func TestDecryptOnlyRanges(t *testing.T) {
+	plain, encrypted := encrypted_fixture()
+	upstream := new_upstream(encrypted)
+	defer upstream.Close()
+	proxy := new_proxy()
+	defer proxy.Close()
+
+	cases := []struct {
+		name   string
+		path   string
+		rng    string
+		status int
+		start  int64
+		end    int64 // 包含 end
+	}{
+		{"完整文件", "/video", "", http.StatusOK, 0, fixtureSize - 1},
+		{"开头", "/video", "bytes=0-99", http.StatusPartialContent, 0, 99},
+		{"跨过加密区", "/video", "bytes=4000-5000", http.StatusPartialContent, 4000, 5000},
+		{"加密区之后", "/video", "bytes=8000-", http.StatusPartialContent, 8000, fixtureSize - 1},
+		{"后缀范围", "/video", "bytes=-100", http.StatusPartialContent, fixtureSize - 100, fixtureSize - 1},
+		{"后缀范围跨过加密区", "/video", "bytes=-13000", http.StatusPartialContent, fixtureSize - 13000, fixtureSize - 1},
+		{"上游忽略 Range", "/norange", "bytes=4090-4200", http.StatusPartialContent, 4090, 4200},
+		{"上游忽略后缀范围", "/norange", "bytes=-13000", http.StatusPartialContent, fixtureSize - 13000, fixtureSize - 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp, body, err := proxy_get(t, proxy, upstream.URL+c.path, c.rng)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != c.status {
+				t.Fatalf("状态码 %d，期望 %d", resp.StatusCode, c.status)
+			}
+			if !bytes.Equal(body, plain[c.start:c.end+1]) {
+				t.Fatalf("解密结果不一致，长度 %d，期望 %d", len(body), c.end-c.start+1)
+			}
+			if c.status == http.StatusPartialContent {
+				want := fmt.Sprintf("bytes %d-%d/%d", c.start, c.end, fixtureSize)
+				if got := resp.Header.Get("Content-Range"); got != want {
+					t.Fatalf("Content-Range 为 %q，期望 %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+// If-Range 和上游的文件不一致时上游返回 200，不能在本地截取成 206
+func TestDecryptOnlyStaleIfRange(t *testing.T) {
+	plain, encrypted := encrypted_fixture()
+	upstream := new_upstream(encrypted)
+	defer upstream.Close()
+	proxy := new_proxy()
+	defer proxy.Close()
+
+	for _, path := range []string{"/norange", "/video"} {
+		t.Run(path, func(t *testing.T) {
+			u := proxy.URL + "/?key=" + strconv.Itoa(fixtureKey) + "&url=" + url.QueryEscape(upstream.URL+path)
+			req, err := http.NewRequest(http.MethodGet, u, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Range", "bytes=4090-4200")
+			req.Header.Set("If-Range", `"stale"`)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("状态码 %d，期望 200", resp.StatusCode)
+			}
+			if resp.Header.Get("Content-Range") != "" {
+				t.Fatalf("完整内容带有 Content-Range %q", resp.Header.Get("Content-Range"))
+			}
+			if !bytes.Equal(body, plain) {
+				t.Fatalf("解密结果不一致，长度 %d，期望 %d", len(body), len(plain))
+			}
+		})
+	}
+}
+
+func TestDecryptOnlyMultipart(t *testing.T) {
+	plain, encrypted := encrypted_fixture()
+	upstream := new_upstream(encrypted)
+	defer upstream.Close()
+	proxy := new_proxy()
+	defer proxy.Close()
+
+	cases := []struct {
+		name   string
+		rng    string
+		ranges [][2]int64
+	}{
+		{"两段", "bytes=0-9,100-199", [][2]int64{{0, 9}, {100, 199}}},
+		{"跨过加密区", "bytes=10-20,4090-4100,9000-9010", [][2]int64{{10, 20}, {4090, 4100}, {9000, 9010}}},
+		{"包含后缀范围", "bytes=0-0,-10", [][2]int64{{0, 0}, {fixtureSize - 10, fixtureSize - 1}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resp, body, err := proxy_get(t, proxy, upstream.URL+"/video", c.rng)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusPartialContent {
+				t.Fatalf("状态码 %d", resp.StatusCode)
+			}
+			media_type, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			if err != nil || media_type != "multipart/byteranges" {
+				t.Fatalf("Content-Type 为 %q", resp.Header.Get("Content-Type"))
+			}
+			mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+			for i, want := range c.ranges {
+				part, err := mr.NextPart()
+				if err != nil {
+					t.Fatalf("读取第 %d 段失败 %v", i+1, err)
+				}
+				start, end, _, ok := parseContentRange(part.Header.Get("Content-Range"))
+				if !ok || start != want[0] || end != want[1] {
+					t.Fatalf("第 %d 段 Content-Range 为 %q", i+1, part.Header.Get("Content-Range"))
+				}
+				data, _ := io.ReadAll(part)
+				if !bytes.Equal(data, plain[start:end+1]) {
+					t.Fatalf("第 %d 段解密结果不一致", i+1)
+				}
+			}
+			if _, err := mr.NextPart(); err != io.EOF {
+				t.Fatalf("多出了分段 %v", err)
+			}
+		})
+	}
+}
+
+// 上游的多段响应不完整时，不能返回看起来成功的响应
+func TestDecryptOnlyBrokenMultipart(t *testing.T) {
+	_, encrypted := encrypted_fixture()
+	upstream := new_upstream(encrypted)
+	defer upstream.Close()
+	proxy := new_proxy()
+	defer proxy.Close()
+
+	_, _, err := proxy_get(t, proxy, upstream.URL+"/broken", "bytes=0-99,200-299")
+	if err == nil {
+		t.Fatal("上游响应不完整时应该中断连接")
+	}
+}
+
+// 输出指定字节数后失败的 ffmpeg
+const fakeFFmpegScript = `#!/bin/sh
+case "$2" in
+-version) echo "ffmpeg version test"; exit 0 ;;
+-encoders) echo " ------"; exit 0 ;;
+esac
+head -c "$FAKE_FFMPEG_BYTES" /dev/zero
+echo "fake failure" >&2
+exit 1
+`
+
+func TestTranscodeFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("需要 sh")
+	}
+	ffmpeg_path := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(ffmpeg_path, []byte(fakeFFmpegScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_, encrypted := encrypted_fixture()
+	upstream := new_upstream(encrypted)
+	defer upstream.Close()
+	profiles := map[string]config.TranscodeProfile{
+		"mp3": {ContentType: "audio/mpeg", Ext: "mp3", Args: []string{"-f", "mp3"}},
+	}
+	mp := NewMediaProxyWithDecrypt(profiles, NewFFmpeg(ffmpeg_path), NewTranscodeJobs(1), jobs.NewEvents(), false)
+	proxy := httptest.NewServer(mp)
+	defer proxy.Close()
+
+	cases := []struct {
+		name  string
+		bytes int
+	}{
+		// 输出的内容还在缓冲区中，可以返回 502
+		{"失败前输出很少", 1000},
+		// 已经发送了一部分内容，只能中断连接
+		{"失败前输出较多", 256 * 1024},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv("FAKE_FFMPEG_BYTES", strconv.Itoa(c.bytes))
+			u := proxy.URL + "/?profile=mp3&url=" + url.QueryEscape(upstream.URL+"/video")
+			resp, err := http.Get(u)
+			if err != nil {
+				// 还没有发送响应头时中断连接也可以接受
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if resp.StatusCode == http.StatusOK && err == nil {
+				t.Fatalf("转码失败时返回了 200，内容长度 %d", len(body))
+			}
+			if c.bytes < 64*1024 && resp.StatusCode != http.StatusBadGateway {
+				t.Fatalf("状态码 %d，期望 502", resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"wx_channel/pkg/jobs"
+)
+
+const (
+	// 通过本地服务下载时事件中的来源
+	eventSource = "proxy"
+	// 发布进度事件的最小间隔
+	progressInterval = 500 * time.Millisecond
+)
+
+var transferSeq atomic.Int64
+
+// 一次通过本地服务的下载，统计发送给浏览器的字节数并发布进度事件
+type transfer struct {
+	events   *jobs.Events
+	id       string
+	stage    string
+	filename string
+	total    int64
+	bytes    int64
+	meter    jobs.Meter
+	reported time.Time
+}
+
+// 页面通过 id 参数关联下载列表中的记录，没有时生成一个
+func (mp *MediaProxyWithDecrypt) track(r *http.Request, filename, stage string, total int64) *transfer {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		id = eventSource + "_" + strconv.FormatInt(transferSeq.Add(1), 10)
+	}
+	t := &transfer{
+		events:   mp.events,
+		id:       id,
+		stage:    stage,
+		filename: filename,
+		total:    total,
+		reported: time.Now(),
+	}
+	ev := t.meter.Progress(id, stage, 0, total)
+	switch stage {
+	case jobs.StageDecrypting:
+		ev.Type = jobs.EventDecrypting
+	case jobs.StageTranscoding:
+		ev.Type = jobs.EventTranscoding
+	}
+	t.publish(ev)
+	return t
+}
+
+func (t *transfer) publish(ev jobs.Event) {
+	ev.Source = eventSource
+	ev.Filename = t.filename
+	t.events.Publish(ev)
+}
+
+func (t *transfer) Reader(r io.Reader) io.Reader {
+	return &transferReader{r: r, t: t}
+}
+
+func (t *transfer) add(n int) {
+	t.bytes += int64(n)
+	if time.Since(t.reported) < progressInterval {
+		return
+	}
+	t.reported = time.Now()
+	t.publish(t.meter.Progress(t.id, t.stage, t.bytes, t.total))
+}
+
+// 请求结束后发布完成或失败事件，浏览器取消下载也算失败
+func (t *transfer) finish(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if errors.Is(err, context.Canceled) {
+		err = errors.New("已取消下载")
+	}
+	if err != nil {
+		t.publish(jobs.Event{
+			Type:  jobs.EventFailed,
+			ID:    t.id,
+			Stage: t.stage,
+			Bytes: t.bytes,
+			Total: t.total,
+			ETA:   -1,
+			Error: err.Error(),
+		})
+		return
+	}
+	t.publish(jobs.Event{
+		Type:    jobs.EventDone,
+		ID:      t.id,
+		Stage:   t.stage,
+		Bytes:   t.bytes,
+		Total:   t.total,
+		Percent: 100,
+	})
+}
+
+type transferReader struct {
+	r io.Reader
+	t *transfer
+}
+
+func (tr *transferReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		tr.t.add(n)
+	}
+	return n, err
+}
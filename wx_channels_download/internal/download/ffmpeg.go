@@ -0,0 +1,163 @@
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"wx_channel/config"
+)
+
+const ffmpegProbeTimeout = 10 * time.Second
+
+// ffmpeg 的检测结果
+type FFmpegCapabilities struct {
+	Available bool     `json:"available"`
+	Path      string   `json:"path"`
+	Version   string   `json:"version,omitempty"`
+	Encoders  []string `json:"encoders,omitempty"`
+	Error     string   `json:"error,omitempty"`
+
+	encoders map[string]bool
+}
+
+// 检测一次并缓存 ffmpeg 的版本和可用编码器，转码前用来判断能否处理
+type FFmpeg struct {
+	path string
+	mu   sync.RWMutex
+	caps *FFmpegCapabilities
+}
+
+// path 为空时从 PATH 中查找 ffmpeg
+func NewFFmpeg(path string) *FFmpeg {
+	if path == "" {
+		path = "ffmpeg"
+	}
+	return &FFmpeg{
+		path: path,
+	}
+}
+
+// 执行 ffmpeg -version 和 -encoders，结果会缓存下来
+func (f *FFmpeg) Probe() *FFmpegCapabilities {
+	caps := probe_ffmpeg(f.path)
+	f.mu.Lock()
+	f.caps = caps
+	f.mu.Unlock()
+	return caps
+}
+
+// 返回缓存的检测结果，还没有检测过时先检测
+func (f *FFmpeg) Capabilities() *FFmpegCapabilities {
+	f.mu.RLock()
+	caps := f.caps
+	f.mu.RUnlock()
+	if caps != nil {
+		return caps
+	}
+	return f.Probe()
+}
+
+// context 结束时 ffmpeg 进程会被结束
+func (f *FFmpeg) CommandContext(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, f.Capabilities().Path, args...)
+}
+
+// 判断是否可以使用该配置转码，不能时返回原因
+func (f *FFmpeg) CheckProfile(profile config.TranscodeProfile) error {
+	caps := f.Capabilities()
+	if !caps.Available {
+		return fmt.Errorf("ffmpeg is not available: %s", caps.Error)
+	}
+	for _, encoder := range profile_encoders(profile.Args) {
+		if !caps.encoders[encoder] {
+			return fmt.Errorf("ffmpeg %s does not support encoder %s", caps.Version, encoder)
+		}
+	}
+	return nil
+}
+
+func probe_ffmpeg(path string) *FFmpegCapabilities {
+	caps := &FFmpegCapabilities{
+		Path:     path,
+		encoders: make(map[string]bool),
+	}
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		caps.Error = err.Error()
+		return caps
+	}
+	caps.Path = resolved
+
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegProbeTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, resolved, "-hide_banner", "-version").Output()
+	if err != nil {
+		caps.Error = err.Error()
+		return caps
+	}
+	caps.Version = parse_ffmpeg_version(out)
+
+	out, err = exec.CommandContext(ctx, resolved, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		caps.Error = err.Error()
+		return caps
+	}
+	caps.Encoders = parse_ffmpeg_encoders(out)
+	for _, name := range caps.Encoders {
+		caps.encoders[name] = true
+	}
+	caps.Available = true
+	return caps
+}
+
+// 第一行形如 ffmpeg version 6.1.1 Copyright (c) 2000-2023 the FFmpeg developers
+func parse_ffmpeg_version(out []byte) string {
+	line, _, _ := bytes.Cut(out, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) >= 3 && fields[1] == "version" {
+		return fields[2]
+	}
+	return strings.TrimSpace(string(line))
+}
+
+// 编码器列表在 ------ 分隔行之后，每行形如 A....D aac  AAC (Advanced Audio Coding)
+func parse_ffmpeg_encoders(out []byte) []string {
+	var encoders []string
+	started := false
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !started {
+			started = strings.HasPrefix(line, "---")
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			encoders = append(encoders, fields[1])
+		}
+	}
+	sort.Strings(encoders)
+	return encoders
+}
+
+// 从转码参数中找出需要的编码器
+func profile_encoders(args []string) []string {
+	var encoders []string
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-acodec", "-vcodec", "-c", "-codec", "-c:a", "-c:v", "-codec:a", "-codec:v":
+			if name := args[i+1]; name != "copy" {
+				encoders = append(encoders, name)
+			}
+			i++
+		}
+	}
+	return encoders
+}
@@ -0,0 +1,159 @@
+package download
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 保留 ffmpeg 最后输出的错误信息大小
+const stderrBufferSize = 16 * 1024
+
+// 正在进行的转码
+type TranscodeJob struct {
+	ID        int64     `json:"id"`
+	PID       int       `json:"pid"`
+	Profile   string    `json:"profile"`
+	Filename  string    `json:"filename"`
+	URL       string    `json:"url"`
+	StartedAt time.Time `json:"startedAt"`
+	Bytes     int64     `json:"bytes"` // 已输出的字节数
+}
+
+type runningJob struct {
+	TranscodeJob
+	bytes atomic.Int64
+}
+
+// 记录正在进行的转码，并限制同时转码的个数
+type TranscodeJobs struct {
+	mu   sync.Mutex
+	next int64
+	jobs map[int64]*runningJob
+	sem  chan struct{}
+}
+
+// limit 小于等于 0 时不限制
+func NewTranscodeJobs(limit int) *TranscodeJobs {
+	j := &TranscodeJobs{
+		jobs: make(map[int64]*runningJob),
+	}
+	if limit > 0 {
+		j.sem = make(chan struct{}, limit)
+	}
+	return j
+}
+
+// 占用一个转码名额，已满时返回 false
+func (j *TranscodeJobs) Acquire() bool {
+	if j.sem == nil {
+		return true
+	}
+	select {
+	case j.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (j *TranscodeJobs) Release() {
+	if j.sem == nil {
+		return
+	}
+	<-j.sem
+}
+
+func (j *TranscodeJobs) Add(pid int, profile, filename, url string) *runningJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.next++
+	job := &runningJob{
+		TranscodeJob: TranscodeJob{
+			ID:        j.next,
+			PID:       pid,
+			Profile:   profile,
+			Filename:  filename,
+			URL:       url,
+			StartedAt: time.Now(),
+		},
+	}
+	j.jobs[job.ID] = job
+	return job
+}
+
+func (j *TranscodeJobs) Remove(id int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.jobs, id)
+}
+
+// 返回当前所有转码的快照
+func (j *TranscodeJobs) List() []TranscodeJob {
+	j.mu.Lock()
+	list := make([]TranscodeJob, 0, len(j.jobs))
+	for _, job := range j.jobs {
+		info := job.TranscodeJob
+		info.Bytes = job.bytes.Load()
+		list = append(list, info)
+	}
+	j.mu.Unlock()
+	sort.Slice(list, func(a, b int) bool { return list[a].ID < list[b].ID })
+	return list
+}
+
+func (j *TranscodeJobs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(j.List())
+}
+
+// 统计写入字节数，用于展示转码进度
+type countingWriter struct {
+	w   io.Writer
+	job *runningJob
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.job.bytes.Add(int64(n))
+	return n, err
+}
+
+// 只保留最后 size 字节的 Writer，用来收集 ffmpeg 的错误输出
+// 同时保证 stderr 一直被读取，输出过多时 ffmpeg 不会阻塞
+type ringBuffer struct {
+	mu   sync.Mutex
+	buf  []byte
+	size int
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{
+		size: size,
+	}
+}
+
+func (b *ringBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(p)
+	if n >= b.size {
+		b.buf = append(b.buf[:0], p[n-b.size:]...)
+		return n, nil
+	}
+	if overflow := len(b.buf) + n - b.size; overflow > 0 {
+		b.buf = append(b.buf[:0], b.buf[overflow:]...)
+	}
+	b.buf = append(b.buf, p...)
+	return n, nil
+}
+
+func (b *ringBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
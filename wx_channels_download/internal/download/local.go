@@ -0,0 +1,126 @@
+package download
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"wx_channel/pkg/decrypt"
+)
+
+var errOutsideRoot = errors.New("path is outside of the allowed root")
+
+// 播放本地已下载的加密视频，边读边解密，支持 Range / If-Range
+// 只允许访问 root 目录下的文件
+type LocalMediaHandler struct {
+	root string
+}
+
+func NewLocalMediaHandler(root string) *LocalMediaHandler {
+	return &LocalMediaHandler{
+		root: root,
+	}
+}
+
+func (h *LocalMediaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.root == "" {
+		http.Error(w, "local root is not configured", http.StatusForbidden)
+		return
+	}
+	q := r.URL.Query()
+	p := q.Get("path")
+	if p == "" {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+	fullpath, err := h.resolve(p)
+	if err != nil {
+		if errors.Is(err, errOutsideRoot) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(fullpath)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	var content io.ReadSeeker = f
+	if keyStr := q.Get("key"); keyStr != "" {
+		key, err := strconv.ParseUint(keyStr, 0, 64)
+		if err != nil {
+			http.Error(w, "invalid key", http.StatusBadRequest)
+			return
+		}
+		var encLen uint32
+		if v := q.Get("enclen"); v != "" {
+			n, ok := decrypt.ParseEncLen(v)
+			if !ok {
+				http.Error(w, "invalid enclen", http.StatusBadRequest)
+				return
+			}
+			encLen = n
+		}
+		content = decrypt.NewReadSeeker(f, key, decrypt.ResolveEncLen(encLen, nil, fullpath))
+	}
+	// ServeContent 根据修改时间处理 If-Range / If-Modified-Since，并支持多段 Range
+	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
+}
+
+// 将请求的路径解析为 root 下的绝对路径，符号链接指向 root 外时同样拒绝
+func (h *LocalMediaHandler) resolve(p string) (string, error) {
+	root, err := filepath.Abs(h.root)
+	if err != nil {
+		return "", err
+	}
+	if real, err := filepath.EvalSymlinks(root); err == nil {
+		root = real
+	}
+	target := filepath.FromSlash(p)
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(root, target)
+	}
+	target, err = filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	if !within_root(root, target) {
+		return "", errOutsideRoot
+	}
+	real, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return "", err
+	}
+	if !within_root(root, real) {
+		return "", errOutsideRoot
+	}
+	return real, nil
+}
+
+func within_root(root, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return false
+	}
+	return true
+}
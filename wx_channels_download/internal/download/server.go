@@ -1,19 +1,55 @@
 package download
 
 import (
+	"net/http"
+
+	"wx_channel/config"
 	"wx_channel/internal/manager"
+	"wx_channel/pkg/jobs"
 )
 
 type DownloadServer struct {
 	*manager.HTTPServer
+	ffmpeg *FFmpeg
+	events *jobs.Events
 }
 
-func NewDownloadServer(addr string) *DownloadServer {
-	srv := manager.NewHTTPServer("下载服务", "download", addr)
-	proxy := NewMediaProxyWithDecrypt()
-	srv.SetHandler(withCORS(proxy))
+// events 同时发布由本程序下载的任务的进度，页面通过 /events 订阅
+func NewDownloadServer(cfg *config.Config, events *jobs.Events) *DownloadServer {
+	srv := manager.NewHTTPServer("下载服务", "download", cfg.DownloadLocalServerAddr)
+	if events == nil {
+		events = jobs.NewEvents()
+	}
+	ffmpeg := NewFFmpeg(cfg.DownloadFFmpegPath)
+	transcodes := NewTranscodeJobs(cfg.DownloadMaxTranscodes)
+	proxy := NewMediaProxyWithDecrypt(cfg.DownloadProfiles, ffmpeg, transcodes, events, cfg.DownloadEmbedTags)
+	mux := http.NewServeMux()
+	mux.Handle("/local", NewLocalMediaHandler(cfg.DownloadLocalServerRoot))
+	mux.HandleFunc("/capabilities", proxy.ServeCapabilities)
+	mux.Handle("/jobs", transcodes)
+	mux.Handle("/events", events)
+	mux.Handle("/", proxy)
+	srv.SetHandler(withCORS(mux))
 
 	return &DownloadServer{
 		HTTPServer: srv,
+		ffmpeg:     ffmpeg,
+		events:     events,
 	}
 }
+
+// 启动前检测一次 ffmpeg，之后的转码请求直接使用检测结果
+func (s *DownloadServer) Start() error {
+	s.ffmpeg.Probe()
+	return s.HTTPServer.Start()
+}
+
+// 先断开 /events 的连接，否则服务会一直等待这些连接结束
+func (s *DownloadServer) Stop() error {
+	s.events.Close()
+	return s.HTTPServer.Stop()
+}
+
+func (s *DownloadServer) FFmpeg() *FFmpegCapabilities {
+	return s.ffmpeg.Capabilities()
+}
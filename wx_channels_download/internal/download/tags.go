@@ -0,0 +1,31 @@
+package download
+
+import (
+	"io"
+	"net/url"
+
+	"wx_channel/pkg/tags"
+)
+
+// 在 ffmpeg 输出的 mp3 前写入 ID3 标签，标题、作者和封面地址由页面通过 title、artist、cover 参数传入
+// 封面和转码同时下载，ffmpeg 输出第一段数据时再写入
+func id3Reader(r io.Reader, q url.Values) io.Reader {
+	t := tags.Tags{
+		Title:    q.Get("title"),
+		Artist:   q.Get("artist"),
+		CoverURL: q.Get("cover"),
+	}
+	if t.Title == "" && t.Artist == "" && t.CoverURL == "" {
+		return r
+	}
+	ready := make(chan []byte, 1)
+	go func() {
+		if t.CoverURL != "" {
+			t.Cover, _ = tags.FetchCover(t.CoverURL)
+		}
+		ready <- tags.ID3v2(t)
+	}()
+	return tags.NewID3Reader(r, func() []byte {
+		return <-ready
+	})
+}
@@ -8,8 +8,13 @@ import (
 	"github.com/ltaoo/echo"
 
 	"wx_channel/config"
+	"wx_channel/pkg/catalog"
 	"wx_channel/pkg/certificate"
+	"wx_channel/pkg/channels"
+	"wx_channel/pkg/jobs"
+	"wx_channel/pkg/live"
 	"wx_channel/pkg/proxy"
+	"wx_channel/pkg/sidecar"
 )
 
 type ChannelInjectedFiles struct {
@@ -25,40 +30,11 @@ type ChannelInjectedFiles struct {
 	JSDownloadList []byte
 }
 
-type ChannelMediaSpec struct {
-	FileFormat       string  `json:"file_format"`
-	FirstLoadBytes   int     `json:"first_load_bytes"`
-	BitRate          int     `json:"bit_rate"`
-	CodingFormat     string  `json:"coding_format"`
-	DynamicRangeType int     `json:"dynamic_range_type"`
-	Vfps             int     `json:"vfps"`
-	Width            int     `json:"width"`
-	Height           int     `json:"height"`
-	DurationMs       int     `json:"duration_ms"`
-	QualityScore     float64 `json:"quality_score"`
-	VideoBitrate     int     `json:"video_bitrate"`
-	AudioBitrate     int     `json:"audio_bitrate"`
-	LevelOrder       int     `json:"level_order"`
-	Bypass           string  `json:"bypass"`
-	Is3az            int     `json:"is3az"`
-}
-type ChannelContact struct {
-	Username string `json:"username"`
-	Nickname string `json:"nickname"`
-	HeadURL  string `json:"head_url"`
-}
-type ChannelMediaProfile struct {
-	Title    string             `json:"title"`
-	CoverURL string             `json:"cover_url"`
-	URL      string             `json:"url"`
-	Size     int                `json:"size"`
-	Key      string             `json:"key"`
-	NonceId  string             `json:"nonce_id"`
-	Nickname string             `json:"nickname"`
-	Type     string             `json:"type"`
-	Contact  ChannelContact     `json:"contact"`
-	Spec     []ChannelMediaSpec `json:"spec"`
-}
+// 页面发送的视频信息，和 fetch 命令获取到的一致
+type ChannelMediaSpec = channels.Spec
+type ChannelContact = channels.Contact
+type ChannelMediaProfile = channels.Profile
+
 type FrontendTip struct {
 	End          int     `json:"end"`
 	Replace      int     `json:"replace"`
@@ -82,7 +58,8 @@ type InterceptorConfig struct {
 	ChannelFiles   *ChannelInjectedFiles
 	Cfg            *config.Config
 	Debug          bool
-	IsDevMode      bool // 是否是开发模式
+	IsDevMode      bool         // 是否是开发模式
+	Events         *jobs.Events // 发布由本程序下载的任务的进度
 }
 
 type Interceptor struct {
@@ -98,6 +75,10 @@ type Interceptor struct {
 	channel_files  *ChannelInjectedFiles
 	cfg            *config.Config
 	echo           *echo.Echo
+	recorders      *live.Manager
+	jobs           *jobs.Store
+	downloads      *jobs.Runner
+	profiles       *catalog.Catalog
 }
 
 func NewInterceptor(payload InterceptorConfig) (*Interceptor, error) {
@@ -106,7 +87,31 @@ func NewInterceptor(payload InterceptorConfig) (*Interceptor, error) {
 	if err != nil {
 		return nil, err
 	}
-	client.AddPlugin(CreateChannelInterceptorPlugin(payload.Version, payload.ChannelFiles, payload.Cfg, payload.IsDevMode))
+	profiles, err := catalog.Open(payload.Cfg.ChannelCatalogFile)
+	if err != nil {
+		return nil, err
+	}
+	client.AddPlugin(CreateChannelInterceptorPlugin(payload.Version, payload.ChannelFiles, payload.Cfg, profiles, payload.IsDevMode))
+	client.AddPlugin(CreateSessionPlugin(payload.Cfg, payload.IsDevMode))
+	recorders := live.NewManager()
+	client.AddPlugin(CreateLivePlugin(payload.Cfg, recorders))
+	store, err := jobs.Open(payload.Cfg.DownloadJobsFile)
+	if err != nil {
+		return nil, err
+	}
+	downloads := jobs.NewRunner(store, jobs.RunnerOptions{
+		Dir:         downloadDir(payload.Cfg),
+		Concurrency: payload.Cfg.DownloadMaxDownloads,
+		Events:      payload.Events,
+		Sidecar: sidecar.Options{
+			JSON:   payload.Cfg.DownloadSidecarJSON,
+			NFO:    payload.Cfg.DownloadSidecarNFO,
+			Poster: payload.Cfg.DownloadSidecarPoster,
+		},
+		EmbedTags:        payload.Cfg.DownloadEmbedTags,
+		FilenameTemplate: payload.Cfg.DownloadFilenameTemplate,
+	})
+	client.AddPlugin(CreateJobsPlugin(store, downloads))
 
 	// 如果配置了积分，添加积分插件（可选，解耦）
 	if payload.Cfg != nil && payload.Cfg.CreditEncrypted != "" {
@@ -135,6 +140,10 @@ func NewInterceptor(payload InterceptorConfig) (*Interceptor, error) {
 		channel_files:  payload.ChannelFiles,
 		cfg:            payload.Cfg,
 		echo:           client,
+		recorders:      recorders,
+		jobs:           store,
+		downloads:      downloads,
+		profiles:       profiles,
 	}, nil
 }
 
@@ -158,6 +167,8 @@ func (c *Interceptor) Start() error {
 			return fmt.Errorf("设置代理失败: %v", err)
 		}
 	}
+	// 继续上次退出时没有完成的下载
+	c.downloads.Start()
 	return nil
 }
 
@@ -166,6 +177,11 @@ func (c *Interceptor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (c *Interceptor) Stop() error {
+	// 先结束直播录制，保证录制文件完整
+	c.recorders.StopAll()
+	c.downloads.Stop()
+	c.jobs.Close()
+	c.profiles.Close()
 	if c.SetSystemProxy {
 		arg := proxy.ProxySettings{
 			Device:   c.Device,
@@ -0,0 +1,228 @@
+package interceptor
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ltaoo/echo"
+
+	"wx_channel/config"
+	"wx_channel/pkg/jobs"
+	"wx_channel/pkg/naming"
+)
+
+type JobAddRequest struct {
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Filename string          `json:"filename"`
+	Profile  json.RawMessage `json:"profile"`
+	Spec     json.RawMessage `json:"spec"`
+	// 不校验密钥，密钥校验失败后由页面确认重新下载
+	Force bool `json:"force"`
+}
+
+type JobUpdateRequest struct {
+	ID string `json:"id"`
+	jobs.JobUpdate
+}
+
+type JobIDRequest struct {
+	ID string `json:"id"`
+}
+
+// 页面发送的视频信息，字段名和页面中的一致
+type job_profile struct {
+	ID       string          `json:"id"`
+	Title    string          `json:"title"`
+	URL      string          `json:"url"`
+	Key      json.RawMessage `json:"key"`
+	CoverURL string          `json:"coverUrl"`
+	Contact  *struct {
+		Nickname string `json:"nickname"`
+	} `json:"contact"`
+}
+
+// CreateJobsPlugin 下载记录保存在本地，页面刷新后也不会丢失
+// 页面也可以只发送视频信息，由本程序下载到本地目录
+func CreateJobsPlugin(store *jobs.Store, downloads *jobs.Runner) *echo.Plugin {
+	return &echo.Plugin{
+		Match: "qq.com",
+		OnRequest: func(ctx *echo.Context) {
+			switch ctx.Req.URL.Path {
+			case "/__wx_channels_api/jobs":
+				handleJobList(ctx, store)
+			case "/__wx_channels_api/jobs/get":
+				handleJobGet(ctx, store)
+			case "/__wx_channels_api/jobs/add":
+				handleJobAdd(ctx, store)
+			case "/__wx_channels_api/jobs/download":
+				handleJobDownload(ctx, downloads)
+			case "/__wx_channels_api/jobs/update":
+				handleJobUpdate(ctx, store)
+			case "/__wx_channels_api/jobs/remove":
+				handleJobRemove(ctx, store)
+			case "/__wx_channels_api/jobs/clear":
+				removed, err := store.Clear()
+				if err != nil {
+					mockJSONResponse(ctx, 500, map[string]interface{}{"error": err.Error()})
+					return
+				}
+				mockJSONResponse(ctx, 200, map[string]interface{}{"removed": removed})
+			}
+		},
+	}
+}
+
+func handleJobList(ctx *echo.Context, store *jobs.Store) {
+	query := ctx.Req.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	mockJSONResponse(ctx, 200, store.List(jobs.ListOptions{
+		Status: query.Get("status"),
+		Limit:  limit,
+	}))
+}
+
+func handleJobGet(ctx *echo.Context, store *jobs.Store) {
+	var body JobIDRequest
+	if err := json.NewDecoder(ctx.Req.Body).Decode(&body); err != nil {
+		mockJSONResponse(ctx, 400, map[string]interface{}{"error": "请求参数错误"})
+		return
+	}
+	job := store.Get(body.ID)
+	if job == nil {
+		mockJSONResponse(ctx, 404, map[string]interface{}{"error": jobs.ErrJobNotFound.Error()})
+		return
+	}
+	mockJSONResponse(ctx, 200, job)
+}
+
+func handleJobAdd(ctx *echo.Context, store *jobs.Store) {
+	job, err := decodeJobAddRequest(ctx)
+	if err != nil {
+		mockJSONResponse(ctx, 400, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	job.Source = jobs.SourcePage
+	created, err := store.Add(job)
+	if err != nil {
+		mockJobError(ctx, err)
+		return
+	}
+	mockJSONResponse(ctx, 200, created)
+}
+
+func handleJobDownload(ctx *echo.Context, downloads *jobs.Runner) {
+	job, err := decodeJobAddRequest(ctx)
+	if err != nil {
+		mockJSONResponse(ctx, 400, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	// 页面按文件名模板生成的文件名，没有时由本程序按同一个模板生成
+	job.Filename = naming.Sanitize(job.Filename)
+	created, err := downloads.Enqueue(job)
+	if err != nil {
+		mockJobError(ctx, err)
+		return
+	}
+	mockJSONResponse(ctx, 200, created)
+}
+
+func decodeJobAddRequest(ctx *echo.Context) (jobs.Job, error) {
+	var body JobAddRequest
+	if err := json.NewDecoder(ctx.Req.Body).Decode(&body); err != nil {
+		return jobs.Job{}, errors.New("请求参数错误")
+	}
+	var profile job_profile
+	if err := json.Unmarshal(body.Profile, &profile); err != nil {
+		return jobs.Job{}, errors.New("视频信息错误")
+	}
+	job := jobs.Job{
+		ID:       body.ID,
+		FeedID:   profile.ID,
+		Title:    profile.Title,
+		CoverURL: profile.CoverURL,
+		URL:      body.URL,
+		Key:      json_text(profile.Key),
+		Filename: body.Filename,
+		Profile:  body.Profile,
+		Force:    body.Force,
+	}
+	if job.URL == "" {
+		job.URL = profile.URL
+	}
+	if profile.Contact != nil {
+		job.Nickname = profile.Contact.Nickname
+	}
+	if json_text(body.Spec) != "" {
+		var spec struct {
+			FileFormat string `json:"fileFormat"`
+		}
+		json.Unmarshal(body.Spec, &spec)
+		job.Spec = body.Spec
+		job.Format = spec.FileFormat
+	}
+	return job, nil
+}
+
+func mockJobError(ctx *echo.Context, err error) {
+	status := 500
+	if errors.Is(err, jobs.ErrJobActive) {
+		status = 409
+	}
+	if errors.Is(err, jobs.ErrJobNotFound) {
+		status = 404
+	}
+	mockJSONResponse(ctx, status, map[string]interface{}{"error": err.Error()})
+}
+
+func handleJobUpdate(ctx *echo.Context, store *jobs.Store) {
+	var body JobUpdateRequest
+	if err := json.NewDecoder(ctx.Req.Body).Decode(&body); err != nil {
+		mockJSONResponse(ctx, 400, map[string]interface{}{"error": "请求参数错误"})
+		return
+	}
+	job, err := store.Update(body.ID, body.JobUpdate)
+	if err != nil {
+		mockJobError(ctx, err)
+		return
+	}
+	mockJSONResponse(ctx, 200, job)
+}
+
+func handleJobRemove(ctx *echo.Context, store *jobs.Store) {
+	var body JobIDRequest
+	if err := json.NewDecoder(ctx.Req.Body).Decode(&body); err != nil {
+		mockJSONResponse(ctx, 400, map[string]interface{}{"error": "请求参数错误"})
+		return
+	}
+	if err := store.Remove(body.ID); err != nil {
+		mockJobError(ctx, err)
+		return
+	}
+	mockJSONResponse(ctx, 200, map[string]interface{}{"id": body.ID})
+}
+
+// 页面中的数字可能是字符串也可能是数字，统一转为字符串，null 为空字符串
+func json_text(v json.RawMessage) string {
+	text := strings.Trim(strings.TrimSpace(string(v)), `"`)
+	if text == "null" {
+		return ""
+	}
+	return text
+}
+
+// downloadDir 由本程序下载时的保存目录，未配置时为用户的下载目录
+func downloadDir(cfg *config.Config) string {
+	if cfg.DownloadDir != "" {
+		return cfg.DownloadDir
+	}
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return filepath.Join(homedir, "Downloads")
+}
@@ -0,0 +1,79 @@
+package interceptor
+
+import (
+	"encoding/json"
+
+	"github.com/ltaoo/echo"
+
+	"wx_channel/config"
+	"wx_channel/pkg/live"
+)
+
+type LiveRecordRequest struct {
+	Action string `json:"action"` // start、stop、status
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Name   string `json:"name"`
+}
+
+// CreateLivePlugin 处理页面发来的直播录制请求，由本程序直接拉流写入文件，不再依赖 ffmpeg
+func CreateLivePlugin(cfg *config.Config, recorders *live.Manager) *echo.Plugin {
+	return &echo.Plugin{
+		Match: "qq.com",
+		OnRequest: func(ctx *echo.Context) {
+			if ctx.Req.URL.Path == "/__wx_channels_api/live/record" {
+				handleLiveRecord(ctx, cfg, recorders)
+			}
+		},
+	}
+}
+
+func handleLiveRecord(ctx *echo.Context, cfg *config.Config, recorders *live.Manager) {
+	var body LiveRecordRequest
+	if err := json.NewDecoder(ctx.Req.Body).Decode(&body); err != nil {
+		mockJSONResponse(ctx, 400, map[string]interface{}{"error": "请求参数错误"})
+		return
+	}
+	switch body.Action {
+	case "start":
+		recorder, err := recorders.Start(live.RecorderOptions{
+			URL:             body.URL,
+			Dir:             liveRecordDir(cfg),
+			Name:            body.Name,
+			SegmentDuration: cfg.DownloadLiveSegmentDuration,
+		})
+		if err != nil {
+			mockJSONResponse(ctx, 400, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		mockJSONResponse(ctx, 200, recorder.Status())
+	case "stop":
+		recorder, err := recorders.Stop(body.ID)
+		if err != nil {
+			mockJSONResponse(ctx, 404, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		mockJSONResponse(ctx, 200, recorder.Status())
+	case "status":
+		if body.ID == "" {
+			mockJSONResponse(ctx, 200, recorders.List())
+			return
+		}
+		recorder := recorders.Get(body.ID)
+		if recorder == nil {
+			mockJSONResponse(ctx, 404, map[string]interface{}{"error": "录制任务不存在"})
+			return
+		}
+		mockJSONResponse(ctx, 200, recorder.Status())
+	default:
+		mockJSONResponse(ctx, 400, map[string]interface{}{"error": "不支持的操作"})
+	}
+}
+
+// liveRecordDir 录制文件保存目录，未配置时和下载目录相同
+func liveRecordDir(cfg *config.Config) string {
+	if cfg.DownloadLiveDir != "" {
+		return cfg.DownloadLiveDir
+	}
+	return downloadDir(cfg)
+}
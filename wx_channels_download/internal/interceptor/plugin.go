@@ -13,6 +13,7 @@ import (
 	"github.com/ltaoo/echo"
 
 	"wx_channel/config"
+	"wx_channel/pkg/catalog"
 	"wx_channel/pkg/util"
 )
 
@@ -39,7 +40,7 @@ var (
 	jsFmp4IndexReg     = regexp.MustCompile(`fmp4Index:p.fmp4Index`)
 )
 
-func CreateChannelInterceptorPlugin(version string, files *ChannelInjectedFiles, cfg *config.Config, isDevMode bool) *echo.Plugin {
+func CreateChannelInterceptorPlugin(version string, files *ChannelInjectedFiles, cfg *config.Config, profiles *catalog.Catalog, isDevMode bool) *echo.Plugin {
 	v := "?t=" + version
 	return &echo.Plugin{
 		Match: "qq.com",
@@ -69,6 +70,11 @@ func CreateChannelInterceptorPlugin(version string, files *ChannelInjectedFiles,
 					if isDevMode {
 						fmt.Println("[ECHO]handler", err.Error())
 					}
+				} else if data.ID != "" && data.Type != "live" {
+					// 直播地址只在直播时有效，不保存
+					if _, err := profiles.Put(data); err != nil {
+						fmt.Printf("[ERROR]%v\n", err.Error())
+					}
 				}
 				if isDevMode {
 					fmt.Printf("\n打开了视频\n%s\n", data.Title)
@@ -318,7 +324,7 @@ func CreateChannelInterceptorPlugin(version string, files *ChannelInjectedFiles,
 						label   string
 						handler string
 					}{
-						{"原始视频", "__wx_channels_handle_click_download__"},
+						{"原始视频", "() => __wx_channels_handle_click_download__(null)"},
 						{"当前视频", "__wx_channels_download_cur__"},
 						{"下载为mp3", "() => __wx_channels_handle_click_download__(null, true)"},
 						{"打印下载命令", "__wx_channels_handle_print_download_command"},
@@ -357,3 +363,11 @@ func CreateChannelInterceptorPlugin(version string, files *ChannelInjectedFiles,
 		},
 	}
 }
+
+func mockJSONResponse(ctx *echo.Context, status int, data interface{}) {
+	resp, _ := json.Marshal(data)
+	ctx.Mock(status, map[string]string{
+		"Content-Type": "application/json",
+		"__debug":      "fake_resp",
+	}, string(resp))
+}
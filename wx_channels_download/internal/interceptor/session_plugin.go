@@ -0,0 +1,58 @@
+package interceptor
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/ltaoo/echo"
+
+	"wx_channel/config"
+	"wx_channel/pkg/channels"
+	"wx_channel/pkg/util"
+)
+
+// CreateSessionPlugin 页面获取视频详情时保存登录信息，fetch 命令使用该信息在命令行中获取视频
+func CreateSessionPlugin(cfg *config.Config, isDevMode bool) *echo.Plugin {
+	var (
+		mu   sync.Mutex
+		last *channels.Session
+	)
+	return &echo.Plugin{
+		Match: "qq.com",
+		OnResponse: func(ctx *echo.Context) {
+			if ctx.Req.URL.Hostname() != "channels.weixin.qq.com" || util.Includes(ctx.Req.URL.Path, "/__wx_channels_api/") {
+				return
+			}
+			if !strings.Contains(strings.ToLower(ctx.GetResponseHeader("Content-Type")), "application/json") {
+				return
+			}
+			resp_body, err := ctx.GetResponseBody()
+			if err != nil || !strings.Contains(resp_body, `"objectDesc"`) {
+				return
+			}
+			var req_body []byte
+			if ctx.Req.Body != nil {
+				req_body, _ = io.ReadAll(ctx.Req.Body)
+			}
+			session := channels.CaptureSession(ctx.Req, req_body, []byte(resp_body))
+			if session == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if session.Same(last) {
+				return
+			}
+			if err := channels.SaveSession(cfg.ChannelSessionFile, session); err != nil {
+				fmt.Printf("[ERROR]%v\n", err.Error())
+				return
+			}
+			last = session
+			if isDevMode {
+				fmt.Printf("已保存登录信息 %s\n", cfg.ChannelSessionFile)
+			}
+		},
+	}
+}
@@ -0,0 +1,236 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"wx_channel/pkg/channels"
+	"wx_channel/pkg/download"
+	"wx_channel/pkg/jsonlog"
+)
+
+var ErrEntryNotFound = errors.New("视频不在本地目录中")
+
+// 打开过的视频
+type Entry struct {
+	Profile     channels.Profile `json:"profile"`
+	FirstSeenAt time.Time        `json:"first_seen_at"`
+	LastSeenAt  time.Time        `json:"last_seen_at"`
+	Views       int              `json:"views"`
+}
+
+type ListOptions struct {
+	Query  string // 匹配标题、作者或视频 ID
+	Author string // 匹配作者昵称或 ID
+	Limit  int
+}
+
+// 文件中的一行，put 写入完整的记录，del 删除记录
+type record struct {
+	Op    string `json:"op"`
+	Entry *Entry `json:"entry,omitempty"`
+	ID    string `json:"id,omitempty"`
+}
+
+// 页面中打开过的视频，保存在本地文件中
+// 文件每行是一条 JSON 记录，修改时追加写入，读取时按顺序重放
+type Catalog struct {
+	mu      sync.Mutex
+	log     *jsonlog.Log[record]
+	entries map[string]*Entry
+}
+
+// 打开视频目录文件，不存在时创建
+func Open(path string) (*Catalog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("创建视频目录失败 %v", err.Error())
+	}
+	entries, err := replay(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Catalog{entries: entries}
+	// 启动时重写一次文件，去掉已经删除和被覆盖的记录
+	c.log, err = jsonlog.Open(path, "视频目录", ".tmp_wx_catalog_*", c.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 只读取视频目录，不修改文件，用于命令行查看
+func Load(path string, opts ListOptions) ([]Entry, error) {
+	entries, err := replay(path)
+	if err != nil {
+		return nil, err
+	}
+	return list(entries, opts), nil
+}
+
+// 只读取一个视频，不存在时返回 ErrEntryNotFound
+func Find(path string, id string) (*Entry, error) {
+	entries, err := replay(path)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := entries[id]
+	if !ok {
+		return nil, ErrEntryNotFound
+	}
+	return entry, nil
+}
+
+// 按视频地址查找，地址中的 token 和规格可以不同
+func FindByURL(path string, video_url string) (*Entry, error) {
+	key := download.MediaKey(video_url)
+	if key == "" {
+		return nil, ErrEntryNotFound
+	}
+	entries, err := replay(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if download.MediaKey(entry.Profile.URL) == key {
+			return entry, nil
+		}
+	}
+	return nil, ErrEntryNotFound
+}
+
+func replay(path string) (map[string]*Entry, error) {
+	entries := make(map[string]*Entry)
+	err := jsonlog.Replay(path, "视频目录", func(r *record) {
+		switch r.Op {
+		case "put":
+			if r.Entry != nil && r.Entry.Profile.ID != "" {
+				entries[r.Entry.Profile.ID] = r.Entry
+			}
+		case "del":
+			delete(entries, r.ID)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// 保存页面发送的视频信息，已存在时更新信息并保留第一次打开的时间
+func (c *Catalog) Put(profile channels.Profile) (*Entry, error) {
+	if profile.ID == "" {
+		return nil, errors.New("视频 ID 不能为空")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	entry, ok := c.entries[profile.ID]
+	if !ok {
+		entry = &Entry{FirstSeenAt: now}
+		c.entries[profile.ID] = entry
+	}
+	// 再次打开时页面中可能没有密钥或规格，沿用之前的
+	if profile.Key == "" {
+		profile.Key = entry.Profile.Key
+	}
+	if len(profile.Spec) == 0 {
+		profile.Spec = entry.Profile.Spec
+	}
+	if profile.Contact == nil {
+		profile.Contact = entry.Profile.Contact
+	}
+	entry.Profile = profile
+	entry.LastSeenAt = now
+	entry.Views++
+	if err := c.append(record{Op: "put", Entry: entry}); err != nil {
+		return nil, err
+	}
+	copied := *entry
+	return &copied, nil
+}
+
+func (c *Catalog) Get(id string) *Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[id]
+	if !ok {
+		return nil
+	}
+	copied := *entry
+	return &copied
+}
+
+// 按第一次打开的时间倒序返回视频
+func (c *Catalog) List(opts ListOptions) []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return list(c.entries, opts)
+}
+
+func list(entries map[string]*Entry, opts ListOptions) []Entry {
+	query := strings.ToLower(strings.TrimSpace(opts.Query))
+	author := strings.ToLower(strings.TrimSpace(opts.Author))
+	result := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if author != "" && !match_author(entry, author) {
+			continue
+		}
+		if query != "" && !strings.Contains(strings.ToLower(entry.Profile.Title), query) && !match_author(entry, query) && entry.Profile.ID != query {
+			continue
+		}
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].FirstSeenAt.Equal(result[j].FirstSeenAt) {
+			return result[i].Profile.ID > result[j].Profile.ID
+		}
+		return result[i].FirstSeenAt.After(result[j].FirstSeenAt)
+	})
+	if opts.Limit > 0 && len(result) > opts.Limit {
+		result = result[:opts.Limit]
+	}
+	return result
+}
+
+func match_author(entry *Entry, keyword string) bool {
+	contact := entry.Profile.Contact
+	if contact == nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(contact.Nickname), keyword) || strings.ToLower(contact.ID) == keyword
+}
+
+func (c *Catalog) Remove(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[id]; !ok {
+		return ErrEntryNotFound
+	}
+	delete(c.entries, id)
+	return c.append(record{Op: "del", ID: id})
+}
+
+func (c *Catalog) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.log.Close()
+}
+
+func (c *Catalog) append(r record) error {
+	return c.log.Append(r, len(c.entries))
+}
+
+// 重写文件时只写入当前的记录
+func (c *Catalog) snapshot() []record {
+	records := make([]record, 0, len(c.entries))
+	for _, entry := range c.entries {
+		records = append(records, record{Op: "put", Entry: entry})
+	}
+	return records
+}
@@ -0,0 +1,150 @@
+package channels
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidFeedRef = errors.New("无法从链接中解析出视频 ID")
+	ErrSessionExpired = errors.New("登录信息已失效，请在微信中重新打开任意一个视频")
+)
+
+// 链接中可能出现的视频 ID 参数名
+var (
+	object_id_keys = []string{"oid", "objectId", "object_id", "feedId", "feed_id", "id"}
+	nonce_id_keys  = []string{"nid", "objectNonceId", "nonceId", "nonce_id"}
+)
+
+// 要获取的视频
+type FeedRef struct {
+	ObjectID string
+	NonceID  string
+}
+
+type Client struct {
+	session *Session
+	http    *http.Client
+}
+
+func NewClient(session *Session) *Client {
+	return &Client{
+		session: session,
+		http:    &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// 解析视频 ID 或分享链接，短链接会先请求一次获取跳转后的地址
+func (c *Client) ResolveFeedRef(input string) (FeedRef, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return FeedRef{}, ErrInvalidFeedRef
+	}
+	if !strings.Contains(input, "://") {
+		return FeedRef{ObjectID: input}, nil
+	}
+	u, err := url.Parse(input)
+	if err != nil {
+		return FeedRef{}, ErrInvalidFeedRef
+	}
+	if ref, ok := feed_ref_from_url(u); ok {
+		return ref, nil
+	}
+	var visited []*url.URL
+	client := &http.Client{
+		Timeout: c.http.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			visited = append(visited, req.URL)
+			if len(via) >= 10 {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return FeedRef{}, ErrInvalidFeedRef
+	}
+	if ua := c.session.Header["User-Agent"]; ua != "" {
+		req.Header.Set("User-Agent", ua)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return FeedRef{}, fmt.Errorf("打开分享链接失败 %v", err.Error())
+	}
+	resp.Body.Close()
+	for _, v := range visited {
+		if ref, ok := feed_ref_from_url(v); ok {
+			return ref, nil
+		}
+	}
+	return FeedRef{}, ErrInvalidFeedRef
+}
+
+func feed_ref_from_url(u *url.URL) (FeedRef, bool) {
+	query := u.Query()
+	var ref FeedRef
+	for _, key := range object_id_keys {
+		if v := query.Get(key); v != "" {
+			ref.ObjectID = v
+			break
+		}
+	}
+	for _, key := range nonce_id_keys {
+		if v := query.Get(key); v != "" {
+			ref.NonceID = v
+			break
+		}
+	}
+	return ref, ref.ObjectID != ""
+}
+
+// 使用保存的登录信息获取视频详情
+func (c *Client) FetchProfile(ref FeedRef) (*Profile, error) {
+	if ref.ObjectID == "" {
+		return nil, ErrInvalidFeedRef
+	}
+	req, err := c.session.NewRequest(ref)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("请求视频详情失败 %v", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, ErrSessionExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("请求视频详情失败 %v", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("读取视频详情失败 %v", err.Error())
+	}
+	var body struct {
+		ErrCode int    `json:"errCode"`
+		ErrMsg  string `json:"errMsg"`
+		Data    *struct {
+			Object json.RawMessage `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("视频详情格式错误 %v", err.Error())
+	}
+	if body.ErrCode != 0 {
+		return nil, fmt.Errorf("获取视频详情失败 %d %s", body.ErrCode, body.ErrMsg)
+	}
+	if body.Data == nil || len(body.Data.Object) == 0 || string(body.Data.Object) == "null" {
+		// 登录失效时接口通常返回成功但没有数据
+		return nil, ErrSessionExpired
+	}
+	return FormatFeed(body.Data.Object)
+}
@@ -0,0 +1,236 @@
+package channels
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const sampleFeed = `{
+	"id": 14123456789012345678,
+	"objectNonceId": "nonce_2",
+	"createtime": 1700000000,
+	"contact": {"username": "v2_author@finder", "nickname": "作者", "headUrl": "https://example.com/avatar.jpg"},
+	"objectDesc": {
+		"description": "标题\n第二行",
+		"mediaType": 4,
+		"media": [{
+			"url": "https://finder.video.qq.com/251/20302/stodownload?encfilekey=abc",
+			"urlToken": "&token=xyz",
+			"decodeKey": 123456,
+			"coverUrl": "https://example.com/cover.jpg",
+			"fileSize": "2048",
+			"videoPlayLen": 15,
+			"spec": [{"fileFormat": "xWT111", "width": 720, "height": 1280, "durationMs": 15400}]
+		}]
+	}
+}`
+
+// 记录收到的请求，并按 handler 返回响应
+type stub_server struct {
+	*httptest.Server
+	method string
+	query  string
+	header http.Header
+	body   map[string]interface{}
+}
+
+func new_stub_server(t *testing.T, handler func(w http.ResponseWriter)) *stub_server {
+	s := &stub_server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.method = r.Method
+		s.query = r.URL.RawQuery
+		s.header = r.Header.Clone()
+		data, _ := io.ReadAll(r.Body)
+		s.body = nil
+		if len(data) > 0 {
+			dec := json.NewDecoder(strings.NewReader(string(data)))
+			dec.UseNumber()
+			if err := dec.Decode(&s.body); err != nil {
+				t.Errorf("请求参数不是 JSON %v", err)
+			}
+		}
+		handler(w)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func new_test_session(url string) *Session {
+	return &Session{
+		Method: http.MethodPost,
+		URL:    url + "/cgi-bin/mmfinderassistant-bin/finderGetCommentDetail?_rid=abc",
+		Header: map[string]string{
+			"Cookie":       "sessionid=1",
+			"Content-Type": "application/json",
+			"X-WECHAT-UIN": "1000",
+		},
+		Body:     json.RawMessage(`{"objectId":14000000000000000001,"objectNonceId":"nonce_1","lastBuff":"","pluginSessionId":null}`),
+		ObjectID: Field{In: "body", Key: "objectId"},
+		NonceID:  Field{In: "body", Key: "objectNonceId"},
+		FeedID:   "14000000000000000001",
+	}
+}
+
+func write_feed(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, `{"errCode":0,"errMsg":"","data":{"object":`+sampleFeed+`}}`)
+}
+
+func TestFetchProfileReplaysRequest(t *testing.T) {
+	server := new_stub_server(t, write_feed)
+	client := NewClient(new_test_session(server.URL))
+
+	profile, err := client.FetchProfile(FeedRef{ObjectID: "14123456789012345678", NonceID: "nonce_2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.method != http.MethodPost || server.query != "_rid=abc" {
+		t.Fatalf("请求为 %s ?%s", server.method, server.query)
+	}
+	if server.header.Get("Cookie") != "sessionid=1" || server.header.Get("X-Wechat-Uin") != "1000" {
+		t.Fatalf("没有带上登录信息 %v", server.header)
+	}
+	// 视频 ID 保持为数字，不能丢失精度
+	if v, ok := server.body["objectId"].(json.Number); !ok || v.String() != "14123456789012345678" {
+		t.Fatalf("objectId 为 %#v", server.body["objectId"])
+	}
+	if server.body["objectNonceId"] != "nonce_2" {
+		t.Fatalf("objectNonceId 为 %#v", server.body["objectNonceId"])
+	}
+	if _, ok := server.body["pluginSessionId"]; !ok {
+		t.Fatal("其他参数没有保留")
+	}
+	if profile.ID != "14123456789012345678" || profile.Key != "123456" || profile.Duration != 15 {
+		t.Fatalf("视频信息错误 %+v", profile)
+	}
+}
+
+func TestFetchProfileWithoutNonceID(t *testing.T) {
+	server := new_stub_server(t, write_feed)
+	client := NewClient(new_test_session(server.URL))
+	if _, err := client.FetchProfile(FeedRef{ObjectID: "14123456789012345678"}); err != nil {
+		t.Fatal(err)
+	}
+	// 没有 nonce id 时不能带上之前视频的
+	if _, ok := server.body["objectNonceId"]; ok {
+		t.Fatalf("请求中仍然有之前视频的 objectNonceId %#v", server.body["objectNonceId"])
+	}
+}
+
+func TestFetchProfileErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		status  int
+		body    string
+		want    error
+		message string
+	}{
+		{"未登录", http.StatusUnauthorized, "", ErrSessionExpired, ""},
+		{"没有权限", http.StatusForbidden, "", ErrSessionExpired, ""},
+		{"没有数据", http.StatusOK, `{"errCode":0,"data":{"object":null}}`, ErrSessionExpired, ""},
+		{"没有 data", http.StatusOK, `{"errCode":0}`, ErrSessionExpired, ""},
+		{"错误码", http.StatusOK, `{"errCode":-4011,"errMsg":"feed not found"}`, nil, "-4011 feed not found"},
+		{"服务器错误", http.StatusBadGateway, "", nil, "502"},
+		{"格式错误", http.StatusOK, `<html>`, nil, "视频详情格式错误"},
+		{"直播", http.StatusOK, `{"errCode":0,"data":{"object":{"id":"1","objectDesc":{"mediaType":9,"media":[{"url":"u"}]},"liveInfo":{"streamUrl":"x"}}}}`, ErrUnsupportedMedia, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := new_stub_server(t, func(w http.ResponseWriter) {
+				w.WriteHeader(c.status)
+				io.WriteString(w, c.body)
+			})
+			client := NewClient(new_test_session(server.URL))
+			_, err := client.FetchProfile(FeedRef{ObjectID: "1"})
+			if err == nil {
+				t.Fatal("应该返回错误")
+			}
+			if c.want != nil && !errors.Is(err, c.want) {
+				t.Fatalf("错误为 %v，期望 %v", err, c.want)
+			}
+			if c.message != "" && !strings.Contains(err.Error(), c.message) {
+				t.Fatalf("错误为 %v，期望包含 %q", err, c.message)
+			}
+		})
+	}
+}
+
+func TestResolveFeedRef(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/s/short" {
+			http.Redirect(w, r, "/web/pages/feed?oid=14123456789012345678&nid=nonce_2", http.StatusFound)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+	client := NewClient(&Session{Header: map[string]string{}})
+
+	cases := []struct {
+		input string
+		want  FeedRef
+		err   error
+	}{
+		{"14123456789012345678", FeedRef{ObjectID: "14123456789012345678"}, nil},
+		{"https://channels.weixin.qq.com/web/pages/feed?oid=1&nid=2", FeedRef{ObjectID: "1", NonceID: "2"}, nil},
+		{server.URL + "/s/short", FeedRef{ObjectID: "14123456789012345678", NonceID: "nonce_2"}, nil},
+		{server.URL + "/s/other", FeedRef{}, ErrInvalidFeedRef},
+		{"  ", FeedRef{}, ErrInvalidFeedRef},
+	}
+	for _, c := range cases {
+		ref, err := client.ResolveFeedRef(c.input)
+		if !errors.Is(err, c.err) || ref != c.want {
+			t.Errorf("ResolveFeedRef(%q) = %+v, %v，期望 %+v, %v", c.input, ref, err, c.want, c.err)
+		}
+	}
+}
+
+func TestFormatFeed(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		err      error
+		duration int64
+	}{
+		{"视频", sampleFeed, nil, 15},
+		{"没有时长时使用规格中的毫秒", strings.Replace(sampleFeed, `"videoPlayLen": 15,`, ``, 1), nil, 15},
+		{"图片", `{"id":"1","objectDesc":{"mediaType":2,"media":[{"url":"u"}]}}`, ErrUnsupportedMedia, 0},
+		{"没有视频", `{"id":"1","objectDesc":{"mediaType":4,"media":[]}}`, ErrNoFeed, 0},
+		{"没有地址", `{"id":"1","objectDesc":{"mediaType":4,"media":[{"url":""}]}}`, ErrNoFeed, 0},
+		{"格式错误", `[]`, ErrNoFeed, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			profile, err := FormatFeed([]byte(c.data))
+			if !errors.Is(err, c.err) {
+				t.Fatalf("错误为 %v，期望 %v", err, c.err)
+			}
+			if err != nil {
+				return
+			}
+			if profile.Duration != c.duration {
+				t.Fatalf("时长为 %d，期望 %d", profile.Duration, c.duration)
+			}
+			if profile.Type != "media" || profile.NonceID != "nonce_2" || profile.Title != "标题\n第二行" {
+				t.Fatalf("视频信息错误 %+v", profile)
+			}
+			if profile.URL != "https://finder.video.qq.com/251/20302/stodownload?encfilekey=abc&token=xyz" {
+				t.Fatalf("地址为 %s", profile.URL)
+			}
+			if profile.Size != 2048 || profile.CreateTime != 1700000000 || profile.CoverURL == "" {
+				t.Fatalf("视频信息错误 %+v", profile)
+			}
+			if profile.Contact == nil || profile.Contact.ID != "v2_author@finder" || profile.Contact.Nickname != "作者" {
+				t.Fatalf("作者信息错误 %+v", profile.Contact)
+			}
+			if len(profile.Spec) != 1 || profile.Spec[0].Width != 720 {
+				t.Fatalf("规格错误 %+v", profile.Spec)
+			}
+		})
+	}
+}
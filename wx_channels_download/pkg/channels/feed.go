@@ -0,0 +1,234 @@
+package channels
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+const (
+	mediaTypePicture = 2
+	mediaTypeVideo   = 4
+	mediaTypeLive    = 9
+)
+
+var (
+	ErrNoFeed           = errors.New("返回的数据中没有视频信息")
+	ErrUnsupportedMedia = errors.New("暂不支持图片和直播，请在页面中下载")
+)
+
+// 视频的一种规格，字段名和页面中的一致
+type Spec struct {
+	FileFormat       string  `json:"fileFormat"`
+	FirstLoadBytes   int     `json:"firstLoadBytes"`
+	BitRate          int     `json:"bitRate"`
+	CodingFormat     string  `json:"codingFormat"`
+	DynamicRangeType int     `json:"dynamicRangeType"`
+	Vfps             int     `json:"vfps"`
+	Width            int     `json:"width"`
+	Height           int     `json:"height"`
+	DurationMs       int     `json:"durationMs"`
+	QualityScore     float64 `json:"qualityScore"`
+	VideoBitrate     int     `json:"videoBitrate"`
+	AudioBitrate     int     `json:"audioBitrate"`
+	LevelOrder       int     `json:"levelOrder"`
+	Bypass           string  `json:"bypass"`
+	Is3az            int     `json:"is3az"`
+}
+
+type Contact struct {
+	ID        string `json:"id"`
+	Nickname  string `json:"nickname"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+// 可以下载的视频信息，和页面中 __wx_format_feed 返回的字段一致
+type Profile struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	NonceID    string   `json:"nonce_id"`
+	Title      string   `json:"title"`
+	URL        string   `json:"url"`
+	Key        string   `json:"key"`
+	CoverURL   string   `json:"coverUrl"`
+	CreateTime int64    `json:"createtime"`
+	Size       int64    `json:"size"`
+	Duration   int64    `json:"duration"`
+	Spec       []Spec   `json:"spec"`
+	Contact    *Contact `json:"contact"`
+}
+
+// 页面中的 id、key 等字段可能是数字、字符串或者 null
+func (p *Profile) UnmarshalJSON(data []byte) error {
+	type plain Profile
+	var v struct {
+		*plain
+		ID         flex_string `json:"id"`
+		Key        flex_string `json:"key"`
+		CreateTime flex_string `json:"createtime"`
+		Size       flex_string `json:"size"`
+		Duration   flex_string `json:"duration"`
+	}
+	v.plain = (*plain)(p)
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	p.ID = string(v.ID)
+	p.Key = string(v.Key)
+	p.CreateTime = v.CreateTime.int64()
+	p.Size = v.Size.int64()
+	p.Duration = v.Duration.int64()
+	return nil
+}
+
+// 描述的第一行作为标题，描述为空时使用视频 ID
+func (p *Profile) Headline() string {
+	for _, line := range strings.Split(p.Title, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return p.ID
+}
+
+// 视频时长（秒），优先使用指定规格的时长
+// 规格中的时长是毫秒，视频信息中的时长是秒
+func (p *Profile) DurationOf(spec *Spec) float64 {
+	if spec != nil && spec.DurationMs > 0 {
+		return float64(spec.DurationMs) / 1000
+	}
+	for _, s := range p.Spec {
+		if s.DurationMs > 0 {
+			return float64(s.DurationMs) / 1000
+		}
+	}
+	return float64(p.Duration)
+}
+
+// 指定规格的下载地址，format 为空时为原始视频
+func (p *Profile) SpecURL(format string) string {
+	if format == "" {
+		return p.URL
+	}
+	return p.URL + "&X-snsvideoflag=" + format
+}
+
+// 查找规格，没有时返回 nil
+func (p *Profile) FindSpec(format string) *Spec {
+	for i := range p.Spec {
+		if p.Spec[i].FileFormat == format {
+			return &p.Spec[i]
+		}
+	}
+	return nil
+}
+
+// 接口中的数字有时是字符串，统一按字符串读取
+type flex_string string
+
+func (s *flex_string) UnmarshalJSON(data []byte) error {
+	text := strings.TrimSpace(string(data))
+	if text == "null" {
+		*s = ""
+		return nil
+	}
+	if strings.HasPrefix(text, `"`) {
+		var v string
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		*s = flex_string(v)
+		return nil
+	}
+	*s = flex_string(text)
+	return nil
+}
+
+func (s flex_string) int64() int64 {
+	if s == "" {
+		return 0
+	}
+	n := json.Number(s)
+	v, err := n.Int64()
+	if err != nil {
+		f, _ := n.Float64()
+		return int64(f)
+	}
+	return v
+}
+
+type raw_media struct {
+	URL          string      `json:"url"`
+	URLToken     string      `json:"urlToken"`
+	DecodeKey    flex_string `json:"decodeKey"`
+	CoverURL     string      `json:"coverUrl"`
+	FileSize     flex_string `json:"fileSize"`
+	VideoPlayLen flex_string `json:"videoPlayLen"`
+	Spec         []Spec      `json:"spec"`
+}
+
+type raw_feed struct {
+	ID            flex_string `json:"id"`
+	ObjectNonceID string      `json:"objectNonceId"`
+	Createtime    flex_string `json:"createtime"`
+	Contact       *struct {
+		Username string `json:"username"`
+		Nickname string `json:"nickname"`
+		HeadURL  string `json:"headUrl"`
+	} `json:"contact"`
+	ObjectDesc *struct {
+		Description string      `json:"description"`
+		MediaType   int         `json:"mediaType"`
+		Media       []raw_media `json:"media"`
+	} `json:"objectDesc"`
+	LiveInfo json.RawMessage `json:"liveInfo"`
+}
+
+// 将接口返回的 object 转换为视频信息
+func FormatFeed(data []byte) (*Profile, error) {
+	var feed raw_feed
+	if err := json.Unmarshal(data, &feed); err != nil {
+		return nil, ErrNoFeed
+	}
+	if len(feed.LiveInfo) > 0 && string(feed.LiveInfo) != "null" {
+		return nil, ErrUnsupportedMedia
+	}
+	if feed.ObjectDesc == nil || len(feed.ObjectDesc.Media) == 0 {
+		return nil, ErrNoFeed
+	}
+	if feed.ObjectDesc.MediaType != mediaTypeVideo {
+		return nil, ErrUnsupportedMedia
+	}
+	media := feed.ObjectDesc.Media[0]
+	if media.URL == "" {
+		return nil, ErrNoFeed
+	}
+	profile := &Profile{
+		Type:       "media",
+		ID:         string(feed.ID),
+		NonceID:    feed.ObjectNonceID,
+		Title:      feed.ObjectDesc.Description,
+		URL:        media.URL + media.URLToken,
+		Key:        string(media.DecodeKey),
+		CoverURL:   media.CoverURL,
+		CreateTime: feed.Createtime.int64(),
+		Size:       media.FileSize.int64(),
+		Duration:   media.VideoPlayLen.int64(),
+		Spec:       media.Spec,
+	}
+	if profile.Spec == nil {
+		profile.Spec = []Spec{}
+	}
+	if profile.Duration == 0 && len(profile.Spec) > 0 {
+		// 规格中的时长是毫秒，视频信息中的时长是秒
+		profile.Duration = int64(profile.Spec[0].DurationMs+500) / 1000
+	}
+	if feed.Contact != nil {
+		profile.Contact = &Contact{
+			ID:        feed.Contact.Username,
+			Nickname:  feed.Contact.Nickname,
+			AvatarURL: feed.Contact.HeadURL,
+		}
+	}
+	return profile, nil
+}
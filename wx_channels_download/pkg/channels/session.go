@@ -0,0 +1,231 @@
+package channels
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrNoSession = errors.New("没有保存的登录信息，请先启动本工具并在微信中打开任意一个视频")
+
+// 请求中视频 ID 所在的位置
+type Field struct {
+	In  string `json:"in"` // body 或 query
+	Key string `json:"key"`
+}
+
+// 页面获取视频详情时的请求，替换其中的视频 ID 后可以在命令行中重新发送
+type Session struct {
+	Method   string            `json:"method"`
+	URL      string            `json:"url"`
+	Header   map[string]string `json:"header"`
+	Body     json.RawMessage   `json:"body,omitempty"`
+	ObjectID Field             `json:"object_id"`
+	NonceID  Field             `json:"nonce_id"`
+	// 保存时的视频，用于确认登录信息是否可用
+	FeedID    string    `json:"feed_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// 重新发送请求时需要带上的请求头
+var session_headers = []string{
+	"Cookie",
+	"User-Agent",
+	"Referer",
+	"Origin",
+	"Content-Type",
+	"Accept",
+	"Accept-Language",
+}
+
+// 从获取视频详情的请求中提取登录信息
+// 请求和响应中都需要有同一个视频的 ID，否则不是获取视频详情的请求，返回 nil
+func CaptureSession(req *http.Request, req_body []byte, resp_body []byte) *Session {
+	var resp struct {
+		Data *struct {
+			Object json.RawMessage `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(resp_body, &resp); err != nil || resp.Data == nil || len(resp.Data.Object) == 0 {
+		return nil
+	}
+	var feed raw_feed
+	if err := json.Unmarshal(resp.Data.Object, &feed); err != nil || feed.ID == "" || feed.ObjectDesc == nil {
+		return nil
+	}
+	s := &Session{
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Header:    map[string]string{},
+		FeedID:    string(feed.ID),
+		UpdatedAt: time.Now(),
+	}
+	for _, key := range session_headers {
+		if v := req.Header.Get(key); v != "" {
+			s.Header[key] = v
+		}
+	}
+	for key, values := range req.Header {
+		// 微信客户端的身份信息
+		if strings.HasPrefix(strings.ToLower(key), "x-wechat") && len(values) > 0 {
+			s.Header[key] = values[0]
+		}
+	}
+	if s.Header["Cookie"] == "" {
+		return nil
+	}
+	if body, err := decode_body(req_body); err == nil && body != nil {
+		s.Body = req_body
+		s.ObjectID = find_field(body, nil, string(feed.ID))
+		s.NonceID = find_field(body, nil, feed.ObjectNonceID)
+	}
+	query := req.URL.Query()
+	if s.ObjectID.Key == "" {
+		s.ObjectID = find_field(nil, query, string(feed.ID))
+	}
+	if s.NonceID.Key == "" && feed.ObjectNonceID != "" {
+		s.NonceID = find_field(nil, query, feed.ObjectNonceID)
+	}
+	if s.ObjectID.Key == "" {
+		return nil
+	}
+	return s
+}
+
+// 数字按原样保留，避免视频 ID 转为浮点数后丢失精度
+func decode_body(data []byte) (map[string]interface{}, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var body map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func find_field(body map[string]interface{}, query url.Values, value string) Field {
+	if value == "" {
+		return Field{}
+	}
+	for key, v := range body {
+		if fmt.Sprint(v) == value {
+			return Field{In: "body", Key: key}
+		}
+	}
+	for key := range query {
+		if query.Get(key) == value {
+			return Field{In: "query", Key: key}
+		}
+	}
+	return Field{}
+}
+
+// 同一个接口、同一个登录状态时不需要重新保存
+func (s *Session) Same(other *Session) bool {
+	if s == nil || other == nil {
+		return false
+	}
+	return s.URL == other.URL && s.Header["Cookie"] == other.Header["Cookie"]
+}
+
+// 生成获取指定视频详情的请求
+func (s *Session) NewRequest(ref FeedRef) (*http.Request, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, fmt.Errorf("登录信息中的地址错误 %v", err.Error())
+	}
+	body, err := decode_body(s.Body)
+	if err != nil {
+		return nil, fmt.Errorf("登录信息中的请求参数错误 %v", err.Error())
+	}
+	query := u.Query()
+	set_field(body, query, s.ObjectID, ref.ObjectID)
+	set_field(body, query, s.NonceID, ref.NonceID)
+	u.RawQuery = query.Encode()
+
+	var req *http.Request
+	if body != nil {
+		data, _ := json.Marshal(body)
+		req, err = http.NewRequest(s.Method, u.String(), strings.NewReader(string(data)))
+	} else {
+		req, err = http.NewRequest(s.Method, u.String(), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range s.Header {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+// 没有 nonce id 时删除之前视频的 nonce id
+func set_field(body map[string]interface{}, query url.Values, f Field, value string) {
+	if f.Key == "" {
+		return
+	}
+	switch f.In {
+	case "body":
+		if body == nil {
+			return
+		}
+		if value == "" {
+			delete(body, f.Key)
+			return
+		}
+		if _, ok := body[f.Key].(json.Number); ok {
+			body[f.Key] = json.Number(value)
+			return
+		}
+		body[f.Key] = value
+	case "query":
+		if value == "" {
+			query.Del(f.Key)
+			return
+		}
+		query.Set(f.Key, value)
+	}
+}
+
+func LoadSession(path string) (*Session, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoSession
+		}
+		return nil, fmt.Errorf("读取登录信息失败 %v", err.Error())
+	}
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("登录信息文件格式错误 %v", err.Error())
+	}
+	return &s, nil
+}
+
+// 登录信息中有 Cookie，只允许当前用户读写
+func SaveSession(path string, s *Session) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("创建目录失败 %v", err.Error())
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("保存登录信息失败 %v", err.Error())
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("保存登录信息失败 %v", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package decrypt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// 未提供加密区长度时使用的默认值，即只有前 128KB 被加密
+const DefaultEncLen uint32 = 131072
+
+// 加密区长度的上限，响应头和元数据文件中超过该值的视为无效
+// 目前视频只加密开头的 128KB，留出足够的余量
+const MaxEncLen uint32 = 64 * 1024 * 1024
+
+// 服务器通过该响应头告知加密区长度
+const EncLenHeader = "X-enclen"
+
+// 与加密视频放在一起的元数据文件后缀，记录解密所需的信息
+const MetadataFileSuffix = ".meta.json"
+
+type Metadata struct {
+	EncLen uint32 `json:"enclen"`
+}
+
+func ParseEncLen(v string) (uint32, bool) {
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil || !ValidEncLen(uint32(n)) {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+func ValidEncLen(n uint32) bool {
+	return n > 0 && n <= MaxEncLen
+}
+
+func EncLenFromHeader(header http.Header) (uint32, bool) {
+	if header == nil {
+		return 0, false
+	}
+	return ParseEncLen(header.Get(EncLenHeader))
+}
+
+func MetadataFilepath(video_filepath string) string {
+	return video_filepath + MetadataFileSuffix
+}
+
+// 读取视频旁的元数据文件，不存在时返回 nil, nil
+func ReadMetadata(video_filepath string) (*Metadata, error) {
+	data, err := os.ReadFile(MetadataFilepath(video_filepath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("解析元数据文件失败 %v", err.Error())
+	}
+	return &m, nil
+}
+
+func WriteMetadata(video_filepath string, m *Metadata) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(MetadataFilepath(video_filepath), data, 0644)
+}
+
+// 确定加密区长度，优先级：显式指定 > 响应头 > 元数据文件 > 默认值
+// explicit 为 0、header 为 nil、video_filepath 为空时跳过对应来源，超过 MaxEncLen 的值也会跳过
+func ResolveEncLen(explicit uint32, header http.Header, video_filepath string) uint32 {
+	if ValidEncLen(explicit) {
+		return explicit
+	}
+	if v, ok := EncLenFromHeader(header); ok {
+		return v
+	}
+	if video_filepath != "" {
+		if m, err := ReadMetadata(video_filepath); err == nil && m != nil && ValidEncLen(m.EncLen) {
+			return m.EncLen
+		}
+	}
+	return DefaultEncLen
+}
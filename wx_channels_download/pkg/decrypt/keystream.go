@@ -0,0 +1,131 @@
+package decrypt
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+	"unsafe"
+)
+
+// 缓存的密钥流总字节数上限，默认加密区长度下可以缓存 32 个 key
+// 按字节而不是个数限制，请求中传入很大的加密区长度时也不会占用过多内存
+const keystreamCacheBytes = 32 * int64(DefaultEncLen)
+
+// 每个 key 除密钥流之外还要保存生成器的状态
+const keystreamEntryOverhead = int64(unsafe.Sizeof(RandCtx64{}))
+
+// 密钥流每次至少生成的长度，避免顺序读取时每次只延长很少的字节
+const keystreamMinGrow = 64 * 1024
+
+// 密钥流按需生成，ctx 保存生成到 stream 末尾时的状态，之后可以继续生成
+type keystream_entry struct {
+	key    uint64
+	mu     sync.Mutex
+	ctx    *RandCtx64
+	stream []byte
+	// 以下字段由 keystream_cache.mu 保护
+	// el 为在 order 中的位置，被淘汰后为 nil；bytes 为计入缓存的字节数
+	el    *list.Element
+	bytes int64
+}
+
+// 按 key 缓存的密钥流，总字节数超过上限时最近最少使用的先淘汰
+type keystream_cache struct {
+	mu        sync.Mutex
+	entries   map[uint64]*list.Element
+	order     *list.List
+	bytes     int64
+	max_bytes int64
+}
+
+var keystreams = &keystream_cache{
+	entries:   make(map[uint64]*list.Element),
+	order:     list.New(),
+	max_bytes: keystreamCacheBytes,
+}
+
+// 返回 key 对应的前 length 字节密钥流，同一个 key 只生成一次
+// 返回的切片是共享的，调用方不能修改
+func Keystream(key uint64, length uint32) []byte {
+	return keystreams.get(key, length, length)
+}
+
+// 至少生成前 length 字节，顺序读取时会多生成一些，但不超过 limit
+func (c *keystream_cache) get(key uint64, length uint32, limit uint32) []byte {
+	c.mu.Lock()
+	var entry *keystream_entry
+	if el, ok := c.entries[key]; ok {
+		entry = el.Value.(*keystream_entry)
+		c.order.MoveToFront(el)
+	} else {
+		entry = &keystream_entry{key: key}
+		entry.el = c.order.PushFront(entry)
+		c.entries[key] = entry.el
+	}
+	c.mu.Unlock()
+
+	// 生成密钥流比较耗时，只锁住当前 key
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if uint32(len(entry.stream)) < length {
+		target := max(length, uint32(len(entry.stream))*2, keystreamMinGrow)
+		target = max(min(target, limit), length)
+		entry.extend(target)
+		c.resize(entry, int64(len(entry.stream))+keystreamEntryOverhead)
+	}
+	return entry.stream[:length:length]
+}
+
+// 更新 entry 占用的字节数，超过上限时淘汰其他 key，当前 key 总是保留
+// 被淘汰的 key 仍在使用时不受影响，使用结束后即可回收
+func (c *keystream_cache) resize(entry *keystream_entry, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry.el == nil {
+		return
+	}
+	c.bytes += bytes - entry.bytes
+	entry.bytes = bytes
+	for c.bytes > c.max_bytes {
+		oldest := c.order.Back()
+		if oldest == entry.el {
+			break
+		}
+		c.remove(oldest.Value.(*keystream_entry))
+	}
+}
+
+func (c *keystream_cache) remove(entry *keystream_entry) {
+	c.order.Remove(entry.el)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.bytes
+	entry.el = nil
+	entry.bytes = 0
+}
+
+// 从上次生成的位置继续生成到 length 字节，长度按 8 字节对齐
+func (e *keystream_entry) extend(length uint32) {
+	if e.ctx == nil {
+		e.ctx = CreateISAacInst(e.key)
+	}
+	aligned := (int(length) + 7) / 8 * 8
+	stream := make([]byte, aligned)
+	copy(stream, e.stream)
+	for i := len(e.stream); i < aligned; i += 8 {
+		binary.BigEndian.PutUint64(stream[i:], e.ctx.ISAacRandom())
+	}
+	e.stream = stream
+}
+
+// 用密钥流解密从文件偏移 offset 开始的数据，超出加密区的部分保持不变
+// 只生成到本次读取的位置，加密区长度异常时也不会一次分配很大的内存
+func XORKeyStreamAt(data []byte, offset uint64, key uint64, encLen uint32) {
+	if offset >= uint64(encLen) || len(data) == 0 {
+		return
+	}
+	end := uint32(min(offset+uint64(len(data)), uint64(encLen)))
+	stream := keystreams.get(key, end, encLen)[offset:]
+	for i, b := range stream {
+		data[i] ^= b
+	}
+}
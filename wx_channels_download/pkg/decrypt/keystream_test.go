@@ -0,0 +1,230 @@
+package decrypt
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net/http"
+	"testing"
+)
+
+// 不使用缓存，从头生成密钥流
+func reference_keystream(key uint64, length uint32) []byte {
+	ctx := CreateISAacInst(key)
+	stream := make([]byte, (length+7)/8*8)
+	for i := 0; i < len(stream); i += 8 {
+		binary.BigEndian.PutUint64(stream[i:], ctx.ISAacRandom())
+	}
+	return stream[:length]
+}
+
+func reset_keystreams() {
+	keystreams.mu.Lock()
+	defer keystreams.mu.Unlock()
+	keystreams.entries = make(map[uint64]*list.Element)
+	keystreams.order.Init()
+	keystreams.bytes = 0
+}
+
+// 缓存的 key 和计入的总字节数
+func cached_bytes() (keys []uint64, total int64) {
+	keystreams.mu.Lock()
+	defer keystreams.mu.Unlock()
+	for el := keystreams.order.Front(); el != nil; el = el.Next() {
+		entry := el.Value.(*keystream_entry)
+		keys = append(keys, entry.key)
+		total += entry.bytes
+	}
+	if total != keystreams.bytes {
+		panic("缓存的总字节数不一致")
+	}
+	return keys, total
+}
+
+func cached_length(key uint64) int {
+	keystreams.mu.Lock()
+	defer keystreams.mu.Unlock()
+	el, ok := keystreams.entries[key]
+	if !ok {
+		return 0
+	}
+	entry := el.Value.(*keystream_entry)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	return len(entry.stream)
+}
+
+func TestKeystreamExtendsOnDemand(t *testing.T) {
+	reset_keystreams()
+	const key = 20240101
+	want := reference_keystream(key, DefaultEncLen)
+
+	// 先读取开头，再跳到后面读取，和生成完整密钥流的结果一致
+	reads := []struct {
+		offset uint64
+		size   int
+	}{
+		{0, 5},
+		{3, 1000},
+		{100000, 31000},
+		{50, 7},
+		{uint64(DefaultEncLen) - 10, 100},
+	}
+	for _, r := range reads {
+		data := make([]byte, r.size)
+		XORKeyStreamAt(data, r.offset, key, DefaultEncLen)
+		end := min(int(r.offset)+r.size, int(DefaultEncLen))
+		if !bytes.Equal(data[:end-int(r.offset)], want[r.offset:end]) {
+			t.Fatalf("offset %d 的密钥流不一致", r.offset)
+		}
+		if !bytes.Equal(data[end-int(r.offset):], make([]byte, r.size-(end-int(r.offset)))) {
+			t.Fatalf("offset %d 加密区之外的数据被修改", r.offset)
+		}
+	}
+}
+
+func TestKeystreamHugeEncLen(t *testing.T) {
+	reset_keystreams()
+	const key = 42
+	// 异常的加密区长度，只读取开头时不应该生成完整的密钥流
+	data := make([]byte, 32*1024)
+	XORKeyStreamAt(data, 0, key, 0xffffffff)
+	if n := cached_length(key); n > 1024*1024 {
+		t.Fatalf("只读取 32KB 时生成了 %d 字节密钥流", n)
+	}
+	if !bytes.Equal(data, reference_keystream(key, uint32(len(data)))) {
+		t.Fatal("密钥流不一致")
+	}
+}
+
+func TestKeystreamCacheBytes(t *testing.T) {
+	reset_keystreams()
+	defer reset_keystreams()
+	// 每个 key 都读取很长的加密区，缓存的总字节数不能超过上限
+	const size = 2 * 1024 * 1024
+	for key := uint64(1); key <= 6; key++ {
+		data := make([]byte, size)
+		XORKeyStreamAt(data, 0, key, MaxEncLen)
+		if !bytes.Equal(data, reference_keystream(key, size)) {
+			t.Fatalf("key %d 的密钥流不一致", key)
+		}
+		keys, total := cached_bytes()
+		if total > keystreamCacheBytes {
+			t.Fatalf("缓存了 %d 个 key 共 %d 字节，超过上限 %d", len(keys), total, keystreamCacheBytes)
+		}
+		if len(keys) == 0 || keys[0] != key {
+			t.Fatalf("最近使用的 key %d 不在缓存中 %v", key, keys)
+		}
+	}
+	// 单个 key 超过上限时仍然保留，只淘汰其他 key
+	data := make([]byte, 8*1024*1024)
+	XORKeyStreamAt(data, 0, 7, MaxEncLen)
+	if keys, _ := cached_bytes(); len(keys) != 1 || keys[0] != 7 {
+		t.Fatalf("缓存的 key 为 %v", keys)
+	}
+	// 被淘汰的 key 重新生成后结果一致
+	data = make([]byte, 4096)
+	XORKeyStreamAt(data, 100, 1, MaxEncLen)
+	if !bytes.Equal(data, reference_keystream(1, 4196)[100:]) {
+		t.Fatal("淘汰后重新生成的密钥流不一致")
+	}
+}
+
+func TestResolveEncLen(t *testing.T) {
+	cases := []struct {
+		name     string
+		explicit uint32
+		header   string
+		want     uint32
+	}{
+		{"默认值", 0, "", DefaultEncLen},
+		{"显式指定", 1024, "2048", 1024},
+		{"响应头", 0, "2048", 2048},
+		{"响应头无效", 0, "abc", DefaultEncLen},
+		{"响应头过大", 0, "4294967295", DefaultEncLen},
+		{"显式指定过大", MaxEncLen + 1, "2048", 2048},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			header := http.Header{}
+			if c.header != "" {
+				header.Set(EncLenHeader, c.header)
+			}
+			if got := ResolveEncLen(c.explicit, header, ""); got != c.want {
+				t.Fatalf("ResolveEncLen = %d，期望 %d", got, c.want)
+			}
+		})
+	}
+}
+
+// 播放器拖动进度时，每次从随机位置读取一段数据
+func scrub_offsets(count int) []int64 {
+	r := rand.New(rand.NewSource(1))
+	offsets := make([]int64, count)
+	for i := range offsets {
+		offsets[i] = r.Int63n(int64(DefaultEncLen))
+	}
+	return offsets
+}
+
+// 优化前的做法：每次读取都重新创建 ISAAC 实例并生成到读取的位置
+func BenchmarkScrubUncached(b *testing.B) {
+	const key = 123456
+	offsets := scrub_offsets(64)
+	buf := make([]byte, 32*1024)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		offset := offsets[i%len(offsets)]
+		end := min(offset+int64(len(buf)), int64(DefaultEncLen))
+		stream := reference_keystream(key, uint32(end))[offset:]
+		for j, v := range stream {
+			buf[j] ^= v
+		}
+	}
+}
+
+func BenchmarkScrubCached(b *testing.B) {
+	const key = 123456
+	offsets := scrub_offsets(64)
+	file := bytes.NewReader(make([]byte, 4*1024*1024))
+	reader := NewReadSeeker(file, key, DefaultEncLen)
+	buf := make([]byte, 32*1024)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := reader.Seek(offsets[i%len(offsets)], io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := reader.Read(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 顺序解密整个文件，加密区之后的数据不需要处理
+func BenchmarkReader(b *testing.B) {
+	data := make([]byte, 8*1024*1024)
+	buf := make([]byte, 32*1024)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader := NewReader(bytes.NewReader(data), 123456, 0, DefaultEncLen)
+		if _, err := io.CopyBuffer(io.Discard, reader, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 缓存的字节数超过上限时，淘汰后需要重新生成
+func BenchmarkKeystreamCacheChurn(b *testing.B) {
+	reset_keystreams()
+	data := make([]byte, DefaultEncLen)
+	keys := int(keystreamCacheBytes/int64(DefaultEncLen)) * 2
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		XORKeyStreamAt(data, 0, uint64(i%keys+1), DefaultEncLen)
+	}
+}
@@ -0,0 +1,90 @@
+package decrypt
+
+import (
+	"io"
+)
+
+// 边读边解密的 Reader，适用于只能顺序读取的数据，例如 HTTP 响应
+type Reader struct {
+	reader io.Reader
+	key    uint64
+	encLen uint32
+	offset uint64
+}
+
+// offset 为 reader 第一个字节在原文件中的位置
+func NewReader(reader io.Reader, key uint64, offset uint64, encLen uint32) *Reader {
+	return &Reader{
+		reader: reader,
+		key:    key,
+		encLen: encLen,
+		offset: offset,
+	}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		XORKeyStreamAt(p[:n], r.offset, r.key, r.encLen)
+		r.offset += uint64(n)
+	}
+	return n, err
+}
+
+// 支持随机读取的解密器，适用于本地加密文件
+type ReaderAt struct {
+	reader io.ReaderAt
+	key    uint64
+	encLen uint32
+}
+
+func NewReaderAt(reader io.ReaderAt, key uint64, encLen uint32) *ReaderAt {
+	return &ReaderAt{
+		reader: reader,
+		key:    key,
+		encLen: encLen,
+	}
+}
+
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.reader.ReadAt(p, off)
+	if n > 0 {
+		XORKeyStreamAt(p[:n], uint64(off), r.key, r.encLen)
+	}
+	return n, err
+}
+
+// 支持 Seek 的解密器，可直接交给 http.ServeContent 等需要 io.ReadSeeker 的地方
+type ReadSeeker struct {
+	reader io.ReadSeeker
+	key    uint64
+	encLen uint32
+	offset int64
+}
+
+// reader 当前的读取位置必须是文件开头
+func NewReadSeeker(reader io.ReadSeeker, key uint64, encLen uint32) *ReadSeeker {
+	return &ReadSeeker{
+		reader: reader,
+		key:    key,
+		encLen: encLen,
+	}
+}
+
+func (r *ReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		XORKeyStreamAt(p[:n], uint64(r.offset), r.key, r.encLen)
+		r.offset += int64(n)
+	}
+	return n, err
+}
+
+func (r *ReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.reader.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	r.offset = pos
+	return pos, nil
+}
@@ -0,0 +1,122 @@
+package decrypt
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadersMatchXORKeyStreamAt(t *testing.T) {
+	const key = 987654321
+	// 加密区长度不是 8 的倍数，密钥流按 8 字节生成
+	const enc_len = 4096 + 5
+	const size = 3*enc_len + 17
+	encrypted := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(encrypted)
+	want := bytes.Clone(encrypted)
+	XORKeyStreamAt(want, 0, key, enc_len)
+	if bytes.Equal(want[:enc_len], encrypted[:enc_len]) || !bytes.Equal(want[enc_len:], encrypted[enc_len:]) {
+		t.Fatal("XORKeyStreamAt 应该只修改加密区")
+	}
+
+	type read struct {
+		offset int64
+		size   int
+	}
+	cases := []struct {
+		name  string
+		reads []read
+	}{
+		{"从头顺序读取", []read{{0, 1}, {1, 7}, {8, enc_len - 10}, {enc_len - 2, 5}, {enc_len + 3, size - enc_len - 3}}},
+		{"从中间开始", []read{{13, 100}, {113, enc_len}}},
+		{"跨过加密区边界", []read{{enc_len - 1, 2}}},
+		{"加密区之后", []read{{enc_len, 10}, {enc_len + 10, 100}}},
+		{"读到文件末尾", []read{{size - 10, 10}}},
+		{"向后跳转", []read{{100, 50}, {enc_len - 3, 10}, {5, 20}, {0, 8}, {enc_len + 100, 10}, {7, 1}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			check := func(kind string, r read, got []byte) {
+				t.Helper()
+				if !bytes.Equal(got, want[r.offset:r.offset+int64(r.size)]) {
+					t.Fatalf("%s 读取 %d 开始的 %d 字节结果不一致", kind, r.offset, r.size)
+				}
+			}
+			// 每种方式都从空的缓存开始，覆盖按需生成密钥流的情况
+			sequential := true
+			for i := 1; i < len(c.reads); i++ {
+				prev := c.reads[i-1]
+				sequential = sequential && c.reads[i].offset == prev.offset+int64(prev.size)
+			}
+			if sequential {
+				reset_keystreams()
+				start := c.reads[0].offset
+				// 每次只返回一部分数据，模拟网络读取
+				reader := NewReader(iotest.HalfReader(bytes.NewReader(encrypted[start:])), key, uint64(start), enc_len)
+				for _, r := range c.reads {
+					got := make([]byte, r.size)
+					if _, err := io.ReadFull(reader, got); err != nil {
+						t.Fatal(err)
+					}
+					check("Reader", r, got)
+				}
+			}
+
+			reset_keystreams()
+			reader_at := NewReaderAt(bytes.NewReader(encrypted), key, enc_len)
+			for _, r := range c.reads {
+				got := make([]byte, r.size)
+				n, err := reader_at.ReadAt(got, r.offset)
+				if n != r.size {
+					t.Fatalf("ReadAt 读取了 %d 字节 %v", n, err)
+				}
+				check("ReaderAt", r, got)
+			}
+
+			reset_keystreams()
+			seeker := NewReadSeeker(bytes.NewReader(encrypted), key, enc_len)
+			var pos int64
+			for _, r := range c.reads {
+				if r.offset != pos {
+					if _, err := seeker.Seek(r.offset, io.SeekStart); err != nil {
+						t.Fatal(err)
+					}
+				}
+				got := make([]byte, r.size)
+				if _, err := io.ReadFull(seeker, got); err != nil {
+					t.Fatal(err)
+				}
+				check("ReadSeeker", r, got)
+				pos = r.offset + int64(r.size)
+			}
+		})
+	}
+
+	// 相对当前位置和文件末尾跳转
+	seeker := NewReadSeeker(bytes.NewReader(encrypted), key, enc_len)
+	steps := []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{enc_len + 4, io.SeekStart, enc_len + 4},
+		{-30, io.SeekCurrent, enc_len - 10}, // 上一步读取了 16 字节
+		{-size, io.SeekEnd, 0},
+		{-16, io.SeekEnd, size - 16},
+	}
+	for _, s := range steps {
+		pos, err := seeker.Seek(s.offset, s.whence)
+		if err != nil || pos != s.want {
+			t.Fatalf("Seek(%d, %d) = %d %v，期望 %d", s.offset, s.whence, pos, err, s.want)
+		}
+		got := make([]byte, 16)
+		if _, err := io.ReadFull(seeker, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want[pos:pos+16]) {
+			t.Fatalf("Seek(%d, %d) 之后读取的结果不一致", s.offset, s.whence)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package decrypt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// 校验时需要的最少字节数，一个 box 头为 8 字节，64 位长度时为 16 字节
+const VerifyHeadSize = 16
+
+var (
+	ErrInvalidKey       = errors.New("解密后不是有效的 MP4 文件，密钥可能不正确")
+	ErrAlreadyDecrypted = errors.New("文件开头已经是有效的 MP4 数据，可能已经解密过")
+	ErrHeadTooShort     = errors.New("数据太短，无法校验密钥")
+)
+
+// 视频文件开头可能出现的 box 类型
+var plausibleBoxTypes = map[string]bool{
+	"ftyp": true,
+	"moov": true,
+	"mdat": true,
+}
+
+// 判断数据开头是否像一个 ISO-BMFF（MP4）box 头
+func IsPlausibleMP4(head []byte) bool {
+	if len(head) < 8 {
+		return false
+	}
+	if !plausibleBoxTypes[string(head[4:8])] {
+		return false
+	}
+	size := binary.BigEndian.Uint32(head[0:4])
+	switch size {
+	case 0:
+		// box 延伸到文件末尾
+		return true
+	case 1:
+		// 64 位长度紧跟在类型之后
+		if len(head) < 16 {
+			return true
+		}
+		return binary.BigEndian.Uint64(head[8:16]) >= 16
+	}
+	return size >= 8
+}
+
+// 用 key 解密 head 的副本并检查结果是否为有效的 MP4 开头，不修改 head
+func VerifyKey(head []byte, key uint64, encLen uint32) error {
+	if len(head) < 8 {
+		return ErrHeadTooShort
+	}
+	if len(head) > VerifyHeadSize {
+		head = head[:VerifyHeadSize]
+	}
+	if IsPlausibleMP4(head) {
+		return ErrAlreadyDecrypted
+	}
+	data := make([]byte, len(head))
+	copy(data, head)
+	XORKeyStreamAt(data, 0, key, encLen)
+	if !IsPlausibleMP4(data) {
+		return ErrInvalidKey
+	}
+	return nil
+}
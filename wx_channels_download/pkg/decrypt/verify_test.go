@@ -0,0 +1,80 @@
+package decrypt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// 以 size、type 开头的 box 头，后面补足到 32 字节
+func box_head(size uint32, typ string, extra ...byte) []byte {
+	head := make([]byte, 8, 32)
+	binary.BigEndian.PutUint32(head, size)
+	copy(head[4:], typ)
+	head = append(head, extra...)
+	for len(head) < 32 {
+		head = append(head, byte(len(head)))
+	}
+	return head
+}
+
+func encrypt_head(head []byte, key uint64) []byte {
+	encrypted := bytes.Clone(head)
+	XORKeyStreamAt(encrypted, 0, key, DefaultEncLen)
+	return encrypted
+}
+
+func TestVerifyKey(t *testing.T) {
+	const key = 123456789
+	ftyp := box_head(32, "ftyp")
+	large := box_head(1, "mdat", 0, 0, 0, 0, 0, 0, 1, 0)
+	cases := []struct {
+		name string
+		head []byte
+		key  uint64
+		want error
+	}{
+		{"密钥正确", encrypt_head(ftyp, key), key, nil},
+		{"以 moov 开头", encrypt_head(box_head(1024, "moov"), key), key, nil},
+		{"64 位长度", encrypt_head(large, key), key, nil},
+		{"密钥错误", encrypt_head(ftyp, key), key + 1, ErrInvalidKey},
+		{"没有加密", ftyp, key, ErrAlreadyDecrypted},
+		{"数据太短", encrypt_head(ftyp, key)[:7], key, ErrHeadTooShort},
+		{"刚好一个 box 头", encrypt_head(ftyp, key)[:8], key, nil},
+		{"不是视频", encrypt_head([]byte("<html><body>404</body></html>"), key), key, ErrInvalidKey},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			head := bytes.Clone(c.head)
+			if err := VerifyKey(head, c.key, DefaultEncLen); !errors.Is(err, c.want) {
+				t.Fatalf("VerifyKey 返回 %v，期望 %v", err, c.want)
+			}
+			if !bytes.Equal(head, c.head) {
+				t.Fatal("VerifyKey 修改了传入的数据")
+			}
+		})
+	}
+}
+
+func TestIsPlausibleMP4(t *testing.T) {
+	cases := []struct {
+		name string
+		head []byte
+		want bool
+	}{
+		{"ftyp", box_head(32, "ftyp"), true},
+		{"mdat 到文件末尾", box_head(0, "mdat"), true},
+		{"64 位长度", box_head(1, "moov", 0, 0, 0, 0, 0, 0, 0, 16), true},
+		{"64 位长度太小", box_head(1, "moov", 0, 0, 0, 0, 0, 0, 0, 8), false},
+		{"64 位长度不完整", box_head(1, "moov")[:12], true},
+		{"长度小于 box 头", box_head(7, "ftyp"), false},
+		{"其他类型", box_head(32, "free"), false},
+		{"太短", []byte("\x00\x00\x00\x20fty"), false},
+	}
+	for _, c := range cases {
+		if got := IsPlausibleMP4(c.head); got != c.want {
+			t.Errorf("%s: IsPlausibleMP4 = %v，期望 %v", c.name, got, c.want)
+		}
+	}
+}
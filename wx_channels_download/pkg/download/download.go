@@ -1,19 +1,17 @@
 package download
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var file_mutex sync.Mutex
-
 type FileDownloadProgress struct {
 	Current int64
 	Total   int64
@@ -142,58 +140,60 @@ func calculate_chunks(total_size, preferred_chunk_size int64) []struct{ start, e
 	return chunks
 }
 
-// 带进度显示的文件分块下载
-func download_part_with_progress(url string, file *os.File, start, end int64, thread_idx int, progress_chan chan<- FileDownloadProgress) error {
-	client := &http.Client{Timeout: 0} // 无超时限制
+// 带进度显示的文件分块下载，边下载边写入，返回已写入文件的字节数
+// idle_timeout 内没有收到数据时中断请求，返回 ErrIdleTimeout
+func download_part_with_progress(parent context.Context, url string, file io.WriterAt, start, end int64, transform ReaderTransform, idle_timeout time.Duration, thread_idx int, progress_chan chan<- FileDownloadProgress) (int64, error) {
+	// 整个分块的下载时间不固定，只限制没有收到数据的时间
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
 
 	// 创建带Range头的请求
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	range_header := fmt.Sprintf("bytes=%d-%d", start, end)
 	req.Header.Add("Range", range_header)
 
 	// 执行请求
-	resp, err := client.Do(req)
+	body := new_idle_timeout_reader(idle_timeout, cancel)
+	defer body.stop()
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return err
+		return 0, body.wrap(err)
 	}
 	defer resp.Body.Close()
+	body.r = resp.Body
 
 	// 检查响应状态
 	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("服务器返回错误状态码: %d", resp.StatusCode)
+		return 0, &StatusError{StatusCode: resp.StatusCode}
+	}
+	if resp.StatusCode == http.StatusOK && start != 0 {
+		return 0, ErrRangeIgnored
 	}
 
 	// 创建带进度统计的Reader
 	total_size := end - start + 1
 	progress_reader := &ProgressReader{
-		Reader:  resp.Body,
+		Reader:  io.LimitReader(body, total_size),
 		Total:   total_size,
 		Thread:  thread_idx,
 		Channel: progress_chan,
 	}
 
-	buf := new(bytes.Buffer)
-	if _, err := io.Copy(buf, progress_reader); err != nil {
-		return err
-	}
-	// 将下载的数据写入文件的指定位置
-
-	// 同步写入文件
-	file_mutex.Lock()
-	defer file_mutex.Unlock()
-	// 定位到文件的指定位置
-	_, err = file.Seek(start, io.SeekStart)
-	if err != nil {
-		return err
+	var reader io.Reader = progress_reader
+	if transform != nil {
+		reader = transform(reader, start)
 	}
-	if _, err := file.Write(buf.Bytes()); err != nil {
-		return err
+	// 直接写入文件的指定位置，WriteAt 可并发调用，无需加锁，内存占用只有 io.Copy 的缓冲区
+	writer := io.NewOffsetWriter(file, start)
+	n, err := io.Copy(writer, reader)
+	if err == nil && n < total_size {
+		err = io.ErrUnexpectedEOF
 	}
-	return nil
+	return n, err
 }
 
 // 带进度统计的Reader
@@ -249,11 +249,27 @@ type PartialFileDownloadProgress struct {
 }
 
 func SingleThreadingDownload(url string, dest_filepath string, on_progress func(progress *PartialFileDownloadProgress)) error {
-	resp, err := http.Get(url)
+	return single_threading_download(context.Background(), url, dest_filepath, nil, DefaultRetryPolicy.IdleTimeout, on_progress)
+}
+
+func single_threading_download(parent context.Context, url string, dest_filepath string, transform ReaderTransform, idle_timeout time.Duration, on_progress func(progress *PartialFileDownloadProgress)) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return fmt.Errorf("下载失败 %v", err.Error())
 	}
+	idle_reader := new_idle_timeout_reader(idle_timeout, cancel)
+	defer idle_reader.stop()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("下载失败 %v", idle_reader.wrap(err).Error())
+	}
 	defer resp.Body.Close()
+	idle_reader.r = resp.Body
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
 	file, err := os.Create(dest_filepath)
 	if err != nil {
 		return fmt.Errorf("创建文件失败 %v", err.Error())
@@ -264,10 +280,14 @@ func SingleThreadingDownload(url string, dest_filepath string, on_progress func(
 	if content_length != "" {
 		total_size, _ = strconv.ParseInt(content_length, 10, 64)
 	}
+	var body io.Reader = idle_reader
+	if transform != nil {
+		body = transform(body, 0)
+	}
 	buf := make([]byte, 32*1024) // 32KB buffer
 	var downloaded int64 = 0
 	for {
-		n, err := resp.Body.Read(buf)
+		n, err := body.Read(buf)
 		if n > 0 {
 			_, werr := file.Write(buf[:n])
 			if werr != nil {
@@ -301,98 +321,290 @@ func SingleThreadingDownload(url string, dest_filepath string, on_progress func(
 	return nil
 }
 
-func MultiThreadingDownload(url string, threads int, dest_filepath string, tmp_dest_filepath string) error {
-	tr := &http.Transport{
-		TLSNextProto: make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
+type RemoteFileMeta struct {
+	ContentLength int64
+	ETag          string
+	LastModified  string
+	// 地址的 MediaKey，用来确认续传记录属于同一个视频
+	Source string
+	// 探测请求的完整响应头，例如 X-enclen
+	Header http.Header
+	// 文件开头的若干字节
+	Head []byte
+}
+
+// 数据写入文件前的处理，offset 为 reader 第一个字节在文件中的位置，可用于边下载边解密
+type ReaderTransform func(reader io.Reader, offset int64) io.Reader
+
+type MultiThreadingDownloadOptions struct {
+	Threads int
+	// 是否根据目标文件旁的续传记录只下载未完成的分块
+	Resume bool
+	// 分块失败时的重试策略，为空时使用 DefaultRetryPolicy
+	Retry RetryPolicy
+	// 写入文件前对每段数据的处理，为空时原样写入
+	Transform ReaderTransform
+	// 探测到远程文件信息后、开始下载前调用，可根据响应头准备 Transform，返回错误时放弃下载
+	OnProbe func(meta *RemoteFileMeta) error
+	// 总进度回调，设置后不再在终端中显示每个线程的进度
+	Progress func(progress *PartialFileDownloadProgress)
+	// 取消后中断所有请求并返回，保留续传记录，为空时不能取消
+	Context context.Context
+}
+
+func (opts *MultiThreadingDownloadOptions) context() context.Context {
+	if opts.Context == nil {
+		return context.Background()
 	}
-	client := &http.Client{Transport: tr, Timeout: 30 * time.Second}
-	// 发送HEAD请求获取文件信息
-	resp, err := client.Head(url)
-	if err != nil {
-		return fmt.Errorf("获取文件信息失败 %v", err.Error())
+	return opts.Context
+}
+
+// 统计写入文件的字节数
+type counting_writer_at struct {
+	io.WriterAt
+	written *atomic.Int64
+}
+
+func (w *counting_writer_at) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.WriterAt.WriteAt(p, off)
+	w.written.Add(int64(n))
+	return n, err
+}
+
+func report_progress(on_progress func(progress *PartialFileDownloadProgress), downloaded, total int64) {
+	percent := float64(0)
+	if total > 0 {
+		percent = float64(downloaded) / float64(total) * 100
 	}
-	defer resp.Body.Close()
+	on_progress(&PartialFileDownloadProgress{
+		DownloadedSize: downloaded,
+		TotalSize:      total,
+		Percent:        percent,
+	})
+}
 
-	fmt.Print("\033c")
+// 下载队列中的一个任务，对应续传记录中的一个分块
+type chunk_task struct {
+	idx    int
+	splits int
+}
 
-	// 检查是否支持断点续传
-	if resp.Header.Get("Accept-Ranges") != "bytes" {
-		return fmt.Errorf("服务器不支持并发下载")
+func MultiThreadingDownload(url string, dest_filepath string, opts MultiThreadingDownloadOptions) error {
+	meta, err := probe_remote_file(opts.context(), url)
+	if err != nil {
+		return err
 	}
-	content_length := resp.Header.Get("Content-Length")
-	if content_length == "" {
-		return fmt.Errorf("无法获取总文件大小，服务器不支持并发下载")
+	if opts.OnProbe != nil {
+		if err := opts.OnProbe(meta); err != nil {
+			return err
+		}
 	}
+	return multi_threading_download(url, dest_filepath, meta, opts)
+}
 
-	file_size, err := strconv.ParseInt(content_length, 10, 64)
-	if err != nil {
-		return fmt.Errorf("解析文件大小失败: %v", err)
+func multi_threading_download(url string, dest_filepath string, meta *RemoteFileMeta, opts MultiThreadingDownloadOptions) error {
+	var err error
+	file_size := meta.ContentLength
+	threads := opts.Threads
+	if threads <= 0 {
+		threads = 4
 	}
+	retry := opts.Retry.withDefaults()
+	ctx := opts.context()
 
-	// start_time := time.Now()
-	var wg sync.WaitGroup
-	errors := make(chan error, threads)
+	var file *os.File
+	var journal *ChunkJournal
+	if opts.Resume {
+		journal, err = LoadChunkJournal(dest_filepath)
+		if err != nil {
+			return fmt.Errorf("无法继续下载，%v，请去掉 --resume 重新下载", err)
+		}
+		if journal != nil {
+			if err := journal.Matches(meta); err != nil {
+				return fmt.Errorf("无法继续下载，%v，请去掉 --resume 重新下载", err)
+			}
+			file, err = os.OpenFile(dest_filepath, os.O_RDWR, 0644)
+			if err != nil {
+				return fmt.Errorf("打开未完成的文件失败 %v", err)
+			}
+			defer file.Close()
+			if info, err := file.Stat(); err != nil || info.Size() != file_size {
+				return fmt.Errorf("未完成的文件大小与记录不一致，请去掉 --resume 重新下载")
+			}
+		}
+	}
+	if journal == nil {
+		// 计算每个分块的大小
+		part_size := file_size / int64(threads)
+		chunks := calculate_chunks(file_size, part_size)
+		journal = NewChunkJournal(dest_filepath, meta, chunks)
 
-	// 计算每个分块的大小
-	part_size := file_size / int64(threads)
-	// remainder := file_size % int64(threads)
+		file, err = os.Create(dest_filepath)
+		if err != nil {
+			return fmt.Errorf("创建文件失败 %v\n", err)
+		}
+		defer file.Close()
+		if err := file.Truncate(file_size); err != nil {
+			return fmt.Errorf("设置文件大小失败: %v", err)
+		}
+		if err := journal.Save(); err != nil {
+			return err
+		}
+	}
+	pending := journal.Pending()
+	if len(pending) < threads {
+		threads = len(pending)
+	}
 
-	chunks := calculate_chunks(file_size, part_size)
 	// 创建进度通道，每个线程一个
-	progress_chans := make([]chan FileDownloadProgress, len(chunks))
+	progress_chans := make([]chan FileDownloadProgress, threads)
 	for i := range progress_chans {
 		progress_chans[i] = make(chan FileDownloadProgress, 10)
 	}
 
-	// 启动进度显示器
 	stop_progress := make(chan bool)
-	go display_progress(progress_chans, stop_progress)
-
-	file, err := os.Create(dest_filepath)
-	if err != nil {
-		return fmt.Errorf("创建文件失败 %v\n", err)
-	}
-	defer file.Close()
-	if err := file.Truncate(file_size); err != nil {
-		return fmt.Errorf("设置文件大小失败: %v", err)
+	var progress_wg sync.WaitGroup
+	var writer io.WriterAt = file
+	if opts.Progress != nil {
+		// 已完成的分块也计入进度
+		written := &atomic.Int64{}
+		for i := range journal.Chunks {
+			if c := journal.Chunk(i); c.Done {
+				written.Add(c.End - c.Start + 1)
+			}
+		}
+		writer = &counting_writer_at{WriterAt: file, written: written}
+		defer func() {
+			report_progress(opts.Progress, written.Load(), file_size)
+		}()
+		// 返回前等待最后一次回调结束，调用方在返回后可能已经关闭了回调中用到的资源
+		progress_wg.Add(1)
+		go func() {
+			defer progress_wg.Done()
+			ticker := time.NewTicker(500 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop_progress:
+					return
+				case <-ticker.C:
+					report_progress(opts.Progress, written.Load(), file_size)
+				}
+			}
+		}()
+	} else {
+		fmt.Print("\033c")
+		// 启动进度显示器
+		go display_progress(progress_chans, stop_progress)
 	}
 
-	// fmt.Println("the chunk size is", len(chunks))
-	// 启动并发下载
-	for i, chunk := range chunks {
-		wg.Add(1)
-		// fmt.Println(i, chunk)
-		go func(thread_idx int, start, end int64) {
-			defer wg.Done()
-			// file, err := os.Create(tmp_dest_filepath + "_" + strconv.Itoa(thread_idx))
-			// if err != nil {
-			// 	errors <- fmt.Errorf("创建文件 %d 失败: %v", thread_idx+1, err)
-			// 	return
-			// }
-			// defer file.Close()
-			if err := download_part_with_progress(
+	// 任务队列，失败的分块拆分后会重新放回队列交给空闲线程
+	var tasks_wg sync.WaitGroup
+	tasks := make(chan chunk_task)
+	enqueue := func(t chunk_task) {
+		tasks_wg.Add(1)
+		go func() { tasks <- t }()
+	}
+	var errors_mu sync.Mutex
+	var range_errors []*RangeError
+
+	run_task := func(thread_idx int, t chunk_task) {
+		defer tasks_wg.Done()
+		chunk := journal.Chunk(t.idx)
+		offset := chunk.Start
+		var last_err error
+		attempt := 0
+		for attempt < retry.MaxAttempts {
+			attempt++
+			n, err := download_part_with_progress(
+				ctx,
 				url,
-				file,
-				start,
-				end,
+				writer,
+				offset,
+				chunk.End,
+				opts.Transform,
+				retry.IdleTimeout,
 				thread_idx,
 				progress_chans[thread_idx],
-			); err != nil {
-				errors <- fmt.Errorf("线程 %d 下载失败: %v", thread_idx+1, err)
+			)
+			offset += n
+			if err == nil {
+				// 数据落盘后再记录为已完成，否则断电后续传会跳过没有写入的分块
+				if err := file.Sync(); err != nil {
+					last_err = fmt.Errorf("写入文件失败 %v", err.Error())
+					break
+				}
+				if err := journal.MarkDone(t.idx); err != nil {
+					last_err = err
+					break
+				}
+				return
+			}
+			last_err = err
+			if ctx.Err() != nil || !is_retryable(err) || attempt >= retry.MaxAttempts {
+				break
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(retry.backoff(attempt)):
+			}
+		}
+		// 重试耗尽，把剩余范围拆开交给其他线程
+		remaining := chunk.End - offset + 1
+		if ctx.Err() == nil && is_retryable(last_err) && t.splits < retry.MaxSplits && remaining >= 2*minSplitChunkSize {
+			// 拆分时已下载的部分会记录为已完成，同样需要先落盘
+			err := file.Sync()
+			if err == nil {
+				var indexes []int
+				if indexes, err = journal.Split(t.idx, offset, 2); err == nil {
+					for _, idx := range indexes {
+						enqueue(chunk_task{idx: idx, splits: t.splits + 1})
+					}
+					return
+				}
+			}
+			last_err = err
+		}
+		errors_mu.Lock()
+		range_errors = append(range_errors, &RangeError{
+			Start:    offset,
+			End:      chunk.End,
+			Attempts: attempt,
+			Err:      last_err,
+		})
+		errors_mu.Unlock()
+	}
+
+	// 启动并发下载
+	var workers_wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		workers_wg.Add(1)
+		go func(thread_idx int) {
+			defer workers_wg.Done()
+			for t := range tasks {
+				run_task(thread_idx, t)
 			}
-		}(i, chunk.start, chunk.end)
+		}(i)
+	}
+	for _, idx := range pending {
+		enqueue(chunk_task{idx: idx})
 	}
 	// 等待所有下载完成
-	wg.Wait()
-	close(errors)
+	tasks_wg.Wait()
+	close(tasks)
+	workers_wg.Wait()
 	close(stop_progress)
+	progress_wg.Wait()
 
 	// 检查错误
-	if len(errors) > 0 {
-		// for err := range errors {
-		// 	fmt.Println(err)
-		// }
-		return fmt.Errorf("下载失败，共%v个错误", len(errors))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(range_errors) > 0 {
+		return fmt.Errorf("%w\n可使用 --resume 继续下载", &DownloadError{Ranges: range_errors})
+	}
+	if err := journal.Remove(); err != nil {
+		return fmt.Errorf("删除续传记录失败 %v", err)
 	}
 	return nil
 }
@@ -0,0 +1,514 @@
+package download
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func random_content(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+// 解析 bytes=start-end，不支持多个范围
+func parse_range(header string, size int64) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+	start_str, end_str, _ := strings.Cut(spec, "-")
+	start, err := strconv.ParseInt(start_str, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end := size - 1
+	if end_str != "" {
+		if end, err = strconv.ParseInt(end_str, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return start, end, start <= end
+}
+
+func write_range(w http.ResponseWriter, data []byte, start, end int64) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(data[start : end+1])
+}
+
+func quiet_options() MultiThreadingDownloadOptions {
+	return MultiThreadingDownloadOptions{
+		Threads:  4,
+		Progress: func(progress *PartialFileDownloadProgress) {},
+		Retry: RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   time.Millisecond,
+			MaxDelay:    10 * time.Millisecond,
+			IdleTimeout: 200 * time.Millisecond,
+		},
+	}
+}
+
+func assert_file(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("文件内容不一致，长度 %d，期望 %d", len(got), len(want))
+	}
+}
+
+func TestDownloadRetriesStalledRange(t *testing.T) {
+	data := random_content(4 * 1024 * 1024)
+	var stalled atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, end, ok := parse_range(r.Header.Get("Range"), int64(len(data)))
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// 第一个非探测的分块发送一半后不再发送数据
+		if start > 0 && stalled.CompareAndSwap(false, true) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start : start+(end-start)/2])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		write_range(w, data, start, end)
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "video.mp4")
+	done := make(chan error, 1)
+	go func() {
+		_, err := Download(server.URL, dest, quiet_options(), nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("分块没有数据时下载一直阻塞")
+	}
+	if !stalled.Load() {
+		t.Fatal("没有模拟分块中断")
+	}
+	assert_file(t, dest, data)
+}
+
+func TestDownloadFallsBackWhenRangeIgnored(t *testing.T) {
+	data := random_content(4 * 1024 * 1024)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		start, end, ok := parse_range(r.Header.Get("Range"), int64(len(data)))
+		// 只有探测请求返回 206，其他请求都返回完整文件
+		if ok && start == 0 && end < probeHeadSize {
+			write_range(w, data, start, end)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "video.mp4")
+	mode, err := Download(server.URL, dest, quiet_options(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != DownloadModeSingleThreading {
+		t.Fatalf("下载方式为 %v，期望单线程下载", mode)
+	}
+	assert_file(t, dest, data)
+	if _, err := os.Stat(JournalFilepath(dest)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("单线程下载后续传记录没有删除")
+	}
+	// 探测 1 次，每个分块 1 次，单线程 1 次，不应该重试
+	if n := requests.Load(); n > 6 {
+		t.Fatalf("请求了 %d 次，服务器忽略 Range 时不应该重试", n)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&StatusError{StatusCode: http.StatusNotFound}, false},
+		{&StatusError{StatusCode: http.StatusForbidden}, false},
+		{&StatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&StatusError{StatusCode: http.StatusBadGateway}, true},
+		{ErrIdleTimeout, true},
+		{ErrRangeIgnored, false},
+		{fmt.Errorf("分块失败 %w", ErrRangeIgnored), false},
+	}
+	for _, c := range cases {
+		if got := is_retryable(c.err); got != c.want {
+			t.Errorf("is_retryable(%v) = %v，期望 %v", c.err, got, c.want)
+		}
+	}
+}
+
+// 按位置生成内容，服务器不需要把整个文件放在内存中
+type pattern_file struct {
+	size   int64
+	offset int64
+}
+
+func (f *pattern_file) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if remaining := f.size - f.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	for i := range p {
+		p[i] = byte((f.offset + int64(i)) * 31 >> 3)
+	}
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (f *pattern_file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		f.offset = offset
+	case io.SeekCurrent:
+		f.offset += offset
+	case io.SeekEnd:
+		f.offset = f.size + offset
+	}
+	return f.offset, nil
+}
+
+// 下载过程中定时记录堆内存的峰值，内存占用应与文件大小无关
+func BenchmarkDownload(b *testing.B) {
+	const size = 256 * 1024 * 1024
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "video.mp4", time.Time{}, &pattern_file{size: size})
+	}))
+	defer server.Close()
+	dir := b.TempDir()
+	opts := quiet_options()
+	opts.Threads = 8
+
+	var peak_heap_inuse uint64
+	var total_alloc uint64
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dest := filepath.Join(dir, fmt.Sprintf("video_%d.mp4", i))
+		runtime.GC()
+		var before runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		stop := make(chan struct{})
+		sampled := make(chan uint64)
+		go func() {
+			var peak uint64
+			var m runtime.MemStats
+			ticker := time.NewTicker(5 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				runtime.ReadMemStats(&m)
+				if m.HeapInuse > peak {
+					peak = m.HeapInuse
+				}
+				select {
+				case <-stop:
+					sampled <- peak
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+		if _, err := Download(server.URL, dest, opts, nil); err != nil {
+			b.Fatal(err)
+		}
+		close(stop)
+		peak := <-sampled
+
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		if peak > peak_heap_inuse {
+			peak_heap_inuse = peak
+		}
+		total_alloc += after.TotalAlloc - before.TotalAlloc
+		os.Remove(dest)
+	}
+	b.ReportMetric(float64(peak_heap_inuse), "peak-heap-inuse-B")
+	b.ReportMetric(float64(total_alloc)/float64(b.N), "total-alloc-B/op")
+}
+
+func save_journal(t *testing.T, dest_filepath string, meta *RemoteFileMeta) {
+	t.Helper()
+	chunks := []struct{ start, end int64 }{{0, meta.ContentLength/2 - 1}, {meta.ContentLength / 2, meta.ContentLength - 1}}
+	if err := NewChunkJournal(dest_filepath, meta, chunks).Save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindResumable(t *testing.T) {
+	const video_url = "https://finder.video.qq.com/251/20302/stodownload?encfilekey=abc&token=1"
+	source := MediaKey(video_url)
+	if source != "abc" || MediaKey("https://finder.video.qq.com/251/20302/stodownload?encfilekey=abc&token=2&X-snsvideoflag=xWT111") != source {
+		t.Fatalf("MediaKey = %q", source)
+	}
+	cases := []struct {
+		name     string
+		journals map[string]*RemoteFileMeta
+		meta     *RemoteFileMeta
+		want     string
+		err      bool
+	}{
+		{
+			name: "升级前的记录 ETag 一致",
+			journals: map[string]*RemoteFileMeta{
+				"1700000000.mp4": {ContentLength: 4096, ETag: `"abc"`},
+				"other.mp4":      {ContentLength: 4096, ETag: `"def"`},
+			},
+			meta: &RemoteFileMeta{ContentLength: 4096, ETag: `"abc"`, Source: source},
+			want: "1700000000.mp4",
+		},
+		{
+			name: "升级前的记录 Last-Modified 一致",
+			journals: map[string]*RemoteFileMeta{
+				"1700000000.mp4": {ContentLength: 4096, LastModified: "Mon, 01 Jan 2024 00:00:00 GMT"},
+			},
+			meta: &RemoteFileMeta{ContentLength: 4096, LastModified: "Mon, 01 Jan 2024 00:00:00 GMT", Source: source},
+			want: "1700000000.mp4",
+		},
+		{
+			name: "只有大小一致",
+			journals: map[string]*RemoteFileMeta{
+				"1700000000.mp4": {ContentLength: 4096},
+			},
+			meta: &RemoteFileMeta{ContentLength: 4096, Source: source},
+		},
+		{
+			name: "地址一致",
+			journals: map[string]*RemoteFileMeta{
+				"标题_original.mp4": {ContentLength: 4096, Source: source},
+				"其他视频.mp4":        {ContentLength: 4096, Source: "other"},
+			},
+			meta: &RemoteFileMeta{ContentLength: 4096, Source: source},
+			want: "标题_original.mp4",
+		},
+		{
+			name: "地址不一致",
+			journals: map[string]*RemoteFileMeta{
+				"其他视频.mp4": {ContentLength: 4096, ETag: `"abc"`, Source: "other"},
+			},
+			meta: &RemoteFileMeta{ContentLength: 4096, ETag: `"abc"`, Source: source},
+		},
+		{
+			name: "大小不一致",
+			journals: map[string]*RemoteFileMeta{
+				"1700000000.mp4": {ContentLength: 4096, ETag: `"abc"`},
+			},
+			meta: &RemoteFileMeta{ContentLength: 8192, ETag: `"abc"`},
+		},
+		{
+			name: "有多个",
+			journals: map[string]*RemoteFileMeta{
+				"1700000000.mp4": {ContentLength: 4096, ETag: `"abc"`},
+				"1700000001.mp4": {ContentLength: 4096, ETag: `"abc"`},
+			},
+			meta: &RemoteFileMeta{ContentLength: 4096, ETag: `"abc"`},
+			err:  true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, meta := range c.journals {
+				save_journal(t, filepath.Join(dir, name), meta)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "broken.mp4"+JournalFileSuffix), []byte("{"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := FindResumable(dir, c.meta)
+			if (err != nil) != c.err {
+				t.Fatalf("FindResumable 返回 %v", err)
+			}
+			want := ""
+			if c.want != "" {
+				want = filepath.Join(dir, c.want)
+			}
+			if got != want {
+				t.Fatalf("FindResumable = %q，期望 %q", got, want)
+			}
+		})
+	}
+	if got, err := FindResumable(filepath.Join(t.TempDir(), "missing"), &RemoteFileMeta{ContentLength: 4096}); got != "" || err != nil {
+		t.Fatalf("目录不存在时返回了 %q %v", got, err)
+	}
+}
+
+// 支持 Range 的服务器，记录探测之外请求的范围
+func new_range_server(t *testing.T, data []byte, etag string) (*httptest.Server, func() [][2]int64) {
+	var mu sync.Mutex
+	var ranges [][2]int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, end, ok := parse_range(r.Header.Get("Range"), int64(len(data)))
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !(start == 0 && end == probeHeadSize-1) {
+			mu.Lock()
+			ranges = append(ranges, [2]int64{start, end})
+			mu.Unlock()
+		}
+		w.Header().Set("ETag", etag)
+		write_range(w, data, start, end)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() [][2]int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(ranges)
+	}
+}
+
+// 生成完成了部分分块的文件和续传记录，未完成的部分为 0
+func write_partial(t *testing.T, dest string, data []byte, meta *RemoteFileMeta, done ...int) *ChunkJournal {
+	t.Helper()
+	j := NewChunkJournal(dest, meta, calculate_chunks(meta.ContentLength, meta.ContentLength/4))
+	partial := make([]byte, meta.ContentLength)
+	for _, idx := range done {
+		c := j.Chunks[idx]
+		copy(partial[c.Start:c.End+1], data[c.Start:c.End+1])
+		j.Chunks[idx].Done = true
+	}
+	if err := os.WriteFile(dest, partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Save(); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func resume_options() MultiThreadingDownloadOptions {
+	opts := quiet_options()
+	opts.Resume = true
+	return opts
+}
+
+func TestResumeDownloadsPendingChunks(t *testing.T) {
+	data := random_content(4 * 1024 * 1024)
+	server, requested := new_range_server(t, data, `"v1"`)
+	dest := filepath.Join(t.TempDir(), "video.mp4")
+	j := write_partial(t, dest, data, &RemoteFileMeta{ContentLength: int64(len(data)), ETag: `"v1"`}, 0, 2)
+
+	mode, err := Download(server.URL, dest, resume_options(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != DownloadModeMultiThreading {
+		t.Fatalf("下载方式为 %v，期望多线程下载", mode)
+	}
+	assert_file(t, dest, data)
+	if _, err := os.Stat(JournalFilepath(dest)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("下载完成后续传记录没有删除")
+	}
+	ranges := requested()
+	if len(ranges) == 0 {
+		t.Fatal("没有下载未完成的分块")
+	}
+	for _, r := range ranges {
+		for _, idx := range []int{0, 2} {
+			if c := j.Chunks[idx]; r[0] <= c.End && r[1] >= c.Start {
+				t.Fatalf("重新下载了已完成的分块 %d-%d（请求 %d-%d）", c.Start, c.End, r[0], r[1])
+			}
+		}
+	}
+}
+
+func TestResumeRejected(t *testing.T) {
+	data := random_content(1024 * 1024)
+	size := int64(len(data))
+	valid := func() []byte {
+		raw, err := json.Marshal(NewChunkJournal("", &RemoteFileMeta{ContentLength: size, ETag: `"v1"`}, calculate_chunks(size, size/4)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	cases := []struct {
+		name    string
+		meta    *RemoteFileMeta
+		journal []byte // 不为空时覆盖生成的续传记录
+		want    string
+	}{
+		{name: "ETag 变化", meta: &RemoteFileMeta{ContentLength: size, ETag: `"v0"`}, want: "ETag 已变化"},
+		{name: "大小变化", meta: &RemoteFileMeta{ContentLength: size / 2, ETag: `"v1"`}, want: "大小已变化"},
+		{name: "记录被截断", journal: valid()[:40], want: "解析续传记录失败"},
+		{name: "记录不是 JSON", journal: []byte("\x00\x00\x00"), want: "解析续传记录失败"},
+		{name: "分块不完整", journal: []byte(`{"content_length":1048576,"etag":"\"v1\"","chunks":[{"start":0,"end":1023,"done":true}]}`), want: "没有覆盖整个文件"},
+		{name: "分块重叠", journal: []byte(`{"content_length":1048576,"etag":"\"v1\"","chunks":[{"start":0,"end":524287,"done":true},{"start":1000,"end":1048575}]}`), want: "无效"},
+		{name: "分块超出文件", journal: []byte(`{"content_length":1048576,"etag":"\"v1\"","chunks":[{"start":0,"end":2097151}]}`), want: "无效"},
+		{name: "没有分块", journal: []byte(`{"content_length":1048576,"etag":"\"v1\""}`), want: "不完整"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server, requested := new_range_server(t, data, `"v1"`)
+			dest := filepath.Join(t.TempDir(), "video.mp4")
+			meta := c.meta
+			if meta == nil {
+				meta = &RemoteFileMeta{ContentLength: size, ETag: `"v1"`}
+			}
+			write_partial(t, dest, data, meta, 0)
+			if c.journal != nil {
+				if err := os.WriteFile(JournalFilepath(dest), c.journal, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = Download(server.URL, dest, resume_options(), nil)
+			if err == nil || !strings.Contains(err.Error(), c.want) || !strings.Contains(err.Error(), "--resume") {
+				t.Fatalf("续传应该因为 %s 失败并提示去掉 --resume，返回 %v", c.want, err)
+			}
+			assert_file(t, dest, before)
+			if _, err := os.Stat(JournalFilepath(dest)); err != nil {
+				t.Fatalf("续传失败后续传记录被删除 %v", err)
+			}
+			if ranges := requested(); len(ranges) > 0 {
+				t.Fatalf("续传失败时仍然下载了 %v", ranges)
+			}
+		})
+	}
+}
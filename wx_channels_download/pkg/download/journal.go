@@ -0,0 +1,244 @@
+package download
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// 断点续传日志文件后缀，与目标文件放在同一目录
+const JournalFileSuffix = ".wxdl"
+
+type JournalChunk struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Done  bool  `json:"done"`
+}
+
+// 记录分块下载进度的日志，每完成一个分块就落盘一次
+type ChunkJournal struct {
+	ContentLength int64          `json:"content_length"`
+	ETag          string         `json:"etag"`
+	LastModified  string         `json:"last_modified"`
+	Source        string         `json:"source,omitempty"` // 视频地址的 MediaKey
+	Chunks        []JournalChunk `json:"chunks"`
+	filepath      string
+	mu            sync.Mutex
+}
+
+func JournalFilepath(dest_filepath string) string {
+	return dest_filepath + JournalFileSuffix
+}
+
+func NewChunkJournal(dest_filepath string, meta *RemoteFileMeta, chunks []struct{ start, end int64 }) *ChunkJournal {
+	j := &ChunkJournal{
+		ContentLength: meta.ContentLength,
+		ETag:          meta.ETag,
+		LastModified:  meta.LastModified,
+		Source:        meta.Source,
+		filepath:      JournalFilepath(dest_filepath),
+	}
+	for _, c := range chunks {
+		j.Chunks = append(j.Chunks, JournalChunk{Start: c.start, End: c.end})
+	}
+	return j
+}
+
+// 读取已存在的续传日志，不存在时返回 nil, nil
+func LoadChunkJournal(dest_filepath string) (*ChunkJournal, error) {
+	p := JournalFilepath(dest_filepath)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("读取续传记录失败 %v", err.Error())
+	}
+	var j ChunkJournal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("解析续传记录失败 %v", err.Error())
+	}
+	if err := j.validate(); err != nil {
+		return nil, err
+	}
+	j.filepath = p
+	return &j, nil
+}
+
+// 分块需要刚好覆盖整个文件，否则续传后的文件会缺少或重复内容
+func (j *ChunkJournal) validate() error {
+	if j.ContentLength <= 0 || len(j.Chunks) == 0 {
+		return fmt.Errorf("续传记录不完整")
+	}
+	chunks := slices.Clone(j.Chunks)
+	slices.SortFunc(chunks, func(a, b JournalChunk) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+	var next int64
+	for _, c := range chunks {
+		if c.Start != next || c.End < c.Start || c.End >= j.ContentLength {
+			return fmt.Errorf("续传记录中的分块 %d-%d 无效", c.Start, c.End)
+		}
+		next = c.End + 1
+	}
+	if next != j.ContentLength {
+		return fmt.Errorf("续传记录中的分块没有覆盖整个文件")
+	}
+	return nil
+}
+
+// 在目录中查找和远程文件一致的续传记录，返回对应的目标文件，没有时返回空字符串
+// 用于没有指定文件名时，继续之前按其他规则命名的下载
+// 只有大小相同不能说明是同一个视频，还需要地址或 ETag、Last-Modified 一致，有多个时返回错误
+func FindResumable(dir string, meta *RemoteFileMeta) (string, error) {
+	if meta == nil || meta.ContentLength <= 0 {
+		return "", nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", nil
+	}
+	var found []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), JournalFileSuffix) {
+			continue
+		}
+		dest_filepath := filepath.Join(dir, strings.TrimSuffix(entry.Name(), JournalFileSuffix))
+		j, err := LoadChunkJournal(dest_filepath)
+		if err != nil || j == nil || j.Matches(meta) != nil || !j.same_source(meta) {
+			continue
+		}
+		found = append(found, dest_filepath)
+	}
+	switch len(found) {
+	case 0:
+		return "", nil
+	case 1:
+		return found[0], nil
+	}
+	names := make([]string, len(found))
+	for i, p := range found {
+		names[i] = filepath.Base(p)
+	}
+	return "", fmt.Errorf("找到多个可以继续的下载 %s，请使用 --filename 指定", strings.Join(names, "、"))
+}
+
+// 是否为同一个文件，旧的记录中没有地址，需要 ETag 或 Last-Modified 一致
+func (j *ChunkJournal) same_source(meta *RemoteFileMeta) bool {
+	if j.Source != "" && meta.Source != "" {
+		return j.Source == meta.Source
+	}
+	if j.ETag != "" && j.ETag == meta.ETag {
+		return true
+	}
+	return j.LastModified != "" && j.LastModified == meta.LastModified
+}
+
+// 检查远程文件与日志记录是否一致，不一致时不能续传
+func (j *ChunkJournal) Matches(meta *RemoteFileMeta) error {
+	if j.ContentLength != meta.ContentLength {
+		return fmt.Errorf("远程文件大小已变化（%d -> %d）", j.ContentLength, meta.ContentLength)
+	}
+	if j.ETag != "" && meta.ETag != "" && j.ETag != meta.ETag {
+		return fmt.Errorf("远程文件 ETag 已变化（%s -> %s）", j.ETag, meta.ETag)
+	}
+	if j.ETag == "" && j.LastModified != "" && meta.LastModified != "" && j.LastModified != meta.LastModified {
+		return fmt.Errorf("远程文件修改时间已变化（%s -> %s）", j.LastModified, meta.LastModified)
+	}
+	return nil
+}
+
+// 返回尚未完成的分块下标
+func (j *ChunkJournal) Pending() []int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var pending []int
+	for i, c := range j.Chunks {
+		if !c.Done {
+			pending = append(pending, i)
+		}
+	}
+	return pending
+}
+
+func (j *ChunkJournal) MarkDone(idx int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Chunks[idx].Done = true
+	return j.save()
+}
+
+// 将分块 [done_until, End] 的剩余范围拆成 parts 份，[Start, done_until) 视为已完成
+// 返回拆分后待下载的分块下标
+func (j *ChunkJournal) Split(idx int, done_until int64, parts int) ([]int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	c := j.Chunks[idx]
+	remaining := c.End - done_until + 1
+	if parts < 1 {
+		parts = 1
+	}
+	part_size := remaining / int64(parts)
+	var indexes []int
+	start := done_until
+	for i := 0; i < parts; i++ {
+		end := start + part_size - 1
+		if i == parts-1 {
+			end = c.End
+		}
+		next := JournalChunk{Start: start, End: end}
+		if i == 0 && done_until == c.Start {
+			// 没有已完成的部分，直接复用原来的下标
+			j.Chunks[idx] = next
+			indexes = append(indexes, idx)
+		} else {
+			j.Chunks = append(j.Chunks, next)
+			indexes = append(indexes, len(j.Chunks)-1)
+		}
+		start = end + 1
+	}
+	if done_until > c.Start {
+		j.Chunks[idx] = JournalChunk{Start: c.Start, End: done_until - 1, Done: true}
+	}
+	return indexes, j.save()
+}
+
+func (j *ChunkJournal) Chunk(idx int) JournalChunk {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Chunks[idx]
+}
+
+func (j *ChunkJournal) Save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.save()
+}
+
+// 先写临时文件再重命名，避免进程中断时日志损坏
+func (j *ChunkJournal) save() error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := j.filepath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("写入续传记录失败 %v", err.Error())
+	}
+	if err := os.Rename(tmp, j.filepath); err != nil {
+		return fmt.Errorf("写入续传记录失败 %v", err.Error())
+	}
+	return nil
+}
+
+func (j *ChunkJournal) Remove() error {
+	if err := os.Remove(j.filepath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
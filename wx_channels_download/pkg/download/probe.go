@@ -0,0 +1,134 @@
+package download
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 服务器不支持 Range 请求，只能单线程下载
+var ErrRangeNotSupported = errors.New("服务器不支持并发下载")
+
+type DownloadMode string
+
+const (
+	DownloadModeMultiThreading  DownloadMode = "multi"
+	DownloadModeSingleThreading DownloadMode = "single"
+)
+
+func (m DownloadMode) String() string {
+	if m == DownloadModeMultiThreading {
+		return "多线程下载"
+	}
+	return "单线程下载"
+}
+
+// 探测时读取的文件开头字节数，可用于校验文件格式
+const probeHeadSize = 16
+
+// 用 Range: bytes=0-15 的 GET 请求探测文件信息，部分 CDN 会拒绝 HEAD 请求
+func ProbeRemoteFile(url string) (*RemoteFileMeta, error) {
+	return probe_remote_file(context.Background(), url)
+}
+
+func probe_remote_file(ctx context.Context, url string) (*RemoteFileMeta, error) {
+	tr := &http.Transport{
+		TLSNextProto: make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
+	}
+	client := &http.Client{Transport: tr, Timeout: 30 * time.Second}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", probeHeadSize-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("获取文件信息失败 %v", err.Error())
+	}
+	defer resp.Body.Close()
+	// 不读取 200 响应的完整内容，只保留开头的几个字节
+	head, _ := io.ReadAll(io.LimitReader(resp.Body, probeHeadSize))
+
+	meta := &RemoteFileMeta{
+		Head:          head,
+		ContentLength: -1,
+		ETag:          resp.Header.Get("ETag"),
+		LastModified:  resp.Header.Get("Last-Modified"),
+		Source:        MediaKey(url),
+		Header:        resp.Header,
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		total, ok := parse_content_range_total(resp.Header.Get("Content-Range"))
+		if !ok {
+			return meta, ErrRangeNotSupported
+		}
+		meta.ContentLength = total
+		return meta, nil
+	case http.StatusOK:
+		if v, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+			meta.ContentLength = v
+		}
+		return meta, ErrRangeNotSupported
+	}
+	return nil, &StatusError{StatusCode: resp.StatusCode}
+}
+
+// 同一个视频的地址中 encfilekey 相同，token 和规格可以不同，没有时使用地址的路径
+func MediaKey(video_url string) string {
+	u, err := url.Parse(video_url)
+	if err != nil {
+		return ""
+	}
+	if key := u.Query().Get("encfilekey"); key != "" {
+		return key
+	}
+	return u.Host + u.Path
+}
+
+// 解析 Content-Range: bytes 0-15/12345 中的总大小
+func parse_content_range_total(content_range string) (int64, bool) {
+	idx := strings.LastIndex(content_range, "/")
+	if idx < 0 {
+		return 0, false
+	}
+	total, err := strconv.ParseInt(strings.TrimSpace(content_range[idx+1:]), 10, 64)
+	if err != nil || total <= 0 {
+		return 0, false
+	}
+	return total, true
+}
+
+// 优先多线程下载，服务器不支持 Range 时退回单线程下载，返回实际使用的下载方式
+func Download(url string, dest_filepath string, opts MultiThreadingDownloadOptions, on_progress func(progress *PartialFileDownloadProgress)) (DownloadMode, error) {
+	ctx := opts.context()
+	meta, err := probe_remote_file(ctx, url)
+	if err != nil && !errors.Is(err, ErrRangeNotSupported) {
+		return DownloadModeMultiThreading, err
+	}
+	if opts.OnProbe != nil {
+		if err := opts.OnProbe(meta); err != nil {
+			return DownloadModeMultiThreading, err
+		}
+	}
+	if err == nil {
+		err = multi_threading_download(url, dest_filepath, meta, opts)
+		// 探测时支持 Range，下载时 CDN 又返回了完整文件，重试没有意义
+		if !errors.Is(err, ErrRangeIgnored) {
+			return DownloadModeMultiThreading, err
+		}
+		os.Remove(JournalFilepath(dest_filepath))
+	}
+	if on_progress == nil {
+		on_progress = func(progress *PartialFileDownloadProgress) {}
+	}
+	return DownloadModeSingleThreading, single_threading_download(ctx, url, dest_filepath, opts.Transform, opts.Retry.withDefaults().IdleTimeout, on_progress)
+}
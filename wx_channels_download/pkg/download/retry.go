@@ -0,0 +1,179 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 单个分块的重试策略
+type RetryPolicy struct {
+	// 每个分块最多尝试的次数（包含第一次）
+	MaxAttempts int
+	// 第一次重试前的等待时间，之后每次翻倍
+	BaseDelay time.Duration
+	// 单次等待时间上限
+	MaxDelay time.Duration
+	// 重试耗尽后，剩余范围最多再拆分几次交给空闲线程
+	MaxSplits int
+	// 超过该时间没有收到数据时中断请求并重试
+	IdleTimeout time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+	MaxSplits:   2,
+	IdleTimeout: 30 * time.Second,
+}
+
+// 拆分后每个分块的最小大小，太小的范围拆分没有意义
+const minSplitChunkSize = 512 * 1024
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = DefaultRetryPolicy.BaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+	if p.MaxSplits < 0 {
+		p.MaxSplits = 0
+	}
+	if p.IdleTimeout <= 0 {
+		p.IdleTimeout = DefaultRetryPolicy.IdleTimeout
+	}
+	return p
+}
+
+// 指数退避，并在 [delay/2, delay] 之间随机抖动，避免所有线程同时重试
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// 服务器返回了非预期的状态码
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("服务器返回错误状态码: %d", e.StatusCode)
+}
+
+// 服务器对 Range 请求返回了 200，重试也不会返回指定的范围，只能单线程下载
+var ErrRangeIgnored = errors.New("服务器忽略了 Range 请求")
+
+// 一段时间内没有收到数据
+var ErrIdleTimeout = errors.New("下载超时，长时间没有收到数据")
+
+// 4xx 通常是链接失效或参数错误，重试没有意义
+func is_retryable(err error) bool {
+	if errors.Is(err, ErrRangeIgnored) {
+		return false
+	}
+	if se, ok := err.(*StatusError); ok {
+		if se.StatusCode == http.StatusRequestTimeout || se.StatusCode == http.StatusTooManyRequests {
+			return true
+		}
+		return se.StatusCode >= 500
+	}
+	return true
+}
+
+// 某个字节范围最终下载失败的原因
+type RangeError struct {
+	Start    int64
+	End      int64
+	Attempts int
+	Err      error
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("bytes=%d-%d 尝试 %d 次后失败: %v", e.Start, e.End, e.Attempts, e.Err)
+}
+
+func (e *RangeError) Unwrap() error {
+	return e.Err
+}
+
+type DownloadError struct {
+	Ranges []*RangeError
+}
+
+func (e *DownloadError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Ranges))
+	for _, r := range e.Ranges {
+		errs = append(errs, r)
+	}
+	return errs
+}
+
+func (e *DownloadError) Error() string {
+	lines := []string{fmt.Sprintf("下载失败，共%v个范围未完成", len(e.Ranges))}
+	for _, r := range e.Ranges {
+		lines = append(lines, "  "+r.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 每次读到数据后重新计时，超时后取消请求，阻塞中的 Read 会立即返回
+type idle_timeout_reader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+// 在发送请求前创建，等待响应头的时间也计入超时
+func new_idle_timeout_reader(timeout time.Duration, cancel context.CancelFunc) *idle_timeout_reader {
+	ir := &idle_timeout_reader{timeout: timeout}
+	ir.timer = time.AfterFunc(timeout, func() {
+		ir.expired.Store(true)
+		cancel()
+	})
+	return ir
+}
+
+func (ir *idle_timeout_reader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if ir.expired.Load() {
+		return n, ErrIdleTimeout
+	}
+	if n > 0 {
+		ir.timer.Reset(ir.timeout)
+	}
+	return n, err
+}
+
+// 请求失败时区分是否因为超时被取消
+func (ir *idle_timeout_reader) wrap(err error) error {
+	if ir.expired.Load() {
+		return ErrIdleTimeout
+	}
+	return err
+}
+
+func (ir *idle_timeout_reader) stop() {
+	ir.timer.Stop()
+}
@@ -0,0 +1,157 @@
+package flv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	TagAudio  uint8 = 8
+	TagVideo  uint8 = 9
+	TagScript uint8 = 18
+)
+
+const (
+	headerSize    = 9
+	tagHeaderSize = 11
+	// 单个 tag 数据的最大长度，超过时认为数据已损坏
+	maxTagDataSize = 1<<24 - 1
+)
+
+var ErrInvalidHeader = errors.New("不是有效的 FLV 文件")
+
+type Header struct {
+	HasAudio bool
+	HasVideo bool
+}
+
+type Tag struct {
+	Type      uint8
+	Timestamp uint32 // 毫秒
+	StreamID  uint32
+	Data      []byte
+}
+
+// 视频帧是否为关键帧
+func (t *Tag) IsKeyframe() bool {
+	return t.Type == TagVideo && len(t.Data) > 0 && t.Data[0]>>4 == 1
+}
+
+// 是否为 AVC 或 AAC 的 sequence header，解码器需要先拿到它才能解码后面的数据
+func (t *Tag) IsSequenceHeader() bool {
+	if len(t.Data) < 2 {
+		return false
+	}
+	switch t.Type {
+	case TagVideo:
+		return t.Data[0]&0x0f == 7 && t.Data[1] == 0
+	case TagAudio:
+		return t.Data[0]>>4 == 10 && t.Data[1] == 0
+	}
+	return false
+}
+
+type Reader struct {
+	r      io.Reader
+	Header Header
+	buf    [tagHeaderSize]byte
+}
+
+// 读取并校验 FLV 文件头
+func NewReader(r io.Reader) (*Reader, error) {
+	head := make([]byte, headerSize+4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if string(head[0:3]) != "FLV" {
+		return nil, ErrInvalidHeader
+	}
+	offset := binary.BigEndian.Uint32(head[5:9])
+	if offset < headerSize {
+		return nil, ErrInvalidHeader
+	}
+	// 文件头可能比 9 字节长，跳过多余的部分
+	if extra := int64(offset) - headerSize; extra > 0 {
+		if _, err := io.CopyN(io.Discard, r, extra); err != nil {
+			return nil, err
+		}
+	}
+	return &Reader{
+		r: r,
+		Header: Header{
+			HasAudio: head[4]&0x04 != 0,
+			HasVideo: head[4]&0x01 != 0,
+		},
+	}, nil
+}
+
+// 读取下一个 tag，读完时返回 io.EOF
+func (r *Reader) ReadTag() (*Tag, error) {
+	if _, err := io.ReadFull(r.r, r.buf[:]); err != nil {
+		return nil, err
+	}
+	b := r.buf[:]
+	size := uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	if size > maxTagDataSize {
+		return nil, fmt.Errorf("tag 长度异常 %d", size)
+	}
+	tag := &Tag{
+		Type:      b[0] & 0x1f,
+		Timestamp: uint32(b[7])<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6]),
+		StreamID:  uint32(b[8])<<16 | uint32(b[9])<<8 | uint32(b[10]),
+		Data:      make([]byte, size),
+	}
+	if _, err := io.ReadFull(r.r, tag.Data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	// PreviousTagSize，不需要校验
+	var prev [4]byte
+	if _, err := io.ReadFull(r.r, prev[:]); err != nil && err != io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return tag, nil
+}
+
+type Writer struct {
+	w   io.Writer
+	buf [tagHeaderSize]byte
+}
+
+// 写入 FLV 文件头
+func NewWriter(w io.Writer, header Header) (*Writer, error) {
+	head := []byte{'F', 'L', 'V', 1, 0, 0, 0, 0, headerSize, 0, 0, 0, 0}
+	if header.HasAudio {
+		head[4] |= 0x04
+	}
+	if header.HasVideo {
+		head[4] |= 0x01
+	}
+	if _, err := w.Write(head); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+func (w *Writer) WriteTag(tag *Tag) error {
+	size := len(tag.Data)
+	if size > maxTagDataSize {
+		return fmt.Errorf("tag 长度异常 %d", size)
+	}
+	b := w.buf[:]
+	b[0] = tag.Type
+	b[1], b[2], b[3] = byte(size>>16), byte(size>>8), byte(size)
+	b[4], b[5], b[6], b[7] = byte(tag.Timestamp>>16), byte(tag.Timestamp>>8), byte(tag.Timestamp), byte(tag.Timestamp>>24)
+	b[8], b[9], b[10] = byte(tag.StreamID>>16), byte(tag.StreamID>>8), byte(tag.StreamID)
+	if _, err := w.w.Write(b); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(tag.Data); err != nil {
+		return err
+	}
+	var prev [4]byte
+	binary.BigEndian.PutUint32(prev[:], uint32(tagHeaderSize+size))
+	_, err := w.w.Write(prev[:])
+	return err
+}
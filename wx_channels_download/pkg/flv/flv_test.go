@@ -0,0 +1,87 @@
+package flv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReadWriteTags(t *testing.T) {
+	tags := []*Tag{
+		{Type: TagScript, Data: []byte{2, 0, 10}},
+		{Type: TagVideo, Timestamp: 0, Data: []byte{0x17, 0, 0, 0, 0, 1}},
+		{Type: TagAudio, Timestamp: 23, Data: []byte{0xaf, 0, 0x12, 0x10}},
+		{Type: TagVideo, Timestamp: 40, Data: []byte{0x27, 1, 0, 0, 40, 0xaa}},
+		// 超过 24 位的时间戳使用扩展字节
+		{Type: TagVideo, Timestamp: 0x01234567, StreamID: 0, Data: []byte{0x17, 1, 0, 0, 0, 0xbb}},
+	}
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, Header{HasAudio: true, HasVideo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range tags {
+		if err := w.WriteTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 录制中断时最后一个 tag 不完整
+	buf.Write([]byte{9, 0, 0, 100, 0, 0, 0, 0, 0, 0, 0, 1, 2})
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Header.HasAudio || !r.Header.HasVideo {
+		t.Fatalf("文件头为 %+v", r.Header)
+	}
+	for i, want := range tags {
+		got, err := r.ReadTag()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != want.Type || got.Timestamp != want.Timestamp || !bytes.Equal(got.Data, want.Data) {
+			t.Fatalf("第 %d 个 tag 为 %+v，期望 %+v", i, got, want)
+		}
+	}
+	if _, err := r.ReadTag(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("不完整的 tag 返回 %v", err)
+	}
+
+	sequence := []struct {
+		tag      *Tag
+		keyframe bool
+		header   bool
+	}{
+		{tags[1], true, true},
+		{tags[2], false, true},
+		{tags[3], false, false},
+		{tags[4], true, false},
+	}
+	for i, c := range sequence {
+		if c.tag.IsKeyframe() != c.keyframe || c.tag.IsSequenceHeader() != c.header {
+			t.Fatalf("第 %d 个 tag 的关键帧、sequence header 判断错误", i)
+		}
+	}
+}
+
+func TestInvalidHeader(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte("MP4\x01\x05\x00\x00\x00\x09\x00\x00\x00\x00"))); !errors.Is(err, ErrInvalidHeader) {
+		t.Fatalf("不是 FLV 时返回 %v", err)
+	}
+	// 文件头比 9 字节长时跳过多余的部分
+	data := []byte("FLV\x01\x05\x00\x00\x00\x0d\x00\x00\x00\x00\xff\xff\xff\xff")
+	data = append(data, 8, 0, 0, 1, 0, 0, 5, 0, 0, 0, 0, 0xaf, 0, 0, 0, 12)
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := r.ReadTag()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Type != TagAudio || tag.Timestamp != 5 || !bytes.Equal(tag.Data, []byte{0xaf}) {
+		t.Fatalf("tag 为 %+v", tag)
+	}
+}
@@ -0,0 +1,196 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	EventQueued      = "queued"
+	EventProgress    = "progress"
+	EventDecrypting  = "decrypting"
+	EventTranscoding = "transcoding"
+	EventDone        = "done"
+	EventFailed      = "failed"
+
+	StageDownloading = "downloading"
+	StageDecrypting  = "decrypting"
+	StageTranscoding = "transcoding"
+
+	// 每个订阅者缓存的事件数，页面处理不过来时丢弃进度事件
+	eventBufferSize = 64
+	// 没有事件时定时发送注释，避免连接被当作空闲关闭
+	heartbeatInterval = 15 * time.Second
+)
+
+// 下载任务的状态变化和进度，通过 SSE 发送给页面
+type Event struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Source   string `json:"source,omitempty"`
+	Stage    string `json:"stage,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Filepath string `json:"filepath,omitempty"`
+	// 已处理的字节数，转码时为已输出的字节数
+	Bytes int64 `json:"bytes"`
+	// 总字节数，未知时为 0
+	Total   int64   `json:"total"`
+	Percent float64 `json:"percent"`
+	// 每秒字节数
+	Speed float64 `json:"speed"`
+	// 预计剩余秒数，未知时为 -1
+	ETA   float64   `json:"eta"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// 将事件广播给所有订阅者，订阅者处理不过来时丢弃事件而不是阻塞下载
+type Events struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+func NewEvents() *Events {
+	return &Events{
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+func (e *Events) Publish(ev Event) {
+	if e == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// 订阅事件，不再需要时调用返回的函数取消订阅
+// 关闭后返回的 channel 会被关闭
+func (e *Events) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	e.mu.Lock()
+	if e.closed {
+		close(ch)
+		e.mu.Unlock()
+		return ch, func() {}
+	}
+	e.subs[ch] = struct{}{}
+	e.mu.Unlock()
+	return ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if _, ok := e.subs[ch]; ok {
+			delete(e.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// 结束所有订阅，SSE 连接随之断开，服务可以正常关闭
+func (e *Events) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	for ch := range e.subs {
+		delete(e.subs, ch)
+		close(ch)
+	}
+}
+
+// 以 SSE 格式持续发送事件，事件名为 Type，数据为 JSON
+func (e *Events) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch, cancel := e.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	// 断开后浏览器 3 秒后重连
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// 根据相邻两次进度计算下载速度和剩余时间
+type Meter struct {
+	last_at    time.Time
+	last_bytes int64
+	speed      float64
+}
+
+// 生成一个进度事件，total 为 0 时不计算百分比和剩余时间
+func (m *Meter) Progress(id, stage string, bytes, total int64) Event {
+	now := time.Now()
+	if !m.last_at.IsZero() {
+		if elapsed := now.Sub(m.last_at).Seconds(); elapsed > 0 {
+			current := float64(bytes-m.last_bytes) / elapsed
+			if current < 0 {
+				current = 0
+			}
+			if m.speed == 0 {
+				m.speed = current
+			} else {
+				// 平滑处理，避免速度跳动太大
+				m.speed = m.speed*0.7 + current*0.3
+			}
+		}
+	}
+	m.last_at = now
+	m.last_bytes = bytes
+	ev := Event{
+		Type:  EventProgress,
+		ID:    id,
+		Stage: stage,
+		Bytes: bytes,
+		Total: total,
+		Speed: m.speed,
+		ETA:   -1,
+		Time:  now,
+	}
+	if total > 0 {
+		ev.Percent = float64(bytes) / float64(total) * 100
+		if m.speed > 0 {
+			ev.ETA = float64(total-bytes) / m.speed
+		}
+	}
+	return ev
+}
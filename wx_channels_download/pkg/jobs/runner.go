@@ -0,0 +1,359 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"wx_channel/pkg/channels"
+	"wx_channel/pkg/decrypt"
+	"wx_channel/pkg/download"
+	"wx_channel/pkg/naming"
+	"wx_channel/pkg/sidecar"
+	"wx_channel/pkg/tags"
+)
+
+type RunnerOptions struct {
+	// 下载目录
+	Dir string
+	// 同时下载的任务数
+	Concurrency int
+	// 每个任务的下载线程数
+	Threads int
+	// 发布任务状态和进度，为空时不发布
+	Events *Events
+	// 下载完成后在视频旁保存的文件
+	Sidecar sidecar.Options
+	// 下载完成后在视频中写入标题、作者和封面
+	EmbedTags bool
+	// 页面没有传文件名时使用的文件名模板
+	FilenameTemplate string
+}
+
+// 依次下载队列中的任务，边下载边解密，直接写入下载目录
+type Runner struct {
+	store *Store
+	opts  RunnerOptions
+	wake  chan struct{}
+	stop  chan struct{}
+	once  sync.Once
+	// 停止时取消正在下载的任务
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+	// 正在使用的文件路径，避免两个任务写入同一个文件
+	mu    sync.Mutex
+	using map[string]bool
+}
+
+func NewRunner(store *Store, opts RunnerOptions) *Runner {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.Threads <= 0 {
+		opts.Threads = 4
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{
+		store:  store,
+		opts:   opts,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+		using:  make(map[string]bool),
+	}
+}
+
+// 启动下载，上次退出时没有完成的任务会继续下载
+func (r *Runner) Start() {
+	for i := 0; i < r.opts.Concurrency; i++ {
+		r.workers.Add(1)
+		go r.work()
+	}
+	r.notify()
+}
+
+// 不再开始新的任务，中断正在下载的任务并等待结束，之后才可以关闭下载记录
+// 中断的任务保留续传记录，下次启动时继续下载
+func (r *Runner) Stop() {
+	r.once.Do(func() {
+		close(r.stop)
+		r.cancel()
+	})
+	r.workers.Wait()
+}
+
+// 加入下载队列
+func (r *Runner) Enqueue(job Job) (*Job, error) {
+	if job.URL == "" {
+		return nil, errors.New("视频地址不能为空")
+	}
+	if job.Filename == "" {
+		job.Filename = r.filename_of(&job)
+	}
+	if job.Filename == "" {
+		return nil, errors.New("文件名不能为空")
+	}
+	job.Source = SourceServer
+	job.Status = StatusPending
+	created, err := r.store.Add(job)
+	if err != nil {
+		return nil, err
+	}
+	r.opts.Events.Publish(Event{
+		Type:     EventQueued,
+		ID:       created.ID,
+		Source:   SourceServer,
+		Filename: created.Filename,
+		ETA:      -1,
+	})
+	r.notify()
+	return created, nil
+}
+
+// 按文件名模板生成，视频信息不完整时使用任务中的标题和视频 ID
+func (r *Runner) filename_of(job *Job) string {
+	var profile channels.Profile
+	if len(job.Profile) > 0 {
+		json.Unmarshal(job.Profile, &profile)
+	}
+	if profile.ID == "" {
+		profile.ID = job.FeedID
+	}
+	if profile.Title == "" {
+		profile.Title = job.Title
+	}
+	return naming.Filename(r.opts.FilenameTemplate, naming.ProfileVars(&profile, job.Format, time.Now()))
+}
+
+func (r *Runner) notify() {
+	// 每个空闲的下载协程被唤醒后会取完队列中的任务，这里不需要阻塞
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Runner) work() {
+	defer r.workers.Done()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.wake:
+		}
+		for {
+			select {
+			case <-r.stop:
+				return
+			default:
+			}
+			job, err := r.store.Claim()
+			if err != nil || job == nil {
+				break
+			}
+			// 还有任务时唤醒其他空闲的协程
+			r.notify()
+			r.run(job)
+		}
+	}
+}
+
+func (r *Runner) run(job *Job) {
+	dest_filepath, resume, err := r.acquire(job)
+	if err != nil {
+		r.fail(job, err)
+		return
+	}
+	defer r.release(dest_filepath)
+	if dest_filepath != job.Filepath {
+		r.store.Update(job.ID, JobUpdate{Filepath: &dest_filepath})
+	}
+	fmt.Printf("开始下载 %s\n", dest_filepath)
+
+	var key uint64
+	if job.Key != "" {
+		key, err = strconv.ParseUint(job.Key, 10, 64)
+		if err != nil {
+			r.fail(job, fmt.Errorf("解密密钥无效 %s", job.Key))
+			return
+		}
+	}
+	var meter Meter
+	var throttle progress_throttle
+	opts := download.MultiThreadingDownloadOptions{
+		Context: r.ctx,
+		Threads: r.opts.Threads,
+		Resume:  resume,
+		Progress: func(progress *download.PartialFileDownloadProgress) {
+			done := progress.TotalSize > 0 && progress.DownloadedSize >= progress.TotalSize
+			throttle.do(done, func() {
+				r.store.Update(job.ID, JobUpdate{Progress: &progress.Percent})
+				ev := meter.Progress(job.ID, StageDownloading, progress.DownloadedSize, progress.TotalSize)
+				ev.Source = SourceServer
+				ev.Filename = job.Filename
+				ev.Filepath = dest_filepath
+				r.opts.Events.Publish(ev)
+			})
+		},
+	}
+	enc_len := decrypt.DefaultEncLen
+	opts.OnProbe = func(meta *download.RemoteFileMeta) error {
+		enc_len = decrypt.ResolveEncLen(0, meta.Header, "")
+		if key != 0 && !job.Force {
+			// 下载前先用文件开头校验密钥，避免下载完才发现解密失败
+			err := decrypt.VerifyKey(meta.Head, key, enc_len)
+			if errors.Is(err, decrypt.ErrAlreadyDecrypted) {
+				// 文件没有加密，原样保存
+				fmt.Printf("%s 没有加密，跳过解密\n", job.Filename)
+				key = 0
+				return nil
+			}
+			return err
+		}
+		if _, ok := decrypt.EncLenFromHeader(meta.Header); ok {
+			// 没有密钥时保留加密区长度，之后用 decrypt 命令解密时读取
+			if err := decrypt.WriteMetadata(dest_filepath, &decrypt.Metadata{EncLen: enc_len}); err != nil {
+				fmt.Printf("[ERROR]写入元数据文件失败 %v\n", err.Error())
+			}
+		}
+		return nil
+	}
+	if key != 0 {
+		opts.Transform = func(reader io.Reader, offset int64) io.Reader {
+			// 校验时发现没有加密会清空 key
+			if key == 0 {
+				return reader
+			}
+			return decrypt.NewReader(reader, key, uint64(offset), enc_len)
+		}
+	}
+	if _, err := download.Download(job.URL, dest_filepath, opts, opts.Progress); err != nil {
+		if r.ctx.Err() != nil {
+			// 程序退出，任务保持下载中，下次启动时重新排队
+			fmt.Printf("下载已中断 %s\n", dest_filepath)
+			return
+		}
+		r.fail(job, err)
+		return
+	}
+	r.post_process(job, dest_filepath)
+	status := StatusCompleted
+	update := JobUpdate{Status: &status}
+	if info, err := os.Stat(dest_filepath); err == nil {
+		size := info.Size()
+		update.Size = &size
+	}
+	r.store.Update(job.ID, update)
+	done := Event{
+		Type:     EventDone,
+		ID:       job.ID,
+		Source:   SourceServer,
+		Filename: job.Filename,
+		Filepath: dest_filepath,
+		Percent:  100,
+	}
+	if update.Size != nil {
+		done.Bytes = *update.Size
+		done.Total = *update.Size
+	}
+	r.opts.Events.Publish(done)
+	fmt.Printf("下载完成 %s\n", dest_filepath)
+}
+
+// 写入标签和保存视频信息，失败时只打印错误，视频已经下载完成
+func (r *Runner) post_process(job *Job, dest_filepath string) {
+	if (!r.opts.EmbedTags && !r.opts.Sidecar.Enabled()) || len(job.Profile) == 0 {
+		return
+	}
+	var profile channels.Profile
+	if err := json.Unmarshal(job.Profile, &profile); err != nil {
+		fmt.Printf("[ERROR]视频信息格式错误 %v\n", err.Error())
+		return
+	}
+	if r.opts.EmbedTags {
+		if err := tags.EmbedDecrypted(dest_filepath, tags.FromProfile(&profile)); err != nil {
+			fmt.Printf("[ERROR]%v\n", err.Error())
+		}
+	}
+	if r.opts.Sidecar.Enabled() {
+		if err := sidecar.Write(dest_filepath, &profile, job.Format, r.opts.Sidecar); err != nil {
+			fmt.Printf("[ERROR]%v\n", err.Error())
+		}
+	}
+}
+
+func (r *Runner) fail(job *Job, err error) {
+	status := StatusFailed
+	message := err.Error()
+	code := ""
+	if errors.Is(err, decrypt.ErrInvalidKey) || errors.Is(err, decrypt.ErrHeadTooShort) {
+		code = ErrorCodeInvalidKey
+	}
+	r.store.Update(job.ID, JobUpdate{Status: &status, Error: &message, ErrorCode: &code})
+	r.opts.Events.Publish(Event{
+		Type:     EventFailed,
+		ID:       job.ID,
+		Source:   SourceServer,
+		Filename: job.Filename,
+		Error:    message,
+		ETA:      -1,
+	})
+	fmt.Printf("[ERROR]下载失败 %s %v\n", job.Filename, message)
+}
+
+// 确定任务的文件路径，之前有未完成的下载时继续下载，否则不覆盖已存在的文件
+func (r *Runner) acquire(job *Job) (string, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if job.Filepath != "" && !r.using[job.Filepath] {
+		if _, err := os.Stat(download.JournalFilepath(job.Filepath)); err == nil {
+			r.using[job.Filepath] = true
+			return job.Filepath, true, nil
+		}
+	}
+	if err := os.MkdirAll(r.opts.Dir, 0755); err != nil {
+		return "", false, fmt.Errorf("创建下载目录失败 %v", err.Error())
+	}
+	name := strings.TrimSuffix(job.Filename, ".mp4")
+	p := naming.Unique(r.opts.Dir, name, ".mp4", func(p string) bool {
+		return r.using[p]
+	})
+	r.using[p] = true
+	return p, false, nil
+}
+
+func (r *Runner) release(p string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.using, p)
+}
+
+// 保存和发布进度的最小间隔，单线程下载时每读取 32KB 就会回调一次
+const progressInterval = 500 * time.Millisecond
+
+// 限制进度回调的频率，避免频繁写入下载记录和发送事件，完成时总是执行
+type progress_throttle struct {
+	mu      sync.Mutex
+	last_at time.Time
+}
+
+func (t *progress_throttle) do(done bool, fn func()) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if !done && now.Sub(t.last_at) < progressInterval {
+		return false
+	}
+	t.last_at = now
+	fn()
+	return true
+}
@@ -0,0 +1,252 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"wx_channel/pkg/decrypt"
+	"wx_channel/pkg/download"
+)
+
+func TestProgressThrottle(t *testing.T) {
+	var throttle progress_throttle
+	calls := 0
+	for i := 0; i < 1000; i++ {
+		throttle.do(false, func() { calls++ })
+	}
+	if calls != 1 {
+		t.Fatalf("连续回调执行了 %d 次，期望 1 次", calls)
+	}
+	// 完成时不受间隔限制
+	if !throttle.do(true, func() { calls++ }) || calls != 2 {
+		t.Fatal("完成时的进度没有执行")
+	}
+	throttle.last_at = time.Now().Add(-progressInterval)
+	if !throttle.do(false, func() { calls++ }) || calls != 3 {
+		t.Fatal("超过间隔后的进度没有执行")
+	}
+}
+
+const (
+	testKey    uint64 = 123456789
+	testEncLen uint32 = 4096
+)
+
+// 以 ftyp box 开头的视频内容
+func test_video(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	binary.BigEndian.PutUint32(data[0:4], 32)
+	copy(data[4:8], "ftyp")
+	return data
+}
+
+func encrypt(data []byte, key uint64) []byte {
+	encrypted := bytes.Clone(data)
+	decrypt.XORKeyStreamAt(encrypted, 0, key, testEncLen)
+	return encrypted
+}
+
+// 支持 Range 的视频服务器，stall 为 true 时除探测外的请求只返回响应头，直到请求被取消
+func new_video_server(t *testing.T, data []byte, stall bool) (*httptest.Server, *atomic.Int32) {
+	var stalled atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end int64 = 0, int64(len(data)) - 1
+		if spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			s, e, _ := strings.Cut(spec, "-")
+			start, _ = strconv.ParseInt(s, 10, 64)
+			if v, err := strconv.ParseInt(e, 10, 64); err == nil && v < end {
+				end = v
+			}
+		}
+		w.Header().Set(decrypt.EncLenHeader, strconv.FormatUint(uint64(testEncLen), 10))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if stall && end-start+1 > 16 {
+			stalled.Add(1)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		w.Write(data[start : end+1])
+	}))
+	t.Cleanup(server.Close)
+	return server, &stalled
+}
+
+func new_test_runner(t *testing.T) (*Runner, *Store, string) {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := Open(filepath.Join(dir, "jobs.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := NewRunner(store, RunnerOptions{Dir: filepath.Join(dir, "Downloads"), Threads: 2})
+	runner.Start()
+	t.Cleanup(func() {
+		runner.Stop()
+		store.Close()
+	})
+	return runner, store, dir
+}
+
+// 等待任务结束
+func wait_job(t *testing.T, store *Store, id string) *Job {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if job := store.Get(id); job != nil && !job.Active() {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("任务没有结束")
+	return nil
+}
+
+func TestRunnerVerifyKey(t *testing.T) {
+	plain := test_video(64 * 1024)
+	cases := []struct {
+		name   string
+		served []byte
+		key    uint64
+		want   []byte // 为 nil 时期望失败
+	}{
+		{"密钥正确", encrypt(plain, testKey), testKey, plain},
+		{"没有加密", plain, testKey, plain},
+		{"没有密钥", encrypt(plain, testKey), 0, encrypt(plain, testKey)},
+		{"密钥错误", encrypt(plain, testKey), testKey + 1, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server, _ := new_video_server(t, c.served, false)
+			runner, store, _ := new_test_runner(t)
+			job := Job{FeedID: "feed", URL: server.URL, Filename: "视频"}
+			if c.key != 0 {
+				job.Key = strconv.FormatUint(c.key, 10)
+			}
+			created, err := runner.Enqueue(job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := wait_job(t, store, created.ID)
+			if c.want == nil {
+				if done.Status != StatusFailed || done.ErrorCode != ErrorCodeInvalidKey {
+					t.Fatalf("密钥错误时任务为 %s %q，期望失败并标记 %s", done.Status, done.ErrorCode, ErrorCodeInvalidKey)
+				}
+				return
+			}
+			if done.Status != StatusCompleted {
+				t.Fatalf("任务失败 %s", done.Error)
+			}
+			got, err := os.ReadFile(done.Filepath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, c.want) {
+				t.Fatal("下载的文件内容不正确")
+			}
+		})
+	}
+}
+
+func TestRunnerForceAfterInvalidKey(t *testing.T) {
+	plain := test_video(64 * 1024)
+	encrypted := encrypt(plain, testKey)
+	server, _ := new_video_server(t, encrypted, false)
+	runner, store, _ := new_test_runner(t)
+	job := Job{FeedID: "feed", URL: server.URL, Filename: "视频", Key: strconv.FormatUint(testKey+1, 10)}
+	created, err := runner.Enqueue(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := wait_job(t, store, created.ID); failed.ErrorCode != ErrorCodeInvalidKey {
+		t.Fatalf("密钥错误时任务为 %s %q", failed.Status, failed.ErrorCode)
+	}
+	// 页面确认后跳过校验重新下载，沿用之前的任务
+	job.Force = true
+	retried, err := runner.Enqueue(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.ID != created.ID || retried.ErrorCode != "" {
+		t.Fatalf("重新下载时任务为 %s %q", retried.ID, retried.ErrorCode)
+	}
+	done := wait_job(t, store, created.ID)
+	if done.Status != StatusCompleted {
+		t.Fatalf("跳过校验后任务失败 %s", done.Error)
+	}
+	got, err := os.ReadFile(done.Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Clone(encrypted)
+	decrypt.XORKeyStreamAt(want, 0, testKey+1, testEncLen)
+	if !bytes.Equal(got, want) {
+		t.Fatal("跳过校验后没有用指定的密钥解密")
+	}
+}
+
+func TestRunnerStopCancelsDownloads(t *testing.T) {
+	server, stalled := new_video_server(t, test_video(2*1024*1024), true)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "jobs.jsonl")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := NewRunner(store, RunnerOptions{Dir: filepath.Join(dir, "Downloads"), Threads: 2})
+	runner.Start()
+	created, err := runner.Enqueue(Job{FeedID: "feed", URL: server.URL, Filename: "视频"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for stalled.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("没有开始下载")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		runner.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop 没有中断正在下载的任务")
+	}
+	// Stop 返回后不会再写入下载记录
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	job := store.Get(created.ID)
+	if job.Status != StatusDownloading {
+		t.Fatalf("中断的任务状态为 %s %s，期望保持下载中", job.Status, job.Error)
+	}
+	if _, err := os.Stat(download.JournalFilepath(job.Filepath)); err != nil {
+		t.Fatalf("中断后续传记录被删除 %v", err)
+	}
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if job := reopened.Get(created.ID); job.Status != StatusPending {
+		t.Fatalf("重新启动后任务状态为 %s，期望重新排队", job.Status)
+	}
+}
@@ -0,0 +1,380 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"wx_channel/pkg/jsonlog"
+)
+
+const (
+	StatusPending     = "pending"
+	StatusDownloading = "downloading"
+	StatusCompleted   = "completed"
+	StatusFailed      = "failed"
+)
+
+const (
+	SourcePage   = "page"   // 页面中下载
+	SourceServer = "server" // 本程序下载
+)
+
+var (
+	ErrJobNotFound = errors.New("下载任务不存在")
+	ErrJobActive   = errors.New("该视频正在下载中")
+)
+
+// 失败原因，页面根据它决定如何重试
+const (
+	// 密钥校验失败，可以加上 force 重新下载
+	ErrorCodeInvalidKey = "invalid_key"
+)
+
+type Job struct {
+	ID       string          `json:"id"`
+	Source   string          `json:"source"`
+	FeedID   string          `json:"feed_id"`
+	Title    string          `json:"title"`
+	Nickname string          `json:"nickname"`
+	CoverURL string          `json:"cover_url"`
+	URL      string          `json:"url"`
+	Key      string          `json:"key"`
+	Spec     json.RawMessage `json:"spec,omitempty"` // 页面中的规格信息，为空时表示原始视频
+	Format   string          `json:"format"`         // 规格名称，如 xWT111，原始视频为 original
+	Filename string          `json:"filename"`
+	Filepath string          `json:"filepath"`
+	Size     int64           `json:"size"`
+	Status   string          `json:"status"`
+	Progress float64         `json:"progress"` // 下载进度百分比，只保存在内存中
+	Error    string          `json:"error,omitempty"`
+	// 失败原因，见 ErrorCode 开头的常量
+	ErrorCode string `json:"error_code,omitempty"`
+	// 不校验密钥，直接用密钥解密，用于密钥校验失败后重新下载
+	Force bool `json:"force,omitempty"`
+	// 页面发送的完整视频信息
+	Profile     json.RawMessage `json:"profile,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+}
+
+func (j *Job) Active() bool {
+	return j.Status == StatusPending || j.Status == StatusDownloading
+}
+
+// 更新任务时只修改不为 nil 的字段
+type JobUpdate struct {
+	Status    *string  `json:"status"`
+	Progress  *float64 `json:"progress"`
+	Error     *string  `json:"error"`
+	ErrorCode *string  `json:"error_code"`
+	Filename  *string  `json:"filename"`
+	Filepath  *string  `json:"filepath"`
+	Size      *int64   `json:"size"`
+}
+
+type ListOptions struct {
+	Status string
+	Limit  int
+}
+
+// 文件中的一行，put 写入完整的任务，del 删除任务
+type record struct {
+	Op  string `json:"op"`
+	Job *Job   `json:"job,omitempty"`
+	ID  string `json:"id,omitempty"`
+}
+
+// 下载任务和历史记录，保存在本地文件中
+// 文件每行是一条 JSON 记录，修改时追加写入，读取时按顺序重放
+type Store struct {
+	mu   sync.Mutex
+	log  *jsonlog.Log[record]
+	jobs map[string]*Job
+	seq  uint64
+}
+
+// 打开下载记录文件，不存在时创建
+// 上次退出时页面中还在下载的任务标记为失败，本程序下载的任务重新排队
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("创建下载记录目录失败 %v", err.Error())
+	}
+	jobs, err := replay(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{jobs: jobs}
+	now := time.Now()
+	for _, job := range jobs {
+		if job.Status != StatusDownloading {
+			continue
+		}
+		if job.Source == SourceServer {
+			job.Status = StatusPending
+		} else {
+			job.Status = StatusFailed
+			job.Error = "下载中断"
+		}
+		job.UpdatedAt = now
+	}
+	// 启动时重写一次文件，去掉已经删除和被覆盖的记录
+	s.log, err = jsonlog.Open(path, "下载记录", ".tmp_wx_jobs_*", s.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 只读取下载记录，不修改文件，用于命令行查看
+func Load(path string, opts ListOptions) ([]Job, error) {
+	jobs, err := replay(path)
+	if err != nil {
+		return nil, err
+	}
+	return list(jobs, opts), nil
+}
+
+func replay(path string) (map[string]*Job, error) {
+	jobs := make(map[string]*Job)
+	err := jsonlog.Replay(path, "下载记录", func(r *record) {
+		switch r.Op {
+		case "put":
+			if r.Job != nil && r.Job.ID != "" {
+				jobs[r.Job.ID] = r.Job
+			}
+		case "del":
+			delete(jobs, r.ID)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// 新增下载任务，相同视频和规格的任务已存在时重新开始该任务
+func (s *Store) Add(job Job) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if job.Format == "" {
+		job.Format = "original"
+	}
+	if job.Status == "" {
+		job.Status = StatusDownloading
+	}
+	if job.FeedID != "" {
+		for id, existing := range s.jobs {
+			if existing.FeedID == job.FeedID && existing.Format == job.Format && existing.Source == job.Source {
+				if existing.Active() {
+					return nil, ErrJobActive
+				}
+				delete(s.jobs, id)
+				// 重新下载时沿用之前的文件，可以继续未完成的下载
+				if job.Filepath == "" {
+					job.Filepath = existing.Filepath
+				}
+				if job.ID == "" {
+					job.ID = id
+				}
+				if job.ID != id {
+					if err := s.append(record{Op: "del", ID: id}); err != nil {
+						return nil, err
+					}
+				}
+				break
+			}
+		}
+	}
+	if job.ID == "" {
+		s.seq++
+		job.ID = strconv.FormatInt(now.UnixMilli(), 36) + strconv.FormatUint(s.seq, 36)
+	}
+	job.Progress = 0
+	job.Error = ""
+	job.ErrorCode = ""
+	job.CompletedAt = nil
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	s.jobs[job.ID] = &job
+	if err := s.append(record{Op: "put", Job: &job}); err != nil {
+		return nil, err
+	}
+	copied := job
+	return &copied, nil
+}
+
+// 更新任务状态，只有进度变化时不写入文件
+func (s *Store) Update(id string, update JobUpdate) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	changed := false
+	if update.Status != nil && *update.Status != job.Status {
+		job.Status = *update.Status
+		switch job.Status {
+		case StatusCompleted:
+			now := time.Now()
+			job.CompletedAt = &now
+			job.Progress = 100
+			job.Error = ""
+			job.ErrorCode = ""
+		case StatusFailed:
+			job.Progress = 0
+		}
+		changed = true
+	}
+	if update.Error != nil && *update.Error != job.Error {
+		job.Error = *update.Error
+		changed = true
+	}
+	if update.ErrorCode != nil && *update.ErrorCode != job.ErrorCode {
+		job.ErrorCode = *update.ErrorCode
+		changed = true
+	}
+	if update.Filename != nil && *update.Filename != job.Filename {
+		job.Filename = *update.Filename
+		changed = true
+	}
+	if update.Filepath != nil && *update.Filepath != job.Filepath {
+		job.Filepath = *update.Filepath
+		changed = true
+	}
+	if update.Size != nil && *update.Size != job.Size {
+		job.Size = *update.Size
+		changed = true
+	}
+	if update.Progress != nil && job.Status == StatusDownloading {
+		job.Progress = min(100, max(0, *update.Progress))
+	}
+	if changed {
+		job.UpdatedAt = time.Now()
+		if err := s.append(record{Op: "put", Job: job}); err != nil {
+			return nil, err
+		}
+	}
+	copied := *job
+	return &copied, nil
+}
+
+// 取出最早加入队列的任务并标记为下载中，没有时返回 nil
+func (s *Store) Claim() (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next *Job
+	for _, job := range s.jobs {
+		if job.Source != SourceServer || job.Status != StatusPending {
+			continue
+		}
+		if next == nil || job.CreatedAt.Before(next.CreatedAt) {
+			next = job
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	next.Status = StatusDownloading
+	next.Progress = 0
+	next.UpdatedAt = time.Now()
+	if err := s.append(record{Op: "put", Job: next}); err != nil {
+		return nil, err
+	}
+	copied := *next
+	return &copied, nil
+}
+
+func (s *Store) Get(id string) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil
+	}
+	copied := *job
+	return &copied
+}
+
+// 按创建时间倒序返回任务
+func (s *Store) List(opts ListOptions) []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return list(s.jobs, opts)
+}
+
+func list(jobs map[string]*Job, opts ListOptions) []Job {
+	result := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		if opts.Status != "" && job.Status != opts.Status {
+			continue
+		}
+		result = append(result, *job)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].ID > result[j].ID
+		}
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	if opts.Limit > 0 && len(result) > opts.Limit {
+		result = result[:opts.Limit]
+	}
+	return result
+}
+
+func (s *Store) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[id]; !ok {
+		return ErrJobNotFound
+	}
+	delete(s.jobs, id)
+	return s.append(record{Op: "del", ID: id})
+}
+
+// 清空已结束的任务，正在下载的任务保留
+func (s *Store) Clear() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for id, job := range s.jobs {
+		if job.Active() {
+			continue
+		}
+		delete(s.jobs, id)
+		removed++
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.log.Compact()
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+func (s *Store) append(r record) error {
+	return s.log.Append(r, len(s.jobs))
+}
+
+// 重写文件时只写入当前的任务
+func (s *Store) snapshot() []record {
+	records := make([]record, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		records = append(records, record{Op: "put", Job: job})
+	}
+	return records
+}
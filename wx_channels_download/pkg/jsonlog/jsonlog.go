@@ -0,0 +1,135 @@
+package jsonlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// 日志行数超过该值，并且大部分是旧记录时重写文件
+const compactThreshold = 500
+
+// 每行一条 JSON 记录的日志文件，修改时追加写入，读取时按顺序重放
+// 行数过多时把当前的所有记录写入临时文件再替换原文件
+// 不是并发安全的，由使用方加锁
+type Log[R any] struct {
+	name     string // 用于错误信息，如「下载记录」
+	pattern  string // 重写时临时文件的名称
+	filepath string
+	file     *os.File
+	lines    int
+	snapshot func() []R
+}
+
+// 按顺序读取每一条记录，文件不存在时不返回错误
+func Replay[R any](path string, name string, apply func(r *R)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("读取%v失败 %v", name, err.Error())
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r R
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// 写入中途退出时最后一行可能不完整，忽略即可
+			continue
+		}
+		apply(&r)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("读取%v失败 %v", name, err.Error())
+	}
+	return nil
+}
+
+// 打开日志文件用于追加写入，打开前先重写一次，去掉已经删除和被覆盖的记录
+// snapshot 返回当前的所有记录，重写时调用
+func Open[R any](path string, name string, pattern string, snapshot func() []R) (*Log[R], error) {
+	l := &Log[R]{
+		name:     name,
+		pattern:  pattern,
+		filepath: path,
+		snapshot: snapshot,
+	}
+	if err := l.Compact(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// 追加一条记录，live 是当前有效的记录数，旧记录过多时重写文件
+func (l *Log[R]) Append(r R, live int) error {
+	if l.file == nil {
+		return fmt.Errorf("%v已关闭", l.name)
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("写入%v失败 %v", l.name, err.Error())
+	}
+	l.lines++
+	if l.lines > compactThreshold && l.lines > live*4 {
+		return l.Compact()
+	}
+	return nil
+}
+
+// 把当前所有记录写入临时文件，再替换原文件
+func (l *Log[R]) Compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(l.filepath), l.pattern)
+	if err != nil {
+		return fmt.Errorf("写入%v失败 %v", l.name, err.Error())
+	}
+	tmp_filepath := tmp.Name()
+	defer os.Remove(tmp_filepath)
+	records := l.snapshot()
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			return fmt.Errorf("写入%v失败 %v", l.name, err.Error())
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("写入%v失败 %v", l.name, err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("写入%v失败 %v", l.name, err.Error())
+	}
+	if l.file != nil {
+		// 在 Windows 上需要先关闭文件才能覆盖
+		l.file.Close()
+		l.file = nil
+	}
+	if err := os.Rename(tmp_filepath, l.filepath); err != nil {
+		return fmt.Errorf("写入%v失败 %v", l.name, err.Error())
+	}
+	file, err := os.OpenFile(l.filepath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("打开%v失败 %v", l.name, err.Error())
+	}
+	l.file = file
+	l.lines = len(records)
+	return nil
+}
+
+func (l *Log[R]) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,149 @@
+package jsonlog
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type test_record struct {
+	Op    string `json:"op"`
+	ID    string `json:"id"`
+	Value int    `json:"value,omitempty"`
+}
+
+// 和使用方一样，用 map 保存当前的记录
+type test_store struct {
+	values map[string]int
+	log    *Log[test_record]
+}
+
+func (s *test_store) apply(r *test_record) {
+	switch r.Op {
+	case "put":
+		s.values[r.ID] = r.Value
+	case "del":
+		delete(s.values, r.ID)
+	}
+}
+
+func (s *test_store) snapshot() []test_record {
+	records := make([]test_record, 0, len(s.values))
+	for id, value := range s.values {
+		records = append(records, test_record{Op: "put", ID: id, Value: value})
+	}
+	return records
+}
+
+func (s *test_store) put(t *testing.T, id string, value int) {
+	t.Helper()
+	s.values[id] = value
+	if err := s.log.Append(test_record{Op: "put", ID: id, Value: value}, len(s.values)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func open_store(t *testing.T, path string) *test_store {
+	t.Helper()
+	s := &test_store{values: make(map[string]int)}
+	if err := Replay(path, "测试记录", s.apply); err != nil {
+		t.Fatal(err)
+	}
+	log, err := Open(path, "测试记录", ".tmp_wx_test_*", s.snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.log = log
+	return s
+}
+
+func count_lines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestReplaySkipsBrokenLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.jsonl")
+	data := `{"op":"put","id":"a","value":1}
+not json
+{"op":"put","id":"b","value":2}
+{"op":"del","id":"a"}
+{"op":"put","id":"c","val`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]int)
+	err := Replay(path, "测试记录", func(r *test_record) {
+		switch r.Op {
+		case "put":
+			values[r.ID] = r.Value
+		case "del":
+			delete(values, r.ID)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || values["b"] != 2 {
+		t.Fatalf("重放结果为 %v，期望只有 b", values)
+	}
+}
+
+func TestReplayMissingFile(t *testing.T) {
+	called := false
+	err := Replay(filepath.Join(t.TempDir(), "missing.jsonl"), "测试记录", func(r *test_record) {
+		called = true
+	})
+	if err != nil || called {
+		t.Fatalf("文件不存在时返回 %v", err)
+	}
+}
+
+func TestAppendCompacts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.jsonl")
+	s := open_store(t, path)
+	// 反复更新同一条记录，行数超过阈值后重写文件
+	for i := 0; i < compactThreshold*2; i++ {
+		s.put(t, "a", i)
+	}
+	s.put(t, "b", 1)
+	if n := count_lines(t, path); n > compactThreshold {
+		t.Fatalf("文件有 %d 行，没有重写", n)
+	}
+	if err := s.log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := open_store(t, path)
+	defer reopened.log.Close()
+	if len(reopened.values) != 2 || reopened.values["a"] != compactThreshold*2-1 || reopened.values["b"] != 1 {
+		t.Fatalf("重新打开后的记录为 %v", reopened.values)
+	}
+	// 打开时重写，只保留当前的记录
+	if n := count_lines(t, path); n != 2 {
+		t.Fatalf("重新打开后文件有 %d 行，期望 2 行", n)
+	}
+	tmp, _ := filepath.Glob(filepath.Join(dir, ".tmp_wx_test_*"))
+	if len(tmp) != 0 {
+		t.Fatalf("临时文件没有删除 %v", tmp)
+	}
+}
+
+func TestAppendAfterClose(t *testing.T) {
+	s := open_store(t, filepath.Join(t.TempDir(), "records.jsonl"))
+	if err := s.log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.log.Append(test_record{Op: "put", ID: "a"}, 1); err == nil || err.Error() != "测试记录已关闭" {
+		t.Fatalf("关闭后写入返回 %v", err)
+	}
+	if err := s.log.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,161 @@
+package live
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"time"
+
+	"wx_channel/pkg/flv"
+)
+
+// 按关键帧切分 FLV 直播流，每个分段都写入文件头、metadata 和 sequence header
+// 时间戳从 0 开始，分段可以单独播放
+type flv_segmenter struct {
+	r        *Recorder
+	header   flv.Header
+	meta     *flv.Tag
+	video_sh *flv.Tag
+	audio_sh *flv.Tag
+
+	file      *os.File
+	buf       *bufio.Writer
+	writer    *flv.Writer
+	base_ts   uint32 // 当前分段第一个 tag 的原始时间戳
+	last_ts   uint32
+	has_media bool
+}
+
+func (r *Recorder) record_flv(body io.Reader) (received bool, err error) {
+	reader, err := flv.NewReader(body)
+	if err != nil {
+		return false, err
+	}
+	s := &flv_segmenter{
+		r:      r,
+		header: reader.Header,
+	}
+	// 每次连接都是新的 FLV 流，时间戳会重新开始，因此总是写入新的分段
+	defer s.close()
+	for {
+		tag, err := reader.ReadTag()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return received, err
+		}
+		received = true
+		if err := s.write(tag); err != nil {
+			return received, err
+		}
+	}
+}
+
+func (s *flv_segmenter) write(tag *flv.Tag) error {
+	switch {
+	case tag.Type == flv.TagScript:
+		if !s.has_media {
+			s.meta = tag
+			return nil
+		}
+	case tag.IsSequenceHeader():
+		if tag.Type == flv.TagVideo {
+			s.video_sh = tag
+		} else {
+			s.audio_sh = tag
+		}
+		if s.writer == nil {
+			return nil
+		}
+	default:
+		if s.writer == nil {
+			// 视频需要从关键帧开始
+			if s.header.HasVideo && tag.Type == flv.TagVideo && !tag.IsKeyframe() {
+				return nil
+			}
+			if err := s.open(tag.Timestamp); err != nil {
+				return err
+			}
+		} else if s.should_split(tag) {
+			s.close()
+			if err := s.open(tag.Timestamp); err != nil {
+				return err
+			}
+		}
+		s.has_media = true
+	}
+	if s.writer == nil {
+		return nil
+	}
+	return s.write_tag(tag)
+}
+
+func (s *flv_segmenter) should_split(tag *flv.Tag) bool {
+	d := s.r.opts.SegmentDuration
+	if d <= 0 || !tag.IsKeyframe() {
+		return false
+	}
+	return s.elapsed(tag.Timestamp) >= d
+}
+
+func (s *flv_segmenter) elapsed(ts uint32) time.Duration {
+	if ts < s.base_ts {
+		return 0
+	}
+	return time.Duration(ts-s.base_ts) * time.Millisecond
+}
+
+func (s *flv_segmenter) open(ts uint32) error {
+	f, err := s.r.create_segment("flv")
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.buf = bufio.NewWriterSize(f, 256*1024)
+	s.writer, err = flv.NewWriter(s.buf, s.header)
+	if err != nil {
+		return err
+	}
+	s.base_ts = ts
+	s.last_ts = ts
+	for _, t := range []*flv.Tag{s.meta, s.video_sh, s.audio_sh} {
+		if t == nil {
+			continue
+		}
+		head := *t
+		head.Timestamp = ts
+		if err := s.write_tag(&head); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *flv_segmenter) write_tag(tag *flv.Tag) error {
+	out := *tag
+	if out.Timestamp < s.base_ts {
+		out.Timestamp = s.base_ts
+	}
+	out.Timestamp -= s.base_ts
+	if err := s.writer.WriteTag(&out); err != nil {
+		return err
+	}
+	if tag.Timestamp > s.last_ts {
+		s.last_ts = tag.Timestamp
+	}
+	s.r.add_progress(int64(len(tag.Data)+15), s.elapsed(s.last_ts))
+	return nil
+}
+
+func (s *flv_segmenter) close() {
+	if s.file == nil {
+		return
+	}
+	s.buf.Flush()
+	s.file.Close()
+	s.r.end_segment(s.elapsed(s.last_ts))
+	s.file = nil
+	s.buf = nil
+	s.writer = nil
+}
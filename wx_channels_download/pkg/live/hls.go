@@ -0,0 +1,261 @@
+package live
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type hls_segment struct {
+	URL      string
+	Duration time.Duration
+}
+
+type hls_playlist struct {
+	// 多码率的主播放列表中各个码率对应的地址
+	Variants       []hls_variant
+	MediaSequence  int64
+	TargetDuration time.Duration
+	Segments       []hls_segment
+	EndList        bool
+	Encrypted      bool
+}
+
+type hls_variant struct {
+	URL       string
+	Bandwidth int64
+}
+
+var errEncryptedHLS = errors.New("暂不支持加密的 HLS 直播流")
+
+var errNestedHLS = errors.New("多码率播放列表指向了另一个多码率播放列表")
+
+// 轮询播放列表，把新出现的分片依次追加到 .ts 分段文件
+func (r *Recorder) record_hls(ctx context.Context, playlist_url string) (received bool, err error) {
+	media_url := playlist_url
+	redirected := false
+	for {
+		pl, err := r.fetch_playlist(ctx, media_url)
+		if err != nil {
+			return received, err
+		}
+		if len(pl.Variants) > 0 {
+			// 只跟随一层，避免播放列表互相指向时一直请求
+			if redirected {
+				return received, errNestedHLS
+			}
+			redirected = true
+			media_url = best_variant(pl.Variants).URL
+			continue
+		}
+		if pl.Encrypted {
+			return received, errEncryptedHLS
+		}
+		r.mu.Lock()
+		r.set_state_recording()
+		r.mu.Unlock()
+		for i, seg := range pl.Segments {
+			seq := pl.MediaSequence + int64(i)
+			if seq <= r.hls_last_seq {
+				continue
+			}
+			if err := r.append_hls_segment(ctx, seg); err != nil {
+				return received, err
+			}
+			r.hls_last_seq = seq
+			received = true
+		}
+		if pl.EndList {
+			return received, ErrStreamEnded
+		}
+		wait := pl.TargetDuration / 2
+		if wait < time.Second {
+			wait = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return received, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (r *Recorder) fetch_playlist(ctx context.Context, u string) (*hls_playlist, error) {
+	req_ctx, cancel := context.WithTimeout(ctx, idleTimeout)
+	defer cancel()
+	resp, err := r.get(req_ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrStreamEnded
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("播放列表请求失败，状态码 %d", resp.StatusCode)
+	}
+	return parse_playlist(resp.Body, resp.Request.URL)
+}
+
+func (r *Recorder) append_hls_segment(ctx context.Context, seg hls_segment) error {
+	d := r.opts.SegmentDuration
+	if r.hls_file != nil && d > 0 && r.hls_elapsed >= d {
+		r.close_hls_file()
+	}
+	if r.hls_file == nil {
+		f, err := r.create_segment("ts")
+		if err != nil {
+			return err
+		}
+		r.hls_file = f
+		r.hls_elapsed = 0
+	}
+	req_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := r.get(req_ctx, seg.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("分片请求失败，状态码 %d", resp.StatusCode)
+	}
+	body := new_idle_reader(resp.Body, idleTimeout, cancel)
+	defer body.Stop()
+	start, err := r.hls_file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("写入录制文件失败 %v", err.Error())
+	}
+	n, err := io.Copy(r.hls_file, body)
+	if err != nil {
+		// 去掉写入了一部分的分片，重连后会重新下载整个分片
+		if terr := r.hls_file.Truncate(start); terr != nil {
+			r.close_hls_file()
+		} else if _, serr := r.hls_file.Seek(start, io.SeekStart); serr != nil {
+			r.close_hls_file()
+		}
+		return err
+	}
+	r.hls_elapsed += seg.Duration
+	r.add_progress(n, r.hls_elapsed)
+	return nil
+}
+
+func (r *Recorder) close_hls_file() {
+	if r.hls_file == nil {
+		return
+	}
+	r.hls_file.Close()
+	r.hls_file = nil
+	r.end_segment(r.hls_elapsed)
+	r.hls_elapsed = 0
+}
+
+func parse_playlist(body io.Reader, base *url.URL) (*hls_playlist, error) {
+	pl := &hls_playlist{}
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	first := true
+	var duration time.Duration
+	var bandwidth int64 = -1
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if first {
+			if line != "#EXTM3U" {
+				return nil, errors.New("不是有效的 m3u8 播放列表")
+			}
+			first = false
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			bandwidth = 0
+			if v, ok := playlist_attr(line, "BANDWIDTH"); ok {
+				bandwidth, _ = strconv.ParseInt(v, 10, 64)
+			}
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			pl.MediaSequence, _ = strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64)
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			secs, _ := strconv.ParseFloat(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"), 64)
+			pl.TargetDuration = time.Duration(secs * float64(time.Second))
+		case strings.HasPrefix(line, "#EXTINF:"):
+			v := strings.TrimPrefix(line, "#EXTINF:")
+			if i := strings.Index(v, ","); i >= 0 {
+				v = v[:i]
+			}
+			secs, _ := strconv.ParseFloat(v, 64)
+			duration = time.Duration(secs * float64(time.Second))
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			if method, ok := playlist_attr(line, "METHOD"); ok && method != "NONE" {
+				pl.Encrypted = true
+			}
+		case line == "#EXT-X-ENDLIST":
+			pl.EndList = true
+		case strings.HasPrefix(line, "#"):
+		default:
+			ref, err := url.Parse(line)
+			if err != nil {
+				continue
+			}
+			u := base.ResolveReference(ref).String()
+			if bandwidth >= 0 {
+				pl.Variants = append(pl.Variants, hls_variant{URL: u, Bandwidth: bandwidth})
+				bandwidth = -1
+				continue
+			}
+			pl.Segments = append(pl.Segments, hls_segment{URL: u, Duration: duration})
+			duration = 0
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if first {
+		return nil, errors.New("不是有效的 m3u8 播放列表")
+	}
+	return pl, nil
+}
+
+// 读取形如 KEY=VALUE 或 KEY="VALUE" 的属性
+func playlist_attr(line string, key string) (string, bool) {
+	_, attrs, _ := strings.Cut(line, ":")
+	for attrs != "" {
+		var pair string
+		in_quote := false
+		i := 0
+		for ; i < len(attrs); i++ {
+			if attrs[i] == '"' {
+				in_quote = !in_quote
+			}
+			if attrs[i] == ',' && !in_quote {
+				break
+			}
+		}
+		pair, attrs = attrs[:i], attrs[min(i+1, len(attrs)):]
+		k, v, ok := strings.Cut(pair, "=")
+		if ok && strings.TrimSpace(k) == key {
+			return strings.Trim(strings.TrimSpace(v), `"`), true
+		}
+	}
+	return "", false
+}
+
+func best_variant(variants []hls_variant) hls_variant {
+	best := variants[0]
+	for _, v := range variants[1:] {
+		if v.Bandwidth > best.Bandwidth {
+			best = v
+		}
+	}
+	return best
+}
@@ -0,0 +1,211 @@
+package live
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParsePlaylist(t *testing.T) {
+	base, _ := url.Parse("https://live.example.com/app/stream/index.m3u8?token=1")
+	cases := []struct {
+		name    string
+		body    string
+		want    *hls_playlist
+		invalid bool
+	}{
+		{
+			name: "多码率",
+			body: "#EXTM3U\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS=\"avc1.4d401f,mp4a.40.2\",RESOLUTION=640x360\n" +
+				"low/index.m3u8\n" +
+				"#EXT-X-STREAM-INF:CODECS=\"avc1.640028,mp4a.40.2\",BANDWIDTH=2500000\n" +
+				"https://cdn.example.com/high/index.m3u8\n",
+			want: &hls_playlist{Variants: []hls_variant{
+				{URL: "https://live.example.com/app/stream/low/index.m3u8", Bandwidth: 800000},
+				{URL: "https://cdn.example.com/high/index.m3u8", Bandwidth: 2500000},
+			}},
+		},
+		{
+			name: "分片",
+			body: "#EXTM3U\r\n" +
+				"#EXT-X-VERSION:3\r\n" +
+				"#EXT-X-TARGETDURATION:4\r\n" +
+				"#EXT-X-MEDIA-SEQUENCE:120\r\n" +
+				"\r\n" +
+				"#EXTINF:3.96,\r\n" +
+				"120.ts\r\n" +
+				"#EXTINF:4.0,title\r\n" +
+				"/other/121.ts?x=1\r\n" +
+				"#EXT-X-KEY:METHOD=NONE\r\n" +
+				"#EXT-X-ENDLIST\r\n",
+			want: &hls_playlist{
+				MediaSequence:  120,
+				TargetDuration: 4 * time.Second,
+				Segments: []hls_segment{
+					{URL: "https://live.example.com/app/stream/120.ts", Duration: 3960 * time.Millisecond},
+					{URL: "https://live.example.com/other/121.ts?x=1", Duration: 4 * time.Second},
+				},
+				EndList: true,
+			},
+		},
+		{
+			name: "加密",
+			body: "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key?a=1,b=2\"\n#EXTINF:2,\n0.ts\n",
+			want: &hls_playlist{
+				Segments:  []hls_segment{{URL: "https://live.example.com/app/stream/0.ts", Duration: 2 * time.Second}},
+				Encrypted: true,
+			},
+		},
+		{name: "空文件", body: "", invalid: true},
+		{name: "不是播放列表", body: "<html></html>\n#EXTM3U\n", invalid: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pl, err := parse_playlist(strings.NewReader(c.body), base)
+			if c.invalid {
+				if err == nil {
+					t.Fatal("无效的播放列表没有返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := fmt.Sprintf("%+v", *pl), fmt.Sprintf("%+v", *c.want); got != want {
+				t.Fatalf("解析结果为\n%s\n期望\n%s", got, want)
+			}
+		})
+	}
+	if v := best_variant([]hls_variant{{URL: "a", Bandwidth: 1}, {URL: "b", Bandwidth: 3}, {URL: "c", Bandwidth: 2}}); v.URL != "b" {
+		t.Fatalf("选择了码率 %d", v.Bandwidth)
+	}
+}
+
+// 模拟 HLS 直播，playlists 依次作为每次连接时的播放列表，broken 中的分片第一次请求时只返回一半
+type hls_server struct {
+	mu        sync.Mutex
+	playlists []string
+	conn      int
+	segments  map[string][]byte
+	broken    map[string]bool
+	requests  map[string]int
+}
+
+func (s *hls_server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	s.requests[name]++
+	switch {
+	case name == "master.m3u8":
+		w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nlive.m3u8\n"))
+	case name == "nested.m3u8":
+		w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nnested.m3u8\n"))
+	case name == "live.m3u8":
+		w.Write([]byte(s.playlists[min(s.conn, len(s.playlists)-1)]))
+	default:
+		data, ok := s.segments[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if s.broken[name] {
+			delete(s.broken, name)
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Write(data)
+	}
+}
+
+func new_hls_recorder(t *testing.T, server *httptest.Server, playlist string) *Recorder {
+	r := NewRecorder("1", RecorderOptions{URL: server.URL + "/" + playlist, Dir: t.TempDir(), Name: "直播"})
+	t.Cleanup(r.close_hls_file)
+	return r
+}
+
+func TestRecordHLSReconnect(t *testing.T) {
+	stub := &hls_server{
+		playlists: []string{
+			"#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:10\n#EXTINF:2,\n10.ts\n#EXTINF:2,\n11.ts\n",
+			// 重连后分片 10、11 仍在播放列表中
+			"#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:10\n#EXTINF:2,\n10.ts\n#EXTINF:2,\n11.ts\n#EXTINF:2,\n12.ts\n#EXT-X-ENDLIST\n",
+		},
+		segments: map[string][]byte{
+			"10.ts": bytes.Repeat([]byte{0x47, 10}, 2000),
+			"11.ts": bytes.Repeat([]byte{0x47, 11}, 2000),
+			"12.ts": bytes.Repeat([]byte{0x47, 12}, 2000),
+		},
+		broken:   map[string]bool{"11.ts": true},
+		requests: map[string]int{},
+	}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	r := new_hls_recorder(t, server, "master.m3u8")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	received, err := r.record_hls(ctx, r.opts.URL)
+	if err == nil || errors.Is(err, ErrStreamEnded) || !received {
+		t.Fatalf("分片中断时返回 %v %v", received, err)
+	}
+	if r.hls_last_seq != 10 {
+		t.Fatalf("中断后最后的分片为 %d", r.hls_last_seq)
+	}
+	stub.mu.Lock()
+	stub.conn++
+	stub.mu.Unlock()
+	if _, err := r.record_hls(ctx, r.opts.URL); !errors.Is(err, ErrStreamEnded) {
+		t.Fatalf("直播结束时返回 %v", err)
+	}
+	if r.hls_last_seq != 12 {
+		t.Fatalf("最后的分片为 %d", r.hls_last_seq)
+	}
+	if n := stub.requests["10.ts"]; n != 1 {
+		t.Fatalf("分片 10 请求了 %d 次", n)
+	}
+	r.close_hls_file()
+	status := r.Status()
+	if len(status.Segments) != 1 {
+		t.Fatalf("生成了 %d 个分段", len(status.Segments))
+	}
+	got, err := os.ReadFile(status.Segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Join([][]byte{stub.segments["10.ts"], stub.segments["11.ts"], stub.segments["12.ts"]}, nil)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("录制文件长度 %d，期望 %d，中断的分片可能重复写入", len(got), len(want))
+	}
+	if status.Bytes != int64(len(want)) || status.Duration != 6 {
+		t.Fatalf("录制进度为 %d 字节 %v 秒", status.Bytes, status.Duration)
+	}
+}
+
+func TestRecordHLSNestedMaster(t *testing.T) {
+	stub := &hls_server{requests: map[string]int{}}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	r := new_hls_recorder(t, server, "nested.m3u8")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := r.record_hls(ctx, r.opts.URL); !errors.Is(err, errNestedHLS) {
+		t.Fatalf("多码率播放列表嵌套时返回 %v", err)
+	}
+	if n := stub.requests["nested.m3u8"]; n != 2 {
+		t.Fatalf("请求了 %d 次播放列表", n)
+	}
+}
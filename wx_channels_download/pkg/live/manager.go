@@ -0,0 +1,96 @@
+package live
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// 管理所有录制任务，同一个直播流同时只会有一个录制
+type Manager struct {
+	mu        sync.Mutex
+	next      int
+	recorders map[string]*Recorder
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		recorders: make(map[string]*Recorder),
+	}
+}
+
+// 开始录制，该直播流已经在录制时返回已有的录制任务
+func (m *Manager) Start(opts RecorderOptions) (*Recorder, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("直播地址不能为空")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.recorders {
+		if r.opts.URL == opts.URL && r.Active() {
+			return r, nil
+		}
+	}
+	m.next++
+	id := strconv.Itoa(m.next)
+	r := NewRecorder(id, opts)
+	if err := r.Start(); err != nil {
+		return nil, err
+	}
+	m.recorders[id] = r
+	return r, nil
+}
+
+func (m *Manager) Get(id string) *Recorder {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.recorders[id]
+}
+
+func (m *Manager) Stop(id string) (*Recorder, error) {
+	r := m.Get(id)
+	if r == nil {
+		return nil, fmt.Errorf("录制任务 %s 不存在", id)
+	}
+	r.Stop()
+	return r, nil
+}
+
+func (m *Manager) List() []Status {
+	m.mu.Lock()
+	recorders := make([]*Recorder, 0, len(m.recorders))
+	for _, r := range m.recorders {
+		recorders = append(recorders, r)
+	}
+	m.mu.Unlock()
+	list := make([]Status, 0, len(recorders))
+	for _, r := range recorders {
+		list = append(list, r.Status())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, _ := strconv.Atoi(list[i].ID)
+		b, _ := strconv.Atoi(list[j].ID)
+		return a < b
+	})
+	return list
+}
+
+// 退出前停止所有录制，保证文件完整写入
+func (m *Manager) StopAll() {
+	m.mu.Lock()
+	recorders := make([]*Recorder, 0, len(m.recorders))
+	for _, r := range m.recorders {
+		recorders = append(recorders, r)
+	}
+	m.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, r := range recorders {
+		wg.Add(1)
+		go func(r *Recorder) {
+			defer wg.Done()
+			r.Stop()
+		}(r)
+	}
+	wg.Wait()
+}
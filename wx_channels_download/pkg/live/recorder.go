@@ -0,0 +1,329 @@
+package live
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"wx_channel/pkg/naming"
+)
+
+type State string
+
+const (
+	StateRecording    State = "recording"
+	StateReconnecting State = "reconnecting"
+	StateStopped      State = "stopped"
+	StateFailed       State = "failed"
+)
+
+const (
+	FormatFLV = "flv"
+	FormatHLS = "hls"
+)
+
+const (
+	// 连续多久没有收到数据时认为连接已断开
+	idleTimeout = 30 * time.Second
+	// 连续重连失败的次数超过该值时停止录制
+	defaultMaxReconnects = 10
+	maxReconnectDelay    = 30 * time.Second
+)
+
+var ErrStreamEnded = errors.New("直播已结束")
+
+type RecorderOptions struct {
+	URL             string
+	Dir             string
+	Name            string        // 文件名前缀，分段文件为 <Name>_001.flv
+	SegmentDuration time.Duration // 每个分段的时长，为 0 时只在重连后分段
+	MaxReconnects   int
+}
+
+type Status struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Name       string    `json:"name"`
+	Format     string    `json:"format"`
+	State      State     `json:"state"`
+	StartedAt  time.Time `json:"started_at"`
+	Duration   float64   `json:"duration"` // 已录制的时长，单位秒
+	Bytes      int64     `json:"bytes"`
+	Segments   []string  `json:"segments"`
+	Reconnects int       `json:"reconnects"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// 直接拉取 FLV 或 HLS 直播流写入本地文件，断开后自动重连
+type Recorder struct {
+	opts   RecorderOptions
+	client *http.Client
+	mu     sync.Mutex
+	status Status
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// 已录制的分段时长之和，当前分段的时长另外计算
+	recorded time.Duration
+	// HLS 已经下载过的最后一个分片序号，重连后跳过已下载的分片
+	hls_last_seq int64
+	hls_file     *os.File
+	hls_elapsed  time.Duration
+}
+
+func NewRecorder(id string, opts RecorderOptions) *Recorder {
+	if opts.MaxReconnects <= 0 {
+		opts.MaxReconnects = defaultMaxReconnects
+	}
+	opts.Name = naming.Sanitize(opts.Name)
+	if opts.Name == "" {
+		opts.Name = fmt.Sprintf("live_%d", time.Now().Unix())
+	}
+	tr := &http.Transport{
+		Proxy:                 nil,
+		TLSNextProto:          make(map[string]func(authority string, c *tls.Conn) http.RoundTripper),
+		ResponseHeaderTimeout: 15 * time.Second,
+	}
+	return &Recorder{
+		opts:   opts,
+		client: &http.Client{Transport: tr},
+		status: Status{
+			ID:       id,
+			URL:      opts.URL,
+			Name:     opts.Name,
+			Format:   detect_format(opts.URL, ""),
+			Segments: []string{},
+		},
+		hls_last_seq: -1,
+		done:         make(chan struct{}),
+	}
+}
+
+func (r *Recorder) Start() error {
+	if err := os.MkdirAll(r.opts.Dir, 0755); err != nil {
+		return fmt.Errorf("创建录制目录失败 %v", err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mu.Lock()
+	r.cancel = cancel
+	r.status.State = StateRecording
+	r.status.StartedAt = time.Now()
+	r.mu.Unlock()
+	go r.run(ctx)
+	return nil
+}
+
+// 停止录制并等待文件写入完成
+func (r *Recorder) Stop() {
+	r.mu.Lock()
+	cancel := r.cancel
+	r.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	<-r.done
+}
+
+func (r *Recorder) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *Recorder) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.status
+	s.Segments = append([]string(nil), r.status.Segments...)
+	return s
+}
+
+func (r *Recorder) Active() bool {
+	select {
+	case <-r.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (r *Recorder) run(ctx context.Context) {
+	defer close(r.done)
+	defer r.close_hls_file()
+	failures := 0
+	for {
+		received, err := r.record_once(ctx)
+		if ctx.Err() != nil {
+			r.finish(StateStopped, nil)
+			return
+		}
+		if errors.Is(err, ErrStreamEnded) {
+			r.finish(StateStopped, err)
+			return
+		}
+		if received {
+			failures = 0
+		}
+		failures++
+		if failures > r.opts.MaxReconnects {
+			r.finish(StateFailed, err)
+			return
+		}
+		r.mu.Lock()
+		r.status.State = StateReconnecting
+		r.status.Reconnects++
+		if err != nil {
+			r.status.Error = err.Error()
+		}
+		r.mu.Unlock()
+
+		delay := time.Duration(failures) * 2 * time.Second
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+		select {
+		case <-ctx.Done():
+			r.finish(StateStopped, nil)
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (r *Recorder) finish(state State, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.State = state
+	if err != nil {
+		r.status.Error = err.Error()
+	} else if state == StateStopped {
+		r.status.Error = ""
+	}
+}
+
+// 建立一次连接并录制到连接断开，received 表示这次连接是否收到了数据
+func (r *Recorder) record_once(ctx context.Context) (received bool, err error) {
+	if r.Status().Format == FormatHLS {
+		return r.record_hls(ctx, r.opts.URL)
+	}
+	conn_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := r.get(conn_ctx, r.opts.URL)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, ErrStreamEnded
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("直播流请求失败，状态码 %d", resp.StatusCode)
+	}
+	if detect_format(r.opts.URL, resp.Header.Get("Content-Type")) == FormatHLS {
+		resp.Body.Close()
+		r.mu.Lock()
+		r.status.Format = FormatHLS
+		r.mu.Unlock()
+		return r.record_hls(ctx, r.opts.URL)
+	}
+	r.mu.Lock()
+	r.set_state_recording()
+	r.mu.Unlock()
+	body := new_idle_reader(resp.Body, idleTimeout, cancel)
+	defer body.Stop()
+	return r.record_flv(body)
+}
+
+func (r *Recorder) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
+	return r.client.Do(req)
+}
+
+// 调用方需要持有 r.mu
+func (r *Recorder) set_state_recording() {
+	r.status.State = StateRecording
+	r.status.Error = ""
+}
+
+// 新建下一个分段文件
+func (r *Recorder) create_segment(ext string) (*os.File, error) {
+	r.mu.Lock()
+	idx := len(r.status.Segments) + 1
+	r.mu.Unlock()
+	p := filepath.Join(r.opts.Dir, fmt.Sprintf("%s_%03d.%s", r.opts.Name, idx, ext))
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, fmt.Errorf("创建录制文件失败 %v", err.Error())
+	}
+	r.mu.Lock()
+	r.status.Segments = append(r.status.Segments, p)
+	r.mu.Unlock()
+	return f, nil
+}
+
+func (r *Recorder) add_progress(n int64, segment_elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.Bytes += n
+	r.status.Duration = (r.recorded + segment_elapsed).Seconds()
+}
+
+// 当前分段结束，累加到已录制的时长
+func (r *Recorder) end_segment(segment_elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recorded += segment_elapsed
+	r.status.Duration = r.recorded.Seconds()
+}
+
+func detect_format(u string, content_type string) string {
+	ct := strings.ToLower(content_type)
+	if strings.Contains(ct, "mpegurl") {
+		return FormatHLS
+	}
+	path := u
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	if strings.HasSuffix(strings.ToLower(path), ".m3u8") {
+		return FormatHLS
+	}
+	return FormatFLV
+}
+
+// 一段时间没有读到数据时调用 on_idle，用来断开卡住的连接
+type idle_reader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func new_idle_reader(r io.Reader, timeout time.Duration, on_idle func()) *idle_reader {
+	return &idle_reader{
+		r:       r,
+		timeout: timeout,
+		timer:   time.AfterFunc(timeout, on_idle),
+	}
+}
+
+func (r *idle_reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func (r *idle_reader) Stop() {
+	r.timer.Stop()
+}
@@ -0,0 +1,220 @@
+package naming
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"wx_channel/pkg/channels"
+)
+
+// 和配置 download.filenameTemplate 的默认值一致
+const DefaultTemplate = "{{filename}}_{{spec}}"
+
+// 文件名最多的字节数，大部分文件系统限制为 255 字节，留出序号和扩展名的位置
+const maxNameBytes = 200
+
+var placeholder_reg = regexp.MustCompile(`\{\{([^}]+)\}\}`)
+
+// Windows 中不能作为文件名的设备名
+var reserved_names = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// 模板中可以使用的变量
+type Vars map[string]string
+
+// 视频信息对应的变量，和页面中 __wx_build_filename 的变量一致
+// spec 为空时表示原始视频
+func ProfileVars(profile *channels.Profile, spec string, now time.Time) Vars {
+	if spec == "" {
+		spec = "original"
+	}
+	vars := Vars{
+		"id":            profile.ID,
+		"nonce_id":      profile.NonceID,
+		"title":         profile.Title,
+		"spec":          spec,
+		"download_at":   strconv.FormatInt(now.Unix(), 10),
+		"download_date": now.Format("2006-01-02"),
+	}
+	switch {
+	case profile.Title != "":
+		vars["filename"] = profile.Title
+	case profile.ID != "":
+		vars["filename"] = profile.ID
+	default:
+		vars["filename"] = strconv.FormatInt(now.UnixMilli(), 10)
+	}
+	if profile.CreateTime > 0 {
+		vars["created_at"] = strconv.FormatInt(profile.CreateTime, 10)
+		vars["date"] = time.Unix(profile.CreateTime, 0).Format("2006-01-02")
+	}
+	if profile.Contact != nil {
+		vars["author"] = profile.Contact.Nickname
+		vars["author_id"] = profile.Contact.ID
+	}
+	s := profile.FindSpec(spec)
+	if s != nil && s.Width > 0 {
+		vars["width"] = strconv.Itoa(s.Width)
+	}
+	if s != nil && s.Height > 0 {
+		vars["height"] = strconv.Itoa(s.Height)
+	}
+	if d := profile.DurationOf(s); d > 0 {
+		vars["duration"] = strconv.Itoa(int(d + 0.5))
+	}
+	return vars
+}
+
+// 没有视频信息时的变量，只有下载时间
+func DefaultVars(spec string, now time.Time) Vars {
+	return ProfileVars(&channels.Profile{}, spec, now)
+}
+
+// 替换模板中的 {{变量}}，变量后可以接过滤器，如 {{title|firstline|truncate:30}}
+// 不存在的变量替换为空字符串，不认识的过滤器会被忽略
+func Render(template string, vars Vars) string {
+	return placeholder_reg.ReplaceAllStringFunc(template, func(match string) string {
+		parts := strings.Split(match[2:len(match)-2], "|")
+		value := vars[strings.TrimSpace(parts[0])]
+		for _, filter := range parts[1:] {
+			name, arg, _ := strings.Cut(strings.TrimSpace(filter), ":")
+			value = apply_filter(value, name, arg)
+		}
+		return value
+	})
+}
+
+func apply_filter(value string, name string, arg string) string {
+	switch name {
+	case "truncate":
+		// 只接受非负整数，和页面中一致
+		n, err := strconv.ParseUint(arg, 10, 31)
+		if err != nil {
+			return value
+		}
+		if runes := []rune(value); len(runes) > int(n) {
+			return string(runes[:n])
+		}
+		return value
+	case "default":
+		if value == "" {
+			return arg
+		}
+		return value
+	case "firstline":
+		for _, line := range strings.Split(value, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				return line
+			}
+		}
+		return ""
+	case "date":
+		sec, err := strconv.ParseUint(value, 10, 63)
+		if err != nil {
+			return ""
+		}
+		return format_date(time.Unix(int64(sec), 0), arg)
+	case "sanitize":
+		return Sanitize(value)
+	}
+	return value
+}
+
+var date_token_reg = regexp.MustCompile(`YYYY|MM|DD|HH|mm|ss`)
+
+// 日期格式使用 YYYY、MM、DD、HH、mm、ss，默认为 YYYY-MM-DD
+func format_date(t time.Time, format string) string {
+	if format == "" {
+		format = "YYYY-MM-DD"
+	}
+	return date_token_reg.ReplaceAllStringFunc(format, func(token string) string {
+		switch token {
+		case "YYYY":
+			return t.Format("2006")
+		case "MM":
+			return t.Format("01")
+		case "DD":
+			return t.Format("02")
+		case "HH":
+			return t.Format("15")
+		case "mm":
+			return t.Format("04")
+		}
+		return t.Format("05")
+	})
+}
+
+// 按模板生成文件名（不包括扩展名），模板为空时使用默认模板
+func Filename(template string, vars Vars) string {
+	if strings.TrimSpace(template) == "" {
+		template = DefaultTemplate
+	}
+	return Sanitize(Render(template, vars))
+}
+
+// 去掉 Windows、macOS 和 Linux 中文件名不能使用的字符
+// 换行等空白字符替换为空格，不能使用的字符替换为 _，并限制文件名的长度
+func Sanitize(name string) string {
+	name = strings.Map(func(c rune) rune {
+		switch {
+		case c == '\n' || c == '\r' || c == '\t':
+			return ' '
+		case c < 0x20 || c == 0x7f || strings.ContainsRune(`\/:*?"<>|`, c):
+			return '_'
+		}
+		return c
+	}, name)
+	// 只合并普通空格，全角空格等保持不变，和页面中的 split(" ") 一致
+	parts := strings.Split(name, " ")
+	words := parts[:0]
+	for _, part := range parts {
+		if part != "" {
+			words = append(words, part)
+		}
+	}
+	name = strings.Join(words, " ")
+	// Windows 中文件名不能以点或空格结尾，以点开头的文件在 macOS 和 Linux 中会被隐藏
+	name = strings.Trim(name, ". ")
+	if len(name) > maxNameBytes {
+		name = name[:maxNameBytes]
+		for !utf8.ValidString(name) {
+			name = name[:len(name)-1]
+		}
+		name = strings.TrimRight(name, ". ")
+	}
+	base, _, _ := strings.Cut(name, ".")
+	if reserved_names[strings.ToUpper(base)] {
+		name = "_" + name
+	}
+	return name
+}
+
+// 返回目录中不存在的文件路径，已存在时在文件名后加上 _1、_2 等序号
+// taken 不为空时，还会跳过 taken 返回 true 的路径
+func Unique(dir string, name string, ext string, taken func(string) bool) string {
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	for i := 0; ; i++ {
+		filename := name + ext
+		if i > 0 {
+			filename = name + "_" + strconv.Itoa(i) + ext
+		}
+		p := filepath.Join(dir, filename)
+		if taken != nil && taken(p) {
+			continue
+		}
+		if _, err := os.Stat(p); err == nil {
+			continue
+		}
+		return p
+	}
+}
@@ -0,0 +1,240 @@
+package naming
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"wx_channel/pkg/channels"
+)
+
+func TestRender(t *testing.T) {
+	vars := Vars{
+		"title":      "  \n第一行标题\n第二行",
+		"author":     "作者",
+		"empty":      "",
+		"created_at": "1700000000",
+	}
+	created := time.Unix(1700000000, 0)
+	cases := []struct {
+		template string
+		want     string
+	}{
+		{"{{author}}", "作者"},
+		{"{{ author }}", "作者"},
+		{"{{missing}}", ""},
+		{"{{title|firstline}}", "第一行标题"},
+		{"{{title|firstline|truncate:3}}", "第一行"},
+		{"{{author|truncate:10}}", "作者"},
+		{"{{author|truncate:0}}", ""},
+		{"{{author|truncate:-1}}", "作者"},
+		{"{{author|truncate:+1}}", "作者"},
+		{"{{author|truncate:abc}}", "作者"},
+		{"{{empty|default:无}}", "无"},
+		{"{{author|default:无}}", "作者"},
+		{"{{empty|default:a:b}}", "a:b"},
+		{"{{created_at|date}}", created.Format("2006-01-02")},
+		{"{{created_at|date:YYYYMMDD_HHmmss}}", created.Format("20060102_150405")},
+		{"{{author|date}}", ""},
+		{"{{title|sanitize}}", "第一行标题 第二行"},
+		{"{{author|unknown}}", "作者"},
+		{"{{author}}_{{empty}}_{{author}}", "作者__作者"},
+		{"没有变量", "没有变量"},
+	}
+	for _, c := range cases {
+		if got := Render(c.template, vars); got != c.want {
+			t.Errorf("Render(%q) = %q，期望 %q", c.template, got, c.want)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	long := strings.Repeat("视频", 40) // 240 字节
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"标题", "标题"},
+		{"a/b\\c:d*e?f\"g<h>i|j", "a_b_c_d_e_f_g_h_i_j"},
+		{"第一行\n第二行\r\n第三行\t结束", "第一行 第二行 第三行 结束"},
+		{"a\x00b\x1fc\x7fd", "a_b_c_d"},
+		{"  多个   空格  ", "多个 空格"},
+		{"全角　空格", "全角　空格"},
+		{"...隐藏文件...", "隐藏文件"},
+		{"结尾的点. . .", "结尾的点"},
+		{"CON", "_CON"},
+		{"con.mp4", "_con.mp4"},
+		{"COM1.tar.gz", "_COM1.tar.gz"},
+		{"CONSOLE", "CONSOLE"},
+		{"", ""},
+		{long, strings.Repeat("视频", 33)},
+		{"a" + long, "a" + strings.Repeat("视频", 33)},
+		{strings.Repeat("a", 199) + ". b", strings.Repeat("a", 199)},
+	}
+	for _, c := range cases {
+		got := Sanitize(c.name)
+		if got != c.want {
+			t.Errorf("Sanitize(%q) = %q，期望 %q", c.name, got, c.want)
+		}
+		if len(got) > maxNameBytes {
+			t.Errorf("Sanitize(%q) 的长度为 %d", c.name, len(got))
+		}
+	}
+}
+
+func test_profile() *channels.Profile {
+	return &channels.Profile{
+		ID:         "14253647586970",
+		NonceID:    "nonce",
+		Title:      "视频的标题\n#话题 #话题2",
+		CreateTime: 1700000000,
+		Duration:   61,
+		Spec: []channels.Spec{
+			{FileFormat: "xWT111", Width: 1080, Height: 1920, DurationMs: 60600},
+			{FileFormat: "xWT98"},
+		},
+		Contact: &channels.Contact{ID: "v2_author@finder", Nickname: "作者/昵称"},
+	}
+}
+
+func TestFilename(t *testing.T) {
+	now := time.Unix(1710000000, 0)
+	cases := []struct {
+		template string
+		spec     string
+		want     string
+	}{
+		{"", "", "视频的标题 #话题 #话题2_original"},
+		{"  ", "xWT111", "视频的标题 #话题 #话题2_xWT111"},
+		{"{{author}}_{{title|firstline}}", "", "作者_昵称_视频的标题"},
+		{"{{id}}_{{width}}x{{height}}_{{duration}}", "xWT111", "14253647586970_1080x1920_61"},
+		{"{{id}}_{{width|default:0}}_{{duration}}", "xWT98", "14253647586970_0_61"},
+		{"{{download_at}}", "", "1710000000"},
+		{"{{missing}}", "", ""},
+	}
+	for _, c := range cases {
+		if got := Filename(c.template, ProfileVars(test_profile(), c.spec, now)); got != c.want {
+			t.Errorf("Filename(%q, %q) = %q，期望 %q", c.template, c.spec, got, c.want)
+		}
+	}
+	if got := Filename("", DefaultVars("", now)); got != "1710000000000_original" {
+		t.Errorf("没有视频信息时的文件名为 %q", got)
+	}
+}
+
+func TestUnique(t *testing.T) {
+	dir := t.TempDir()
+	if got := Unique(dir, "视频", "mp4", nil); got != filepath.Join(dir, "视频.mp4") {
+		t.Fatalf("Unique = %q", got)
+	}
+	for _, name := range []string{"视频.mp4", "视频_1.mp4"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := Unique(dir, "视频", ".mp4", nil); got != filepath.Join(dir, "视频_2.mp4") {
+		t.Fatalf("已存在时 Unique = %q", got)
+	}
+	// 正在下载、还没有创建的文件也要跳过
+	taken := func(p string) bool {
+		return p == filepath.Join(dir, "视频_2.mp4")
+	}
+	if got := Unique(dir, "视频", ".mp4", taken); got != filepath.Join(dir, "视频_3.mp4") {
+		t.Fatalf("跳过 taken 时 Unique = %q", got)
+	}
+}
+
+// 在 node 中运行 inject/utils.js，和页面中生成的文件名比较
+const page_script = `
+const vm = require("vm");
+const fs = require("fs");
+const ctx = { window: {}, TextEncoder, TextDecoder };
+vm.createContext(ctx);
+vm.runInContext(fs.readFileSync(process.argv[1], "utf8"), ctx);
+const input = JSON.parse(fs.readFileSync(0, "utf8"));
+ctx.input = input;
+const output = vm.runInContext(
+  "({" +
+    "sanitize: input.names.map((name) => __wx_sanitize_filename(name))," +
+    "filenames: input.filenames.map((c) => __wx_build_filename(c.profile, (c.profile.spec || []).find((s) => s.fileFormat === c.spec) || null, c.template))," +
+    "})",
+  ctx
+);
+process.stdout.write(JSON.stringify(output));
+`
+
+func TestMatchesPageScript(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("没有安装 node")
+	}
+	names := []string{
+		"标题",
+		"a/b\\c:d*e?f\"g<h>i|j",
+		"第一行\n第二行\r\n第三行\t结束",
+		"a\x00b\x1fc\x7fd",
+		"  多个   空格  ",
+		"全角　 空格  c.",
+		"不换行 空格",
+		"...隐藏文件...",
+		"con.mp4",
+		"LPT9",
+		strings.Repeat("视频", 40),
+		strings.Repeat("a", 199) + "视频",
+		strings.Repeat("a", 199) + ". b",
+	}
+	templates := []string{
+		"",
+		"{{author}}_{{title|firstline}}",
+		"{{title|firstline|truncate:4}}_{{spec}}",
+		"{{id}}_{{width}}x{{height}}_{{duration}}",
+		"{{date}}_{{created_at|date:YYYYMMDD_HHmmss}}",
+		"{{nonce_id|default:无}}_{{author_id|truncate:+3}}_{{author|truncate:2}}",
+		"{{title|sanitize|truncate:3}}.{{missing|default:a:b}}",
+	}
+	type filename_case struct {
+		Profile  *channels.Profile `json:"profile"`
+		Spec     string            `json:"spec"`
+		Template string            `json:"template"`
+	}
+	var filenames []filename_case
+	var want_filenames []string
+	profile := test_profile()
+	for _, template := range templates {
+		for _, spec := range []string{"", "xWT111", "xWT98"} {
+			filenames = append(filenames, filename_case{profile, spec, template})
+			want_filenames = append(want_filenames, Filename(template, ProfileVars(profile, spec, time.Now())))
+		}
+	}
+	input, err := json.Marshal(map[string]any{"names": names, "filenames": filenames})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(node, "-e", page_script, filepath.Join("..", "..", "inject", "utils.js"))
+	cmd.Stdin = strings.NewReader(string(input))
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("运行 inject/utils.js 失败 %v", err)
+	}
+	var result struct {
+		Sanitize  []string `json:"sanitize"`
+		Filenames []string `json:"filenames"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		if want := Sanitize(name); result.Sanitize[i] != want {
+			t.Errorf("Sanitize(%q) 为 %q，页面中为 %q", name, want, result.Sanitize[i])
+		}
+	}
+	for i, c := range filenames {
+		if result.Filenames[i] != want_filenames[i] {
+			t.Errorf("模板 %q 规格 %q 的文件名为 %q，页面中为 %q", c.Template, c.Spec, want_filenames[i], result.Filenames[i])
+		}
+	}
+}
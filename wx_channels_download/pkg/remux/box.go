@@ -0,0 +1,156 @@
+package remux
+
+import (
+	"encoding/binary"
+)
+
+// MP4 box 的序列化辅助函数
+
+func u8(v uint8) []byte {
+	return []byte{v}
+}
+
+func u16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func u64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	out := make([]byte, 0, size)
+	out = binary.BigEndian.AppendUint32(out, uint32(size))
+	out = append(out, typ...)
+	for _, p := range payload {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func full_box(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	head := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{head}, payload...)...)
+}
+
+var unity_matrix = []byte{
+	0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0x00, 0x00, 0x00,
+}
+
+func ftyp(major string, compatible ...string) []byte {
+	payload := [][]byte{[]byte(major), u32(512)}
+	for _, c := range compatible {
+		payload = append(payload, []byte(c))
+	}
+	return box("ftyp", payload...)
+}
+
+func mvhd(timescale uint32, duration uint64, next_track_id uint32) []byte {
+	return full_box("mvhd", 1, 0,
+		u64(0), u64(0), u32(timescale), u64(duration),
+		u32(0x00010000), u16(0x0100), zeros(10),
+		unity_matrix,
+		zeros(24),
+		u32(next_track_id),
+	)
+}
+
+func tkhd(t *track, duration uint64) []byte {
+	var volume uint16
+	if t.kind == kindAudio {
+		volume = 0x0100
+	}
+	return full_box("tkhd", 1, 0x3,
+		u64(0), u64(0), u32(t.id), u32(0), u64(duration),
+		zeros(8), u16(0), u16(0), u16(volume), u16(0),
+		unity_matrix,
+		u32(uint32(t.width)<<16), u32(uint32(t.height)<<16),
+	)
+}
+
+func mdhd(timescale uint32, duration uint64) []byte {
+	// 语言为 und
+	return full_box("mdhd", 1, 0, u64(0), u64(0), u32(timescale), u64(duration), u16(0x55c4), u16(0))
+}
+
+func hdlr(t *track) []byte {
+	if t.kind == kindVideo {
+		return full_box("hdlr", 0, 0, u32(0), []byte("vide"), zeros(12), []byte("VideoHandler\x00"))
+	}
+	return full_box("hdlr", 0, 0, u32(0), []byte("soun"), zeros(12), []byte("SoundHandler\x00"))
+}
+
+func media_header(t *track) []byte {
+	if t.kind == kindVideo {
+		return full_box("vmhd", 0, 1, zeros(8))
+	}
+	return full_box("smhd", 0, 0, zeros(4))
+}
+
+func dinf() []byte {
+	return box("dinf", full_box("dref", 0, 0, u32(1), full_box("url ", 0, 1)))
+}
+
+func stsd(t *track) []byte {
+	var entry []byte
+	if t.kind == kindVideo {
+		entry = box("avc1",
+			zeros(6), u16(1),
+			zeros(16),
+			u16(uint16(t.width)), u16(uint16(t.height)),
+			u32(0x00480000), u32(0x00480000),
+			u32(0), u16(1),
+			zeros(32),
+			u16(0x0018), u16(0xffff),
+			box("avcC", t.config),
+		)
+	} else {
+		entry = box("mp4a",
+			zeros(6), u16(1),
+			zeros(8),
+			u16(t.channels), u16(16),
+			u16(0), u16(0),
+			u32(t.sample_rate<<16),
+			esds(t),
+		)
+	}
+	return full_box("stsd", 0, 0, u32(1), entry)
+}
+
+func esds(t *track) []byte {
+	decoder_specific := descriptor(0x05, t.config)
+	decoder_config := descriptor(0x04,
+		u8(0x40), u8(0x15), zeros(3), u32(0), u32(0),
+		decoder_specific,
+	)
+	sl_config := descriptor(0x06, u8(0x02))
+	es := descriptor(0x03, u16(uint16(t.id)), u8(0), decoder_config, sl_config)
+	return full_box("esds", 0, 0, es)
+}
+
+// 长度使用 4 字节的可变长编码，兼容性最好
+func descriptor(tag uint8, payload ...[]byte) []byte {
+	size := 0
+	for _, p := range payload {
+		size += len(p)
+	}
+	out := []byte{tag, byte(size>>21) | 0x80, byte(size>>14) | 0x80, byte(size>>7) | 0x80, byte(size & 0x7f)}
+	for _, p := range payload {
+		out = append(out, p...)
+	}
+	return out
+}
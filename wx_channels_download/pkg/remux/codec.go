@@ -0,0 +1,197 @@
+package remux
+
+import (
+	"errors"
+)
+
+var errShortConfig = errors.New("编码参数数据不完整")
+
+// 从 AVCDecoderConfigurationRecord 中读取视频宽高
+func parse_avc_config(config []byte) (width, height int, err error) {
+	if len(config) < 8 {
+		return 0, 0, errShortConfig
+	}
+	if config[5]&0x1f == 0 {
+		return 0, 0, errors.New("编码参数中没有 SPS")
+	}
+	size := int(config[6])<<8 | int(config[7])
+	if len(config) < 8+size || size < 4 {
+		return 0, 0, errShortConfig
+	}
+	return parse_sps(config[8 : 8+size])
+}
+
+// 按 H.264 规范解析 SPS，只取计算宽高需要的字段
+func parse_sps(nal []byte) (width, height int, err error) {
+	br := &bit_reader{data: unescape_rbsp(nal[1:])}
+	profile_idc := br.read_bits(8)
+	br.read_bits(16) // constraint_set_flags、level_idc
+	br.read_ue()     // seq_parameter_set_id
+	chroma_format_idc := uint32(1)
+	switch profile_idc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma_format_idc = br.read_ue()
+		if chroma_format_idc == 3 {
+			br.read_bits(1) // separate_colour_plane_flag
+		}
+		br.read_ue()    // bit_depth_luma_minus8
+		br.read_ue()    // bit_depth_chroma_minus8
+		br.read_bits(1) // qpprime_y_zero_transform_bypass_flag
+		if br.read_bits(1) == 1 {
+			lists := 8
+			if chroma_format_idc == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if br.read_bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + br.read_se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	br.read_ue() // log2_max_frame_num_minus4
+	switch br.read_ue() {
+	case 0:
+		br.read_ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		br.read_bits(1) // delta_pic_order_always_zero_flag
+		br.read_se()    // offset_for_non_ref_pic
+		br.read_se()    // offset_for_top_to_bottom_field
+		n := br.read_ue()
+		for i := uint32(0); i < n && !br.overflow; i++ {
+			br.read_se()
+		}
+	}
+	br.read_ue()    // max_num_ref_frames
+	br.read_bits(1) // gaps_in_frame_num_value_allowed_flag
+	width_mbs := int(br.read_ue()) + 1
+	height_map_units := int(br.read_ue()) + 1
+	frame_mbs_only := int(br.read_bits(1))
+	if frame_mbs_only == 0 {
+		br.read_bits(1) // mb_adaptive_frame_field_flag
+	}
+	br.read_bits(1) // direct_8x8_inference_flag
+	var crop_left, crop_right, crop_top, crop_bottom int
+	if br.read_bits(1) == 1 {
+		crop_left = int(br.read_ue())
+		crop_right = int(br.read_ue())
+		crop_top = int(br.read_ue())
+		crop_bottom = int(br.read_ue())
+	}
+	if br.overflow {
+		return 0, 0, errors.New("SPS 数据不完整")
+	}
+	crop_unit_x, crop_unit_y := 1, 2-frame_mbs_only
+	switch chroma_format_idc {
+	case 1:
+		crop_unit_x, crop_unit_y = 2, 2*(2-frame_mbs_only)
+	case 2:
+		crop_unit_x = 2
+	}
+	width = width_mbs*16 - (crop_left+crop_right)*crop_unit_x
+	height = (2-frame_mbs_only)*height_map_units*16 - (crop_top+crop_bottom)*crop_unit_y
+	return width, height, nil
+}
+
+// 去掉防竞争字节 0x000003 中的 03
+func unescape_rbsp(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+var aac_sample_rates = []uint32{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// 从 AudioSpecificConfig 中读取采样率和声道数
+func parse_aac_config(config []byte) (sample_rate uint32, channels uint16, err error) {
+	if len(config) < 2 {
+		return 0, 0, errShortConfig
+	}
+	br := &bit_reader{data: config}
+	if object_type := br.read_bits(5); object_type == 31 {
+		br.read_bits(6)
+	}
+	if idx := br.read_bits(4); idx == 15 {
+		sample_rate = br.read_bits(24)
+	} else if int(idx) < len(aac_sample_rates) {
+		sample_rate = aac_sample_rates[idx]
+	} else {
+		return 0, 0, errors.New("AAC 采样率无效")
+	}
+	channels = uint16(br.read_bits(4))
+	if br.overflow || sample_rate == 0 {
+		return 0, 0, errShortConfig
+	}
+	if channels == 0 {
+		channels = 2
+	}
+	return sample_rate, channels, nil
+}
+
+type bit_reader struct {
+	data     []byte
+	pos      int
+	overflow bool
+}
+
+func (br *bit_reader) read_bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		idx := br.pos >> 3
+		if idx >= len(br.data) {
+			br.overflow = true
+			return v
+		}
+		bit := (br.data[idx] >> (7 - uint(br.pos&7))) & 1
+		v = v<<1 | uint32(bit)
+		br.pos++
+	}
+	return v
+}
+
+// 无符号指数哥伦布编码
+func (br *bit_reader) read_ue() uint32 {
+	zeros := 0
+	for br.read_bits(1) == 0 {
+		if br.overflow || zeros >= 31 {
+			br.overflow = true
+			return 0
+		}
+		zeros++
+	}
+	return (1<<uint(zeros) - 1) + br.read_bits(zeros)
+}
+
+// 有符号指数哥伦布编码
+func (br *bit_reader) read_se() int32 {
+	v := br.read_ue()
+	if v&1 == 1 {
+		return int32((v + 1) / 2)
+	}
+	return -int32(v / 2)
+}
@@ -0,0 +1,417 @@
+package remux
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// 每个 fragment 的最短时长，单位毫秒，有视频时在关键帧处切分
+const fragmentDuration = 1000
+
+type chunk struct {
+	offset uint64
+	count  uint32
+}
+
+// 普通 MP4 的采样表
+type sample_table struct {
+	dts    []int64
+	cts    []int32
+	sizes  []uint32
+	keys   []uint32 // 关键帧的序号，从 1 开始
+	chunks []chunk
+}
+
+// 先写入 mdat，采样表记在内存中，最后在文件末尾写入 moov
+type progressive_writer struct {
+	f          *os.File
+	buf        *bufio.Writer
+	tracks     []*track
+	tables     map[*track]*sample_table
+	mdat_start uint64
+	pos        uint64 // 下一个采样在文件中的位置
+	last       *track
+}
+
+func new_progressive_writer(f *os.File, video, audio *track) (*progressive_writer, error) {
+	w := &progressive_writer{
+		f:      f,
+		buf:    bufio.NewWriterSize(f, 1024*1024),
+		tables: make(map[*track]*sample_table),
+	}
+	for _, t := range []*track{video, audio} {
+		if t != nil {
+			w.tracks = append(w.tracks, t)
+			w.tables[t] = &sample_table{}
+		}
+	}
+	head := ftyp("isom", "isom", "iso2", "avc1", "mp41")
+	// mdat 使用 64 位长度，写完后再回填
+	head = append(head, u32(1)...)
+	head = append(head, "mdat"...)
+	head = append(head, u64(0)...)
+	if _, err := w.buf.Write(head); err != nil {
+		return nil, err
+	}
+	w.mdat_start = uint64(len(head) - 16)
+	w.pos = uint64(len(head))
+	return w, nil
+}
+
+func (w *progressive_writer) WriteSample(s *sample) error {
+	if _, err := w.buf.Write(s.data); err != nil {
+		return err
+	}
+	tb := w.tables[s.track]
+	tb.dts = append(tb.dts, s.dts)
+	tb.cts = append(tb.cts, s.cts)
+	tb.sizes = append(tb.sizes, uint32(len(s.data)))
+	if s.key {
+		tb.keys = append(tb.keys, uint32(len(tb.dts)))
+	}
+	// 同一轨道连续的采样放在同一个 chunk 中
+	if w.last == s.track && len(tb.chunks) > 0 {
+		tb.chunks[len(tb.chunks)-1].count++
+	} else {
+		tb.chunks = append(tb.chunks, chunk{offset: w.pos, count: 1})
+	}
+	w.last = s.track
+	w.pos += uint64(len(s.data))
+	return nil
+}
+
+func (w *progressive_writer) Close() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.f.WriteAt(u64(w.pos-w.mdat_start), int64(w.mdat_start)+8); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(int64(w.pos), io.SeekStart); err != nil {
+		return err
+	}
+	_, err := w.f.Write(w.moov())
+	return err
+}
+
+func (w *progressive_writer) moov() []byte {
+	var movie_duration uint64
+	var traks [][]byte
+	for _, t := range w.tracks {
+		tb := w.tables[t]
+		if len(tb.dts) == 0 {
+			continue
+		}
+		durations := sample_durations(tb.dts, t)
+		first := tb.dts[0]
+		last := len(tb.dts) - 1
+		media_duration := uint64(tb.dts[last] - first + int64(durations[last]))
+		track_duration := uint64(first) + media_duration
+		if track_duration > movie_duration {
+			movie_duration = track_duration
+		}
+		stbl := [][]byte{stsd(t), stts(durations)}
+		if c := ctts(tb.cts); c != nil {
+			stbl = append(stbl, c)
+		}
+		if t.kind == kindVideo && len(tb.keys) < len(tb.dts) {
+			stbl = append(stbl, full_box("stss", 0, 0, u32(uint32(len(tb.keys))), u32s(tb.keys)))
+		}
+		stbl = append(stbl, stsc(tb.chunks), stsz(tb.sizes), co64(tb.chunks))
+		trak := [][]byte{tkhd(t, track_duration)}
+		if first > 0 || tb.cts[0] != 0 {
+			trak = append(trak, edts(uint64(first), media_duration, int64(tb.cts[0])))
+		}
+		trak = append(trak, box("mdia",
+			mdhd(timescale, media_duration),
+			hdlr(t),
+			box("minf", media_header(t), dinf(), box("stbl", stbl...)),
+		))
+		traks = append(traks, box("trak", trak...))
+	}
+	return box("moov", append([][]byte{mvhd(timescale, movie_duration, uint32(len(w.tracks)+1))}, traks...)...)
+}
+
+// 根据相邻采样的解码时间计算时长，最后一个采样沿用前一个的时长
+func sample_durations(dts []int64, t *track) []uint32 {
+	durations := make([]uint32, len(dts))
+	for i := 0; i+1 < len(dts); i++ {
+		durations[i] = uint32(dts[i+1] - dts[i])
+	}
+	last := len(dts) - 1
+	if last > 0 {
+		durations[last] = durations[last-1]
+	} else {
+		durations[last] = default_sample_duration(t)
+	}
+	return durations
+}
+
+func default_sample_duration(t *track) uint32 {
+	if t.kind == kindVideo {
+		return defaultVideoSampleDuration
+	}
+	return defaultAudioSampleDuration
+}
+
+func stts(durations []uint32) []byte {
+	var entries []byte
+	var count uint32
+	for i, d := range durations {
+		if i > 0 && d != durations[i-1] {
+			entries = append(entries, u32(count)...)
+			entries = append(entries, u32(durations[i-1])...)
+			count = 0
+		}
+		count++
+	}
+	entries = append(entries, u32(count)...)
+	entries = append(entries, u32(durations[len(durations)-1])...)
+	return full_box("stts", 0, 0, u32(uint32(len(entries)/8)), entries)
+}
+
+// 所有采样的显示时间偏移都为 0 时不需要 ctts
+func ctts(cts []int32) []byte {
+	has_offset := false
+	var version uint8
+	for _, c := range cts {
+		if c != 0 {
+			has_offset = true
+		}
+		if c < 0 {
+			version = 1
+		}
+	}
+	if !has_offset {
+		return nil
+	}
+	var entries []byte
+	var count uint32
+	for i, c := range cts {
+		if i > 0 && c != cts[i-1] {
+			entries = append(entries, u32(count)...)
+			entries = append(entries, u32(uint32(cts[i-1]))...)
+			count = 0
+		}
+		count++
+	}
+	entries = append(entries, u32(count)...)
+	entries = append(entries, u32(uint32(cts[len(cts)-1]))...)
+	return full_box("ctts", version, 0, u32(uint32(len(entries)/8)), entries)
+}
+
+func stsc(chunks []chunk) []byte {
+	var entries []byte
+	for i, c := range chunks {
+		if i > 0 && c.count == chunks[i-1].count {
+			continue
+		}
+		entries = append(entries, u32(uint32(i+1))...)
+		entries = append(entries, u32(c.count)...)
+		entries = append(entries, u32(1)...)
+	}
+	return full_box("stsc", 0, 0, u32(uint32(len(entries)/12)), entries)
+}
+
+func stsz(sizes []uint32) []byte {
+	return full_box("stsz", 0, 0, u32(0), u32(uint32(len(sizes))), u32s(sizes))
+}
+
+func co64(chunks []chunk) []byte {
+	offsets := make([]byte, 0, len(chunks)*8)
+	for _, c := range chunks {
+		offsets = append(offsets, u64(c.offset)...)
+	}
+	return full_box("co64", 0, 0, u32(uint32(len(chunks))), offsets)
+}
+
+// 轨道开始时间不为 0 时，用空的 edit 补齐前面的时间，并跳过 B 帧带来的显示延迟
+func edts(start uint64, media_duration uint64, media_time int64) []byte {
+	var entries [][]byte
+	if start > 0 {
+		entries = append(entries, u64(start), u64(^uint64(0)), u32(0x00010000))
+	}
+	entries = append(entries, u64(media_duration), u64(uint64(media_time)), u32(0x00010000))
+	return box("edts", full_box("elst", 1, 0, append([][]byte{u32(uint32(len(entries) / 3))}, entries...)...))
+}
+
+func u32s(values []uint32) []byte {
+	out := make([]byte, 0, len(values)*4)
+	for _, v := range values {
+		out = append(out, u32(v)...)
+	}
+	return out
+}
+
+// fragmented MP4，开头只写入编码参数，之后每段数据写成一个 moof + mdat
+type fragmented_writer struct {
+	w          *bufio.Writer
+	video      *track
+	tracks     []*track
+	seq        uint32
+	pending    map[*track][]*sample
+	count      int
+	frag_start int64
+	last_dur   map[*track]uint32
+}
+
+func new_fragmented_writer(f *os.File, video, audio *track) (*fragmented_writer, error) {
+	w := &fragmented_writer{
+		w:        bufio.NewWriterSize(f, 1024*1024),
+		video:    video,
+		pending:  make(map[*track][]*sample),
+		last_dur: make(map[*track]uint32),
+	}
+	var traks [][]byte
+	var trex [][]byte
+	for _, t := range []*track{video, audio} {
+		if t == nil {
+			continue
+		}
+		w.tracks = append(w.tracks, t)
+		stbl := box("stbl",
+			stsd(t),
+			full_box("stts", 0, 0, u32(0)),
+			full_box("stsc", 0, 0, u32(0)),
+			full_box("stsz", 0, 0, u32(0), u32(0)),
+			full_box("stco", 0, 0, u32(0)),
+		)
+		traks = append(traks, box("trak",
+			tkhd(t, 0),
+			box("mdia", mdhd(timescale, 0), hdlr(t), box("minf", media_header(t), dinf(), stbl)),
+		))
+		trex = append(trex, full_box("trex", 0, 0, u32(t.id), u32(1), u32(0), u32(0), u32(0)))
+	}
+	moov := [][]byte{mvhd(timescale, 0, uint32(len(w.tracks)+1))}
+	moov = append(moov, traks...)
+	moov = append(moov, box("mvex", trex...))
+	if _, err := w.w.Write(ftyp("isom", "isom", "iso6", "avc1", "mp41")); err != nil {
+		return nil, err
+	}
+	if _, err := w.w.Write(box("moov", moov...)); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *fragmented_writer) WriteSample(s *sample) error {
+	if w.count > 0 && s.dts-w.frag_start >= fragmentDuration {
+		if w.video == nil || (s.track == w.video && s.key) {
+			if err := w.flush(s); err != nil {
+				return err
+			}
+		}
+	}
+	if w.count == 0 {
+		w.frag_start = s.dts
+	}
+	w.pending[s.track] = append(w.pending[s.track], s)
+	w.count++
+	return nil
+}
+
+func (w *fragmented_writer) Close() error {
+	if err := w.flush(nil); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// 写出缓存的采样，next 为下一个 fragment 的第一个采样，用来计算最后一个采样的时长
+func (w *fragmented_writer) flush(next *sample) error {
+	if w.count == 0 {
+		return nil
+	}
+	w.seq++
+	type traf_data struct {
+		t         *track
+		samples   []*sample
+		durations []uint32
+	}
+	var trafs []traf_data
+	for _, t := range w.tracks {
+		samples := w.pending[t]
+		if len(samples) == 0 {
+			continue
+		}
+		durations := make([]uint32, len(samples))
+		for i := 0; i+1 < len(samples); i++ {
+			durations[i] = uint32(samples[i+1].dts - samples[i].dts)
+		}
+		last := len(samples) - 1
+		switch {
+		case next != nil && next.track == t:
+			durations[last] = uint32(next.dts - samples[last].dts)
+		case last > 0:
+			durations[last] = durations[last-1]
+		case w.last_dur[t] > 0:
+			durations[last] = w.last_dur[t]
+		default:
+			durations[last] = default_sample_duration(t)
+		}
+		w.last_dur[t] = durations[last]
+		trafs = append(trafs, traf_data{t: t, samples: samples, durations: durations})
+	}
+	build := func(data_offsets []int32) []byte {
+		parts := [][]byte{full_box("mfhd", 0, 0, u32(w.seq))}
+		for i, tf := range trafs {
+			flags := uint32(0x000001 | 0x000100 | 0x000200 | 0x000400)
+			if tf.t.kind == kindVideo {
+				flags |= 0x000800
+			}
+			var entries []byte
+			for j, s := range tf.samples {
+				entries = append(entries, u32(tf.durations[j])...)
+				entries = append(entries, u32(uint32(len(s.data)))...)
+				entries = append(entries, u32(sample_flags(s))...)
+				if tf.t.kind == kindVideo {
+					entries = append(entries, u32(uint32(s.cts))...)
+				}
+			}
+			parts = append(parts, box("traf",
+				full_box("tfhd", 0, 0x020000, u32(tf.t.id)),
+				full_box("tfdt", 1, 0, u64(uint64(tf.samples[0].dts))),
+				full_box("trun", 1, flags, u32(uint32(len(tf.samples))), u32(uint32(data_offsets[i])), entries),
+			))
+		}
+		return box("moof", parts...)
+	}
+	// moof 的长度与 data offset 的值无关，先算出长度再填入偏移
+	offsets := make([]int32, len(trafs))
+	moof_size := len(build(offsets))
+	mdat_size := 8
+	for i, tf := range trafs {
+		offsets[i] = int32(moof_size + mdat_size)
+		for _, s := range tf.samples {
+			mdat_size += len(s.data)
+		}
+	}
+	if _, err := w.w.Write(build(offsets)); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(append(u32(uint32(mdat_size)), "mdat"...)); err != nil {
+		return err
+	}
+	for _, tf := range trafs {
+		for _, s := range tf.samples {
+			if _, err := w.w.Write(s.data); err != nil {
+				return err
+			}
+		}
+	}
+	for t := range w.pending {
+		w.pending[t] = nil
+	}
+	w.count = 0
+	return nil
+}
+
+func sample_flags(s *sample) uint32 {
+	if s.key {
+		// sample_depends_on = 2，不依赖其他帧
+		return 0x02000000
+	}
+	// sample_depends_on = 1，sample_is_non_sync_sample = 1
+	return 0x01010000
+}
@@ -0,0 +1,330 @@
+package remux
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"wx_channel/pkg/flv"
+)
+
+const (
+	kindVideo = "video"
+	kindAudio = "audio"
+	// FLV 的时间戳单位为毫秒，两个轨道都直接使用毫秒作为时间单位
+	timescale = 1000
+	// 相邻两个 tag 的时间戳相差超过该值时认为是断线重连留下的间隔
+	maxTimestampGap = 1000
+	// 一个轨道只有一个采样，或者无法推算时长时使用的默认时长
+	defaultVideoSampleDuration = 40
+	defaultAudioSampleDuration = 23
+)
+
+var (
+	ErrNoInput       = errors.New("没有需要转换的文件")
+	ErrNoMediaTracks = errors.New("文件中没有 H.264 视频或 AAC 音频")
+)
+
+type Options struct {
+	// 输出 fragmented MP4，否则输出普通 MP4
+	Fragmented bool
+}
+
+type Result struct {
+	Duration        time.Duration
+	VideoSamples    int
+	AudioSamples    int
+	Discontinuities int // 修正的时间戳间隔个数
+}
+
+type track struct {
+	id       uint32
+	kind     string
+	config   []byte
+	width    int
+	height   int
+	channels uint16
+	// 音频采样率，轨道的时间单位仍然是毫秒
+	sample_rate uint32
+	last_dts    int64
+	samples     int
+}
+
+type sample struct {
+	track *track
+	dts   int64
+	cts   int32
+	key   bool
+	data  []byte
+}
+
+// 将一个或多个 FLV 文件（同一场直播的多个分段）按顺序转换为一个 MP4 文件，不重新编码
+// 先写入同目录的临时文件，完成后再重命名为 output
+func RemuxFLVToMP4(inputs []string, output string, opts Options) (*Result, error) {
+	if len(inputs) == 0 {
+		return nil, ErrNoInput
+	}
+	video, audio, err := scan_tracks(inputs)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(output), ".tmp_wx_remux_*")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时文件失败 %v", err.Error())
+	}
+	tmp_filepath := tmp.Name()
+	defer os.Remove(tmp_filepath)
+
+	var w sample_writer
+	if opts.Fragmented {
+		w, err = new_fragmented_writer(tmp, video, audio)
+	} else {
+		w, err = new_progressive_writer(tmp, video, audio)
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	result, err := remux(inputs, video, audio, w)
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("写入文件失败 %v", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("写入文件失败 %v", err.Error())
+	}
+	if err := os.Rename(tmp_filepath, output); err != nil {
+		return nil, fmt.Errorf("写入文件失败 %v", err.Error())
+	}
+	return result, nil
+}
+
+type sample_writer interface {
+	WriteSample(s *sample) error
+	Close() error
+}
+
+// 读取编码参数，确定输出文件中有哪些轨道
+func scan_tracks(inputs []string) (video, audio *track, err error) {
+	for _, input := range inputs {
+		err := each_tag(input, func(tag *flv.Tag) (bool, error) {
+			if !tag.IsSequenceHeader() {
+				return true, nil
+			}
+			if tag.Type == flv.TagVideo && video == nil {
+				video, err = new_video_track(tag)
+			}
+			if tag.Type == flv.TagAudio && audio == nil {
+				audio, err = new_audio_track(tag)
+			}
+			if err != nil {
+				return false, err
+			}
+			return video == nil || audio == nil, nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if video != nil && audio != nil {
+			break
+		}
+	}
+	if video == nil && audio == nil {
+		return nil, nil, ErrNoMediaTracks
+	}
+	var id uint32 = 1
+	for _, t := range []*track{video, audio} {
+		if t != nil {
+			t.id = id
+			t.last_dts = -1
+			id++
+		}
+	}
+	return video, audio, nil
+}
+
+func new_video_track(tag *flv.Tag) (*track, error) {
+	if tag.Data[0]&0x0f != 7 {
+		return nil, errors.New("仅支持 H.264 视频")
+	}
+	if len(tag.Data) < 5 {
+		return nil, errShortConfig
+	}
+	config := tag.Data[5:]
+	width, height, err := parse_avc_config(config)
+	if err != nil {
+		return nil, err
+	}
+	return &track{
+		kind:   kindVideo,
+		config: config,
+		width:  width,
+		height: height,
+	}, nil
+}
+
+func new_audio_track(tag *flv.Tag) (*track, error) {
+	if tag.Data[0]>>4 != 10 {
+		return nil, errors.New("仅支持 AAC 音频")
+	}
+	config := tag.Data[2:]
+	sample_rate, channels, err := parse_aac_config(config)
+	if err != nil {
+		return nil, err
+	}
+	return &track{
+		kind:        kindAudio,
+		config:      config,
+		sample_rate: sample_rate,
+		channels:    channels,
+	}, nil
+}
+
+// 依次读取文件中的 tag，fn 返回 false 时停止读取
+func each_tag(input string, fn func(tag *flv.Tag) (bool, error)) error {
+	f, err := os.Open(input)
+	if err != nil {
+		return fmt.Errorf("读取文件失败 %v", err.Error())
+	}
+	defer f.Close()
+	reader, err := flv.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%s %v", input, err)
+	}
+	for {
+		tag, err := reader.ReadTag()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// 录制中断时最后一个 tag 可能不完整，忽略即可
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s %v", input, err)
+		}
+		more, err := fn(tag)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// 把各个文件、各段的时间戳映射到一条连续的时间线上
+type timeline struct {
+	offset  int64
+	last_ts int64 // 上一个 tag 的原始时间戳
+	end     int64 // 已输出内容的结束时间
+	started bool
+	gaps    int
+}
+
+func (tl *timeline) reset() {
+	tl.started = false
+}
+
+func (tl *timeline) dts(ts uint32, duration int64) int64 {
+	raw := int64(ts)
+	if !tl.started {
+		tl.offset = tl.end - raw
+		tl.started = true
+	} else if raw < tl.last_ts-maxTimestampGap || raw > tl.last_ts+maxTimestampGap {
+		// 时间戳回退或者突然跳跃，接在已输出内容之后继续
+		tl.offset = tl.end - raw
+		tl.gaps++
+	}
+	tl.last_ts = raw
+	dts := raw + tl.offset
+	if dts+duration > tl.end {
+		tl.end = dts + duration
+	}
+	return dts
+}
+
+func remux(inputs []string, video, audio *track, w sample_writer) (*Result, error) {
+	tl := &timeline{}
+	result := &Result{}
+	for i, input := range inputs {
+		tl.reset()
+		// 每个分段都以关键帧开始写入视频
+		waiting_keyframe := video != nil
+		err := each_tag(input, func(tag *flv.Tag) (bool, error) {
+			var t *track
+			switch tag.Type {
+			case flv.TagVideo:
+				t = video
+			case flv.TagAudio:
+				t = audio
+			}
+			if t == nil || len(tag.Data) < 2 {
+				return true, nil
+			}
+			if tag.IsSequenceHeader() {
+				config := tag.Data[2:]
+				if t.kind == kindVideo && len(tag.Data) >= 5 {
+					config = tag.Data[5:]
+				}
+				if !bytes.Equal(config, t.config) {
+					return false, fmt.Errorf("第 %d 个文件 %s 的编码参数与前面的不一致，无法合并", i+1, input)
+				}
+				return true, nil
+			}
+			s := &sample{track: t}
+			if t.kind == kindVideo {
+				if tag.Data[0]&0x0f != 7 || tag.Data[1] != 1 || len(tag.Data) < 5 {
+					return true, nil
+				}
+				s.key = tag.IsKeyframe()
+				if waiting_keyframe && !s.key {
+					return true, nil
+				}
+				waiting_keyframe = false
+				cts := int32(tag.Data[2])<<16 | int32(tag.Data[3])<<8 | int32(tag.Data[4])
+				// 24 位有符号数
+				s.cts = cts << 8 >> 8
+				s.data = tag.Data[5:]
+				s.dts = tl.dts(tag.Timestamp, defaultVideoSampleDuration)
+			} else {
+				if tag.Data[1] != 1 {
+					return true, nil
+				}
+				s.key = true
+				s.data = tag.Data[2:]
+				s.dts = tl.dts(tag.Timestamp, defaultAudioSampleDuration)
+			}
+			// 同一轨道的解码时间必须递增
+			if s.dts <= t.last_dts {
+				s.dts = t.last_dts + 1
+			}
+			t.last_dts = s.dts
+			t.samples++
+			if err := w.WriteSample(s); err != nil {
+				return false, fmt.Errorf("写入文件失败 %v", err.Error())
+			}
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if video != nil {
+		result.VideoSamples = video.samples
+	}
+	if audio != nil {
+		result.AudioSamples = audio.samples
+	}
+	if result.VideoSamples+result.AudioSamples == 0 {
+		return nil, ErrNoMediaTracks
+	}
+	result.Duration = time.Duration(tl.end) * time.Millisecond
+	result.Discontinuities = tl.gaps
+	return result, nil
+}
@@ -0,0 +1,512 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"wx_channel/pkg/flv"
+)
+
+type bit_writer struct {
+	data []byte
+	bits int
+}
+
+func (bw *bit_writer) write_bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if bw.bits%8 == 0 {
+			bw.data = append(bw.data, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			bw.data[len(bw.data)-1] |= 1 << uint(7-bw.bits%8)
+		}
+		bw.bits++
+	}
+}
+
+func (bw *bit_writer) write_ue(v uint32) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	bw.write_bits(0, n)
+	bw.write_bits(v, n+1)
+}
+
+// baseline profile 的 SPS，只包含计算宽高需要的字段
+func test_sps(width, height int) []byte {
+	bw := &bit_writer{}
+	bw.write_bits(0x67, 8) // NAL 头
+	bw.write_bits(66, 8)   // profile_idc
+	bw.write_bits(0, 8)    // constraint_set_flags
+	bw.write_bits(30, 8)   // level_idc
+	bw.write_ue(0)         // seq_parameter_set_id
+	bw.write_ue(0)         // log2_max_frame_num_minus4
+	bw.write_ue(0)         // pic_order_cnt_type
+	bw.write_ue(0)         // log2_max_pic_order_cnt_lsb_minus4
+	bw.write_ue(1)         // max_num_ref_frames
+	bw.write_bits(0, 1)    // gaps_in_frame_num_value_allowed_flag
+	bw.write_ue(uint32(width/16 - 1))
+	bw.write_ue(uint32(height/16 - 1))
+	bw.write_bits(1, 1) // frame_mbs_only_flag
+	bw.write_bits(1, 1) // direct_8x8_inference_flag
+	bw.write_bits(0, 1) // frame_cropping_flag
+	bw.write_bits(0, 1) // vui_parameters_present_flag
+	bw.write_bits(1, 1) // rbsp_stop_one_bit
+	return bw.data
+}
+
+func test_avc_config(width, height int) []byte {
+	sps := test_sps(width, height)
+	pps := []byte{0x68, 0xce, 0x38, 0x80}
+	config := []byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1}
+	config = binary.BigEndian.AppendUint16(config, uint16(len(sps)))
+	config = append(config, sps...)
+	config = append(config, 1)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(pps)))
+	return append(config, pps...)
+}
+
+// AAC LC，44100Hz，双声道
+var test_aac_config = []byte{0x12, 0x10}
+
+// 每个采样的内容包含轨道和序号，用来检查输出中的偏移
+func sample_payload(kind string, idx int) []byte {
+	return []byte(fmt.Sprintf("%s-sample-%05d", kind, idx))
+}
+
+type test_segment struct {
+	frames int // 视频帧数，音频按 23ms 一帧
+	jump   int // 在第几帧之后时间戳跳跃，为 0 时不跳跃
+	start  uint32
+}
+
+// 生成一个分段文件，返回写入的视频帧数和音频帧数
+// video_idx 和 audio_idx 是该分段第一个采样的全局序号
+func write_test_flv(t *testing.T, path string, seg test_segment, video_idx, audio_idx int) (int, int) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w, err := flv.NewWriter(f, flv.Header{HasAudio: true, HasVideo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(tag *flv.Tag) {
+		if err := w.WriteTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(&flv.Tag{Type: flv.TagScript, Timestamp: seg.start, Data: []byte{2, 0, 10}})
+	write(&flv.Tag{Type: flv.TagVideo, Timestamp: seg.start, Data: append([]byte{0x17, 0, 0, 0, 0}, test_avc_config(320, 240)...)})
+	write(&flv.Tag{Type: flv.TagAudio, Timestamp: seg.start, Data: append([]byte{0xaf, 0}, test_aac_config...)})
+
+	type item struct {
+		ts  uint32
+		tag *flv.Tag
+	}
+	var items []item
+	var offset uint32
+	var end uint32
+	for i := 0; i < seg.frames; i++ {
+		if seg.jump > 0 && i == seg.jump {
+			offset = 60000
+		}
+		ts := seg.start + offset + uint32(i*40)
+		head := []byte{0x27, 1, 0, 0, 40}
+		if i%10 == 0 {
+			head[0] = 0x17
+		}
+		items = append(items, item{ts, &flv.Tag{Type: flv.TagVideo, Timestamp: ts, Data: append(head, sample_payload("v", video_idx+i)...)}})
+		end = ts + 40
+	}
+	audio := 0
+	for i := 0; ; i++ {
+		local := uint32(i * 23)
+		if seg.jump > 0 && local >= uint32(seg.jump*40) {
+			local += 60000
+		}
+		ts := seg.start + local
+		if ts >= end {
+			break
+		}
+		items = append(items, item{ts, &flv.Tag{Type: flv.TagAudio, Timestamp: ts, Data: append([]byte{0xaf, 1}, sample_payload("a", audio_idx+i)...)}})
+		audio++
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].ts < items[j].ts })
+	for _, it := range items {
+		write(it.tag)
+	}
+	// 录制中断时最后一个 tag 不完整
+	if _, err := f.Write([]byte{9, 0, 0, 100, 0}); err != nil {
+		t.Fatal(err)
+	}
+	return seg.frames, audio
+}
+
+// 第一个分段中间时间戳跳跃，第二个分段从 0 开始，模拟断线重连
+func write_test_inputs(t *testing.T) ([]string, int, int) {
+	dir := t.TempDir()
+	segments := []test_segment{
+		{frames: 50, jump: 20, start: 1000},
+		{frames: 30, start: 0},
+	}
+	var inputs []string
+	var videos, audios int
+	for i, seg := range segments {
+		path := filepath.Join(dir, fmt.Sprintf("live_part%d.flv", i+1))
+		v, a := write_test_flv(t, path, seg, videos, audios)
+		videos += v
+		audios += a
+		inputs = append(inputs, path)
+	}
+	return inputs, videos, audios
+}
+
+type parsed_box struct {
+	typ     string
+	offset  int64 // 在文件中的位置
+	payload []byte
+	header  int64
+}
+
+func parse_boxes(t *testing.T, data []byte, base int64) []parsed_box {
+	t.Helper()
+	var boxes []parsed_box
+	var pos int64
+	for pos < int64(len(data)) {
+		size := int64(binary.BigEndian.Uint32(data[pos:]))
+		header := int64(8)
+		if size == 1 {
+			size = int64(binary.BigEndian.Uint64(data[pos+8:]))
+			header = 16
+		}
+		if size < header || pos+size > int64(len(data)) {
+			t.Fatalf("box 长度错误 %d，位置 %d", size, base+pos)
+		}
+		boxes = append(boxes, parsed_box{
+			typ:     string(data[pos+4 : pos+8]),
+			offset:  base + pos,
+			payload: data[pos+header : pos+size],
+			header:  header,
+		})
+		pos += size
+	}
+	return boxes
+}
+
+func find_box(t *testing.T, boxes []parsed_box, path ...string) parsed_box {
+	t.Helper()
+	for _, b := range boxes {
+		if b.typ != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return b
+		}
+		return find_box(t, parse_boxes(t, b.payload, b.offset+b.header), path[1:]...)
+	}
+	t.Fatalf("没有找到 %v", path)
+	return parsed_box{}
+}
+
+func find_all(boxes []parsed_box, typ string) []parsed_box {
+	var result []parsed_box
+	for _, b := range boxes {
+		if b.typ == typ {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+// 一个轨道的所有采样，data 是按输出中的偏移读取的内容
+type parsed_track struct {
+	id        uint32
+	durations []uint32
+	data      [][]byte
+}
+
+func (p *parsed_track) check(t *testing.T, kind string, count int) {
+	t.Helper()
+	if len(p.data) != count {
+		t.Fatalf("轨道 %d 有 %d 个采样，期望 %d", p.id, len(p.data), count)
+	}
+	for i, d := range p.data {
+		if want := sample_payload(kind, i); !bytes.Equal(d, want) {
+			t.Fatalf("轨道 %d 第 %d 个采样为 %q，期望 %q", p.id, i, d, want)
+		}
+	}
+	for i, d := range p.durations {
+		if d == 0 || d > maxTimestampGap {
+			t.Fatalf("轨道 %d 第 %d 个采样时长为 %d", p.id, i, d)
+		}
+	}
+}
+
+func (p *parsed_track) total() uint64 {
+	var sum uint64
+	for _, d := range p.durations {
+		sum += uint64(d)
+	}
+	return sum
+}
+
+// 按 stts、stsc、stsz、co64 展开每个采样
+func parse_progressive(t *testing.T, data []byte) map[uint32]*parsed_track {
+	t.Helper()
+	top := parse_boxes(t, data, 0)
+	if len(top) != 3 || top[0].typ != "ftyp" || top[1].typ != "mdat" || top[2].typ != "moov" {
+		t.Fatalf("最外层的 box 不正确 %v", top)
+	}
+	mdat := top[1]
+	tracks := make(map[uint32]*parsed_track)
+	for _, trak := range find_all(parse_boxes(t, top[2].payload, top[2].offset+8), "trak") {
+		children := parse_boxes(t, trak.payload, trak.offset+8)
+		id := binary.BigEndian.Uint32(find_box(t, children, "tkhd").payload[20:])
+		stbl := parse_boxes(t, find_box(t, children, "mdia", "minf", "stbl").payload, 0)
+		p := &parsed_track{id: id}
+
+		stts := find_box(t, stbl, "stts").payload
+		for i := 0; i < int(binary.BigEndian.Uint32(stts[4:])); i++ {
+			count := binary.BigEndian.Uint32(stts[8+i*8:])
+			delta := binary.BigEndian.Uint32(stts[12+i*8:])
+			for j := uint32(0); j < count; j++ {
+				p.durations = append(p.durations, delta)
+			}
+		}
+		mdhd := find_box(t, children, "mdia", "mdhd").payload
+		if d := binary.BigEndian.Uint64(mdhd[24:]); d != p.total() {
+			t.Fatalf("轨道 %d mdhd 时长 %d，采样时长之和 %d", id, d, p.total())
+		}
+
+		stsz := find_box(t, stbl, "stsz").payload
+		sizes := make([]uint32, binary.BigEndian.Uint32(stsz[8:]))
+		for i := range sizes {
+			sizes[i] = binary.BigEndian.Uint32(stsz[12+i*4:])
+		}
+		co64 := find_box(t, stbl, "co64").payload
+		offsets := make([]uint64, binary.BigEndian.Uint32(co64[4:]))
+		for i := range offsets {
+			offsets[i] = binary.BigEndian.Uint64(co64[8+i*8:])
+			if i > 0 && offsets[i] <= offsets[i-1] {
+				t.Fatalf("轨道 %d chunk 偏移没有递增 %d <= %d", id, offsets[i], offsets[i-1])
+			}
+			if offsets[i] < uint64(mdat.offset+mdat.header) || offsets[i] >= uint64(mdat.offset+mdat.header)+uint64(len(mdat.payload)) {
+				t.Fatalf("轨道 %d chunk 偏移 %d 不在 mdat 中", id, offsets[i])
+			}
+		}
+		stsc := find_box(t, stbl, "stsc").payload
+		entries := int(binary.BigEndian.Uint32(stsc[4:]))
+		sample := 0
+		for chunk := range offsets {
+			per_chunk := uint32(0)
+			for e := 0; e < entries; e++ {
+				if int(binary.BigEndian.Uint32(stsc[8+e*12:])) <= chunk+1 {
+					per_chunk = binary.BigEndian.Uint32(stsc[12+e*12:])
+				}
+			}
+			pos := offsets[chunk]
+			for j := uint32(0); j < per_chunk; j++ {
+				p.data = append(p.data, data[pos:pos+uint64(sizes[sample])])
+				pos += uint64(sizes[sample])
+				sample++
+			}
+		}
+		if sample != len(sizes) || len(p.durations) != len(sizes) {
+			t.Fatalf("轨道 %d stsc 中有 %d 个采样，stts 中有 %d 个，stsz 中有 %d 个", id, sample, len(p.durations), len(sizes))
+		}
+		tracks[id] = p
+	}
+	return tracks
+}
+
+// 按每个 moof 中的 tfdt、trun 展开采样，检查解码时间在 fragment 之间连续
+func parse_fragmented(t *testing.T, data []byte) map[uint32]*parsed_track {
+	t.Helper()
+	top := parse_boxes(t, data, 0)
+	if len(top) < 4 || top[0].typ != "ftyp" || top[1].typ != "moov" {
+		t.Fatalf("最外层的 box 不正确")
+	}
+	find_box(t, top, "moov", "mvex", "trex")
+	tracks := make(map[uint32]*parsed_track)
+	var seq uint32
+	for i := 2; i < len(top); i += 2 {
+		moof := top[i]
+		if moof.typ != "moof" || i+1 >= len(top) || top[i+1].typ != "mdat" {
+			t.Fatalf("第 %d 个 box 不是 moof + mdat", i)
+		}
+		children := parse_boxes(t, moof.payload, moof.offset+8)
+		mfhd := find_box(t, children, "mfhd").payload
+		if s := binary.BigEndian.Uint32(mfhd[4:]); s != seq+1 {
+			t.Fatalf("moof 序号为 %d，期望 %d", s, seq+1)
+		}
+		seq++
+		for _, traf := range find_all(children, "traf") {
+			boxes := parse_boxes(t, traf.payload, traf.offset+8)
+			id := binary.BigEndian.Uint32(find_box(t, boxes, "tfhd").payload[4:])
+			p, ok := tracks[id]
+			if !ok {
+				p = &parsed_track{id: id}
+				tracks[id] = p
+			}
+			tfdt := binary.BigEndian.Uint64(find_box(t, boxes, "tfdt").payload[4:])
+			if len(p.durations) > 0 && tfdt != p.total() {
+				t.Fatalf("轨道 %d 第 %d 个 fragment 开始于 %d，前面的采样结束于 %d", id, seq, tfdt, p.total())
+			}
+			trun := find_box(t, boxes, "trun").payload
+			flags := binary.BigEndian.Uint32(trun[0:4]) & 0xffffff
+			count := int(binary.BigEndian.Uint32(trun[4:]))
+			offset := int64(binary.BigEndian.Uint32(trun[8:]))
+			entry := 12
+			if flags&0x800 != 0 {
+				entry = 16
+			}
+			pos := moof.offset + offset
+			for j := 0; j < count; j++ {
+				e := trun[12+j*entry:]
+				duration := binary.BigEndian.Uint32(e)
+				size := int64(binary.BigEndian.Uint32(e[4:]))
+				p.durations = append(p.durations, duration)
+				p.data = append(p.data, data[pos:pos+size])
+				pos += size
+			}
+		}
+	}
+	return tracks
+}
+
+func TestRemuxFLVToMP4(t *testing.T) {
+	inputs, videos, audios := write_test_inputs(t)
+	for _, fragmented := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fragmented=%v", fragmented), func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "live.mp4")
+			result, err := RemuxFLVToMP4(inputs, output, Options{Fragmented: fragmented})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.VideoSamples != videos || result.AudioSamples != audios {
+				t.Fatalf("转换了 %d 个视频采样、%d 个音频采样，期望 %d、%d", result.VideoSamples, result.AudioSamples, videos, audios)
+			}
+			if result.Discontinuities != 1 {
+				t.Fatalf("修正了 %d 个时间戳间隔，期望 1", result.Discontinuities)
+			}
+			// 两个分段共 80 帧，跳跃的 60 秒和分段开头的 1 秒都不应该计入时长
+			if ms := result.Duration.Milliseconds(); ms < 80*40 || ms > 80*40+100 {
+				t.Fatalf("时长为 %d 毫秒", ms)
+			}
+			data, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tracks map[uint32]*parsed_track
+			if fragmented {
+				tracks = parse_fragmented(t, data)
+			} else {
+				tracks = parse_progressive(t, data)
+			}
+			if len(tracks) != 2 {
+				t.Fatalf("输出中有 %d 个轨道", len(tracks))
+			}
+			tracks[1].check(t, "v", videos)
+			tracks[2].check(t, "a", audios)
+			for _, p := range tracks {
+				if total := int64(p.total()); total > result.Duration.Milliseconds()+defaultVideoSampleDuration {
+					t.Fatalf("轨道 %d 的时长 %d 超过 %v", p.id, total, result.Duration)
+				}
+			}
+		})
+	}
+}
+
+func TestRemuxConfigMismatch(t *testing.T) {
+	inputs, _, _ := write_test_inputs(t)
+	// 第二个分段的分辨率不同，不能合并
+	f, err := os.Create(inputs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := flv.NewWriter(f, flv.Header{HasVideo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteTag(&flv.Tag{Type: flv.TagVideo, Data: append([]byte{0x17, 0, 0, 0, 0}, test_avc_config(640, 480)...)})
+	w.WriteTag(&flv.Tag{Type: flv.TagVideo, Data: append([]byte{0x17, 1, 0, 0, 0}, sample_payload("v", 0)...)})
+	f.Close()
+
+	output := filepath.Join(t.TempDir(), "live.mp4")
+	if _, err := RemuxFLVToMP4(inputs, output, Options{}); err == nil {
+		t.Fatal("编码参数不一致时没有返回错误")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatal("转换失败时生成了输出文件")
+	}
+}
+
+func TestParseCodecConfig(t *testing.T) {
+	for _, size := range [][2]int{{320, 240}, {1280, 720}, {1920, 1088}} {
+		width, height, err := parse_avc_config(test_avc_config(size[0], size[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if width != size[0] || height != size[1] {
+			t.Fatalf("分辨率为 %dx%d，期望 %dx%d", width, height, size[0], size[1])
+		}
+	}
+	if _, _, err := parse_avc_config(test_avc_config(320, 240)[:10]); err == nil {
+		t.Fatal("不完整的 AVC 编码参数没有返回错误")
+	}
+
+	cases := []struct {
+		config      []byte
+		sample_rate uint32
+		channels    uint16
+	}{
+		{test_aac_config, 44100, 2},
+		{[]byte{0x11, 0x88}, 48000, 1},
+		{[]byte{0x13, 0x00}, 24000, 2}, // 声道为 0 时按双声道处理
+	}
+	for _, c := range cases {
+		sample_rate, channels, err := parse_aac_config(c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sample_rate != c.sample_rate || channels != c.channels {
+			t.Fatalf("%x 的采样率 %d、声道 %d，期望 %d、%d", c.config, sample_rate, channels, c.sample_rate, c.channels)
+		}
+	}
+	if _, _, err := parse_aac_config([]byte{0x17, 0x80}); err == nil {
+		t.Fatal("无效的采样率没有返回错误")
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	tl := &timeline{}
+	var got []int64
+	// 跳跃、回退之后都接在已输出内容之后
+	for _, ts := range []uint32{5000, 5040, 5080, 90000, 90040, 100, 140} {
+		got = append(got, tl.dts(ts, 40))
+	}
+	want := []int64{0, 40, 80, 120, 160, 200, 240}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("解码时间为 %v，期望 %v", got, want)
+		}
+	}
+	if tl.gaps != 2 {
+		t.Fatalf("修正了 %d 个间隔，期望 2", tl.gaps)
+	}
+	// 新的文件从已输出内容的结束时间开始，不计为间隔
+	tl.reset()
+	if dts := tl.dts(0, 40); dts != 280 || tl.gaps != 2 {
+		t.Fatalf("新文件的解码时间为 %d，间隔 %d", dts, tl.gaps)
+	}
+}
@@ -0,0 +1,254 @@
+package sidecar
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"wx_channel/pkg/channels"
+	"wx_channel/pkg/tags"
+)
+
+// 视频旁要保存的文件
+type Options struct {
+	JSON   bool // 视频信息 .json
+	NFO    bool // Kodi、Jellyfin 使用的 .nfo
+	Poster bool // 封面 -poster.jpg
+}
+
+func (o Options) Enabled() bool {
+	return o.JSON || o.NFO || o.Poster
+}
+
+// 下载后保存的视频信息
+type Metadata struct {
+	FeedID       string            `json:"feed_id"`
+	NonceID      string            `json:"nonce_id,omitempty"`
+	Title        string            `json:"title"`
+	Description  string            `json:"description"`
+	Author       *channels.Contact `json:"author,omitempty"`
+	Format       string            `json:"format"` // 规格名称，原始视频为 original
+	Width        int               `json:"width,omitempty"`
+	Height       int               `json:"height,omitempty"`
+	Codec        string            `json:"codec,omitempty"`
+	Bitrate      int               `json:"bitrate,omitempty"`
+	Duration     float64           `json:"duration"` // 秒
+	Size         int64             `json:"size,omitempty"`
+	CoverURL     string            `json:"cover_url,omitempty"`
+	PublishedAt  *time.Time        `json:"published_at,omitempty"`
+	DownloadedAt time.Time         `json:"downloaded_at"`
+	Spec         *channels.Spec    `json:"spec,omitempty"` // 下载的规格，原始视频为空
+}
+
+// 根据视频信息和下载的规格生成，format 为空时表示原始视频
+func NewMetadata(profile *channels.Profile, format string) *Metadata {
+	if format == "" {
+		format = "original"
+	}
+	m := &Metadata{
+		FeedID:       profile.ID,
+		NonceID:      profile.NonceID,
+		Title:        profile.Headline(),
+		Description:  strings.TrimSpace(profile.Title),
+		Author:       profile.Contact,
+		Format:       format,
+		Size:         profile.Size,
+		CoverURL:     profile.CoverURL,
+		DownloadedAt: time.Now(),
+		Spec:         profile.FindSpec(format),
+	}
+	if profile.CreateTime > 0 {
+		t := time.Unix(profile.CreateTime, 0)
+		m.PublishedAt = &t
+	}
+	if m.Spec != nil {
+		m.Width = m.Spec.Width
+		m.Height = m.Spec.Height
+		m.Codec = m.Spec.CodingFormat
+		m.Bitrate = m.Spec.BitRate
+	}
+	m.Duration = profile.DurationOf(m.Spec)
+	return m
+}
+
+// 在视频旁保存视频信息，文件名和视频相同
+// 某个文件保存失败时继续保存其他文件，最后返回所有错误
+func Write(video_filepath string, profile *channels.Profile, format string, opts Options) error {
+	m := NewMetadata(profile, format)
+	if info, err := os.Stat(video_filepath); err == nil {
+		m.Size = info.Size()
+	}
+	var errs []error
+	if opts.JSON {
+		if err := WriteJSON(JSONFilepath(video_filepath), m); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if opts.NFO {
+		if err := WriteNFO(NFOFilepath(video_filepath), m); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if opts.Poster && m.CoverURL != "" {
+		if err := DownloadPoster(PosterFilepath(video_filepath), m.CoverURL); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func base_filepath(video_filepath string) string {
+	return strings.TrimSuffix(video_filepath, filepath.Ext(video_filepath))
+}
+
+func JSONFilepath(video_filepath string) string {
+	return base_filepath(video_filepath) + ".json"
+}
+
+func NFOFilepath(video_filepath string) string {
+	return base_filepath(video_filepath) + ".nfo"
+}
+
+// 媒体库按「视频文件名-poster.jpg」查找封面，PNG 格式的封面保存为 -poster.png
+func PosterFilepath(video_filepath string) string {
+	return base_filepath(video_filepath) + "-poster.jpg"
+}
+
+func WriteJSON(path string, m *Metadata) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	// 标题中常有 & 和 <>，保持原样方便查看
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	if err := write_file(path, buf.Bytes()); err != nil {
+		return fmt.Errorf("保存视频信息失败 %v", err.Error())
+	}
+	return nil
+}
+
+type nfo_movie struct {
+	XMLName   xml.Name      `xml:"movie"`
+	Title     string        `xml:"title"`
+	Plot      string        `xml:"plot,omitempty"`
+	Studio    string        `xml:"studio,omitempty"`
+	Premiered string        `xml:"premiered,omitempty"`
+	Year      int           `xml:"year,omitempty"`
+	Runtime   int           `xml:"runtime,omitempty"` // 分钟
+	Thumb     *nfo_thumb    `xml:"thumb,omitempty"`
+	UniqueID  nfo_unique_id `xml:"uniqueid"`
+	FileInfo  *nfo_fileinfo `xml:"fileinfo,omitempty"`
+}
+
+type nfo_thumb struct {
+	Aspect string `xml:"aspect,attr"`
+	URL    string `xml:",chardata"`
+}
+
+type nfo_unique_id struct {
+	Type    string `xml:"type,attr"`
+	Default bool   `xml:"default,attr"`
+	ID      string `xml:",chardata"`
+}
+
+type nfo_fileinfo struct {
+	Video nfo_video `xml:"streamdetails>video"`
+}
+
+type nfo_video struct {
+	Codec    string `xml:"codec,omitempty"`
+	Width    int    `xml:"width,omitempty"`
+	Height   int    `xml:"height,omitempty"`
+	Duration int    `xml:"durationinseconds,omitempty"`
+}
+
+// 按 Kodi 的电影格式保存，Jellyfin、Emby 也可以识别
+func WriteNFO(path string, m *Metadata) error {
+	movie := nfo_movie{
+		Title:    m.Title,
+		Plot:     m.Description,
+		UniqueID: nfo_unique_id{Type: "wx_channels", Default: true, ID: m.FeedID},
+	}
+	if m.Author != nil {
+		movie.Studio = m.Author.Nickname
+	}
+	if m.PublishedAt != nil {
+		movie.Premiered = m.PublishedAt.Format("2006-01-02")
+		movie.Year = m.PublishedAt.Year()
+	}
+	if m.Duration > 0 {
+		movie.Runtime = max(1, int(m.Duration+30)/60)
+	}
+	if m.CoverURL != "" {
+		movie.Thumb = &nfo_thumb{Aspect: "poster", URL: m.CoverURL}
+	}
+	if m.Width > 0 || m.Duration > 0 {
+		movie.FileInfo = &nfo_fileinfo{Video: nfo_video{
+			Codec:    nfo_codec(m.Codec),
+			Width:    m.Width,
+			Height:   m.Height,
+			Duration: int(m.Duration + 0.5),
+		}}
+	}
+	data, err := xml.MarshalIndent(movie, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+	if err := write_file(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("保存 nfo 文件失败 %v", err.Error())
+	}
+	return nil
+}
+
+func nfo_codec(codec string) string {
+	switch strings.ToLower(codec) {
+	case "h265", "hevc":
+		return "hevc"
+	case "h264", "avc":
+		return "h264"
+	}
+	return strings.ToLower(codec)
+}
+
+// 下载封面保存到 path，扩展名按封面的实际格式，不是图片时（例如错误页面）不保存
+func DownloadPoster(path string, cover_url string) error {
+	data, err := tags.FetchCover(cover_url)
+	if err != nil {
+		return err
+	}
+	switch tags.CoverMIME(data) {
+	case "image/jpeg":
+		path = strings.TrimSuffix(path, filepath.Ext(path)) + ".jpg"
+	case "image/png":
+		path = strings.TrimSuffix(path, filepath.Ext(path)) + ".png"
+	default:
+		return fmt.Errorf("封面不是 JPEG 或 PNG 格式（%s），没有保存", http.DetectContentType(data))
+	}
+	if err := write_file(path, data); err != nil {
+		return fmt.Errorf("保存封面失败 %v", err.Error())
+	}
+	return nil
+}
+
+// 先写入临时文件再替换，媒体库不会读到不完整的文件
+func write_file(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package sidecar
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"wx_channel/pkg/channels"
+)
+
+func test_profile() *channels.Profile {
+	return &channels.Profile{
+		ID:         "14253647586970",
+		NonceID:    "123_0_0",
+		Title:      "视频的标题 & <话题>\n#话题 #话题2\n",
+		CoverURL:   "https://finder.video.qq.com/cover?a=1&b=2",
+		CreateTime: 1700000000,
+		Size:       1000,
+		Duration:   61,
+		Spec: []channels.Spec{
+			{FileFormat: "xWT111", Width: 1080, Height: 1920, DurationMs: 60600, CodingFormat: "h265", BitRate: 2000},
+			{FileFormat: "xWT98", Width: 720, Height: 1280},
+		},
+		Contact: &channels.Contact{ID: "v2_author@finder", Nickname: "作者"},
+	}
+}
+
+const golden_json = `{
+  "feed_id": "14253647586970",
+  "nonce_id": "123_0_0",
+  "title": "视频的标题 & <话题>",
+  "description": "视频的标题 & <话题>\n#话题 #话题2",
+  "author": {
+    "id": "v2_author@finder",
+    "nickname": "作者",
+    "avatar_url": ""
+  },
+  "format": "xWT111",
+  "width": 1080,
+  "height": 1920,
+  "codec": "h265",
+  "bitrate": 2000,
+  "duration": 60.6,
+  "size": 1000,
+  "cover_url": "https://finder.video.qq.com/cover?a=1&b=2",
+  "published_at": "2023-11-14T22:13:20Z",
+  "downloaded_at": "2024-03-09T16:00:00Z",
+  "spec": {
+    "fileFormat": "xWT111",
+    "firstLoadBytes": 0,
+    "bitRate": 2000,
+    "codingFormat": "h265",
+    "dynamicRangeType": 0,
+    "vfps": 0,
+    "width": 1080,
+    "height": 1920,
+    "durationMs": 60600,
+    "qualityScore": 0,
+    "videoBitrate": 0,
+    "audioBitrate": 0,
+    "levelOrder": 0,
+    "bypass": "",
+    "is3az": 0
+  }
+}
+`
+
+const golden_nfo = `<?xml version="1.0" encoding="UTF-8"?>
+<movie>
+  <title>视频的标题 &amp; &lt;话题&gt;</title>
+  <plot>视频的标题 &amp; &lt;话题&gt;&#xA;#话题 #话题2</plot>
+  <studio>作者</studio>
+  <premiered>2023-11-14</premiered>
+  <year>2023</year>
+  <runtime>1</runtime>
+  <thumb aspect="poster">https://finder.video.qq.com/cover?a=1&amp;b=2</thumb>
+  <uniqueid type="wx_channels" default="true">14253647586970</uniqueid>
+  <fileinfo>
+    <streamdetails>
+      <video>
+        <codec>hevc</codec>
+        <width>1080</width>
+        <height>1920</height>
+        <durationinseconds>61</durationinseconds>
+      </video>
+    </streamdetails>
+  </fileinfo>
+</movie>
+`
+
+// 原始视频没有规格，时长使用第一个有时长的规格
+const golden_nfo_original = `<?xml version="1.0" encoding="UTF-8"?>
+<movie>
+  <title>14253647586970</title>
+  <premiered>2023-11-14</premiered>
+  <year>2023</year>
+  <runtime>1</runtime>
+  <uniqueid type="wx_channels" default="true">14253647586970</uniqueid>
+  <fileinfo>
+    <streamdetails>
+      <video>
+        <durationinseconds>61</durationinseconds>
+      </video>
+    </streamdetails>
+  </fileinfo>
+</movie>
+`
+
+func fixed_metadata(profile *channels.Profile, format string) *Metadata {
+	m := NewMetadata(profile, format)
+	m.DownloadedAt = time.Date(2024, 3, 9, 16, 0, 0, 0, time.UTC)
+	if m.PublishedAt != nil {
+		published := m.PublishedAt.UTC()
+		m.PublishedAt = &published
+	}
+	return m
+}
+
+func assert_golden(t *testing.T, path string, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("%s 的内容为\n%s\n期望\n%s", filepath.Base(path), got, want)
+	}
+}
+
+func TestWriteGolden(t *testing.T) {
+	dir := t.TempDir()
+	m := fixed_metadata(test_profile(), "xWT111")
+	if err := WriteJSON(filepath.Join(dir, "视频.json"), m); err != nil {
+		t.Fatal(err)
+	}
+	assert_golden(t, filepath.Join(dir, "视频.json"), golden_json)
+	if err := WriteNFO(filepath.Join(dir, "视频.nfo"), m); err != nil {
+		t.Fatal(err)
+	}
+	assert_golden(t, filepath.Join(dir, "视频.nfo"), golden_nfo)
+
+	profile := test_profile()
+	profile.Title = "\n \n"
+	profile.CoverURL = ""
+	profile.Contact = nil
+	if err := WriteNFO(filepath.Join(dir, "原始.nfo"), fixed_metadata(profile, "")); err != nil {
+		t.Fatal(err)
+	}
+	assert_golden(t, filepath.Join(dir, "原始.nfo"), golden_nfo_original)
+}
+
+func TestWritePoster(t *testing.T) {
+	jpeg := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01jpeg")
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDRpng")
+	covers := map[string][]byte{
+		"/jpeg": jpeg,
+		"/png":  png,
+		"/webp": []byte("RIFF\x10\x00\x00\x00WEBPVP8 webp"),
+		"/html": []byte("<!DOCTYPE html><html><body>error</body></html>"),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(covers[r.URL.Path])
+	}))
+	defer server.Close()
+	cases := []struct {
+		path string
+		want string // 期望保存的文件名，为空时不保存
+		data []byte
+	}{
+		{"/jpeg", "视频-poster.jpg", jpeg},
+		{"/png", "视频-poster.png", png},
+		{"/webp", "", nil},
+		{"/html", "", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			dir := t.TempDir()
+			video := filepath.Join(dir, "视频.mp4")
+			if err := os.WriteFile(video, []byte("video"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			profile := test_profile()
+			profile.CoverURL = server.URL + c.path
+			err := Write(video, profile, "", Options{JSON: true, Poster: true})
+			if (err != nil) != (c.want == "") {
+				t.Fatalf("保存封面返回 %v", err)
+			}
+			entries, _ := os.ReadDir(dir)
+			var names []string
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			want := []string{"视频.json", "视频.mp4"}
+			if c.want != "" {
+				want = append(want, c.want)
+			}
+			sort.Strings(want)
+			if strings.Join(names, ",") != strings.Join(want, ",") {
+				t.Fatalf("保存的文件为 %v，期望 %v", names, want)
+			}
+			if c.want != "" {
+				assert_golden(t, filepath.Join(dir, c.want), string(c.data))
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+
+package tags
+
+import "errors"
+
+// 其他系统不检查剩余空间
+func disk_free_space(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package tags
+
+import "syscall"
+
+// 目录所在磁盘的剩余空间
+func disk_free_space(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
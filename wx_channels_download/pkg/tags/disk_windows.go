@@ -0,0 +1,27 @@
+//go:build windows
+
+package tags
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32            = syscall.NewLazyDLL("kernel32.dll")
+	get_disk_free_space_ex = modkernel32.NewProc("GetDiskFreeSpaceExW")
+)
+
+// 目录所在磁盘的剩余空间
+func disk_free_space(dir string) (int64, error) {
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available uint64
+	ret, _, err := get_disk_free_space_ex.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&available)), 0, 0)
+	if ret == 0 {
+		return 0, err
+	}
+	return int64(available), nil
+}
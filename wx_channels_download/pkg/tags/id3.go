@@ -0,0 +1,137 @@
+package tags
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf16"
+)
+
+// 生成 ID3v2.3 标签，文字使用 UTF-16 保存，Windows 资源管理器也可以正常显示中文
+func ID3v2(t Tags) []byte {
+	var frames bytes.Buffer
+	if t.Title != "" {
+		frames.Write(id3_frame("TIT2", id3_text(t.Title)))
+	}
+	if t.Artist != "" {
+		frames.Write(id3_frame("TPE1", id3_text(t.Artist)))
+	}
+	if mime := CoverMIME(t.Cover); mime != "" {
+		var apic bytes.Buffer
+		apic.WriteByte(0) // ISO-8859-1
+		apic.WriteString(mime)
+		apic.WriteByte(0)
+		apic.WriteByte(3) // 封面
+		apic.WriteByte(0) // 空的描述
+		apic.Write(t.Cover)
+		frames.Write(id3_frame("APIC", apic.Bytes()))
+	}
+	if frames.Len() == 0 {
+		return nil
+	}
+	header := []byte{'I', 'D', '3', 3, 0, 0}
+	header = append(header, syncsafe(uint32(frames.Len()))...)
+	return append(header, frames.Bytes()...)
+}
+
+func id3_frame(id string, content []byte) []byte {
+	frame := make([]byte, 0, 10+len(content))
+	frame = append(frame, id...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(content)))
+	frame = append(frame, 0, 0)
+	return append(frame, content...)
+}
+
+// UTF-16 带 BOM 的文字
+func id3_text(text string) []byte {
+	out := []byte{1, 0xff, 0xfe}
+	for _, v := range utf16.Encode([]rune(text)) {
+		out = binary.LittleEndian.AppendUint16(out, v)
+	}
+	return out
+}
+
+func syncsafe(n uint32) []byte {
+	return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+}
+
+// 开头的 ID3v2 标签长度，没有标签时返回 0
+func id3_size(head []byte) int64 {
+	if len(head) < 10 || string(head[:3]) != "ID3" {
+		return 0
+	}
+	size := int64(head[6]&0x7f)<<21 | int64(head[7]&0x7f)<<14 | int64(head[8]&0x7f)<<7 | int64(head[9]&0x7f)
+	size += 10
+	if head[5]&0x10 != 0 {
+		// 有标签尾
+		size += 10
+	}
+	return size
+}
+
+// 在 MP3 数据前写入标签，原有的 ID3v2 标签会被去掉
+// tag 在读到第一段数据时才调用，可以在转码的同时准备封面
+func NewID3Reader(r io.Reader, tag func() []byte) io.Reader {
+	return &id3_reader{r: r, tag: tag}
+}
+
+type id3_reader struct {
+	r       io.Reader
+	tag     func() []byte
+	pending []byte
+	started bool
+}
+
+func (ir *id3_reader) Read(p []byte) (int, error) {
+	if !ir.started {
+		if err := ir.start(); err != nil {
+			return 0, err
+		}
+	}
+	if len(ir.pending) > 0 {
+		n := copy(p, ir.pending)
+		ir.pending = ir.pending[n:]
+		return n, nil
+	}
+	return ir.r.Read(p)
+}
+
+func (ir *id3_reader) start() error {
+	head := make([]byte, 10)
+	n, err := io.ReadFull(ir.r, head)
+	if n == 0 {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return err
+	}
+	ir.started = true
+	head = head[:n]
+	if size := id3_size(head); size > 0 {
+		if _, err := io.CopyN(io.Discard, ir.r, size-int64(len(head))); err != nil && err != io.EOF {
+			return err
+		}
+		head = nil
+	}
+	ir.pending = append(ir.tag(), head...)
+	return nil
+}
+
+// 在 MP3 文件开头写入标签
+func WriteMP3(path string, t Tags) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("打开文件失败 %v", err.Error())
+	}
+	defer f.Close()
+	return rewrite(path, func(w io.Writer) error {
+		reader := NewID3Reader(f, func() []byte { return ID3v2(t) })
+		if _, err := io.Copy(w, reader); err != nil {
+			return fmt.Errorf("写入标签失败 %v", err.Error())
+		}
+		// 在 Windows 上需要先关闭文件才能覆盖
+		return f.Close()
+	})
+}
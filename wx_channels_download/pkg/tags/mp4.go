@@ -0,0 +1,437 @@
+package tags
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrInvalidMP4    = errors.New("不是有效的 MP4 文件")
+	ErrFragmentedMP4 = errors.New("暂不支持在分片的 MP4 文件中写入标签")
+	ErrNoSpace       = errors.New("磁盘剩余空间不足，跳过写入标签")
+)
+
+// 获取剩余空间的方法，测试时替换
+var free_space = disk_free_space
+
+// iTunes 标签的名称
+const (
+	atomTitle  = "\xa9nam"
+	atomArtist = "\xa9ART"
+	atomCover  = "covr"
+)
+
+// data 中值的类型
+const (
+	dataTypeUTF8 = 1
+	dataTypeJPEG = 13
+	dataTypePNG  = 14
+)
+
+// 文件中的一个 box
+type mp4_box struct {
+	typ    string
+	offset int64
+	size   int64 // 包括头部
+}
+
+// 内存中的一个 box，data 包括头部
+type mp4_child struct {
+	typ    string
+	data   []byte
+	header int
+}
+
+func (c mp4_child) payload() []byte {
+	return c.data[c.header:]
+}
+
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	out := make([]byte, 0, size)
+	out = binary.BigEndian.AppendUint32(out, uint32(size))
+	out = append(out, typ...)
+	for _, p := range payload {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// 在 moov/udta/meta/ilst 中写入标题、作者和封面，其他标签保持不变
+// moov 在文件末尾时在末尾追加新的 moov，否则需要重写整个文件
+// moov 在 mdat 之前时，moov 的长度变化后需要修改每个 chunk 的偏移
+func WriteMP4(path string, t Tags) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("打开文件失败 %v", err.Error())
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("打开文件失败 %v", err.Error())
+	}
+	boxes, err := read_top_boxes(f, info.Size())
+	if err != nil {
+		return err
+	}
+	if len(boxes) == 0 || boxes[0].typ != "ftyp" {
+		return ErrInvalidMP4
+	}
+	var moov *mp4_box
+	for i := range boxes {
+		if boxes[i].typ == "moov" {
+			moov = &boxes[i]
+			break
+		}
+	}
+	if moov == nil {
+		return ErrInvalidMP4
+	}
+	data := make([]byte, moov.size)
+	if _, err := f.ReadAt(data, moov.offset); err != nil {
+		return fmt.Errorf("读取文件失败 %v", err.Error())
+	}
+	old_moov, err := parse_children(data)
+	if err != nil || len(old_moov) != 1 {
+		return ErrInvalidMP4
+	}
+	new_moov, err := build_moov(old_moov[0].payload(), t)
+	if err != nil {
+		return err
+	}
+	// chunk 的偏移都在 moov 之前，不需要修改
+	if moov.offset == boxes[len(boxes)-1].offset {
+		if available, err := free_space(filepath.Dir(path)); err == nil && available < int64(len(new_moov)) {
+			return ErrNoSpace
+		}
+		return overwrite_moov(path, *moov, new_moov)
+	}
+	moov_end := moov.offset + moov.size
+	delta := int64(len(new_moov)) - moov.size
+	if delta != 0 {
+		for _, b := range boxes {
+			if b.typ == "moof" && b.offset > moov.offset {
+				return ErrFragmentedMP4
+			}
+		}
+		if err := shift_chunk_offsets(new_moov[8:], moov_end, delta); err != nil {
+			return err
+		}
+	}
+	// 临时文件和原文件同时存在，剩余空间不足时不写入，不影响已经下载的视频
+	if available, err := free_space(filepath.Dir(path)); err == nil && available < info.Size()+delta {
+		return ErrNoSpace
+	}
+	return rewrite(path, func(w io.Writer) error {
+		for _, b := range boxes {
+			if b.offset == moov.offset {
+				if _, err := w.Write(new_moov); err != nil {
+					return fmt.Errorf("写入标签失败 %v", err.Error())
+				}
+				continue
+			}
+			if _, err := io.Copy(w, io.NewSectionReader(f, b.offset, b.size)); err != nil {
+				return fmt.Errorf("写入标签失败 %v", err.Error())
+			}
+		}
+		// 在 Windows 上需要先关闭文件才能覆盖
+		return f.Close()
+	})
+}
+
+// 替换文件末尾的 moov 时用到的文件操作，测试时模拟写入失败
+type moov_file interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+}
+
+// 替换文件末尾的 moov，文件会增加新 moov 的大小
+func overwrite_moov(path string, old mp4_box, moov []byte) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("写入标签失败 %v", err.Error())
+	}
+	if err := append_moov(f, old, moov); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("写入标签失败 %v", err.Error())
+	}
+	return nil
+}
+
+// 先在原来的 moov 之后写入新的 moov，落盘后再把原来的 moov 改为 free
+// 每一步失败时原来的 moov 都是完整的，不会只剩下写了一半的 moov
+func append_moov(f moov_file, old mp4_box, moov []byte) error {
+	end := old.offset + old.size
+	head := make([]byte, 4)
+	if _, err := f.ReadAt(head, old.offset); err != nil {
+		return fmt.Errorf("读取文件失败 %v", err.Error())
+	}
+	// 长度为 0 表示到文件末尾，追加之前先写入实际的长度
+	if binary.BigEndian.Uint32(head) == 0 {
+		if old.size > math.MaxUint32 {
+			return ErrInvalidMP4
+		}
+		if _, err := f.WriteAt(binary.BigEndian.AppendUint32(nil, uint32(old.size)), old.offset); err != nil {
+			return fmt.Errorf("写入标签失败 %v", err.Error())
+		}
+	}
+	// 写入失败时去掉追加的部分，原文件不变
+	rollback := func(err error) error {
+		f.Truncate(end)
+		return fmt.Errorf("写入标签失败 %v", err.Error())
+	}
+	if _, err := f.WriteAt(moov, end); err != nil {
+		return rollback(err)
+	}
+	if err := f.Sync(); err != nil {
+		return rollback(err)
+	}
+	if _, err := f.WriteAt([]byte("free"), old.offset+4); err != nil {
+		return rollback(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("写入标签失败 %v", err.Error())
+	}
+	return nil
+}
+
+// 读取文件最外层的 box，mdat 等大的 box 不读取内容
+func read_top_boxes(f *os.File, file_size int64) ([]mp4_box, error) {
+	var boxes []mp4_box
+	head := make([]byte, 16)
+	var offset int64
+	for file_size-offset >= 8 {
+		if _, err := f.ReadAt(head[:8], offset); err != nil {
+			return nil, fmt.Errorf("读取文件失败 %v", err.Error())
+		}
+		size := int64(binary.BigEndian.Uint32(head[:4]))
+		header := int64(8)
+		switch size {
+		case 0:
+			// 一直到文件末尾
+			size = file_size - offset
+		case 1:
+			if _, err := f.ReadAt(head[8:16], offset+8); err != nil {
+				return nil, ErrInvalidMP4
+			}
+			size = int64(binary.BigEndian.Uint64(head[8:16]))
+			header = 16
+		}
+		if size < header || size > file_size-offset {
+			return nil, ErrInvalidMP4
+		}
+		boxes = append(boxes, mp4_box{typ: string(head[4:8]), offset: offset, size: size})
+		offset += size
+	}
+	return boxes, nil
+}
+
+func parse_children(data []byte) ([]mp4_child, error) {
+	var children []mp4_child
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, ErrInvalidMP4
+		}
+		size := uint64(binary.BigEndian.Uint32(data[:4]))
+		header := 8
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, ErrInvalidMP4
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			header = 16
+		}
+		if size < uint64(header) || size > uint64(len(data)) {
+			return nil, ErrInvalidMP4
+		}
+		children = append(children, mp4_child{typ: string(data[4:8]), data: data[:size], header: header})
+		data = data[size:]
+	}
+	return children, nil
+}
+
+func build_moov(payload []byte, t Tags) ([]byte, error) {
+	children, err := parse_children(payload)
+	if err != nil {
+		return nil, err
+	}
+	var out [][]byte
+	found := false
+	for _, c := range children {
+		if c.typ == "udta" && !found {
+			out = append(out, build_udta(c.payload(), t))
+			found = true
+			continue
+		}
+		out = append(out, c.data)
+	}
+	if !found {
+		out = append(out, build_udta(nil, t))
+	}
+	return box("moov", out...), nil
+}
+
+// 无法解析的 udta 和 meta 直接替换
+func build_udta(payload []byte, t Tags) []byte {
+	children, _ := parse_children(payload)
+	var out [][]byte
+	found := false
+	for _, c := range children {
+		if c.typ == "meta" && !found {
+			out = append(out, build_meta(c.payload(), t))
+			found = true
+			continue
+		}
+		out = append(out, c.data)
+	}
+	if !found {
+		out = append(out, build_meta(nil, t))
+	}
+	return box("udta", out...)
+}
+
+func build_meta(payload []byte, t Tags) []byte {
+	// MP4 中的 meta 是 full box，QuickTime 中没有版本号
+	version := []byte{0, 0, 0, 0}
+	body := payload
+	if len(payload) >= 12 && string(payload[8:12]) == "hdlr" {
+		version = payload[:4]
+		body = payload[4:]
+	} else if len(payload) >= 8 && string(payload[4:8]) == "hdlr" {
+		version = nil
+	}
+	children, err := parse_children(body)
+	if err != nil {
+		children = nil
+	}
+	out := [][]byte{version}
+	has_hdlr := false
+	for _, c := range children {
+		if c.typ == "hdlr" {
+			has_hdlr = true
+		}
+	}
+	if !has_hdlr {
+		out = append(out, mdir_hdlr())
+	}
+	found := false
+	for _, c := range children {
+		if c.typ == "ilst" && !found {
+			out = append(out, build_ilst(c.payload(), t))
+			found = true
+			continue
+		}
+		out = append(out, c.data)
+	}
+	if !found {
+		out = append(out, build_ilst(nil, t))
+	}
+	return box("meta", out...)
+}
+
+// iTunes 标签使用的 handler
+func mdir_hdlr() []byte {
+	payload := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	payload = append(payload, "mdirappl"...)
+	payload = append(payload, make([]byte, 9)...)
+	return box("hdlr", payload)
+}
+
+func build_ilst(payload []byte, t Tags) []byte {
+	children, _ := parse_children(payload)
+	var out [][]byte
+	for _, c := range children {
+		if (c.typ == atomTitle && t.Title != "") || (c.typ == atomArtist && t.Artist != "") || (c.typ == atomCover && CoverMIME(t.Cover) != "") {
+			continue
+		}
+		out = append(out, c.data)
+	}
+	if t.Title != "" {
+		out = append(out, ilst_item(atomTitle, dataTypeUTF8, []byte(t.Title)))
+	}
+	if t.Artist != "" {
+		out = append(out, ilst_item(atomArtist, dataTypeUTF8, []byte(t.Artist)))
+	}
+	switch CoverMIME(t.Cover) {
+	case "image/jpeg":
+		out = append(out, ilst_item(atomCover, dataTypeJPEG, t.Cover))
+	case "image/png":
+		out = append(out, ilst_item(atomCover, dataTypePNG, t.Cover))
+	}
+	return box("ilst", out...)
+}
+
+func ilst_item(typ string, data_type uint32, value []byte) []byte {
+	head := binary.BigEndian.AppendUint32(nil, data_type)
+	head = binary.BigEndian.AppendUint32(head, 0)
+	return box(typ, box("data", head, value))
+}
+
+// 修改 stco 和 co64 中位于 after 之后的偏移
+func shift_chunk_offsets(payload []byte, after int64, delta int64) error {
+	children, err := parse_children(payload)
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		p := c.payload()
+		switch c.typ {
+		case "trak", "mdia", "minf", "stbl":
+			if err := shift_chunk_offsets(p, after, delta); err != nil {
+				return err
+			}
+		case "stco":
+			if len(p) < 8 {
+				return ErrInvalidMP4
+			}
+			count := int(binary.BigEndian.Uint32(p[4:8]))
+			if len(p) < 8+count*4 {
+				return ErrInvalidMP4
+			}
+			for i := 0; i < count; i++ {
+				entry := p[8+i*4 : 12+i*4]
+				v := int64(binary.BigEndian.Uint32(entry))
+				if v < after {
+					continue
+				}
+				v += delta
+				if v > math.MaxUint32 {
+					return errors.New("文件过大，无法写入标签")
+				}
+				binary.BigEndian.PutUint32(entry, uint32(v))
+			}
+		case "co64":
+			if len(p) < 8 {
+				return ErrInvalidMP4
+			}
+			count := int(binary.BigEndian.Uint32(p[4:8]))
+			if len(p) < 8+count*8 {
+				return ErrInvalidMP4
+			}
+			for i := 0; i < count; i++ {
+				entry := p[8+i*8 : 16+i*8]
+				v := int64(binary.BigEndian.Uint64(entry))
+				if v >= after {
+					binary.BigEndian.PutUint64(entry, uint64(v+delta))
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package tags
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 一个 track、两个 chunk 的最小 MP4，stco 指向 mdat 中的两段数据
+func build_test_mp4(moov_first bool) ([]byte, []byte) {
+	ftyp := box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41"))
+	media := []byte("chunk-one-data--chunk-two-data--")
+	stco := func(mdat_offset int) []byte {
+		p := []byte{0, 0, 0, 0}
+		p = binary.BigEndian.AppendUint32(p, 2)
+		p = binary.BigEndian.AppendUint32(p, uint32(mdat_offset+8))
+		p = binary.BigEndian.AppendUint32(p, uint32(mdat_offset+8+16))
+		return box("moov", box("trak", box("mdia", box("minf", box("stbl", box("stco", p))))))
+	}
+	mdat := box("mdat", media)
+	if moov_first {
+		moov_size := len(stco(0))
+		return append(append(ftyp, stco(len(ftyp)+moov_size)...), mdat...), media
+	}
+	return append(append(ftyp, mdat...), stco(len(ftyp))...), media
+}
+
+// 按 stco 中的偏移读取每个 chunk
+func read_chunks(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	top, err := parse_children(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	var walk func(payload []byte)
+	walk = func(payload []byte) {
+		children, err := parse_children(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range children {
+			switch c.typ {
+			case "trak", "mdia", "minf", "stbl":
+				walk(c.payload())
+			case "stco":
+				p := c.payload()
+				for i := 0; i < int(binary.BigEndian.Uint32(p[4:8])); i++ {
+					offset := binary.BigEndian.Uint32(p[8+i*4:])
+					chunks = append(chunks, data[offset:offset+16])
+				}
+			}
+		}
+	}
+	for _, c := range top {
+		if c.typ == "moov" {
+			walk(c.payload())
+		}
+	}
+	return chunks
+}
+
+// 找到 ilst 中的标签
+func read_ilst(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	items := make(map[string][]byte)
+	var walk func(payload []byte)
+	walk = func(payload []byte) {
+		children, err := parse_children(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range children {
+			switch c.typ {
+			case "moov", "udta":
+				walk(c.payload())
+			case "meta":
+				walk(c.payload()[4:])
+			case "ilst":
+				for _, item := range must_children(t, c.payload()) {
+					data := must_children(t, item.payload())[0].payload()
+					items[item.typ] = data[8:]
+				}
+			}
+		}
+	}
+	walk(data)
+	return items
+}
+
+func must_children(t *testing.T, data []byte) []mp4_child {
+	t.Helper()
+	children, err := parse_children(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return children
+}
+
+func write_test_file(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWriteMP4(t *testing.T) {
+	cases := []struct {
+		name       string
+		moov_first bool
+		in_place   bool
+		top        string // 写入两次后最外层的 box
+	}{
+		{"moov 在末尾", false, true, "ftyp mdat free free moov"},
+		{"moov 在 mdat 之前", true, false, "ftyp moov mdat"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data, media := build_test_mp4(c.moov_first)
+			path := write_test_file(t, data)
+			before, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := WriteMP4(path, Tags{Title: "一个很长很长很长的标题", Artist: "作者"}); err != nil {
+				t.Fatal(err)
+			}
+			after, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if os.SameFile(before, after) != c.in_place {
+				t.Fatalf("直接修改原文件为 %v，期望 %v", os.SameFile(before, after), c.in_place)
+			}
+			// 再写入一次，标题更短，moov 变小
+			if err := WriteMP4(path, Tags{Title: "短标题"}); err != nil {
+				t.Fatal(err)
+			}
+			result, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			items := read_ilst(t, result)
+			if string(items[atomTitle]) != "短标题" || string(items[atomArtist]) != "作者" {
+				t.Fatalf("标签为 %q", items)
+			}
+			chunks := read_chunks(t, result)
+			if len(chunks) != 2 || !bytes.Equal(chunks[0], media[:16]) || !bytes.Equal(chunks[1], media[16:]) {
+				t.Fatalf("chunk 偏移错误 %q", chunks)
+			}
+			if top := top_types(t, result); top != c.top {
+				t.Fatalf("最外层的 box 为 %s，期望 %s", top, c.top)
+			}
+		})
+	}
+}
+
+func top_types(t *testing.T, data []byte) string {
+	t.Helper()
+	var types []string
+	for _, c := range must_children(t, data) {
+		types = append(types, c.typ)
+	}
+	return strings.Join(types, " ")
+}
+
+// 模拟替换末尾的 moov 时某一步失败
+type failing_file struct {
+	*os.File
+	fail string
+}
+
+var errInjected = errors.New("模拟写入失败")
+
+func (f *failing_file) WriteAt(p []byte, off int64) (int, error) {
+	switch {
+	case f.fail == "append" && len(p) > 8:
+		// 只写入一半
+		n, _ := f.File.WriteAt(p[:len(p)/2], off)
+		return n, errInjected
+	case f.fail == "free" && string(p) == "free":
+		return 0, errInjected
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *failing_file) Sync() error {
+	if f.fail == "sync" {
+		return errInjected
+	}
+	return f.File.Sync()
+}
+
+func TestAppendMoovFailure(t *testing.T) {
+	for _, fail := range []string{"append", "sync", "free"} {
+		t.Run(fail, func(t *testing.T) {
+			data, _ := build_test_mp4(false)
+			path := write_test_file(t, data)
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			boxes, err := read_top_boxes(f, int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			old := boxes[len(boxes)-1]
+			moov, err := build_moov(data[old.offset+8:], Tags{Title: "一个很长很长很长的标题", Artist: "作者"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := append_moov(&failing_file{File: f, fail: fail}, old, moov); err == nil || !strings.Contains(err.Error(), errInjected.Error()) {
+				t.Fatalf("写入失败时返回 %v", err)
+			}
+			result, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(result, data) {
+				t.Fatalf("写入失败后文件被修改，长度 %d，原长度 %d", len(result), len(data))
+			}
+		})
+	}
+}
+
+func TestWriteMP4MoovToEnd(t *testing.T) {
+	// 最后一个 box 的长度为 0，表示到文件末尾
+	data, media := build_test_mp4(false)
+	moov_offset := len(data) - len(must_children(t, data)[2].data)
+	binary.BigEndian.PutUint32(data[moov_offset:], 0)
+	path := write_test_file(t, data)
+	if err := WriteMP4(path, Tags{Title: "标题"}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if top := top_types(t, result); top != "ftyp mdat free moov" {
+		t.Fatalf("最外层的 box 为 %s", top)
+	}
+	if items := read_ilst(t, result); string(items[atomTitle]) != "标题" {
+		t.Fatalf("标签为 %q", items)
+	}
+	if chunks := read_chunks(t, result); len(chunks) != 2 || !bytes.Equal(chunks[1], media[16:]) {
+		t.Fatalf("chunk 偏移错误 %q", chunks)
+	}
+}
+
+func TestWriteMP4NoSpace(t *testing.T) {
+	defer func(f func(string) (int64, error)) { free_space = f }(free_space)
+	free_space = func(dir string) (int64, error) {
+		return 16, nil
+	}
+
+	// moov 在末尾时也需要追加新 moov 的空间
+	for _, moov_first := range []bool{false, true} {
+		data, _ := build_test_mp4(moov_first)
+		path := write_test_file(t, data)
+		if err := WriteMP4(path, Tags{Title: "标题"}); !errors.Is(err, ErrNoSpace) {
+			t.Fatalf("剩余空间不足时返回 %v", err)
+		}
+		result, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, data) {
+			t.Fatal("剩余空间不足时修改了原文件")
+		}
+		if tmp, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".tmp_wx_tags_*")); len(tmp) != 0 {
+			t.Fatalf("临时文件没有删除 %v", tmp)
+		}
+	}
+}
+
+func TestDiskFreeSpace(t *testing.T) {
+	available, err := disk_free_space(t.TempDir())
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("当前系统不支持获取剩余空间")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if available <= 0 {
+		t.Fatalf("剩余空间为 %d", available)
+	}
+}
@@ -0,0 +1,128 @@
+package tags
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"wx_channel/pkg/channels"
+	"wx_channel/pkg/decrypt"
+)
+
+// 封面最大的大小，避免异常的响应写入文件
+const maxCoverSize = 10 * 1024 * 1024
+
+var ErrUnsupportedFile = errors.New("只支持在 MP4 和 MP3 文件中写入标签")
+
+// 写入文件的标签
+type Tags struct {
+	Title  string
+	Artist string
+	// 封面图片，为空时根据 CoverURL 下载
+	Cover    []byte
+	CoverURL string
+}
+
+// 标题使用描述的第一行，作者使用视频号昵称
+func FromProfile(profile *channels.Profile) Tags {
+	t := Tags{
+		Title:    profile.Headline(),
+		CoverURL: profile.CoverURL,
+	}
+	if profile.Contact != nil {
+		t.Artist = profile.Contact.Nickname
+	}
+	return t
+}
+
+// 下载封面，封面地址不需要登录信息
+func FetchCover(cover_url string) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(cover_url)
+	if err != nil {
+		return nil, fmt.Errorf("下载封面失败 %v", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("下载封面失败 %v", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCoverSize))
+	if err != nil {
+		return nil, fmt.Errorf("下载封面失败 %v", err.Error())
+	}
+	return data, nil
+}
+
+// 封面的格式，只有 JPEG 和 PNG 可以写入标签，其他格式返回空字符串
+func CoverMIME(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return "image/jpeg"
+	case "image/png":
+		return "image/png"
+	}
+	return ""
+}
+
+// 根据扩展名在文件中写入标签
+// 封面下载失败时仍然写入标题和作者，并返回封面的错误
+func Embed(path string, t Tags) error {
+	var cover_err error
+	if t.Cover == nil && t.CoverURL != "" {
+		t.Cover, cover_err = FetchCover(t.CoverURL)
+	}
+	if t.Cover != nil && CoverMIME(t.Cover) == "" {
+		t.Cover = nil
+		cover_err = errors.New("封面不是 JPEG 或 PNG 格式")
+	}
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp4", ".m4a", ".m4v", ".mov":
+		err = WriteMP4(path, t)
+	case ".mp3":
+		err = WriteMP3(path, t)
+	default:
+		err = ErrUnsupportedFile
+	}
+	if err != nil {
+		return err
+	}
+	return cover_err
+}
+
+// 没有密钥时下载的文件仍然是加密的，等解密后再写入
+func EmbedDecrypted(path string, t Tags) error {
+	if m, _ := decrypt.ReadMetadata(path); m != nil {
+		return nil
+	}
+	return Embed(path, t)
+}
+
+// 先写入同目录的临时文件再替换原文件，写入失败时原文件不受影响
+func rewrite(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp_wx_tags_*")
+	if err != nil {
+		return fmt.Errorf("写入标签失败 %v", err.Error())
+	}
+	tmp_filepath := tmp.Name()
+	defer os.Remove(tmp_filepath)
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("写入标签失败 %v", err.Error())
+	}
+	if info, err := os.Stat(path); err == nil {
+		os.Chmod(tmp_filepath, info.Mode())
+	}
+	if err := os.Rename(tmp_filepath, path); err != nil {
+		return fmt.Errorf("写入标签失败 %v", err.Error())
+	}
+	return nil
+}